@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,12 +31,125 @@ type BackupPolicySpec struct {
 
 	// Foo is an example field of BackupPolicy. Edit backuppolicy_types.go to remove/update
 	Foo string `json:"foo,omitempty"`
+
+	// Retention decides which archived incarnations of the selected objects are kept. An incarnation is
+	// kept if any rule selecting its object, in any policy, keeps it. Objects no rule selects keep all of
+	// their incarnations, and the current incarnation of an object is always kept.
+	// +optional
+	Retention []RetentionRule `json:"retention,omitempty"`
+
+	// Quotas bound the bytes the backups of each namespace may take.
+	// +optional
+	Quotas []Quota `json:"quotas,omitempty"`
+
+	// TombstoneTTLs override how long the backups of deleted objects are kept before garbage collection.
+	// When several apply to an object, in any policy, the longest wins.
+	// +optional
+	TombstoneTTLs []TombstoneTTL `json:"tombstoneTTLs,omitempty"`
+}
+
+// TombstoneTTL sets how long the backups of the selected objects are kept once they are deleted.
+type TombstoneTTL struct {
+	ObjectSelector `json:",inline"`
+
+	// TTL is the time from the deletion of an object until its backup is collected, e.g. 720h.
+	TTL metav1.Duration `json:"ttl"`
+}
+
+// ObjectSelector selects backed up objects by kind and namespace.
+type ObjectSelector struct {
+	// Group of the selected kind, the core group if empty. Without a kind, every kind of the group is
+	// selected, or every kind if empty.
+	// +optional
+	Group string `json:"group,omitempty"`
+	// Kind selects objects of this kind, every kind if empty.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// Namespaces selects objects in these namespaces, every namespace if empty.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// RetentionRule selects objects by kind and namespace and keeps their archived incarnations by count, by
+// age and by calendar representatives. Every criterion counts incarnations, not revisions: an incarnation
+// keeps only its latest revision and is dated by its last backup. An incarnation is kept if any of the
+// rule's criteria keeps it.
+type RetentionRule struct {
+	ObjectSelector `json:",inline"`
+
+	// KeepLast keeps the latest incarnations.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepLast int32 `json:"keepLast,omitempty"`
+	// KeepWithin keeps every incarnation last backed up within this long of now, e.g. 720h.
+	// +optional
+	KeepWithin *metav1.Duration `json:"keepWithin,omitempty"`
+	// KeepDaily keeps the latest incarnation of each of the last days that have one.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepDaily int32 `json:"keepDaily,omitempty"`
+	// KeepWeekly keeps the latest incarnation of each of the last ISO weeks that have one.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepWeekly int32 `json:"keepWeekly,omitempty"`
+	// KeepMonthly keeps the latest incarnation of each of the last months that have one.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepMonthly int32 `json:"keepMonthly,omitempty"`
+}
+
+// QuotaAction is what happens to a namespace whose backups exceed their quota.
+// +kubebuilder:validation:Enum=Prune;Suspend
+type QuotaAction string
+
+const (
+	// QuotaActionPrune removes the oldest archived incarnations of the namespace until it fits its quota.
+	QuotaActionPrune QuotaAction = "Prune"
+	// QuotaActionSuspend stops backing up the selected objects of the namespace until it fits its quota.
+	QuotaActionSuspend QuotaAction = "Suspend"
+)
+
+// Quota bounds the bytes taken by the backups of the selected objects, in each namespace separately.
+type Quota struct {
+	ObjectSelector `json:",inline"`
+
+	// Limit on the bytes of the stored manifests of the selected objects in a namespace, archived
+	// incarnations included.
+	Limit resource.Quantity `json:"limit"`
+
+	// Action taken when a namespace exceeds the limit. Incarnations under hold are never pruned, and a
+	// namespace pruning cannot bring under the limit stays exceeded.
+	// +kubebuilder:default=Prune
+	// +optional
+	Action QuotaAction `json:"action,omitempty"`
+}
+
+// QuotaUsage is the usage of a namespace selected by a quota.
+type QuotaUsage struct {
+	// Quota is the index of the quota in spec.quotas.
+	Quota int32 `json:"quota"`
+	// Namespace is empty for cluster-scoped objects.
+	Namespace string `json:"namespace"`
+	// UsedManifestBytes is the size of the stored manifests of the selected objects encoded as JSON,
+	// archived incarnations included.
+	UsedManifestBytes int64 `json:"usedManifestBytes"`
+	LimitBytes        int64 `json:"limitBytes"`
+	// Exceeded is set while the namespace uses more than the limit.
+	// +optional
+	Exceeded bool `json:"exceeded,omitempty"`
+	// Suspended is set while backups of the selected objects of the namespace are suspended.
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
 }
 
 // BackupPolicyStatus defines the observed state of BackupPolicy
 type BackupPolicyStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: StartWorkers "make" to regenerate code after modifying this file
+	// Quotas is the usage of every namespace selected by a quota, as last measured.
+	// +optional
+	Quotas []QuotaUsage `json:"quotas,omitempty"`
+	// LastMeasured is when the usage was last measured.
+	// +optional
+	LastMeasured *metav1.Time `json:"lastMeasured,omitempty"`
 }
 
 //+kubebuilder:object:root=true
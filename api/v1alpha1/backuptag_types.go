@@ -0,0 +1,87 @@
+/*
+Copyright 2025 debankur.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupTagSpec selects the backups a tag applies to and what it records about them. Empty scope fields
+// match everything, so a tag naming only a namespace or a kind covers all of its backups.
+type BackupTagSpec struct {
+	// Group of the tagged objects, the core group if empty.
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Kind of the tagged objects, every kind of Group if empty.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Namespace of the tagged objects, every namespace if empty.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Object is the name of the tagged object, every object in scope if empty.
+	// +optional
+	Object string `json:"object,omitempty"`
+
+	// UID selects one incarnation of Object when objects with different UIDs shared its name.
+	// +optional
+	UID string `json:"uid,omitempty"`
+
+	// Labels attached to the tagged backups.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Note recorded with the tagged backups, e.g. the incident they are kept for.
+	// +optional
+	Note string `json:"note,omitempty"`
+
+	// Hold keeps the tagged backups from being deleted by garbage collection, retention or replica
+	// pruning until the tag is removed or the hold lifted.
+	// +optional
+	Hold bool `json:"hold,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Hold",type=boolean,JSONPath=`.spec.hold`
+//+kubebuilder:printcolumn:name="Kind",type=string,JSONPath=`.spec.kind`
+//+kubebuilder:printcolumn:name="Namespace",type=string,JSONPath=`.spec.namespace`
+//+kubebuilder:printcolumn:name="Object",type=string,JSONPath=`.spec.object`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// BackupTag labels, annotates and optionally holds stored backups
+type BackupTag struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec BackupTagSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// BackupTagList contains a list of BackupTag
+type BackupTagList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BackupTag `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BackupTag{}, &BackupTagList{})
+}
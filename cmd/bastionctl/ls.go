@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// runLs lists the objects of a store selected by the given filters, a page at a time when --limit is set.
+// The token printed after a page is passed as --continue to get the next one.
+func runLs(args []string) int {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store to list, as [backend:]location")
+	kind := fs.String("kind", "", "Only objects of this kind, as group/version/Kind, or version/Kind for the core group")
+	namespace := fs.String("namespace", "", "Only objects in this namespace")
+	prefix := fs.String("prefix", "", "Only objects whose name starts with this prefix")
+	selector := fs.String("selector", "", "Only objects whose backed up labels match this label selector")
+	since := fs.String("since", "", "Only objects backed up after this RFC 3339 time, or this long ago, e.g. 24h")
+	limit := fs.Int("limit", 0, "Objects per page, all of them if 0")
+	token := fs.String("continue", "", "Continue token printed after the previous page")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+
+	filter, err := parseFilter(*kind, *namespace, *prefix, *selector, *since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store, err := openStore(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	page, err := storage.ListPage(context.Background(), store, filter, *limit, *token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(page); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	default:
+		for _, entry := range page.Entries {
+			state := ""
+			if entry.Tombstoned {
+				state = "tombstoned"
+			}
+			fmt.Printf("%-40s %-20s %-40s %-25s %s\n", entry.GVK.GroupKind().String(), entry.Namespace, entry.Name,
+				entry.Modified.Format(time.RFC3339), state)
+		}
+		if page.Continue != "" {
+			fmt.Printf("continue: %s\n", page.Continue)
+		}
+	}
+	return 0
+}
+
+// parseFilter builds the filter of the ls flags.
+func parseFilter(kind, namespace, prefix, selector, since string) (storage.Filter, error) {
+	filter := storage.Filter{Namespace: namespace, NamePrefix: prefix}
+	if kind != "" {
+		parts := strings.Split(kind, "/")
+		switch len(parts) {
+		case 2:
+			filter.GVK = schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}
+		case 3:
+			filter.GVK = schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}
+		default:
+			return filter, fmt.Errorf("invalid kind %q, expected group/version/Kind or version/Kind", kind)
+		}
+	}
+	if selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return filter, fmt.Errorf("invalid selector: %w", err)
+		}
+		filter.Labels = parsed
+	}
+	if since != "" {
+		if ago, err := time.ParseDuration(since); err == nil {
+			filter.ChangedSince = time.Now().Add(-ago)
+		} else if at, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.ChangedSince = at
+		} else {
+			return filter, fmt.Errorf("invalid --since %q, expected an RFC 3339 time or a duration", since)
+		}
+	}
+	return filter, nil
+}
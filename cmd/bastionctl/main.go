@@ -0,0 +1,82 @@
+/*
+Copyright 2025 debankur.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// bastionctl runs maintenance operations directly against a backup store.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: bastionctl <command> [flags]
+
+Commands:
+  ls       List stored objects by kind, namespace, name prefix, labels or change time
+  scrub    Verify the integrity of every stored backup
+  verify   Check every stored backup against its signature and the signed Merkle root
+  attest   Sign the Merkle root over the store as it is now
+  sync     Copy what differs from one store to another, once or continuously
+  migrate  Copy every object, revision and tombstone to another store, resumably
+  upgrade  Move a store to the on-disk format version of this build
+  snapshot Write a consistent copy of a kv store to a file
+  prune    Apply the retention rules of backup policies to a store once
+  tag      Tag, pin or place under legal hold the backups in a scope
+  freeze   List or acknowledge mass deletions that froze garbage collection
+  usage    Show the bytes stored per namespace and GVK
+
+Run 'bastionctl <command> -h' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var code int
+	switch os.Args[1] {
+	case "ls":
+		code = runLs(os.Args[2:])
+	case "scrub":
+		code = runScrub(os.Args[2:])
+	case "verify":
+		code = runVerify(os.Args[2:])
+	case "attest":
+		code = runAttest(os.Args[2:])
+	case "sync":
+		code = runSync(os.Args[2:])
+	case "migrate":
+		code = runMigrate(os.Args[2:])
+	case "upgrade":
+		code = runUpgrade(os.Args[2:])
+	case "snapshot":
+		code = runSnapshot(os.Args[2:])
+	case "prune":
+		code = runPrune(os.Args[2:])
+	case "tag":
+		code = runTag(os.Args[2:])
+	case "freeze":
+		code = runFreeze(os.Args[2:])
+	case "usage":
+		code = runUsage(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		code = 2
+	}
+	os.Exit(code)
+}
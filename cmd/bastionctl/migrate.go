@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/migrate"
+	"github.com/bastion/internal/storage"
+)
+
+// runMigrate copies every object, revision and tombstone from one store to another. It can run while
+// the controller keeps writing to the source, and resumes from its checkpoint when run again.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store to migrate from, as [backend:]location")
+	to := fs.String("to", "", "Store to migrate to, as [backend:]location")
+	checkpoint := fs.String("checkpoint", "", "File progress is kept in, defaults to one next to the destination")
+	layout := fs.String("layout", "flat", "Layout of the destination if it is created, flat or sharded")
+	dryRun := fs.Bool("dry-run", false, "Only count what would be migrated")
+	catchUp := fs.Int("catch-up-passes", 3, "Passes copying changes made to the source while migrating")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "--to is required")
+		return 2
+	}
+	if *checkpoint == "" {
+		*checkpoint = checkpointPath(*to)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	source, release, err := openSource(ctx, *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer release()
+	open := func(spec string) (storage.Storage, error) { return createStore(spec, *layout) }
+	if *dryRun {
+		open = openStore // leaves a new destination untouched
+	}
+	destination, err := open(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	m := migrate.NewMigrator(source, destination, hash.NewDefaultHasher(), *checkpoint, *dryRun)
+	m.From, m.To = canonicalSpec(*from), canonicalSpec(*to)
+	m.CatchUpPasses = *catchUp
+	report, err := m.Migrate(ctx)
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, mismatch := range report.Mismatches {
+			fmt.Println("mismatch", mismatch)
+		}
+		fmt.Printf("%d kinds: %d objects, %d archived revisions and %d tombstones migrated, %d skipped, %d caught up\n",
+			report.Kinds, report.Objects, report.Revisions, report.Tombstones, report.Skipped, report.CaughtUp)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(report.Mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// canonicalSpec spells out the backend and absolute location of the store described by spec, so a
+// checkpoint matches the same stores however they are given.
+func canonicalSpec(spec string) string {
+	backend, location, found := strings.Cut(spec, ":")
+	if !found {
+		backend, location = "fs", spec
+	}
+	if backend != "memory" {
+		if abs, err := filepath.Abs(location); err == nil {
+			location = abs
+		}
+	}
+	return backend + ":" + location
+}
+
+// checkpointPath returns the default checkpoint of a migration to the store described by spec: a file next
+// to the destination, so migrations to distinct stores never share one. Memory destinations start empty on
+// every run, so their migrations have no progress to resume.
+func checkpointPath(spec string) string {
+	backend, location, _ := strings.Cut(canonicalSpec(spec), ":")
+	if backend == "memory" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(location), "."+filepath.Base(location)+".migrate-checkpoint.json")
+}
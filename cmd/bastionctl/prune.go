@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/retention"
+	"sigs.k8s.io/yaml"
+)
+
+// runPrune applies the retention rules of backup policy manifests to a store once and prints what was
+// pruned, or with --dry-run what would be.
+func runPrune(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store to prune, as [backend:]location")
+	policyFiles := fs.String("policy", "", "Comma separated BackupPolicy manifests whose retention rules are applied")
+	dryRun := fs.Bool("dry-run", false, "Only print the incarnations that would be pruned")
+	output := fs.String("output", "text", "Output format, text or json")
+	kubeconfig := fs.String("kubeconfig", "", "Kubeconfig of the cluster whose BackupTag resources hold backups, the default one if empty")
+	_ = fs.Parse(args)
+
+	if *policyFiles == "" {
+		fmt.Fprintln(os.Stderr, "--policy is required")
+		return 2
+	}
+	var policies []v1alpha1.BackupPolicy
+	for _, path := range strings.Split(*policyFiles, ",") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		var policy v1alpha1.BackupPolicy
+		if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse policy %s: %v\n", path, err)
+			return 2
+		}
+		policies = append(policies, policy)
+	}
+	store, err := openStore(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx := context.Background()
+	guarded, err := guardStore(ctx, *from, *kubeconfig, store)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	pruner := retention.NewPruner(guarded, func(context.Context) ([]v1alpha1.BackupPolicy, error) {
+		return policies, nil
+	}, 0, *dryRun)
+	report, err := pruner.Prune(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	default:
+		for _, pruned := range report.Pruned {
+			fmt.Printf("%s %s %s\n", pruned.LastBackup.Format(time.RFC3339), pruned.UID, pruned.Key)
+		}
+		verb := "pruned"
+		if report.DryRun {
+			verb = "would prune"
+		}
+		fmt.Printf("scanned %d objects, %s %d incarnations, %d held\n", report.Scanned, verb, len(report.Pruned), report.Held)
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/scrub"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/filesystem"
+)
+
+// runScrub verifies the store once and prints the report. It exits with 1 when problems were found.
+func runScrub(args []string) int {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	backupRoot := fs.String("backup-root", "/backups", "Backup root directory")
+	reportPath := fs.String("report", "", "File to also write the JSON report to")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+
+	scrubber := scrub.NewScrubber(filesystem.NewFileSystemBasedBackup(*backupRoot), hash.NewDefaultHasher(), 0, *reportPath)
+	report, err := scrubber.Scrub(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return printReport(report, *output)
+}
+
+// printReport prints the problems of a report and returns the exit code, 1 when there are any.
+func printReport(report storage.ScrubReport, output string) int {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	default:
+		for _, p := range report.Problems {
+			fmt.Printf("%-18s %s", p.Type, p.Path)
+			if p.Detail != "" {
+				fmt.Printf(": %s", p.Detail)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("scanned %d entries, found %d problems\n", report.Scanned, len(report.Problems))
+	}
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
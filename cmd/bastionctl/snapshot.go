@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bastion/internal/storage/kv"
+)
+
+// runSnapshot writes a consistent point-in-time copy of a kv store to a file, for export. The copy is
+// written next to the target and renamed into place once complete. The controller holding the store
+// writes it when running, as the database is locked by the process using it.
+func runSnapshot(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Root of the kv store to snapshot")
+	to := fs.String("to", "", "File the snapshot is written to, a kv store when placed in a root as bastion.db")
+	_ = fs.Parse(args)
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "--to is required")
+		return 2
+	}
+	path, err := filepath.Abs(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	n, err := snapshot(context.Background(), *from, path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("wrote %d bytes to %s\n", n, path)
+	return 0
+}
+
+// snapshot writes a snapshot of the kv store rooted at dir to path: through the process holding the
+// store if one serves snapshots of it, or by opening the store otherwise.
+func snapshot(ctx context.Context, dir, path string) (int64, error) {
+	n, err := kv.RequestSnapshot(ctx, dir, path)
+	if !errors.Is(err, kv.ErrNotServed) {
+		return n, err
+	}
+	store, err := kv.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	return store.SnapshotFile(ctx, path)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/hold"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/filesystem"
+	"github.com/bastion/internal/storage/kv"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/segment"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// openStore opens the store described by spec, written as [backend:]location. The backend defaults to
+// fs, the filesystem store rooted at location, segment is the segment store and kv the embedded database
+// store rooted at location.
+// Stores in a format this build does not know are refused.
+func openStore(spec string) (storage.Storage, error) {
+	backend, location, found := strings.Cut(spec, ":")
+	if !found {
+		backend, location = "fs", spec
+	}
+	if location == "" {
+		return nil, fmt.Errorf("store %q has no location", spec)
+	}
+	switch backend {
+	case "fs":
+		fs := filesystem.NewFileSystemBasedBackup(location)
+		if _, err := fs.CheckFormat(context.Background()); err != nil {
+			return nil, err
+		}
+		return fs, nil
+	case "segment":
+		store, err := segment.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "kv":
+		store, err := kv.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q in %q", backend, spec)
+}
+
+// createStore opens the store described by spec for writing. A new store is created in layout and gets
+// its format descriptor, an existing one keeps its layout and is upgraded to the current format first.
+// The memory backend is a store kept in memory under location, so a sync or migration can be rehearsed,
+// verification included, without writing anything.
+func createStore(spec, layout string) (storage.Storage, error) {
+	backend, location, found := strings.Cut(spec, ":")
+	if !found {
+		backend, location = "fs", spec
+	}
+	if location == "" {
+		return nil, fmt.Errorf("store %q has no location", spec)
+	}
+	switch backend {
+	case "fs":
+		parsed, err := filesystem.ParseLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		fs := filesystem.NewFileSystemBasedBackup(location)
+		fs.Layout = parsed
+		if err := fs.Upgrade(context.Background()); err != nil {
+			return nil, err
+		}
+		return fs, nil
+	case "segment":
+		store, err := segment.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "kv":
+		store, err := kv.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "memory":
+		return memory.Open(location), nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q in %q", backend, spec)
+}
+
+// tagsFile returns the tags file of the store described by spec. Memory stores have none.
+func tagsFile(spec string) (*hold.File, error) {
+	backend, location, found := strings.Cut(spec, ":")
+	if !found {
+		backend, location = "fs", spec
+	}
+	if backend == "memory" {
+		return nil, fmt.Errorf("store %q has no tags file", spec)
+	}
+	if location == "" {
+		return nil, fmt.Errorf("store %q has no location", spec)
+	}
+	return hold.NewFile(hold.Path(location)), nil
+}
+
+// guardStore returns store refusing to delete the backups held by the tags file of the store described by
+// spec or by BackupTag resources. Those are read from the cluster of kubeconfig, or of $KUBECONFIG,
+// ~/.kube/config or the pod bastionctl runs in if empty; when they cannot be read nothing is deleted, so
+// the guard is only returned once they could be. Memory stores hold nothing.
+func guardStore(ctx context.Context, spec, kubeconfig string, store storage.Storage) (storage.Storage, error) {
+	if backend, _, _ := strings.Cut(spec, ":"); backend == "memory" {
+		return store, nil
+	}
+	file, err := tagsFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("refusing to delete without checking the holds of BackupTag resources: %w", err)
+	}
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	reader, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("refusing to delete without checking the holds of BackupTag resources: %w", err)
+	}
+	tags := hold.Sources(file, reader)
+	if _, err := tags(ctx); err != nil {
+		return nil, fmt.Errorf("refusing to delete without checking every hold: %w", err)
+	}
+	return hold.NewGuard(store, tags), nil
+}
+
+// openSource opens the store described by spec to read from. A kv store held by a running controller is
+// locked, so the controller is asked for a snapshot, read instead: changes made after it are not seen.
+// The returned func releases what was opened.
+func openSource(ctx context.Context, spec string) (storage.Storage, func(), error) {
+	backend, location, _ := strings.Cut(spec, ":")
+	if backend != "kv" || location == "" {
+		store, err := openStore(spec)
+		return store, func() {}, err
+	}
+	dir, err := os.MkdirTemp("", "bastion-snapshot-")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := kv.RequestSnapshot(ctx, location, filepath.Join(dir, "bastion.db")); err != nil {
+		_ = os.RemoveAll(dir)
+		if errors.Is(err, kv.ErrNotServed) {
+			store, err := openStore(spec)
+			return store, func() {}, err
+		}
+		return nil, nil, err
+	}
+	store, err := kv.Open(dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	fmt.Fprintf(os.Stderr, "reading a snapshot of %s taken by the process holding it, later changes are not migrated\n", location)
+	return store, func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bastion/internal/replica"
+)
+
+// runSync brings one store up to date with another, once or, with --watch, until interrupted.
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store to copy from, as [backend:]location")
+	to := fs.String("to", "", "Store to copy to, as [backend:]location")
+	prune := fs.Bool("prune", false, "Delete objects of the destination that are not in the source")
+	layout := fs.String("layout", "flat", "Layout of the destination if it is created, flat or sharded")
+	watch := fs.Bool("watch", false, "Keep syncing every --interval until interrupted")
+	interval := fs.Duration("interval", 5*time.Minute, "Pause between passes with --watch")
+	kubeconfig := fs.String("kubeconfig", "", "Kubeconfig of the cluster whose BackupTag resources hold backups, the default one if empty")
+	_ = fs.Parse(args)
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "--to is required")
+		return 2
+	}
+
+	source, err := openStore(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	destination, err := createStore(*to, *layout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *prune {
+		if destination, err = guardStore(ctx, *to, *kubeconfig, destination); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	syncer := replica.NewSyncer(source, destination, *interval, *prune)
+	report, err := syncer.SyncOnce(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("compared %d objects in %d kinds: %d copied, %d tombstoned, %d untombstoned, %d pruned, %d held\n",
+		report.Compared, report.Kinds, report.Copied, report.Tombstoned, report.Untombstoned, report.Pruned, report.Held)
+	if *watch {
+		syncer.Run(ctx)
+	}
+	return 0
+}
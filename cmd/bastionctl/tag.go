@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bastion/internal/hold"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const tagUsage = `Usage: bastionctl tag <add|ls|rm> [flags]
+
+  add  Tag, and with --hold pin or place under legal hold, the backups in a scope
+  ls   List the tags of a store
+  rm   Remove a tag, lifting its hold
+`
+
+// runTag manages the tags file of a store. Tags placed through BackupTag resources are managed with kubectl.
+func runTag(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, tagUsage)
+		return 2
+	}
+	switch args[0] {
+	case "add":
+		return runTagAdd(args[1:])
+	case "ls":
+		return runTagLs(args[1:])
+	case "rm":
+		return runTagRm(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown tag command %q\n\n%s", args[0], tagUsage)
+	return 2
+}
+
+func runTagAdd(args []string) int {
+	fs := flag.NewFlagSet("tag add", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store whose tags file is changed, as [backend:]location")
+	name := fs.String("name", "", "Name of the tag, replacing the tag of that name")
+	group := fs.String("group", "", "Group of the tagged objects, the core group if empty")
+	kind := fs.String("kind", "", "Kind of the tagged objects, every kind of --group if empty")
+	namespace := fs.String("namespace", "", "Namespace of the tagged objects, every namespace if empty")
+	object := fs.String("object", "", "Name of the tagged object, every object in scope if empty")
+	uid := fs.String("uid", "", "Incarnation of --object, every one if empty")
+	labelList := fs.String("labels", "", "Comma separated key=value labels attached to the tagged backups")
+	note := fs.String("note", "", "Note recorded with the tagged backups")
+	held := fs.Bool("hold", false, "Keep the tagged backups from being deleted until the tag is removed")
+	_ = fs.Parse(args)
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "--name is required")
+		return 2
+	}
+
+	tag := hold.Tag{
+		Name:      *name,
+		Group:     *group,
+		Kind:      *kind,
+		Namespace: *namespace,
+		Object:    *object,
+		UID:       types.UID(*uid),
+		Note:      *note,
+		Hold:      *held,
+		CreatedAt: time.Now().UTC(),
+	}
+	if *labelList != "" {
+		tag.Labels = map[string]string{}
+		for _, label := range strings.Split(*labelList, ",") {
+			key, value, found := strings.Cut(label, "=")
+			if !found || key == "" {
+				fmt.Fprintf(os.Stderr, "label %q is not key=value\n", label)
+				return 2
+			}
+			tag.Labels[key] = value
+		}
+	}
+	file, err := tagsFile(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := file.Add(context.Background(), tag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
+
+func runTagLs(args []string) int {
+	fs := flag.NewFlagSet("tag ls", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store whose tags are listed, as [backend:]location")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+
+	file, err := tagsFile(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	tags, err := file.Load(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(tags); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	default:
+		for _, tag := range tags {
+			state := "tag"
+			if tag.Hold {
+				state = "hold"
+			}
+			scope := strings.Join([]string{tag.Group, tag.Kind, tag.Namespace, tag.Object, string(tag.UID)}, "/")
+			fmt.Printf("%-20s %-4s %s %s\n", tag.Name, state, scope, tag.Note)
+		}
+	}
+	return 0
+}
+
+func runTagRm(args []string) int {
+	fs := flag.NewFlagSet("tag rm", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store whose tags file is changed, as [backend:]location")
+	name := fs.String("name", "", "Name of the tag to remove")
+	_ = fs.Parse(args)
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "--name is required")
+		return 2
+	}
+
+	file, err := tagsFile(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	removed, err := file.Remove(context.Background(), *name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if !removed {
+		fmt.Fprintf(os.Stderr, "no tag named %q\n", *name)
+		return 1
+	}
+	return 0
+}
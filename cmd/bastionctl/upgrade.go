@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bastion/internal/storage/filesystem"
+)
+
+// runUpgrade moves a filesystem store to the format version of this build, as the controller does when
+// it starts. With --check it only reports the format.
+func runUpgrade(args []string) int {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	backupRoot := fs.String("backup-root", "/backups", "Backup root directory")
+	check := fs.Bool("check", false, "Only report the format version, exiting with 1 if an upgrade is needed")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	store := filesystem.NewFileSystemBasedBackup(*backupRoot)
+	format, err := store.CheckFormat(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("format %s version %d, this build writes version %d\n", format.Name, format.Version, filesystem.FormatVersion)
+	if *check {
+		if format.Version < filesystem.FormatVersion {
+			return 1
+		}
+		return 0
+	}
+	if err := store.Upgrade(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("upgraded to version %d\n", filesystem.FormatVersion)
+	return 0
+}
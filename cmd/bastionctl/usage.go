@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/bastion/internal/quota"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// usageEntry is the usage of a namespace and GVK.
+type usageEntry struct {
+	Namespace     string `json:"namespace"`
+	GVK           string `json:"gvk"`
+	ManifestBytes int64  `json:"manifestBytes"`
+}
+
+// runUsage prints the bytes of the manifests stored per namespace and GVK, largest first.
+func runUsage(args []string) int {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	from := fs.String("from", "/backups", "Store to measure, as [backend:]location")
+	namespace := fs.String("namespace", "", "Only usage in this namespace")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+
+	store, err := openStore(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	items, err := quota.Sizes(context.Background(), store)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var entries []usageEntry
+	var total int64
+	for scope, bytes := range quota.Usage(items) {
+		if *namespace != "" && scope.Namespace != *namespace {
+			continue
+		}
+		entries = append(entries, usageEntry{Namespace: scope.Namespace, GVK: scope.GVK.String(), ManifestBytes: bytes})
+		total += bytes
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ManifestBytes != entries[j].ManifestBytes {
+			return entries[i].ManifestBytes > entries[j].ManifestBytes
+		}
+		return entries[i].Namespace+entries[i].GVK < entries[j].Namespace+entries[j].GVK
+	})
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	default:
+		for _, entry := range entries {
+			fmt.Printf("%-10s %-20s %s\n", resource.NewQuantity(entry.ManifestBytes, resource.BinarySI), entry.Namespace, entry.GVK)
+		}
+		fmt.Printf("%s in %d incarnations\n", resource.NewQuantity(total, resource.BinarySI), len(items))
+	}
+	return 0
+}
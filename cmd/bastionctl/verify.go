@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/signing"
+	"github.com/bastion/internal/storage/filesystem"
+)
+
+// runVerify checks every stored revision against its signature and the store against its signed
+// Merkle root. It exits with 1 when any of them does not match.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	backupRoot := fs.String("backup-root", "/backups", "Backup root directory")
+	publicKey := fs.String("public-key", "", "PEM encoded ed25519 public key of the signing key")
+	output := fs.String("output", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+	if *publicKey == "" {
+		fmt.Fprintln(os.Stderr, "--public-key is required")
+		return 2
+	}
+
+	verifier, err := signing.LoadVerifier(*publicKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store := filesystem.NewFileSystemBasedBackup(*backupRoot)
+	report, err := store.Verify(context.Background(), verifier, hash.NewDefaultHasher())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return printReport(report, *output)
+}
+
+// runAttest signs the Merkle root over the store as it is now, e.g. right before an audit.
+func runAttest(args []string) int {
+	fs := flag.NewFlagSet("attest", flag.ExitOnError)
+	backupRoot := fs.String("backup-root", "/backups", "Backup root directory")
+	signingKey := fs.String("signing-key", "", "PEM encoded ed25519 private key")
+	_ = fs.Parse(args)
+	if *signingKey == "" {
+		fmt.Fprintln(os.Stderr, "--signing-key is required")
+		return 2
+	}
+
+	signer, err := signing.LoadSigner(*signingKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store := filesystem.NewFileSystemBasedBackup(*backupRoot)
+	store.Signer = signer
+	attestation, err := store.Attest(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("root %s over %d revisions, signed by key %s\n", attestation.Root, attestation.Leaves, attestation.KeyID)
+	return 0
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/bastion/internal/config"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"os"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
@@ -58,6 +59,34 @@ func main() {
 	var backupRoot string
 	var maxRetries int
 	var gcRetain time.Duration
+	var gcInterval time.Duration
+	var gcJitter float64
+	var gcConcurrency int
+	var gcMaxPerSweep int
+	var massDeletionThreshold int
+	var massDeletionWindow time.Duration
+	var finalizerMode bool
+	var finalizerTimeout time.Duration
+	var checkpointInterval time.Duration
+	var metadataOnlyInformers bool
+	var reconcileInterval time.Duration
+	var reconcileConcurrency int
+	var scrubInterval time.Duration
+	var signingKeyFile string
+	var attestInterval time.Duration
+	var replicaRoot string
+	var replicaSyncInterval time.Duration
+	var replicaPrune bool
+	var mirrorRoots string
+	var mirrorPolicy string
+	var storageLayout string
+	var storageEngine string
+	var compactionInterval time.Duration
+	var compactionRetain time.Duration
+	var clusterName string
+	var retentionInterval time.Duration
+	var retentionDryRun bool
+	var quotaInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metric endpoint binds to. "+
 		"Use the port :8080. If not set, it will be '0 in order to disable the metrics server")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -72,7 +101,62 @@ func main() {
 	// Command-line flags
 	flag.StringVar(&backupRoot, "backup-root", "/backups", "Backup root directory")
 	flag.IntVar(&maxRetries, "max-retries", 5, "Maximum retry count for failed backups")
-	flag.DurationVar(&gcRetain, "gc-retain", 10*time.Minute, "Duration to retain tombstoned resources before garbage collection")
+	flag.DurationVar(&gcRetain, "gc-retain", 10*time.Minute,
+		"Duration to retain tombstoned resources before garbage collection, unless a BackupPolicy sets a TTL for them")
+	flag.DurationVar(&gcInterval, "gc-interval", time.Minute, "How often the garbage collector sweeps expired tombstones")
+	flag.Float64Var(&gcJitter, "gc-jitter", 0.1, "Fraction of --gc-interval randomly added to the wait before every sweep")
+	flag.IntVar(&gcConcurrency, "gc-concurrency", 4, "Number of expired tombstones collected in parallel")
+	flag.IntVar(&gcMaxPerSweep, "gc-max-per-sweep", 1000,
+		"Maximum number of expired tombstones collected per sweep, oldest first, 0 for no limit")
+	flag.IntVar(&massDeletionThreshold, "mass-deletion-threshold", 100,
+		"Deletions of a GVK or in a namespace within --mass-deletion-window that freeze their garbage collection "+
+			"until acknowledged, 0 disables detection")
+	flag.DurationVar(&massDeletionWindow, "mass-deletion-window", 5*time.Minute,
+		"Sliding window over which deletions are counted for mass deletion detection")
+	flag.BoolVar(&finalizerMode, "finalizer-mode", false,
+		"If set, a finalizer is added to backed up resources so their final state is captured before deletion")
+	flag.DurationVar(&finalizerTimeout, "finalizer-timeout", 2*time.Minute,
+		"Maximum time a deletion is held by the finalizer before it is released without capture")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 30*time.Second,
+		"How often informer resume points are persisted, letting restarts skip already backed up resources")
+	flag.BoolVar(&metadataOnlyInformers, "metadata-only-informers", false,
+		"If set, informers cache only resource metadata and full resources are fetched when they change")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", time.Hour,
+		"How often every resource is compared between cluster and backup store to repair drift, 0 disables it")
+	flag.IntVar(&reconcileConcurrency, "reconcile-concurrency", 2, "Number of GVKs reconciled in parallel")
+	flag.DurationVar(&scrubInterval, "scrub-interval", 24*time.Hour,
+		"How often every stored backup is verified against its hash, 0 disables it")
+	flag.DurationVar(&retentionInterval, "retention-interval", time.Hour,
+		"How often the retention rules of backup policies prune archived incarnations, 0 disables it")
+	flag.BoolVar(&retentionDryRun, "retention-dry-run", false,
+		"If set, retention only logs and counts the incarnations it would prune")
+	flag.DurationVar(&quotaInterval, "quota-interval", 15*time.Minute,
+		"How often backup usage is measured and the quotas of backup policies are enforced, 0 disables it")
+	flag.StringVar(&signingKeyFile, "signing-key", "",
+		"PEM encoded ed25519 private key used to sign every backup revision, signing is disabled if not set")
+	flag.DurationVar(&attestInterval, "attest-interval", time.Hour,
+		"How often the signed Merkle root over all backups is refreshed when a signing key is set")
+	flag.StringVar(&replicaRoot, "replica-root", "",
+		"Second backup root continuously synced from the backup root, replication is disabled if not set")
+	flag.DurationVar(&replicaSyncInterval, "replica-sync-interval", 5*time.Minute,
+		"How often the replica is compared with the backup root and brought up to date")
+	flag.BoolVar(&replicaPrune, "replica-prune", false,
+		"If set, replica objects that no longer exist in the backup root are deleted")
+	flag.StringVar(&mirrorRoots, "mirror-roots", "",
+		"Comma separated backup roots every change is also written to, mirroring is disabled if not set")
+	flag.StringVar(&mirrorPolicy, "mirror-policy", "all",
+		"When a mirrored change counts as stored: all, quorum or primary-sync")
+	flag.StringVar(&storageLayout, "storage-layout", "flat",
+		"Layout of new backup roots: flat, or sharded for namespaces with hundreds of thousands of objects")
+	flag.StringVar(&storageEngine, "storage-engine", "filesystem",
+		"How backups are kept: filesystem, with a few files per resource, segment, appending every change to segment files, "+
+			"or kv, in a single-file embedded database")
+	flag.DurationVar(&compactionInterval, "compaction-interval", time.Hour,
+		"How often the segment engine rewrites its segments without superseded records")
+	flag.DurationVar(&compactionRetain, "compaction-retain", 0,
+		"How long the segment engine keeps superseded records before compaction drops them")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"Identity of the cluster recorded in the metadata of every backup, the UID of the kube-system namespace if empty")
 
 	opts := zap.Options{
 		Development: true,
@@ -113,8 +197,38 @@ func main() {
 	}
 	cfg := &config.Options{}
 	cfg.GcRetain = gcRetain
+	cfg.GcInterval = gcInterval
+	cfg.GcJitter = gcJitter
+	cfg.GcConcurrency = gcConcurrency
+	cfg.GcMaxPerSweep = gcMaxPerSweep
+	cfg.MassDeletionThreshold = massDeletionThreshold
+	cfg.MassDeletionWindow = massDeletionWindow
 	cfg.MaxRetries = maxRetries
 	cfg.BackupRoot = backupRoot
+	cfg.FinalizerMode = finalizerMode
+	cfg.FinalizerTimeout = finalizerTimeout
+	cfg.CheckpointInterval = checkpointInterval
+	cfg.MetadataOnlyInformers = metadataOnlyInformers
+	cfg.ReconcileInterval = reconcileInterval
+	cfg.ReconcileConcurrency = reconcileConcurrency
+	cfg.ScrubInterval = scrubInterval
+	cfg.RetentionInterval = retentionInterval
+	cfg.RetentionDryRun = retentionDryRun
+	cfg.QuotaInterval = quotaInterval
+	cfg.SigningKeyFile = signingKeyFile
+	cfg.AttestInterval = attestInterval
+	cfg.ReplicaRoot = replicaRoot
+	cfg.ReplicaSyncInterval = replicaSyncInterval
+	cfg.ReplicaPrune = replicaPrune
+	if mirrorRoots != "" {
+		cfg.MirrorRoots = strings.Split(mirrorRoots, ",")
+	}
+	cfg.MirrorPolicy = mirrorPolicy
+	cfg.StorageLayout = storageLayout
+	cfg.StorageEngine = storageEngine
+	cfg.CompactionInterval = compactionInterval
+	cfg.CompactionRetain = compactionRetain
+	cfg.ClusterName = clusterName
 	ctx := ctrl.SetupSignalHandler()
 	controller := controllers.NewBackupController(cfg)
 	if err := controller.Setup(ctx, mgr); err != nil {
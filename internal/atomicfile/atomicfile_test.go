@@ -0,0 +1,61 @@
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestAtomicFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AtomicFile Suite")
+}
+
+var _ = Describe("UpdateJSON", func() {
+	var path string
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "atomicfile-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		path = filepath.Join(dir, ".bastion", "state.json")
+	})
+
+	It("reads nothing from a missing file and writes only changes", func() {
+		names := []string{"kept"}
+		Expect(ReadJSON(path, &names)).To(Succeed())
+		Expect(names).To(Equal([]string{"kept"}))
+
+		Expect(UpdateJSON(path, &names, func() bool { return false })).To(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+
+	It("loses no update made concurrently, each under its own lock", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				var names []string
+				Expect(UpdateJSON(path, &names, func() bool {
+					names = append(names, fmt.Sprintf("name-%d", i))
+					return true
+				})).To(Succeed())
+			}(i)
+		}
+		wg.Wait()
+
+		var names []string
+		Expect(ReadJSON(path, &names)).To(Succeed())
+		Expect(names).To(HaveLen(20))
+		entries, err := os.ReadDir(filepath.Dir(path))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2), "only the file and its lock are left")
+	})
+})
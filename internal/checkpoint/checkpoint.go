@@ -0,0 +1,255 @@
+package checkpoint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is what is known about the last backed up state of an object.
+type entry struct {
+	ResourceVersion string `json:"rv"`
+	Hash            string `json:"h"`
+}
+
+// state is the persisted progress of a single GVK.
+type state struct {
+	LastResourceVersion string           `json:"lastResourceVersion"`
+	Objects             map[string]entry `json:"objects"` // keyed by namespace/name
+	dirty               bool
+}
+
+// Store persists per-GVK resume points, so a restarted controller can skip objects it already backed up
+// instead of re-reading and rehashing every stored manifest.
+type Store struct {
+	Dir     string
+	mu      sync.Mutex
+	flushMu sync.Mutex // Serializes flushes, so an older snapshot never replaces a newer one
+	states  map[schema.GroupVersionKind]*state
+}
+
+// NewStore returns a Store keeping its files in dir.
+func NewStore(dir string) *Store {
+	return &Store{
+		Dir:    dir,
+		states: make(map[schema.GroupVersionKind]*state),
+	}
+}
+
+// storeFile records the identity of the store the resume points describe.
+const storeFile = "store-id"
+
+// Bind ties the resume points to the store with the given identity. Resume points recorded for another
+// store, e.g. before the engine was switched or the store was wiped or migrated, are dropped, since they
+// would skip objects that store does not have.
+func (s *Store) Bind(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.Dir, storeFile)
+	bound, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read checkpoint store id: %w", err)
+	}
+	if string(bound) == id {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json.gz"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("failed to drop checkpoint: %w", err)
+		}
+	}
+	s.states = make(map[schema.GroupVersionKind]*state)
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint dir: %w", err)
+	}
+	if err := atomicfile.WriteFile(path, []byte(id)); err != nil {
+		return fmt.Errorf("failed to write checkpoint store id: %w", err)
+	}
+	return nil
+}
+
+// Seen reports whether obj was already backed up at its current resourceVersion.
+func (s *Store) Seen(gvk schema.GroupVersionKind, obj *unstructured.Unstructured) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.load(gvk).Objects[objectKey(obj.GetNamespace(), obj.GetName())]
+	return ok && e.ResourceVersion != "" && e.ResourceVersion == obj.GetResourceVersion()
+}
+
+// Hash returns the hash recorded for an object, if any.
+func (s *Store) Hash(gvk schema.GroupVersionKind, namespace, name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.load(gvk).Objects[objectKey(namespace, name)]
+	return e.Hash, ok
+}
+
+// Record notes that obj is backed up with the given hash.
+func (s *Store) Record(gvk schema.GroupVersionKind, obj *unstructured.Unstructured, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.load(gvk)
+	st.Objects[objectKey(obj.GetNamespace(), obj.GetName())] = entry{ResourceVersion: obj.GetResourceVersion(), Hash: hash}
+	st.LastResourceVersion = obj.GetResourceVersion()
+	st.dirty = true
+}
+
+// Forget drops an object, e.g. once it was deleted from the cluster.
+func (s *Store) Forget(gvk schema.GroupVersionKind, namespace, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.load(gvk)
+	key := objectKey(namespace, name)
+	if _, ok := st.Objects[key]; ok {
+		delete(st.Objects, key)
+		st.dirty = true
+	}
+}
+
+// Len returns the number of objects recorded for a GVK and its last observed resourceVersion.
+func (s *Store) Len(gvk schema.GroupVersionKind) (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.load(gvk)
+	return len(st.Objects), st.LastResourceVersion
+}
+
+// Run flushes the resume points every interval until ctx is done, then flushes a last time.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	logger := log.FromContext(ctx).WithName("Checkpoint").WithName("run")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				logger.Error(err, "failed to flush checkpoints")
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				logger.Error(err, "failed to flush checkpoints")
+			}
+		}
+	}
+}
+
+// Flush writes the resume points of every GVK that changed since the last flush. The changed states are
+// copied under the lock and encoded outside of it, so workers are not held up while they are written.
+func (s *Store) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	dirty := make(map[schema.GroupVersionKind]*state)
+	for gvk, st := range s.states {
+		if !st.dirty {
+			continue
+		}
+		objects := make(map[string]entry, len(st.Objects))
+		for key, e := range st.Objects {
+			objects[key] = e
+		}
+		dirty[gvk] = &state{LastResourceVersion: st.LastResourceVersion, Objects: objects}
+		st.dirty = false
+	}
+	s.mu.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		s.redirty(dirty)
+		return fmt.Errorf("failed to create checkpoint dir: %w", err)
+	}
+	for gvk, st := range dirty {
+		if err := s.write(gvk, st); err != nil {
+			s.redirty(dirty)
+			return err
+		}
+		delete(dirty, gvk)
+	}
+	return nil
+}
+
+// redirty marks the states of the GVKs whose snapshots were not written as changed again, so the next
+// flush retries them.
+func (s *Store) redirty(unwritten map[schema.GroupVersionKind]*state) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for gvk := range unwritten {
+		if st, ok := s.states[gvk]; ok {
+			st.dirty = true
+		}
+	}
+}
+
+// load returns the state of a GVK, reading it from disk on first use. Unreadable checkpoints are
+// dropped, which only costs a full rehash of that GVK.
+func (s *Store) load(gvk schema.GroupVersionKind) *state {
+	if st, ok := s.states[gvk]; ok {
+		return st
+	}
+	st := &state{}
+	if err := s.read(gvk, st); err != nil || st.Objects == nil {
+		st = &state{Objects: make(map[string]entry)}
+	}
+	s.states[gvk] = st
+	return st
+}
+
+func (s *Store) read(gvk schema.GroupVersionKind, st *state) error {
+	f, err := os.Open(s.path(gvk))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return json.NewDecoder(gz).Decode(st)
+}
+
+// write replaces the checkpoint file of a GVK atomically and durably, so a crash leaves either the old or
+// the new resume points.
+func (s *Store) write(gvk schema.GroupVersionKind, st *state) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(st); err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress checkpoint: %w", err)
+	}
+	if err := atomicfile.WriteFile(s.path(gvk), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// path returns the checkpoint file of a GVK, named after its encoded segments, which never contain the
+// '+' joining them, so distinct GVKs never share a file.
+func (s *Store) path(gvk schema.GroupVersionKind) string {
+	segments := storage.Key{GVK: gvk}.Segments()[:3]
+	return filepath.Join(s.Dir, strings.Join(segments, "+")+".json.gz")
+}
+
+func objectKey(namespace, name string) string {
+	return namespace + "/" + name
+}
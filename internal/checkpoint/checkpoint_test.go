@@ -0,0 +1,89 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestCheckpoint(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Checkpoint Suite")
+}
+
+var taskGVK = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+
+func newTask(name, resourceVersion string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(taskGVK)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+var _ = Describe("Store", func() {
+	It("survives a restart through flush", func() {
+		dir := GinkgoT().TempDir()
+		store := NewStore(dir)
+		store.Record(taskGVK, newTask("task-a", "10"), "h1")
+		store.Record(taskGVK, newTask("task-b", "11"), "h2")
+		store.Forget(taskGVK, "default", "task-b")
+		Expect(store.Flush()).To(Succeed())
+
+		restarted := NewStore(dir)
+		Expect(restarted.Seen(taskGVK, newTask("task-a", "10"))).To(BeTrue())
+		Expect(restarted.Seen(taskGVK, newTask("task-a", "12"))).To(BeFalse())
+		Expect(restarted.Seen(taskGVK, newTask("task-b", "11"))).To(BeFalse())
+		hash, ok := restarted.Hash(taskGVK, "default", "task-a")
+		Expect(ok).To(BeTrue())
+		Expect(hash).To(Equal("h1"))
+		count, lastResourceVersion := restarted.Len(taskGVK)
+		Expect(count).To(Equal(1))
+		Expect(lastResourceVersion).To(Equal("11"))
+	})
+
+	It("drops resume points recorded for another store", func() {
+		dir := GinkgoT().TempDir()
+		store := NewStore(dir)
+		Expect(store.Bind("store-1")).To(Succeed())
+		store.Record(taskGVK, newTask("task-a", "10"), "h1")
+		Expect(store.Flush()).To(Succeed())
+
+		restarted := NewStore(dir)
+		Expect(restarted.Bind("store-1")).To(Succeed())
+		Expect(restarted.Seen(taskGVK, newTask("task-a", "10"))).To(BeTrue())
+
+		switched := NewStore(dir)
+		Expect(switched.Bind("store-2")).To(Succeed())
+		Expect(switched.Seen(taskGVK, newTask("task-a", "10"))).To(BeFalse())
+		Expect(NewStore(dir).Seen(taskGVK, newTask("task-a", "10"))).To(BeFalse())
+	})
+
+	It("keeps GVKs whose names join alike in separate files", func() {
+		dir := GinkgoT().TempDir()
+		store := NewStore(dir)
+		first := schema.GroupVersionKind{Group: "a_b", Version: "v1", Kind: "Task"}
+		second := schema.GroupVersionKind{Group: "a", Version: "b_v1", Kind: "Task"}
+		store.Record(first, newTask("task-a", "10"), "h1")
+		store.Record(second, newTask("task-b", "11"), "h2")
+		Expect(store.Flush()).To(Succeed())
+
+		restarted := NewStore(dir)
+		Expect(restarted.Seen(first, newTask("task-a", "10"))).To(BeTrue())
+		Expect(restarted.Seen(second, newTask("task-b", "11"))).To(BeTrue())
+		Expect(filepath.Glob(filepath.Join(dir, "*.json.gz"))).To(HaveLen(2))
+	})
+
+	It("starts empty without a checkpoint", func() {
+		store := NewStore(GinkgoT().TempDir())
+		Expect(store.Seen(taskGVK, newTask("task-a", "10"))).To(BeFalse())
+		_, ok := store.Hash(taskGVK, "default", "task-a")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -7,10 +7,63 @@ import (
 )
 
 type Options struct {
-	BackupRoot      string
-	MaxRetries      int
-	NumberOfWorkers int
-	GcRetain        time.Duration
+	BackupRoot       string
+	MaxRetries       int
+	NumberOfWorkers  int
+	GcRetain         time.Duration
+	FinalizerMode    bool
+	FinalizerTimeout time.Duration
+	// GcInterval is how often expired tombstones are swept, GcJitter the random fraction of it added to every wait.
+	GcInterval time.Duration
+	GcJitter   float64
+	// GcConcurrency is how many expired tombstones are collected in parallel.
+	GcConcurrency int
+	// GcMaxPerSweep bounds the expired tombstones collected per sweep, zero for no limit.
+	GcMaxPerSweep int
+	// MassDeletionThreshold is the number of deletions of a GVK or in a namespace within MassDeletionWindow
+	// that freezes their garbage collection, zero disables detection.
+	MassDeletionThreshold int
+	MassDeletionWindow    time.Duration
+	// CheckpointInterval is how often informer resume points are flushed to disk.
+	CheckpointInterval time.Duration
+	// MetadataOnlyInformers caches only object metadata, fetching full objects when they change.
+	MetadataOnlyInformers bool
+	// ReconcileInterval is how often the cluster and store are fully compared, zero disables it.
+	ReconcileInterval    time.Duration
+	ReconcileConcurrency int
+	// ScrubInterval is how often the integrity of the whole store is verified, zero disables it.
+	ScrubInterval time.Duration
+	// RetentionInterval is how often backup policy retention rules are applied, zero disables it.
+	RetentionInterval time.Duration
+	// RetentionDryRun only reports the incarnations retention would prune.
+	RetentionDryRun bool
+	// QuotaInterval is how often usage is measured and backup policy quotas enforced, zero disables it.
+	QuotaInterval time.Duration
+	// SigningKeyFile is a PEM ed25519 private key used to sign every backup revision, empty disables signing.
+	SigningKeyFile string
+	// AttestInterval is how often the signed Merkle root over the store is refreshed.
+	AttestInterval time.Duration
+	// ReplicaRoot is a second backup root kept in sync with BackupRoot, empty disables replication.
+	ReplicaRoot         string
+	ReplicaSyncInterval time.Duration
+	// ReplicaPrune deletes replica objects that no longer exist in the backup root.
+	ReplicaPrune bool
+	// MirrorRoots are further backup roots every change is written to, next to BackupRoot.
+	MirrorRoots []string
+	// MirrorPolicy decides when a mirrored change counts as stored: all, quorum or primary-sync.
+	MirrorPolicy string
+	// StorageLayout is the layout of new backup roots: flat, or sharded for millions of objects.
+	StorageLayout string
+	// StorageEngine is how backups are kept: filesystem, with files per object, segment, appending
+	// every change to segment files, or kv, in a single-file embedded database.
+	StorageEngine string
+	// CompactionInterval is how often segment stores drop superseded records.
+	CompactionInterval time.Duration
+	// CompactionRetain is how long superseded records are kept by compaction.
+	CompactionRetain time.Duration
+	// ClusterName identifies the backed up cluster in the metadata of every backup, the UID of the
+	// kube-system namespace if empty.
+	ClusterName string
 }
 
 func getEnv(key, defaultVal string) string {
@@ -1,22 +1,45 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/checkpoint"
 	"github.com/bastion/internal/config"
 	"github.com/bastion/internal/dispatcher"
+	"github.com/bastion/internal/finalizer"
+	"github.com/bastion/internal/freeze"
 	"github.com/bastion/internal/gc"
 	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/hold"
+	"github.com/bastion/internal/quota"
+	"github.com/bastion/internal/reconciler"
+	"github.com/bastion/internal/replica"
+	"github.com/bastion/internal/retention"
+	"github.com/bastion/internal/scrub"
+	"github.com/bastion/internal/signing"
 	"github.com/bastion/internal/storage"
 	"github.com/bastion/internal/storage/filesystem"
+	"github.com/bastion/internal/storage/kv"
+	"github.com/bastion/internal/storage/mirror"
+	"github.com/bastion/internal/storage/segment"
 	"github.com/bastion/internal/worker"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apiextensionsinformer "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/tools/cache"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"time"
@@ -26,53 +49,433 @@ import (
 type BackupController struct {
 	Dispatcher         *dispatcher.Dispatcher                       // Central dispatcher that manages informer and worker wiring
 	Hasher             hash.Hasher                                  // Responsible for hashing resource manifests
-	StoreFactory       func(base string) storage.Storage            // Factory to provide a storage writer
+	StoreFactory       func(base string) (storage.Storage, error)   // Factory to provide a storage writer
 	InformerFactory    dynamicinformer.DynamicSharedInformerFactory // Dynamic informer factory for CR instances
 	MaxRetries         int                                          // Max number of retries for failed backup attempts
 	BaseDir            string                                       // Base directory for storing backups
 	totalRegisteredGVK int                                          // Count of active GVK informers (for monitoring/logging)
 	GcRetain           time.Duration
+	GcInterval         time.Duration // How often expired tombstones are swept
+	GcJitter           float64       // Random fraction of GcInterval added to every wait
+	GcConcurrency      int           // Expired tombstones collected in parallel
+	GcMaxPerSweep      int           // Expired tombstones collected per sweep, zero for no limit
+	// Deletions within MassDeletionWindow that freeze garbage collection of their scope, zero disables it
+	MassDeletionThreshold int
+	MassDeletionWindow    time.Duration
+	FinalizerMode         bool              // Add a finalizer to in-scope CRs to capture their exact final state
+	FinalizerTimeout      time.Duration     // Max time a deletion is held for the final state capture
+	Checkpoints           *checkpoint.Store // Per-GVK resume points that let a restart skip already backed up objects
+	CheckpointInterval    time.Duration     // How often resume points are flushed to disk
+	// Cache only object metadata in informers and fetch full objects when their resourceVersion changes
+	MetadataOnlyInformers bool
+	ReconcileInterval     time.Duration // How often the cluster and store are fully compared, zero disables it
+	ReconcileConcurrency  int           // Number of GVKs reconciled in parallel
+	ScrubInterval         time.Duration // How often the integrity of the store is verified, zero disables it
+	RetentionInterval     time.Duration // How often backup policy retention rules are applied, zero disables it
+	RetentionDryRun       bool          // Only report the incarnations retention would prune
+	QuotaInterval         time.Duration // How often usage is measured and quotas enforced, zero disables it
+	SigningKeyFile        string        // ed25519 key signing every revision, empty disables signing
+	AttestInterval        time.Duration // How often the signed Merkle root over the store is refreshed
+	ReplicaRoot           string        // Second store kept in sync with BaseDir, empty disables it
+	ReplicaSyncInterval   time.Duration // How often the replica is brought up to date
+	ReplicaPrune          bool          // Delete replica objects that are gone from BaseDir
+	MirrorRoots           []string      // Further stores every change is fanned out to, next to BaseDir
+	MirrorPolicy          string        // When a mirrored change counts as stored: all, quorum or primary-sync
+	StorageLayout         string        // Layout of new filesystem stores: flat or sharded
+	StorageEngine         string        // How backups are kept: filesystem, segment or kv
+	CompactionInterval    time.Duration // How often segment stores drop superseded records
+	CompactionRetain      time.Duration // How long segment stores keep superseded records
+	ClusterName           string        // Identity of the cluster recorded in backup metadata
 }
 
 // NewBackupController constructs the controller with dependencies injected from config.
 func NewBackupController(cfg *config.Options) *BackupController {
+	checkpoints := checkpoint.NewStore(filepath.Join(cfg.BackupRoot, ".bastion", "checkpoints"))
 	return &BackupController{
-		Dispatcher:   dispatcher.NewDispatcher(),
-		Hasher:       hash.NewDefaultHasher(),
-		StoreFactory: func(base string) storage.Storage { return filesystem.NewFileSystemBasedBackup(base) },
-		MaxRetries:   cfg.MaxRetries,
-		BaseDir:      cfg.BackupRoot,
-		GcRetain:     cfg.GcRetain,
+		Dispatcher:            dispatcher.NewDispatcher(checkpoints),
+		Hasher:                hash.NewDefaultHasher(),
+		StoreFactory:          newStoreFactory(cfg.StorageEngine, cfg.StorageLayout, cfg.CompactionRetain),
+		MaxRetries:            cfg.MaxRetries,
+		BaseDir:               cfg.BackupRoot,
+		GcRetain:              cfg.GcRetain,
+		GcInterval:            cfg.GcInterval,
+		GcJitter:              cfg.GcJitter,
+		GcConcurrency:         cfg.GcConcurrency,
+		GcMaxPerSweep:         cfg.GcMaxPerSweep,
+		MassDeletionThreshold: cfg.MassDeletionThreshold,
+		MassDeletionWindow:    cfg.MassDeletionWindow,
+		FinalizerMode:         cfg.FinalizerMode,
+		FinalizerTimeout:      cfg.FinalizerTimeout,
+		Checkpoints:           checkpoints,
+		CheckpointInterval:    cfg.CheckpointInterval,
+		MetadataOnlyInformers: cfg.MetadataOnlyInformers,
+		ReconcileInterval:     cfg.ReconcileInterval,
+		ReconcileConcurrency:  cfg.ReconcileConcurrency,
+		ScrubInterval:         cfg.ScrubInterval,
+		RetentionInterval:     cfg.RetentionInterval,
+		RetentionDryRun:       cfg.RetentionDryRun,
+		QuotaInterval:         cfg.QuotaInterval,
+		SigningKeyFile:        cfg.SigningKeyFile,
+		AttestInterval:        cfg.AttestInterval,
+		ReplicaRoot:           cfg.ReplicaRoot,
+		ReplicaSyncInterval:   cfg.ReplicaSyncInterval,
+		ReplicaPrune:          cfg.ReplicaPrune,
+		MirrorRoots:           cfg.MirrorRoots,
+		MirrorPolicy:          cfg.MirrorPolicy,
+		StorageLayout:         cfg.StorageLayout,
+		StorageEngine:         cfg.StorageEngine,
+		CompactionInterval:    cfg.CompactionInterval,
+		CompactionRetain:      cfg.CompactionRetain,
+		ClusterName:           cfg.ClusterName,
 	}
 }
 
+// newStoreFactory returns a StoreFactory for stores of the given engine. New filesystem stores are
+// created in layout, segment stores keep superseded records for retain.
+func newStoreFactory(engine, layout string, retain time.Duration) func(base string) (storage.Storage, error) {
+	return func(base string) (storage.Storage, error) {
+		switch engine {
+		case "", "filesystem":
+			fs := filesystem.NewFileSystemBasedBackup(base)
+			if fs.Layout == "" {
+				fs.Layout = filesystem.Layout(layout)
+			}
+			return fs, nil
+		case "segment":
+			store, err := segment.Open(base)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open segment store: %w", err)
+			}
+			store.Retain = retain
+			return store, nil
+		case "kv":
+			store, err := kv.Open(base)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open kv store: %w", err)
+			}
+			return store, nil
+		}
+		return nil, fmt.Errorf("unknown storage engine %q, expected filesystem, segment or kv", engine)
+	}
+}
+
+// clusterName returns the identity of the cluster recorded in backup metadata: the configured name, or
+// else the UID of the kube-system namespace, which lives as long as the cluster does.
+func (bc *BackupController) clusterName(ctx context.Context, client dynamic.Interface) string {
+	if bc.ClusterName != "" {
+		return bc.ClusterName
+	}
+	ns, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).
+		Get(ctx, "kube-system", metav1.GetOptions{})
+	if err != nil {
+		log.FromContext(ctx).WithName("BackupController").Error(err, "failed to identify cluster, backups will not record it")
+		return ""
+	}
+	return string(ns.GetUID())
+}
+
+// controllerNamespace returns the namespace the controller runs in, or default when it runs outside of a
+// pod.
+func controllerNamespace() string {
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return metav1.NamespaceDefault
+	}
+	return string(bytes.TrimSpace(data))
+}
+
+// policies returns the source of the backup policies whose retention rules, quotas and tombstone TTLs
+// apply to the store. Clusters without the BackupPolicy CRD, e.g. Helm installs, have none.
+func (bc *BackupController) policies(reader client.Reader) func(ctx context.Context) ([]v1alpha1.BackupPolicy, error) {
+	return func(ctx context.Context) ([]v1alpha1.BackupPolicy, error) {
+		policies := &v1alpha1.BackupPolicyList{}
+		if err := reader.List(ctx, policies); err != nil {
+			if meta.IsNoMatchError(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return policies.Items, nil
+	}
+}
+
+// runCompaction starts dropping superseded records from store, if it is a segment store.
+func (bc *BackupController) runCompaction(ctx context.Context, store storage.Storage) {
+	segments, ok := store.(*segment.Store)
+	if !ok {
+		return
+	}
+	interval := bc.CompactionInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go segments.RunCompaction(ctx, interval)
+}
+
+// serveSnapshots starts taking snapshot requests for store, if it is a kv store: its database is locked
+// by this process, so bastionctl asks for snapshots through the socket of the store.
+func (bc *BackupController) serveSnapshots(ctx context.Context, store storage.Storage) {
+	db, ok := store.(*kv.KV)
+	if !ok {
+		return
+	}
+	go func() {
+		if err := db.ServeSnapshots(ctx); err != nil {
+			log.FromContext(ctx).WithName("BackupController").Error(err, "failed to serve kv snapshots", "dir", db.Dir)
+		}
+	}()
+}
+
 // Setup wires the backup controller with the manager and starts CRD + backup handlers.
 func (bc *BackupController) Setup(ctx context.Context, mgr manager.Manager) error {
 	logger := log.FromContext(ctx).WithName("BackupController").WithName("setup")
 	logger.Info("setting up backup controller, with options",
 		"MaxRetries", bc.MaxRetries,
 		"GcRetain", bc.GcRetain,
-		"BaseDir", bc.BaseDir)
-	// Setup dynamic client and shared informer factory
+		"GcInterval", bc.GcInterval,
+		"GcJitter", bc.GcJitter,
+		"GcConcurrency", bc.GcConcurrency,
+		"GcMaxPerSweep", bc.GcMaxPerSweep,
+		"MassDeletionThreshold", bc.MassDeletionThreshold,
+		"MassDeletionWindow", bc.MassDeletionWindow,
+		"BaseDir", bc.BaseDir,
+		"FinalizerMode", bc.FinalizerMode,
+		"FinalizerTimeout", bc.FinalizerTimeout,
+		"MetadataOnlyInformers", bc.MetadataOnlyInformers,
+		"ReconcileInterval", bc.ReconcileInterval,
+		"ReconcileConcurrency", bc.ReconcileConcurrency,
+		"ScrubInterval", bc.ScrubInterval,
+		"RetentionInterval", bc.RetentionInterval,
+		"RetentionDryRun", bc.RetentionDryRun,
+		"QuotaInterval", bc.QuotaInterval,
+		"SigningEnabled", bc.SigningKeyFile != "",
+		"AttestInterval", bc.AttestInterval,
+		"ReplicaRoot", bc.ReplicaRoot,
+		"ReplicaSyncInterval", bc.ReplicaSyncInterval,
+		"MirrorRoots", bc.MirrorRoots,
+		"MirrorPolicy", bc.MirrorPolicy,
+		"StorageLayout", bc.StorageLayout,
+		"StorageEngine", bc.StorageEngine,
+		"CompactionInterval", bc.CompactionInterval,
+		"CompactionRetain", bc.CompactionRetain,
+		"ClusterName", bc.ClusterName)
+	if _, err := filesystem.ParseLayout(bc.StorageLayout); err != nil {
+		return err
+	}
+	// Setup dynamic client and shared informer factory, used by the dispatcher for every GVK
 	dynamicClient := dynamic.NewForConfigOrDie(mgr.GetConfig())
 	bc.InformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	bc.Dispatcher.DynamicClient = dynamicClient
+	bc.Dispatcher.InformerFactory = bc.InformerFactory
+	if bc.MetadataOnlyInformers {
+		metadataClient := metadata.NewForConfigOrDie(mgr.GetConfig())
+		bc.Dispatcher.MetadataClient = metadataClient
+		bc.Dispatcher.MetadataFactory = metadatainformer.NewSharedInformerFactory(metadataClient, 0)
+	}
 
 	// Setup CRD client to watch for CRD add/delete events
 	apiExtClient, err := apiextensionsclientset.NewForConfig(mgr.GetConfig())
 	if err != nil {
 		return fmt.Errorf("failed to create apiextensions client: %w", err)
 	}
+	var backends []storage.Storage
+	for _, root := range append([]string{bc.BaseDir}, bc.MirrorRoots...) {
+		backend, err := bc.StoreFactory(root)
+		if err != nil {
+			return err
+		}
+		backends = append(backends, backend)
+	}
+	// Refuse stores in a format this build does not know, and upgrade older ones before touching them
+	for _, backend := range backends {
+		if upgrader, ok := backend.(storage.Upgrader); ok {
+			if err := upgrader.Upgrade(ctx); err != nil {
+				return fmt.Errorf("failed to upgrade store format: %w", err)
+			}
+		}
+	}
+	// Sign every revision, and periodically the Merkle root over all of them, for tamper evidence
+	if bc.SigningKeyFile != "" {
+		signer, err := signing.LoadSigner(bc.SigningKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %w", err)
+		}
+		attestInterval := bc.AttestInterval
+		if attestInterval <= 0 {
+			attestInterval = time.Hour
+		}
+		for _, backend := range backends {
+			fs, ok := backend.(*filesystem.FileSystem)
+			if !ok {
+				return fmt.Errorf("signing is only supported by the filesystem store")
+			}
+			fs.Signer = signer
+			// Nothing writes to the store yet, entries torn by a crash stay marked and are left to recovery
+			signed, err := fs.SignUnsigned(ctx, bc.Hasher)
+			if err != nil {
+				return fmt.Errorf("failed to sign unsigned backups: %w", err)
+			}
+			if signed > 0 {
+				logger.Info("Signed backups stored without a signature", "root", fs.BaseDir, "signatures", signed)
+			}
+			go fs.RunAttestation(ctx, attestInterval)
+		}
+		logger.Info("Signing backups", "keyID", signer.KeyID)
+	}
+	for _, backend := range backends {
+		bc.runCompaction(ctx, backend)
+		bc.serveSnapshots(ctx, backend)
+	}
+	store := backends[0]
+	// Fan changes out to every backend so a single volume is not a single point of failure
+	if len(backends) > 1 {
+		policy, err := mirror.ParsePolicy(bc.MirrorPolicy)
+		if err != nil {
+			return err
+		}
+		queue, err := mirror.NewQueue(filepath.Join(bc.BaseDir, ".bastion", "replay"))
+		if err != nil {
+			return fmt.Errorf("failed to open mirror replay queue: %w", err)
+		}
+		mirrored, err := mirror.NewMirror(backends, policy, queue)
+		if err != nil {
+			return err
+		}
+		go mirrored.RunReplay(ctx, 10*time.Second)
+		store = mirrored
+	}
+
+	// Repair entries torn by a crash before anything writes to the store again
+	if recoverer, ok := store.(storage.Recoverer); ok {
+		report, err := recoverer.Recover(ctx, bc.Hasher)
+		if err != nil {
+			return fmt.Errorf("failed to recover store: %w", err)
+		}
+		logger.Info("Store recovery scan complete",
+			"checked", report.Checked,
+			"repaired", report.Repaired,
+			"quarantined", report.Quarantined,
+			"unsigned", report.Unsigned,
+			"tempFilesRemoved", report.TempFilesRemoved)
+	}
+
+	// Resume points recorded for another store would skip objects this one does not have
+	if identifier, ok := store.(storage.Identifier); ok {
+		id, err := identifier.ID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to identify store: %w", err)
+		}
+		if err := bc.Checkpoints.Bind(id); err != nil {
+			return fmt.Errorf("failed to bind checkpoints to store: %w", err)
+		}
+	}
+
+	// Deletions by GC, retention, quotas and replica pruning are refused for backups under hold
+	tags := hold.Sources(hold.NewFile(hold.Path(bc.BaseDir)), mgr.GetClient())
+	guarded := hold.NewGuard(store, tags)
+
 	// Create and start a shared worker pool for backup processing
-	bw := worker.NewBackupWorker("default-backup-worker", bc.Hasher, bc.StoreFactory(bc.BaseDir), 100, bc.MaxRetries, 5)
+	bw := worker.NewBackupWorker("default-backup-worker", bc.Hasher, store, 100, bc.MaxRetries, 5)
+	// The guard is always wired so finalizers left from an earlier run are released when the mode is off
+	bw.Finalizer = finalizer.NewGuard(dynamicClient, bc.FinalizerMode, bc.FinalizerTimeout)
+	bw.Checkpoints = bc.Checkpoints
+	bw.DynamicClient = dynamicClient
+	bw.Cluster = bc.clusterName(ctx, dynamicClient)
+	// Freeze garbage collection of a GVK or namespace seeing a burst of deletions until it is acknowledged
+	freezes := freeze.NewFile(freeze.Path(bc.BaseDir))
+	var detector *freeze.Detector
+	if bc.MassDeletionThreshold > 0 {
+		detector = freeze.NewDetector(freezes, bc.MassDeletionThreshold, bc.MassDeletionWindow)
+		detector.Recorder = mgr.GetEventRecorderFor("bastion")
+		detector.Namespace = controllerNamespace()
+		bc.Dispatcher.Deletions = detector
+	}
+	// Measure usage and apply quotas, suspending the backups of namespaces over a suspending quota
+	if bc.QuotaInterval > 0 {
+		enforcer := quota.NewEnforcer(guarded, bc.policies(mgr.GetAPIReader()), bc.QuotaInterval)
+		enforcer.UpdateStatus = func(ctx context.Context, policy *v1alpha1.BackupPolicy) error {
+			return mgr.GetClient().Status().Update(ctx, policy)
+		}
+		enforcer.Recorder = mgr.GetEventRecorderFor("bastion")
+		bw.Suspended = enforcer.Suspended
+		go enforcer.Run(ctx)
+	}
 	bw.StartWorkers(ctx)
 
+	// Persist resume points so a restart does not rehash every stored manifest
+	checkpointInterval := bc.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = 30 * time.Second
+	}
+	go bc.Checkpoints.Run(ctx, checkpointInterval)
+
 	// Launch garbage collector for tombstone cleanup
-	garbageCollector := gc.NewGarbageCollector(bc.GcRetain, dynamicClient, bc.StoreFactory(bc.BaseDir))
+	garbageCollector := gc.NewGarbageCollector(bc.GcRetain, dynamicClient, guarded)
+	garbageCollector.SweepInterval = bc.GcInterval
+	garbageCollector.Jitter = bc.GcJitter
+	garbageCollector.Concurrency = bc.GcConcurrency
+	garbageCollector.MaxPerSweep = bc.GcMaxPerSweep
+	garbageCollector.Policies = bc.policies(mgr.GetAPIReader())
+	garbageCollector.Freezes = freezes.Load
 	go garbageCollector.Run(ctx)
 
+	// Launch periodic reconciliation to repair drift left by dropped or failed events
+	if bc.ReconcileInterval > 0 {
+		rec := reconciler.NewReconciler(dynamicClient, store, bc.Hasher, bw,
+			bc.Dispatcher.Registered, bc.ReconcileInterval, bc.ReconcileConcurrency)
+		go rec.Run(ctx)
+	}
+
+	// Launch periodic scrubbing to detect backups that were corrupted at rest
+	if scrubbable, ok := store.(storage.Scrubber); ok && bc.ScrubInterval > 0 {
+		scrubber := scrub.NewScrubber(scrubbable, bc.Hasher, bc.ScrubInterval,
+			filepath.Join(bc.BaseDir, ".bastion", "scrub-report.json"))
+		go scrubber.Run(ctx)
+	}
+
+	// Launch retention pruning of archived incarnations the backup policies no longer keep
+	if bc.RetentionInterval > 0 {
+		pruner := retention.NewPruner(guarded, bc.policies(mgr.GetAPIReader()), bc.RetentionInterval, bc.RetentionDryRun)
+		go pruner.Run(ctx)
+	}
+
+	// Launch anti-entropy sync keeping a second copy of the backups up to date
+	if bc.ReplicaRoot != "" {
+		interval := bc.ReplicaSyncInterval
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		replicaStore, err := bc.StoreFactory(bc.ReplicaRoot)
+		if err != nil {
+			return err
+		}
+		if upgrader, ok := replicaStore.(storage.Upgrader); ok {
+			if err := upgrader.Upgrade(ctx); err != nil {
+				return fmt.Errorf("failed to upgrade replica format: %w", err)
+			}
+		}
+		bc.runCompaction(ctx, replicaStore)
+		bc.serveSnapshots(ctx, replicaStore)
+		syncer := replica.NewSyncer(store, hold.NewGuard(replicaStore, tags), interval, bc.ReplicaPrune)
+		go syncer.Run(ctx)
+	}
+
 	// Start CRD informer to dynamically track new GVKs
 	crdInformerFactory := apiextensionsinformer.NewSharedInformerFactory(apiExtClient, 0)
 	crdInformer := crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Informer()
+	if detector != nil {
+		crds := crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions().Lister()
+		detector.CustomResource = func(ctx context.Context, gvr schema.GroupVersionResource) (bool, error) {
+			_, err := crds.Get(gvr.GroupResource().String())
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+	if err := crdInformer.SetTransform(dispatcher.StripUnstoredFields); err != nil {
+		return err
+	}
 	_, err = crdInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			crd := obj.(*apiextensionsv1.CustomResourceDefinition)
@@ -87,7 +490,7 @@ func (bc *BackupController) Setup(ctx context.Context, mgr manager.Manager) erro
 				Resource: crd.Spec.Names.Plural,
 			}
 			// Register informer for new GVK
-			_ = bc.Dispatcher.Register(ctx, gvr, gvk, dynamicClient, bw)
+			_ = bc.Dispatcher.Register(ctx, gvr, gvk, bw)
 			bc.totalRegisteredGVK++
 			logger.Info("Registering informers for GVK", "GVK", gvk)
 			logger.Info("Current total registered informer per GVK", "count", bc.totalRegisteredGVK)
@@ -99,10 +502,15 @@ func (bc *BackupController) Setup(ctx context.Context, mgr manager.Manager) erro
 				Version: crd.Spec.Versions[0].Name,
 				Kind:    crd.Spec.Names.Kind,
 			}
+			gvr := schema.GroupVersionResource{
+				Group:    crd.Spec.Group,
+				Version:  crd.Spec.Versions[0].Name,
+				Resource: crd.Spec.Names.Plural,
+			}
 			bc.totalRegisteredGVK = bc.totalRegisteredGVK - 1
 			logger.Info("Deregistering informers for GVK", "GVK", gvk)
 			logger.Info("Current total registered informer per GVK", "count", bc.totalRegisteredGVK)
-			_ = bc.Dispatcher.Stop(ctx, gvk)
+			_ = bc.Dispatcher.Stop(ctx, gvr, gvk)
 		},
 	})
 	if err != nil {
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"github.com/bastion/internal/config"
+	"github.com/bastion/internal/storage"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
@@ -91,8 +92,9 @@ var _ = DescribeTable("Backup Controller",
 		By("Creating CR")
 		Expect(k8sClient.Create(ctx, cr)).To(Succeed())
 		time.Sleep(3 * time.Second)
-		manifest := filepath.Join(backupRoot, "demo.bastion.io", "v1", kind, cr.GetNamespace(), cr.GetName(), "manifest.yaml")
-		hash := filepath.Join(backupRoot, "demo.bastion.io", "v1", kind, cr.GetNamespace(), cr.GetName(), "hash.txt")
+		dir := filepath.Join(append([]string{backupRoot}, storage.KeyOf(cr).Segments()...)...)
+		manifest := filepath.Join(dir, "manifest.yaml")
+		hash := filepath.Join(dir, "hash.txt")
 		By("Expecting backup files to exist")
 		Expect(manifest).Should(BeAnExistingFile())
 		Expect(hash).Should(BeAnExistingFile())
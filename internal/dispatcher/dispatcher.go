@@ -4,10 +4,20 @@ import (
 	"context"
 	"fmt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bastion/internal/checkpoint"
+	"github.com/bastion/internal/finalizer"
+	"github.com/bastion/internal/freeze"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
 	"github.com/bastion/internal/worker"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -17,33 +27,81 @@ import (
 
 type Dispatcher struct {
 	informerCancels map[string]context.CancelFunc
+	registered      map[schema.GroupVersionKind]schema.GroupVersionResource
+	stopped         map[schema.GroupVersionResource]bool // Resources whose shared informer was stopped and cannot be restarted
 	mu              sync.Mutex
+	Checkpoints     *checkpoint.Store // Resume points used to skip already backed up objects, nil disables skipping
+	Deletions       *freeze.Detector  // Counts deletions to freeze garbage collection after a mass deletion, nil disables it
+
+	DynamicClient   dynamic.Interface
+	InformerFactory dynamicinformer.DynamicSharedInformerFactory // Shared factory for full object informers
+	MetadataClient  metadata.Interface
+	MetadataFactory metadatainformer.SharedInformerFactory // Shared factory for metadata-only informers, nil caches full objects
 }
 
-func NewDispatcher() *Dispatcher {
+func NewDispatcher(checkpoints *checkpoint.Store) *Dispatcher {
 	return &Dispatcher{
 		informerCancels: make(map[string]context.CancelFunc),
+		registered:      make(map[schema.GroupVersionKind]schema.GroupVersionResource),
+		stopped:         make(map[schema.GroupVersionResource]bool),
+		Checkpoints:     checkpoints,
 	}
 }
 
-func (d *Dispatcher) Register(ctx context.Context, gvr schema.GroupVersionResource, gvk schema.GroupVersionKind, dynamicClient dynamic.Interface, w *worker.BackupWorker) error {
+// MetadataOnly reports whether informers cache only object metadata, leaving the worker to fetch
+// the full object when its resourceVersion changes.
+func (d *Dispatcher) MetadataOnly() bool {
+	return d.MetadataFactory != nil
+}
+
+func (d *Dispatcher) Register(ctx context.Context, gvr schema.GroupVersionResource, gvk schema.GroupVersionKind, w *worker.BackupWorker) error {
 	logger := log.FromContext(ctx)
-	logger.Info("Registering backup controller", "gvr", gvr.String(), "gvk", gvk.String())
-	// Create a tweakListOptions function to filter by label
-	tweakListOptions := func(opts *metav1.ListOptions) {
-		// opts.LabelSelector = "backup.bastion.io/enabled=true"
+	logger.Info("Registering backup controller", "gvr", gvr.String(), "gvk", gvk.String(), "metadataOnly", d.MetadataOnly())
+	informer := d.informerFor(gvr)
+	// Drop what Bastion never stores before it reaches the informer cache
+	if err := informer.SetTransform(StripUnstoredFields); err != nil {
+		return err
+	}
+	if d.Checkpoints != nil {
+		count, lastResourceVersion := d.Checkpoints.Len(gvk)
+		logger.Info("Resuming from checkpoint", "gvk", gvk.String(), "objects", count, "lastResourceVersion", lastResourceVersion)
 	}
-	filteredInformerFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, metav1.NamespaceAll, tweakListOptions)
-	informer := filteredInformerFactory.ForResource(gvr).Informer()
-	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			d.enqueueIfAnnotated(obj, w, 2)
+	var queued, skipped atomic.Int64
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			result := "queued"
+			if !d.enqueueIfAnnotated(obj, gvr, gvk, w, worker.Create) {
+				result = "skipped"
+			}
+			if isInInitialList {
+				if result == "queued" {
+					queued.Add(1)
+				} else {
+					skipped.Add(1)
+				}
+				metrics.StartupSyncObjects.WithLabelValues(gvk.String(), result).Inc()
+			}
 		},
-		UpdateFunc: func(_, newObj interface{}) {
-			d.enqueueIfAnnotated(newObj, w, 0)
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Objects deleted gracefully, e.g. held by a finalizer, are counted when they get their deletion timestamp
+			if deletionTimestamp(oldObj) == nil {
+				if deleted := deletionTimestamp(newObj); deleted != nil {
+					d.observeDeletion(ctx, gvr, gvk, newObj, deleted.Time)
+				}
+			}
+			if d.MetadataOnly() && resourceVersion(oldObj) == resourceVersion(newObj) {
+				return // resync, nothing to fetch
+			}
+			d.enqueueIfAnnotated(newObj, gvr, gvk, w, worker.Update)
 		},
 		DeleteFunc: func(obj interface{}) {
-			d.enqueueIfAnnotated(obj, w, 1)
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if deletionTimestamp(obj) == nil {
+				d.observeDeletion(ctx, gvr, gvk, obj, time.Now())
+			}
+			d.enqueueIfAnnotated(obj, gvr, gvk, w, worker.Delete)
 		},
 	})
 	if err != nil {
@@ -53,46 +111,160 @@ func (d *Dispatcher) Register(ctx context.Context, gvr schema.GroupVersionResour
 	childCtx, cancel := context.WithCancel(ctx)
 	key := gvk.String()
 	d.informerCancels[key] = cancel
+	d.registered[gvk] = gvr
 	d.mu.Unlock()
+	metrics.StartupSyncComplete.WithLabelValues(gvk.String()).Set(0)
 	go informer.Run(childCtx.Done())
+	go func() {
+		if !cache.WaitForCacheSync(childCtx.Done(), informer.HasSynced) {
+			return
+		}
+		metrics.StartupSyncComplete.WithLabelValues(gvk.String()).Set(1)
+		logger.Info("Initial sync handled", "gvk", gvk.String(), "queued", queued.Load(), "skipped", skipped.Load())
+	}()
 	return nil
 }
 
-func (d *Dispatcher) Stop(ctx context.Context, gvk schema.GroupVersionKind) error {
+// informerFor returns the informer of a resource from the shared factory. A stopped shared informer
+// cannot be run again, so a resource registered again after Stop gets a standalone informer.
+func (d *Dispatcher) informerFor(gvr schema.GroupVersionResource) cache.SharedIndexInformer {
+	// Create a tweakListOptions function to filter by label
+	tweakListOptions := func(opts *metav1.ListOptions) {
+		// opts.LabelSelector = "backup.bastion.io/enabled=true"
+	}
+	d.mu.Lock()
+	stopped := d.stopped[gvr]
+	d.mu.Unlock()
+	switch {
+	case d.MetadataOnly() && stopped:
+		return metadatainformer.NewFilteredMetadataInformer(d.MetadataClient, gvr, metav1.NamespaceAll, 0, cache.Indexers{}, tweakListOptions).Informer()
+	case d.MetadataOnly():
+		return d.MetadataFactory.ForResource(gvr).Informer()
+	case stopped:
+		return dynamicinformer.NewFilteredDynamicInformer(d.DynamicClient, gvr, metav1.NamespaceAll, 0, cache.Indexers{}, tweakListOptions).Informer()
+	default:
+		return d.InformerFactory.ForResource(gvr).Informer()
+	}
+}
+
+func (d *Dispatcher) Stop(ctx context.Context, gvr schema.GroupVersionResource, gvk schema.GroupVersionKind) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	logger := log.FromContext(ctx)
 	if cancel, ok := d.informerCancels[gvk.String()]; ok {
 		cancel()
 		delete(d.informerCancels, gvk.String())
+		delete(d.registered, gvk)
+		d.stopped[gvr] = true
 	}
 	logger.Info("Stopping informer", "gvk", gvk.String())
 	return nil
 }
 
+// Registered returns the GVKs with a running informer and their resources.
+func (d *Dispatcher) Registered() map[schema.GroupVersionKind]schema.GroupVersionResource {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	registered := make(map[schema.GroupVersionKind]schema.GroupVersionResource, len(d.registered))
+	for gvk, gvr := range d.registered {
+		registered[gvk] = gvr
+	}
+	return registered
+}
+
 func gvkKey(gvk schema.GroupVersionKind) string {
 	return fmt.Sprintf("%s/%s/%s", gvk.Group, gvk.Version, gvk.Kind)
 }
 
-func (d *Dispatcher) enqueueIfAnnotated(obj interface{}, w *worker.BackupWorker, eventType worker.EventType) {
-	var (
-		u *unstructured.Unstructured
-	)
-	if eventType == 0 {
-		// Handle tombstone
-		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
-			if realObj, ok := tombstone.Obj.(*unstructured.Unstructured); ok {
-				u = realObj
-			} else {
-				return
-			}
-		} else if o, ok := obj.(*unstructured.Unstructured); ok {
-			u = o
-		} else {
-			return
+// StripUnstoredFields is the informer transform dropping managedFields, which Bastion never stores
+// and which make up a large share of every cached object.
+func StripUnstoredFields(obj interface{}) (interface{}, error) {
+	if o, ok := obj.(metav1.Object); ok {
+		o.SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+func deletionTimestamp(obj interface{}) *metav1.Time {
+	if o, ok := obj.(metav1.Object); ok {
+		return o.GetDeletionTimestamp()
+	}
+	return nil
+}
+
+// observeDeletion counts the deletion of obj at the time it happened towards mass deletion detection,
+// rather than when a worker gets to it, so a backlog of queued events cannot bunch deletions together or
+// spread them apart. The deletion is recorded either way, so a failure is only logged.
+func (d *Dispatcher) observeDeletion(ctx context.Context, gvr schema.GroupVersionResource, gvk schema.GroupVersionKind, obj interface{}, at time.Time) {
+	o, ok := obj.(metav1.Object)
+	if d.Deletions == nil || !ok {
+		return
+	}
+	key := storage.Key{GVK: gvk, Namespace: o.GetNamespace(), Name: o.GetName()}
+	if err := d.Deletions.Observe(ctx, gvr, key, at); err != nil {
+		log.FromContext(ctx).Error(err, "failed to observe deletion", "key", key.String())
+	}
+}
+
+func resourceVersion(obj interface{}) string {
+	if o, ok := obj.(metav1.Object); ok {
+		return o.GetResourceVersion()
+	}
+	return ""
+}
+
+// toUnstructured unwraps an informer object, which in metadata-only mode carries only the metadata.
+func toUnstructured(obj interface{}, gvk schema.GroupVersionKind) (*unstructured.Unstructured, bool) {
+	switch o := obj.(type) {
+	case *unstructured.Unstructured:
+		return o.DeepCopy(), true
+	case *metav1.PartialObjectMetadata:
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o)
+		if err != nil {
+			return nil, false
 		}
-	} else {
-		u = obj.(*unstructured.Unstructured)
+		u := &unstructured.Unstructured{Object: content}
+		u.SetGroupVersionKind(gvk)
+		return u, true
+	}
+	return nil, false
+}
+
+// enqueueIfAnnotated queues an event for backup and reports whether it did. Adds and updates of objects
+// already backed up at their current resourceVersion are skipped.
+func (d *Dispatcher) enqueueIfAnnotated(obj interface{}, gvr schema.GroupVersionResource, gvk schema.GroupVersionKind, w *worker.BackupWorker, eventType worker.EventType) bool {
+	// Handle tombstone
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok && eventType == worker.Delete {
+		obj = tombstone.Obj
+	}
+	u, ok := toUnstructured(obj, gvk)
+	if !ok {
+		return false
+	}
+	if eventType != worker.Delete && finalizer.Deleting(u) {
+		eventType = worker.Finalize
+	}
+	if d.alreadyBackedUp(u, w, eventType) {
+		return false
+	}
+	w.EnqueueEvent(worker.BackupEvent{
+		Object:       u,
+		EventType:    eventType,
+		GVK:          gvk,
+		GVR:          gvr,
+		MetadataOnly: d.MetadataOnly(),
+	})
+	return true
+}
+
+// alreadyBackedUp reports whether an add or update can be skipped because the resume points show the
+// object was backed up at this resourceVersion, and it does not need the finalizer added.
+func (d *Dispatcher) alreadyBackedUp(u *unstructured.Unstructured, w *worker.BackupWorker, eventType worker.EventType) bool {
+	if d.Checkpoints == nil || (eventType != worker.Create && eventType != worker.Update) {
+		return false
+	}
+	if w.Finalizer != nil && w.Finalizer.Needs(u) {
+		return false
 	}
-	w.Enqueue(u.DeepCopy(), eventType)
+	return d.Checkpoints.Seen(u.GroupVersionKind(), u)
 }
@@ -0,0 +1,105 @@
+package dispatcher
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/freeze"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	"github.com/bastion/internal/worker"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dispatcher Suite")
+}
+
+var _ = Describe("Dispatcher", func() {
+	var (
+		ctx    context.Context
+		client *dynamicfake.FakeDynamicClient
+		file   *freeze.File
+	)
+
+	frozen := func() []freeze.Scope {
+		freezes, err := file.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		var scopes []freeze.Scope
+		for _, f := range freezes {
+			scopes = append(scopes, f.Scope)
+		}
+		return scopes
+	}
+
+	// deleteGracefully gives the task a deletion timestamp, as the API server does for an object held by a
+	// finalizer, then removes it once released
+	deleteGracefully := func(name string, deletedAt time.Time) {
+		obj, err := client.Resource(storagetest.TaskGVR).Namespace("default").Get(ctx, name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		obj.SetDeletionTimestamp(&metav1.Time{Time: deletedAt})
+		_, err = client.Resource(storagetest.TaskGVR).Namespace("default").Update(ctx, obj, metav1.UpdateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Resource(storagetest.TaskGVR).Namespace("default").Delete(ctx, name, metav1.DeleteOptions{})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		dir, err := os.MkdirTemp("", "dispatcher-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		file = freeze.NewFile(freeze.Path(dir))
+
+		client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{storagetest.TaskGVR: "TaskList"},
+			storagetest.NewTask("task-a", "", ""), storagetest.NewTask("task-b", "", ""))
+		// The informer only sees changes made once it watches
+		watching := make(chan struct{})
+		var once sync.Once
+		client.PrependWatchReactor("*", func(k8stesting.Action) (bool, watch.Interface, error) {
+			once.Do(func() { close(watching) })
+			return false, nil, nil
+		})
+
+		d := NewDispatcher(nil)
+		d.DynamicClient = client
+		d.InformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+		d.Deletions = freeze.NewDetector(file, 2, time.Minute)
+		w := worker.NewBackupWorker("test", hash.NewDefaultHasher(), memory.NewStore(), 100, 3, 1)
+		Expect(d.Register(ctx, storagetest.TaskGVR, storagetest.TaskGVK, w)).To(Succeed())
+		Eventually(watching).Should(BeClosed())
+	})
+
+	It("counts a graceful deletion once, when the object gets its deletion timestamp", func() {
+		deleteGracefully("task-a", time.Now())
+		Consistently(frozen, 200*time.Millisecond).Should(BeEmpty())
+
+		Expect(client.Resource(storagetest.TaskGVR).Namespace("default").Delete(ctx, "task-b", metav1.DeleteOptions{})).To(Succeed())
+		Eventually(frozen).Should(ConsistOf(
+			freeze.Scope{Group: storagetest.TaskGVK.Group, Kind: storagetest.TaskGVK.Kind},
+			freeze.Scope{Namespace: "default"},
+		))
+	})
+
+	It("counts a graceful deletion at its deletion timestamp rather than when it is seen", func() {
+		deleteGracefully("task-a", time.Now().Add(-time.Hour))
+		Expect(client.Resource(storagetest.TaskGVR).Namespace("default").Delete(ctx, "task-b", metav1.DeleteOptions{})).To(Succeed())
+		Consistently(frozen, 200*time.Millisecond).Should(BeEmpty())
+	})
+})
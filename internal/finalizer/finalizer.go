@@ -0,0 +1,130 @@
+package finalizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"time"
+)
+
+const (
+	// Name is the finalizer Bastion puts on in-scope CRs to capture their final state before deletion.
+	Name = "bastion.io/backup-protection"
+	// BypassAnnotation, set to "true" on a CR, makes Bastion release the finalizer without capturing.
+	BypassAnnotation = "bastion.io/skip-finalizer"
+)
+
+// Guard adds and releases the backup protection finalizer on CRs.
+// A disabled Guard never adds the finalizer but still releases it, so objects protected while the mode
+// was on are not wedged once it is turned off.
+type Guard struct {
+	DynamicClient dynamic.Interface
+	Enabled       bool          // Whether in-scope CRs get the finalizer added
+	Timeout       time.Duration // Max time a deleting object is held before the finalizer is released regardless
+}
+
+// NewGuard returns a Guard that holds deleting objects for at most timeout.
+func NewGuard(dynamicClient dynamic.Interface, enabled bool, timeout time.Duration) *Guard {
+	return &Guard{
+		DynamicClient: dynamicClient,
+		Enabled:       enabled,
+		Timeout:       timeout,
+	}
+}
+
+// Has reports whether obj carries the backup protection finalizer.
+func Has(obj *unstructured.Unstructured) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Bypassed reports whether obj opted out of pre-deletion capture.
+func Bypassed(obj *unstructured.Unstructured) bool {
+	return obj.GetAnnotations()[BypassAnnotation] == "true"
+}
+
+// Deleting reports whether obj is waiting on the backup protection finalizer to be deleted.
+func Deleting(obj *unstructured.Unstructured) bool {
+	return obj.GetDeletionTimestamp() != nil && Has(obj)
+}
+
+// Remaining returns how long a deleting obj may still be held, zero once the timeout has passed.
+func (g *Guard) Remaining(obj *unstructured.Unstructured, now time.Time) time.Duration {
+	ts := obj.GetDeletionTimestamp()
+	if ts == nil {
+		return g.Timeout
+	}
+	remaining := ts.Add(g.Timeout).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Needs reports whether the finalizer should be added to obj: the guard is enabled, and obj does not
+// have it yet, is not bypassed and is not being deleted.
+func (g *Guard) Needs(obj *unstructured.Unstructured) bool {
+	return g.Enabled && !Has(obj) && !Bypassed(obj) && obj.GetDeletionTimestamp() == nil
+}
+
+// Ensure adds the finalizer to obj if it needs it.
+func (g *Guard) Ensure(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	if !g.Needs(obj) {
+		return nil
+	}
+	return g.patch(ctx, gvr, obj, append(obj.GetFinalizers(), Name))
+}
+
+// Release removes the finalizer from obj. The removal is index based and tested, so it neither needs
+// an up-to-date resourceVersion nor drops finalizers other controllers added in the meantime.
+func (g *Guard) Release(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	for i, f := range obj.GetFinalizers() {
+		if f != Name {
+			continue
+		}
+		path := fmt.Sprintf("/metadata/finalizers/%d", i)
+		patch, err := json.Marshal([]map[string]interface{}{
+			{"op": "test", "path": path, "value": Name},
+			{"op": "remove", "path": path},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal finalizer patch: %w", err)
+		}
+		_, err = g.DynamicClient.Resource(gvr).Namespace(obj.GetNamespace()).
+			Patch(ctx, obj.GetName(), types.JSONPatchType, patch, metav1.PatchOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to remove finalizer: %w", err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// patch replaces the finalizers of obj, guarded by its resourceVersion so concurrent edits are not lost.
+func (g *Guard) patch(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured, finalizers []string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": obj.GetResourceVersion(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal finalizer patch: %w", err)
+	}
+	_, err = g.DynamicClient.Resource(gvr).Namespace(obj.GetNamespace()).
+		Patch(ctx, obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to add finalizer: %w", err)
+	}
+	return nil
+}
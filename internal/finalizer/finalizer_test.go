@@ -0,0 +1,85 @@
+package finalizer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestFinalizer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Finalizer Suite")
+}
+
+var taskGVR = schema.GroupVersionResource{Group: "demo.bastion.io", Version: "v1", Resource: "tasks"}
+
+func newTask(finalizers ...string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"})
+	obj.SetNamespace("default")
+	obj.SetName("task-a")
+	obj.SetFinalizers(finalizers)
+	return obj
+}
+
+var _ = Describe("Guard", func() {
+	var (
+		ctx    context.Context
+		client *dynamicfake.FakeDynamicClient
+	)
+
+	get := func() *unstructured.Unstructured {
+		obj, err := client.Resource(taskGVR).Namespace("default").Get(ctx, "task-a", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return obj
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{taskGVR: "TaskList"})
+	})
+
+	It("adds the finalizer when enabled and releases it keeping others", func() {
+		obj, err := client.Resource(taskGVR).Namespace("default").Create(ctx, newTask("other.io/keep"), metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		guard := NewGuard(client, true, time.Minute)
+
+		Expect(guard.Ensure(ctx, taskGVR, obj)).To(Succeed())
+		Expect(get().GetFinalizers()).To(Equal([]string{"other.io/keep", Name}))
+
+		Expect(guard.Release(ctx, taskGVR, get())).To(Succeed())
+		Expect(get().GetFinalizers()).To(Equal([]string{"other.io/keep"}))
+	})
+
+	It("does not add the finalizer when disabled or bypassed", func() {
+		obj := newTask()
+		obj.SetAnnotations(map[string]string{BypassAnnotation: "true"})
+		obj, err := client.Resource(taskGVR).Namespace("default").Create(ctx, obj, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(NewGuard(client, false, time.Minute).Ensure(ctx, taskGVR, obj)).To(Succeed())
+		Expect(NewGuard(client, true, time.Minute).Ensure(ctx, taskGVR, obj)).To(Succeed())
+		Expect(get().GetFinalizers()).To(BeEmpty())
+	})
+
+	It("stops holding a deleting object once the timeout has passed", func() {
+		guard := NewGuard(client, true, time.Minute)
+		obj := newTask(Name)
+		deletedAt := metav1.NewTime(time.Now().Add(-30 * time.Second))
+		obj.SetDeletionTimestamp(&deletedAt)
+
+		Expect(Deleting(obj)).To(BeTrue())
+		Expect(guard.Remaining(obj, time.Now())).To(BeNumerically("~", 30*time.Second, time.Second))
+		Expect(guard.Remaining(obj, time.Now().Add(time.Minute))).To(BeZero())
+	})
+})
@@ -0,0 +1,235 @@
+package freeze
+
+import (
+	"context"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scope is a GVK across namespaces, or a namespace across kinds, in which deletions are counted.
+type Scope struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Scopes returns the scopes a deletion of the object under key counts in.
+func Scopes(key storage.Key) []Scope {
+	scopes := []Scope{{Group: key.GVK.Group, Kind: key.GVK.Kind}}
+	if key.Namespace != "" {
+		scopes = append(scopes, Scope{Namespace: key.Namespace})
+	}
+	return scopes
+}
+
+// Covers reports whether the object under key is in the scope.
+func (s Scope) Covers(key storage.Key) bool {
+	if s.Kind != "" && (s.Group != key.GVK.Group || s.Kind != key.GVK.Kind) {
+		return false
+	}
+	return s.Namespace == "" || s.Namespace == key.Namespace
+}
+
+func (s Scope) String() string {
+	if s.Kind != "" {
+		return "kind/" + schema.GroupKind{Group: s.Group, Kind: s.Kind}.String()
+	}
+	return "namespace/" + s.Namespace
+}
+
+// Freeze suspends the garbage collection of the tombstoned backups in its scope, after a mass deletion,
+// until it is acknowledged.
+type Freeze struct {
+	Scope
+	Deletions int           `json:"deletions"` // Deletions within Window that crossed the threshold
+	Window    time.Duration `json:"window"`
+	FrozenAt  time.Time     `json:"frozenAt"`
+}
+
+// Path returns the freezes file of the store rooted at root.
+func Path(root string) string {
+	return filepath.Join(root, ".bastion", "freezes.json")
+}
+
+// File keeps the active freezes in a JSON file, updated under a lock shared with other processes and
+// replaced through a rename so readers never see it half written. Acknowledging a freeze removes it.
+type File struct {
+	Path string
+}
+
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Load returns the freezes in the file, or none if there is no file.
+func (f *File) Load(ctx context.Context) ([]Freeze, error) {
+	var freezes []Freeze
+	if err := atomicfile.ReadJSON(f.Path, &freezes); err != nil {
+		return nil, fmt.Errorf("failed to load freezes: %w", err)
+	}
+	return freezes, nil
+}
+
+// Add stores freeze and reports whether its scope was not frozen yet.
+func (f *File) Add(ctx context.Context, freeze Freeze) (bool, error) {
+	added := false
+	err := f.update(func(freezes []Freeze) []Freeze {
+		for _, existing := range freezes {
+			if existing.Scope == freeze.Scope {
+				return nil
+			}
+		}
+		added = true
+		return append(freezes, freeze)
+	})
+	return added, err
+}
+
+// Acknowledge removes the freeze of scope and reports whether there was one.
+func (f *File) Acknowledge(ctx context.Context, scope Scope) (bool, error) {
+	acknowledged := false
+	err := f.update(func(freezes []Freeze) []Freeze {
+		kept := make([]Freeze, 0, len(freezes))
+		for _, existing := range freezes {
+			if existing.Scope != scope {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == len(freezes) {
+			return nil
+		}
+		acknowledged = true
+		return kept
+	})
+	return acknowledged, err
+}
+
+// update replaces the freezes in the file with those returned by change, unless it returns nil.
+func (f *File) update(change func(freezes []Freeze) []Freeze) error {
+	var freezes []Freeze
+	err := atomicfile.UpdateJSON(f.Path, &freezes, func() bool {
+		changed := change(freezes)
+		if changed == nil {
+			return false
+		}
+		sort.Slice(changed, func(i, j int) bool { return changed[i].String() < changed[j].String() })
+		freezes = changed
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update freezes: %w", err)
+	}
+	metrics.GCFrozenScopes.Set(float64(len(freezes)))
+	return nil
+}
+
+// Detector counts deletions per scope over a sliding window and freezes a scope once they reach the
+// threshold. Counts restart at every freeze, so deletions that triggered an acknowledged freeze do not
+// trigger it again.
+type Detector struct {
+	File      *File
+	Threshold int // Deletions within Window that freeze a scope
+	Window    time.Duration
+	Recorder  record.EventRecorder // Receives MassDeletion events, nil records none
+	// CustomResource reports whether a resource is served by a CustomResourceDefinition, on which the
+	// freezes of its kind are reported. Freezes of other kinds, and of every kind if nil, are reported on
+	// Namespace, the namespace of the controller.
+	CustomResource func(ctx context.Context, gvr schema.GroupVersionResource) (bool, error)
+	Namespace      string
+
+	mu        sync.Mutex
+	deletions map[Scope][]time.Time
+}
+
+func NewDetector(file *File, threshold int, window time.Duration) *Detector {
+	return &Detector{
+		File:      file,
+		Threshold: threshold,
+		Window:    window,
+		deletions: map[Scope][]time.Time{},
+	}
+}
+
+// Observe counts the deletion of the object under key, of resource gvr, at now.
+func (d *Detector) Observe(ctx context.Context, gvr schema.GroupVersionResource, key storage.Key, now time.Time) error {
+	for _, scope := range Scopes(key) {
+		count := d.count(scope, now)
+		if count < d.Threshold {
+			continue
+		}
+		if err := d.freeze(ctx, gvr, Freeze{Scope: scope, Deletions: count, Window: d.Window, FrozenAt: now.UTC()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count adds a deletion in scope at now and returns the deletions within the window, restarting the
+// count once it reaches the threshold.
+func (d *Detector) count(scope Scope, now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	recent := d.deletions[scope][:0]
+	for _, at := range d.deletions[scope] {
+		if now.Sub(at) < d.Window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) >= d.Threshold {
+		delete(d.deletions, scope)
+	} else {
+		d.deletions[scope] = recent
+	}
+	return len(recent)
+}
+
+func (d *Detector) freeze(ctx context.Context, gvr schema.GroupVersionResource, freeze Freeze) error {
+	added, err := d.File.Add(ctx, freeze)
+	if err != nil {
+		return fmt.Errorf("failed to freeze %s: %w", freeze.Scope, err)
+	}
+	if !added {
+		return nil
+	}
+	log.FromContext(ctx).WithName("Detector").Info("Mass deletion detected, garbage collection frozen",
+		"scope", freeze.Scope.String(), "deletions", freeze.Deletions, "window", freeze.Window)
+	metrics.MassDeletions.WithLabelValues(freeze.Scope.String()).Inc()
+	if d.Recorder != nil {
+		d.Recorder.Eventf(d.involved(ctx, gvr, freeze.Scope), corev1.EventTypeWarning, "MassDeletion",
+			"%d deletions in %s within %s, garbage collection of their backups is frozen until acknowledged",
+			freeze.Deletions, freeze.Scope, freeze.Window)
+	}
+	return nil
+}
+
+// involved returns the object a freeze is reported on: the namespace, the definition of the resource, or
+// the namespace of the controller for kinds that have no definition, such as core and built-in kinds.
+func (d *Detector) involved(ctx context.Context, gvr schema.GroupVersionResource, scope Scope) *corev1.ObjectReference {
+	if scope.Kind == "" {
+		return &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: scope.Namespace}
+	}
+	if d.CustomResource != nil {
+		custom, err := d.CustomResource(ctx, gvr)
+		if err != nil {
+			log.FromContext(ctx).WithName("Detector").Error(err,
+				"failed to look up the definition of the resource, reporting on the controller namespace",
+				"resource", gvr.GroupResource().String())
+		}
+		if custom {
+			return &corev1.ObjectReference{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition",
+				Name: gvr.GroupResource().String()}
+		}
+	}
+	return &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: d.Namespace}
+}
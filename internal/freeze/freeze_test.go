@@ -0,0 +1,103 @@
+package freeze
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFreeze(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Freeze Suite")
+}
+
+var _ = Describe("Detector", func() {
+	var (
+		ctx      context.Context
+		file     *File
+		recorder *record.FakeRecorder
+		detector *Detector
+		start    time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		dir, err := os.MkdirTemp("", "freeze-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		file = NewFile(Path(dir))
+		recorder = record.NewFakeRecorder(10)
+		detector = NewDetector(file, 5, time.Minute)
+		detector.Recorder = recorder
+		start = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("ignores deletions spread beyond the window", func() {
+		for i := 0; i < 10; i++ {
+			key := storagetest.TaskKey(fmt.Sprintf("task-%d", i), storagetest.InNamespace(fmt.Sprintf("ns-%d", i)))
+			Expect(detector.Observe(ctx, storagetest.TaskGVR, key, start.Add(time.Duration(i)*20*time.Second))).To(Succeed())
+		}
+		freezes, err := file.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(freezes).To(BeEmpty())
+		Expect(file.Path).NotTo(BeAnExistingFile())
+	})
+
+	It("freezes a scope once, until the freeze is acknowledged", func() {
+		for i := 0; i < 12; i++ {
+			key := storagetest.TaskKey(fmt.Sprintf("task-%d", i), storagetest.InNamespace("payments"))
+			Expect(detector.Observe(ctx, storagetest.TaskGVR, key, start.Add(time.Duration(i)*time.Second))).To(Succeed())
+		}
+		freezes, err := file.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(freezes).To(HaveLen(2))
+		Expect(freezes[0].Scope).To(Equal(Scope{Group: "demo.bastion.io", Kind: "Task"}))
+		Expect(freezes[1].Scope).To(Equal(Scope{Namespace: "payments"}))
+		Expect(freezes[1].Deletions).To(Equal(5))
+		Expect(recorder.Events).To(HaveLen(2))
+		Expect(<-recorder.Events).To(ContainSubstring("MassDeletion"))
+
+		Expect(freezes[0].Covers(storagetest.TaskKey("task-0"))).To(BeTrue())
+		Expect(freezes[1].Covers(storage.Key{GVK: schema.GroupVersionKind{Kind: "Other"}, Namespace: "payments"})).To(BeTrue())
+		Expect(freezes[1].Covers(storagetest.TaskKey("task-0"))).To(BeFalse())
+
+		acknowledged, err := file.Acknowledge(ctx, Scope{Namespace: "payments"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(acknowledged).To(BeTrue())
+		// The two deletions left after the last freeze do not freeze it again
+		Expect(detector.Observe(ctx, storagetest.TaskGVR, storagetest.TaskKey("task-12", storagetest.InNamespace("payments")), start.Add(12*time.Second))).To(Succeed())
+		freezes, err = file.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(freezes).To(HaveLen(1))
+	})
+
+	It("reports kinds without a definition on the namespace of the controller", func() {
+		detector.Namespace = "bastion-system"
+		detector.CustomResource = func(ctx context.Context, gvr schema.GroupVersionResource) (bool, error) {
+			return gvr.Group == storagetest.TaskGVR.Group, nil
+		}
+		kind := Scope{Group: storagetest.TaskGVK.Group, Kind: storagetest.TaskGVK.Kind}
+		Expect(detector.involved(ctx, storagetest.TaskGVR, kind)).To(Equal(&corev1.ObjectReference{
+			APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", Name: "tasks.demo.bastion.io"}))
+		for _, gvr := range []schema.GroupVersionResource{
+			{Version: "v1", Resource: "configmaps"},
+			{Group: "apps", Version: "v1", Resource: "deployments"},
+		} {
+			Expect(detector.involved(ctx, gvr, Scope{Group: gvr.Group, Kind: "Other"})).To(Equal(&corev1.ObjectReference{
+				APIVersion: "v1", Kind: "Namespace", Name: "bastion-system"}))
+		}
+		Expect(detector.involved(ctx, storagetest.TaskGVR, Scope{Namespace: "payments"})).To(Equal(&corev1.ObjectReference{
+			APIVersion: "v1", Kind: "Namespace", Name: "payments"}))
+	})
+})
@@ -2,23 +2,56 @@ package gc
 
 import (
 	"context"
+	stderrors "errors"
+	"fmt"
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/freeze"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/retention"
 	"github.com/bastion/internal/storage"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"math/rand"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Results of collecting an expired tombstone.
+const (
+	ResultDeleted      = "deleted"      // The object is gone from the cluster and its backup was removed
+	ResultUntombstoned = "untombstoned" // The object exists again and only its tombstone was removed
+	ResultHeld         = "held"         // The backup is under hold and was kept
+	ResultFailed       = "failed"
+)
+
 type GarbageCollector struct {
 	BaseDir       string
-	RetainPeriod  time.Duration
+	RetainPeriod  time.Duration // Default time a tombstoned backup is kept
+	SweepInterval time.Duration // Time between sweeps, RetainPeriod if zero
+	Jitter        float64       // Fraction of SweepInterval randomly added to every wait
+	Concurrency   int           // Expired tombstones collected in parallel, 1 if zero
+	MaxPerSweep   int           // Expired tombstones collected per sweep, unbounded if zero
+	// Policies supplies per-policy tombstone TTLs, RetainPeriod applies to every object if nil.
+	Policies func(ctx context.Context) ([]v1alpha1.BackupPolicy, error)
+	// Freezes supplies the scopes frozen after a mass deletion, whose tombstones are kept, nil freezes none.
+	Freezes       func(ctx context.Context) ([]freeze.Freeze, error)
 	DynamicClient dynamic.Interface
 	Store         storage.Storage
 }
 
+// SweepReport is the result of a sweep.
+type SweepReport struct {
+	Expired  int            `json:"expired"`  // Tombstones older than their TTL
+	Deferred int            `json:"deferred"` // Expired tombstones left for a later sweep
+	Frozen   int            `json:"frozen"`   // Expired tombstones kept by a mass deletion freeze
+	Results  map[string]int `json:"results"`  // Collected tombstones by result
+}
+
 func NewGarbageCollector(retain time.Duration,
 	dynamicClient dynamic.Interface,
 	store storage.Storage) *GarbageCollector {
@@ -31,55 +64,180 @@ func NewGarbageCollector(retain time.Duration,
 
 func (gc *GarbageCollector) Run(ctx context.Context) {
 	logger := log.FromContext(ctx).WithName("GarbageCollector").WithName("run")
-	logger.Info("Starting garbage collector")
-	ticker := time.NewTicker(gc.RetainPeriod)
-	defer ticker.Stop()
+	interval := gc.SweepInterval
+	if interval <= 0 {
+		interval = gc.RetainPeriod
+	}
+	logger.Info("Starting garbage collector", "interval", interval, "jitter", gc.Jitter,
+		"retain", gc.RetainPeriod, "concurrency", gc.Concurrency, "maxPerSweep", gc.MaxPerSweep)
+	timer := time.NewTimer(gc.wait(interval))
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Info("Garbage collector stopped")
 			return
-		case <-ticker.C:
-			gc.sweep(ctx)
+		case <-timer.C:
+			if _, err := gc.Sweep(ctx); err != nil {
+				logger.Error(err, "failed to sweep tombstones")
+			}
+			timer.Reset(gc.wait(interval))
+		}
+	}
+}
+
+// wait spreads sweeps of replicas started together so they do not hit the API server at once.
+func (gc *GarbageCollector) wait(interval time.Duration) time.Duration {
+	if gc.Jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Float64()*gc.Jitter*float64(interval))
+}
+
+// TTL returns how long the backup of the object under key is kept once tombstoned: the longest
+// tombstone TTL of the policies selecting it, or RetainPeriod if none does.
+func (gc *GarbageCollector) TTL(key storage.Key, policies []v1alpha1.BackupPolicy) time.Duration {
+	ttl, matched := gc.RetainPeriod, false
+	for _, policy := range policies {
+		for _, rule := range policy.Spec.TombstoneTTLs {
+			if !retention.Selects(rule.ObjectSelector, key) {
+				continue
+			}
+			if !matched || rule.TTL.Duration > ttl {
+				ttl, matched = rule.TTL.Duration, true
+			}
 		}
 	}
+	return ttl
 }
 
-func (gc *GarbageCollector) sweep(ctx context.Context) {
+// Sweep collects the expired tombstones once, oldest first and at most MaxPerSweep of them.
+func (gc *GarbageCollector) Sweep(ctx context.Context) (SweepReport, error) {
 	logger := log.FromContext(ctx).WithName("GarbageCollector").WithName("sweep")
+	started := time.Now()
+	defer func() { metrics.GCSweepDuration.Observe(time.Since(started).Seconds()) }()
+	report := SweepReport{Results: map[string]int{}}
 
+	// Without the policies a TTL could be cut short, so nothing is collected
+	var policies []v1alpha1.BackupPolicy
+	if gc.Policies != nil {
+		var err error
+		if policies, err = gc.Policies(ctx); err != nil {
+			return report, fmt.Errorf("failed to list backup policies: %w", err)
+		}
+	}
+	// Nor while a mass deletion may be under way
+	var freezes []freeze.Freeze
+	if gc.Freezes != nil {
+		var err error
+		if freezes, err = gc.Freezes(ctx); err != nil {
+			return report, fmt.Errorf("failed to load freezes: %w", err)
+		}
+	}
+	metrics.GCFrozenScopes.Set(float64(len(freezes)))
 	tombstones, err := gc.Store.ListTombstones(ctx)
 	if err != nil {
-		logger.Error(err, "failed to list tombstones")
-		return
+		return report, fmt.Errorf("failed to list tombstones: %w", err)
 	}
+	var expired []storage.TombstoneEntry
 	for _, entry := range tombstones {
-		age := time.Since(entry.ModTime)
-		if age > gc.RetainPeriod {
-			_, _, err := gc.Store.Read(ctx, entry.GVK, entry.Namespace, entry.Name)
-			if err != nil {
-				logger.Error(err, "failed to read object from storage", "gvk", entry.GVK, "ns", entry.Namespace, "name", entry.Name)
-				continue
-			}
+		if started.Sub(entry.DeletedAt) <= gc.TTL(entry.Key, policies) {
+			continue
+		}
+		if frozen(freezes, entry.Key) {
+			report.Frozen++
+			continue
+		}
+		expired = append(expired, entry)
+	}
+	sort.SliceStable(expired, func(i, j int) bool { return expired[i].DeletedAt.Before(expired[j].DeletedAt) })
+	report.Expired = len(expired) + report.Frozen
+	if gc.MaxPerSweep > 0 && len(expired) > gc.MaxPerSweep {
+		report.Deferred = len(expired) - gc.MaxPerSweep
+		expired = expired[:gc.MaxPerSweep]
+	}
+	metrics.GCDeferred.Set(float64(report.Deferred))
 
-			gvr := schema.GroupVersionResource{
-				Group:    entry.GVK.Group,
-				Version:  entry.GVK.Version,
-				Resource: strings.ToLower(entry.GVK.Kind) + "s", // same: simple plural for now
+	workers := gc.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	entries := make(chan storage.TombstoneEntry)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				result := gc.collect(ctx, entry)
+				metrics.GCCleaned.WithLabelValues(result).Inc()
+				mu.Lock()
+				report.Results[result]++
+				mu.Unlock()
 			}
+		}()
+	}
+	for _, entry := range expired {
+		if ctx.Err() != nil {
+			break
+		}
+		entries <- entry
+	}
+	close(entries)
+	wg.Wait()
 
-			res := gc.DynamicClient.Resource(gvr).Namespace(entry.Namespace)
-			_, err = res.Get(ctx, entry.Name, metav1.GetOptions{})
-			if err != nil {
-				if errors.IsNotFound(err) {
-					logger.Info("Cleaning tombstoned object", "gvk", entry.GVK, "ns", entry.Namespace, "name", entry.Name)
-					_ = gc.Store.Delete(ctx, entry.GVK, entry.Namespace, entry.Name)
-				} else {
-					logger.Error(err, "error checking resource existence", "gvk", entry.GVK, "ns", entry.Namespace, "name", entry.Name)
-				}
-			} else {
-				_ = gc.Store.DeleteTombstone(ctx, entry.GVK, entry.Namespace, entry.Name)
-			}
+	logger.Info("Sweep complete", "expired", report.Expired, "deferred", report.Deferred, "frozen", report.Frozen,
+		"results", report.Results, "duration", time.Since(started))
+	return report, ctx.Err()
+}
+
+func frozen(freezes []freeze.Freeze, key storage.Key) bool {
+	for _, f := range freezes {
+		if f.Covers(key) {
+			return true
 		}
 	}
+	return false
+}
+
+// collect removes the backup of an expired tombstone if the object is still gone from the cluster,
+// or only the tombstone if it came back.
+func (gc *GarbageCollector) collect(ctx context.Context, entry storage.TombstoneEntry) string {
+	logger := log.FromContext(ctx).WithName("GarbageCollector").WithName("collect").
+		WithValues("gvk", entry.GVK, "ns", entry.Namespace, "name", entry.Name)
+	_, _, err := gc.Store.Read(ctx, entry.Key)
+	if err != nil {
+		logger.Error(err, "failed to read object from storage")
+		return ResultFailed
+	}
+
+	gvr := schema.GroupVersionResource{
+		Group:    entry.GVK.Group,
+		Version:  entry.GVK.Version,
+		Resource: strings.ToLower(entry.GVK.Kind) + "s", // same: simple plural for now
+	}
+
+	res := gc.DynamicClient.Resource(gvr).Namespace(entry.Namespace)
+	_, err = res.Get(ctx, entry.Name, metav1.GetOptions{})
+	if err == nil {
+		if err := gc.Store.DeleteTombstone(ctx, entry.Key); err != nil {
+			logger.Error(err, "failed to remove tombstone of existing object")
+			return ResultFailed
+		}
+		return ResultUntombstoned
+	}
+	if !errors.IsNotFound(err) {
+		logger.Error(err, "error checking resource existence")
+		return ResultFailed
+	}
+	logger.Info("Cleaning tombstoned object")
+	if err := gc.Store.Delete(ctx, entry.Key); stderrors.Is(err, storage.ErrHeld) {
+		logger.Info("Keeping tombstoned object under hold")
+		return ResultHeld
+	} else if err != nil {
+		logger.Error(err, "failed to clean tombstoned object")
+		return ResultFailed
+	}
+	return ResultDeleted
 }
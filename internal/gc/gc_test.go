@@ -0,0 +1,131 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/freeze"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestGC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GC Suite")
+}
+
+var _ = Describe("GarbageCollector", func() {
+	var (
+		ctx       context.Context
+		store     storage.Storage
+		collector *GarbageCollector
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = memory.NewStore()
+		now := time.Now()
+		for _, tombstone := range []struct {
+			obj *unstructured.Unstructured
+			age time.Duration
+		}{
+			{storagetest.NewTask("gone", "uid-gone", ""), 2 * time.Hour},
+			{storagetest.NewTask("back", "uid-back", ""), 3 * time.Hour},
+			{storagetest.NewTask("recent", "uid-recent", ""), 10 * time.Minute},
+			{storagetest.NewTask("audited", "uid-audited", "", storagetest.InNamespace("payments")), 5 * time.Hour},
+		} {
+			_, err := store.Write(ctx, tombstone.obj, tombstone.obj.GetName())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.MarkTombstone(ctx, tombstone.obj, now.Add(-tombstone.age))).To(Succeed())
+		}
+		client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{storagetest.TaskGVR: "TaskList"},
+			storagetest.NewTask("back", "uid-back", ""))
+		collector = NewGarbageCollector(time.Hour, client, store)
+		collector.Policies = func(context.Context) ([]v1alpha1.BackupPolicy, error) {
+			return []v1alpha1.BackupPolicy{{Spec: v1alpha1.BackupPolicySpec{TombstoneTTLs: []v1alpha1.TombstoneTTL{
+				{ObjectSelector: v1alpha1.ObjectSelector{Namespaces: []string{"payments"}}, TTL: metav1.Duration{Duration: 24 * time.Hour}},
+				{ObjectSelector: v1alpha1.ObjectSelector{Group: "demo.bastion.io", Kind: "Task", Namespaces: []string{"payments"}},
+					TTL: metav1.Duration{Duration: 30 * time.Minute}},
+			}}}}, nil
+		}
+	})
+
+	It("resolves the longest TTL of the policies selecting an object", func() {
+		policies, err := collector.Policies(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(collector.TTL(storagetest.TaskKey("audited", storagetest.InNamespace("payments")), policies)).To(Equal(24 * time.Hour))
+		Expect(collector.TTL(storagetest.TaskKey("gone"), policies)).To(Equal(time.Hour))
+	})
+
+	It("collects expired tombstones oldest first, bounded per sweep", func() {
+		collector.MaxPerSweep = 1
+		report, err := collector.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Expired).To(Equal(2))
+		Expect(report.Deferred).To(Equal(1))
+		Expect(report.Results).To(Equal(map[string]int{ResultUntombstoned: 1}))
+		tombstone, err := store.ReadTombstone(ctx, storagetest.TaskKey("back"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstone).To(BeNil())
+
+		collector.MaxPerSweep = 0
+		collector.Concurrency = 4
+		report, err = collector.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Results).To(Equal(map[string]int{ResultDeleted: 1}))
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("gone"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+		for _, key := range []storage.Key{storagetest.TaskKey("recent"), storagetest.TaskKey("audited", storagetest.InNamespace("payments"))} {
+			tombstone, err := store.ReadTombstone(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tombstone).NotTo(BeNil())
+		}
+	})
+
+	It("keeps the expired tombstones of frozen scopes", func() {
+		collector.Freezes = func(context.Context) ([]freeze.Freeze, error) {
+			return []freeze.Freeze{{Scope: freeze.Scope{Namespace: "default"}}}, nil
+		}
+		report, err := collector.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Frozen).To(Equal(2))
+		Expect(report.Results).To(BeEmpty())
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("gone"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).NotTo(BeNil())
+	})
+
+	It("collects with the default TTL when there are no policies, and nothing while they cannot be listed", func() {
+		collector.Policies = func(context.Context) ([]v1alpha1.BackupPolicy, error) {
+			return nil, errors.New("policies unavailable")
+		}
+		_, err := collector.Sweep(ctx)
+		Expect(err).To(MatchError(ContainSubstring("policies unavailable")))
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(HaveLen(4))
+
+		collector.Policies = func(context.Context) ([]v1alpha1.BackupPolicy, error) { return nil, nil }
+		report, err := collector.Sweep(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Expired).To(Equal(3))
+		Expect(report.Results).To(Equal(map[string]int{ResultDeleted: 2, ResultUntombstoned: 1}))
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("audited", storagetest.InNamespace("payments")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+	})
+})
@@ -14,6 +14,20 @@ type Hasher interface {
 	Hash(obj *unstructured.Unstructured) (string, error)
 }
 
+// Named is implemented by hashers that name the algorithm they hash with. The name changes whenever the
+// hashes of the same object would, so stored hashes can be told apart from ones a hasher cannot reproduce.
+type Named interface {
+	Name() string
+}
+
+// NameOf returns the name of h, or its type if it does not implement Named.
+func NameOf(h Hasher) string {
+	if named, ok := h.(Named); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", h)
+}
+
 // DefaultHasher implements SHA256 hashing after sanitizing.
 type DefaultHasher struct{}
 
@@ -22,6 +36,11 @@ func NewDefaultHasher() *DefaultHasher {
 	return &DefaultHasher{}
 }
 
+// Name identifies the sanitizing rules and digest of Hash.
+func (h *DefaultHasher) Name() string {
+	return "sha256-sanitized-v1"
+}
+
 // Hash computes a SHA256 hash of a sanitized Kubernetes object.
 func (h *DefaultHasher) Hash(obj *unstructured.Unstructured) (string, error) {
 	sanitized := obj.DeepCopy()
@@ -0,0 +1,219 @@
+package hold
+
+import (
+	"context"
+	"fmt"
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"time"
+)
+
+// Tag labels and annotates the backups in its scope. A tag with Hold set keeps them from being deleted,
+// pinning a single object or incarnation, or placing a whole namespace or GVK under legal hold.
+type Tag struct {
+	Name      string            `json:"name"`
+	Group     string            `json:"group,omitempty"`
+	Kind      string            `json:"kind,omitempty"` // Every kind of Group if empty
+	Namespace string            `json:"namespace,omitempty"`
+	Object    string            `json:"object,omitempty"` // Name of the tagged object, every object in scope if empty
+	UID       types.UID         `json:"uid,omitempty"`    // Incarnation of the object, every one if empty
+	Labels    map[string]string `json:"labels,omitempty"`
+	Note      string            `json:"note,omitempty"`
+	Hold      bool              `json:"hold,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// Covers reports whether the incarnation of key with the given UID is in the scope of the tag. An empty
+// uid stands for every incarnation of key, so it is covered by tags on any of them.
+func (t Tag) Covers(key storage.Key, uid types.UID) bool {
+	switch {
+	case t.Kind != "" && (t.Group != key.GVK.Group || t.Kind != key.GVK.Kind):
+		return false
+	case t.Kind == "" && t.Group != "" && t.Group != key.GVK.Group:
+		return false
+	case t.Namespace != "" && t.Namespace != key.Namespace:
+		return false
+	case t.Object != "" && t.Object != key.Name:
+		return false
+	}
+	return t.UID == "" || uid == "" || t.UID == uid
+}
+
+// Path returns the tags file of the store rooted at root.
+func Path(root string) string {
+	return filepath.Join(root, ".bastion", "tags.json")
+}
+
+// File keeps tags in a JSON file, updated under a lock shared with other processes and replaced through a
+// rename so readers never see it half written.
+type File struct {
+	Path string
+}
+
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Load returns the tags in the file, sorted by name, or none if there is no file.
+func (f *File) Load(ctx context.Context) ([]Tag, error) {
+	var tags []Tag
+	if err := atomicfile.ReadJSON(f.Path, &tags); err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	return tags, nil
+}
+
+// Add stores tag, replacing the tag of the same name.
+func (f *File) Add(ctx context.Context, tag Tag) error {
+	return f.update(func(tags []Tag) ([]Tag, bool) {
+		return append(without(tags, tag.Name), tag), true
+	})
+}
+
+// Remove deletes the tag with the given name and reports whether there was one.
+func (f *File) Remove(ctx context.Context, name string) (bool, error) {
+	removed := false
+	err := f.update(func(tags []Tag) ([]Tag, bool) {
+		kept := without(tags, name)
+		removed = len(kept) < len(tags)
+		return kept, removed
+	})
+	return removed, err
+}
+
+// update replaces the tags in the file with those returned by change, if it reports a change.
+func (f *File) update(change func(tags []Tag) ([]Tag, bool)) error {
+	var tags []Tag
+	err := atomicfile.UpdateJSON(f.Path, &tags, func() bool {
+		changed, ok := change(tags)
+		if !ok {
+			return false
+		}
+		sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+		tags = changed
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update tags: %w", err)
+	}
+	return nil
+}
+
+// without returns the tags other than the one with the given name.
+func without(tags []Tag, name string) []Tag {
+	kept := make([]Tag, 0, len(tags))
+	for _, existing := range tags {
+		if existing.Name != name {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
+
+// Guard is a store that refuses to delete backups under hold. Tags are read on every deletion, so a
+// hold takes effect as soon as it is placed, and a deletion is refused when they cannot be read.
+type Guard struct {
+	storage.Storage
+	Tags func(ctx context.Context) ([]Tag, error)
+}
+
+func NewGuard(store storage.Storage, tags func(ctx context.Context) ([]Tag, error)) *Guard {
+	return &Guard{
+		Storage: store,
+		Tags:    tags,
+	}
+}
+
+// Held reports whether the incarnation of key with the given UID, or any of them if uid is empty, is
+// under hold.
+func (g *Guard) Held(ctx context.Context, key storage.Key, uid types.UID) (bool, error) {
+	tag, err := g.holding(ctx, key, uid)
+	return tag != nil, err
+}
+
+// Delete removes an object and all of its incarnations, unless any of them is under hold.
+func (g *Guard) Delete(ctx context.Context, key storage.Key) error {
+	if err := g.check(ctx, key, "", "delete"); err != nil {
+		return err
+	}
+	return g.Storage.Delete(ctx, key)
+}
+
+// DeleteIncarnation removes an archived incarnation, unless it is under hold.
+func (g *Guard) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	if err := g.check(ctx, key, uid, "delete_incarnation"); err != nil {
+		return err
+	}
+	return g.Storage.DeleteIncarnation(ctx, key, uid)
+}
+
+func (g *Guard) check(ctx context.Context, key storage.Key, uid types.UID, operation string) error {
+	tag, err := g.holding(ctx, key, uid)
+	if err != nil {
+		return err
+	}
+	if tag != nil {
+		metrics.HeldDeletions.WithLabelValues(operation).Inc()
+		return fmt.Errorf("refusing to delete %s: held by tag %q: %w", key, tag.Name, storage.ErrHeld)
+	}
+	return nil
+}
+
+// holding returns the first tag holding the incarnation, or nil if none does.
+func (g *Guard) holding(ctx context.Context, key storage.Key, uid types.UID) (*Tag, error) {
+	tags, err := g.Tags(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	for _, tag := range tags {
+		if tag.Hold && tag.Covers(key, uid) {
+			return &tag, nil
+		}
+	}
+	return nil, nil
+}
+
+// Sources returns the tags placed on backups through file and through BackupTag resources read with
+// reader. Clusters without the BackupTag CRD only have the former.
+func Sources(file *File, reader client.Reader) func(ctx context.Context) ([]Tag, error) {
+	return func(ctx context.Context) ([]Tag, error) {
+		tags, err := file.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		list := &v1alpha1.BackupTagList{}
+		if err := reader.List(ctx, list); err != nil {
+			if meta.IsNoMatchError(err) {
+				return tags, nil
+			}
+			return nil, fmt.Errorf("failed to list backup tags: %w", err)
+		}
+		for _, tag := range list.Items {
+			tags = append(tags, FromBackupTag(tag))
+		}
+		return tags, nil
+	}
+}
+
+// FromBackupTag returns the tag placed by a BackupTag resource.
+func FromBackupTag(tag v1alpha1.BackupTag) Tag {
+	return Tag{
+		Name:      tag.Name,
+		Group:     tag.Spec.Group,
+		Kind:      tag.Spec.Kind,
+		Namespace: tag.Spec.Namespace,
+		Object:    tag.Spec.Object,
+		UID:       types.UID(tag.Spec.UID),
+		Labels:    tag.Spec.Labels,
+		Note:      tag.Spec.Note,
+		Hold:      tag.Spec.Hold,
+		CreatedAt: tag.CreationTimestamp.UTC(),
+	}
+}
@@ -0,0 +1,110 @@
+package hold
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHold(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Hold Suite")
+}
+
+var _ = Describe("Guard", func() {
+	var (
+		ctx   context.Context
+		file  *File
+		guard *Guard
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		dir, err := os.MkdirTemp("", "hold-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		file = NewFile(Path(dir))
+		store := memory.NewStore()
+		for _, obj := range []*unstructured.Unstructured{
+			storagetest.NewTask("task-a", "uid-1", ""),
+			storagetest.NewTask("task-a", "uid-2", ""),
+			storagetest.NewTask("task-b", "uid-3", ""),
+			storagetest.NewTask("task-c", "uid-4", "", storagetest.InNamespace("payments")),
+		} {
+			_, err := store.Write(ctx, obj, string(obj.GetUID()))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		guard = NewGuard(store, file.Load)
+	})
+
+	It("refuses to delete pinned incarnations and objects under legal hold", func() {
+		Expect(file.Add(ctx, Tag{Name: "pin", Kind: "Task", Group: "demo.bastion.io", Namespace: "default",
+			Object: "task-a", UID: "uid-1", Hold: true})).To(Succeed())
+		Expect(file.Add(ctx, Tag{Name: "incident", Namespace: "payments", Hold: true, Note: "incident 1234"})).To(Succeed())
+		Expect(file.Add(ctx, Tag{Name: "label-only", Object: "task-b", Labels: map[string]string{"tier": "web"}})).To(Succeed())
+
+		taskA := storagetest.TaskKey("task-a")
+		err := guard.Delete(ctx, taskA)
+		Expect(errors.Is(err, storage.ErrHeld)).To(BeTrue())
+		Expect(guard.DeleteIncarnation(ctx, taskA, "uid-1")).To(MatchError(storage.ErrHeld))
+		Expect(errors.Is(guard.Delete(ctx, storagetest.TaskKey("task-c", storagetest.InNamespace("payments"))), storage.ErrHeld)).To(BeTrue())
+		Expect(guard.Delete(ctx, storagetest.TaskKey("task-b"))).To(Succeed())
+
+		removed, err := file.Remove(ctx, "pin")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(BeTrue())
+		Expect(guard.DeleteIncarnation(ctx, taskA, "uid-1")).To(Succeed())
+		Expect(guard.Delete(ctx, taskA)).To(Succeed())
+		obj, _, err := guard.Read(ctx, taskA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+
+		tags, err := file.Load(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tags).To(HaveLen(2))
+		Expect(tags[0].Name).To(Equal("incident"))
+	})
+
+	It("refuses deletions when the tags cannot be read", func() {
+		Expect(os.MkdirAll(filepath.Dir(file.Path), 0755)).To(Succeed())
+		Expect(os.WriteFile(file.Path, []byte("{"), 0644)).To(Succeed())
+		Expect(guard.Delete(ctx, storagetest.TaskKey("task-b"))).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Sources", func() {
+	It("holds what the tags file or a BackupTag resource holds", func() {
+		ctx := context.Background()
+		dir, err := os.MkdirTemp("", "hold-test")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		file := NewFile(Path(dir))
+		Expect(file.Add(ctx, Tag{Name: "incident", Namespace: "payments", Hold: true})).To(Succeed())
+		scheme := runtime.NewScheme()
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&v1alpha1.BackupTag{
+			ObjectMeta: metav1.ObjectMeta{Name: "keep-task-a"},
+			Spec:       v1alpha1.BackupTagSpec{Group: storagetest.TaskGVK.Group, Kind: storagetest.TaskGVK.Kind, Namespace: "default", Object: "task-a", Hold: true},
+		}).Build()
+		guard := NewGuard(memory.NewStore(), Sources(file, reader))
+
+		for _, held := range []storage.Key{storagetest.TaskKey("task-a"), storagetest.TaskKey("task-c", storagetest.InNamespace("payments"))} {
+			Expect(guard.Held(ctx, held, "")).To(BeTrue())
+		}
+		Expect(guard.Held(ctx, storagetest.TaskKey("task-b"), "")).To(BeFalse())
+	})
+})
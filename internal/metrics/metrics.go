@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// StartupSyncObjects counts objects of the initial informer list, by whether they were queued or skipped.
+	StartupSyncObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_startup_sync_objects_total",
+		Help: "Objects seen in the initial list of an informer, by result (queued or skipped).",
+	}, []string{"gvk", "result"})
+
+	// StartupSyncComplete is 1 once the initial list of a GVK has been handled.
+	StartupSyncComplete = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_startup_sync_complete",
+		Help: "Whether the initial list of the informer of a GVK has been handled.",
+	}, []string{"gvk"})
+
+	// ReconcileDrift is the drift found by the last reconciliation of a GVK, by type (missing, changed or orphaned).
+	ReconcileDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_reconcile_drift_objects",
+		Help: "Objects found out of sync between cluster and store by the last reconciliation, by type.",
+	}, []string{"gvk", "type"})
+
+	// ReconcileDuration observes how long reconciling a GVK takes.
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bastion_reconcile_duration_seconds",
+		Help:    "Time taken to reconcile a GVK between cluster and store.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"gvk"})
+
+	// ScrubProblems is the number of integrity problems found by the last scrub, by type.
+	ScrubProblems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_scrub_problems",
+		Help: "Integrity problems found in the store by the last scrub, by type.",
+	}, []string{"type"})
+
+	// ScrubScannedObjects is the number of entries verified by the last scrub.
+	ScrubScannedObjects = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_scrub_scanned_objects",
+		Help: "Entries verified by the last scrub of the store.",
+	})
+
+	// ScrubLastCompletion is the time the last scrub finished.
+	ScrubLastCompletion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_scrub_last_completion_timestamp_seconds",
+		Help: "Unix time the last scrub of the store finished.",
+	})
+
+	// SyncObjects counts the changes the replica sync applied to the destination store, by result.
+	SyncObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_sync_objects_total",
+		Help: "Changes applied to the replica store, by result (copied, tombstoned, untombstoned or pruned).",
+	}, []string{"result"})
+
+	// SyncLastCompletion is the time the last replica sync pass finished.
+	SyncLastCompletion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_sync_last_completion_timestamp_seconds",
+		Help: "Unix time the last replica sync pass finished.",
+	})
+
+	// MirrorWriteFailures counts changes a backend of a mirrored store failed to apply.
+	MirrorWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_mirror_write_failures_total",
+		Help: "Changes a backend of the mirrored store failed to apply, by backend index.",
+	}, []string{"backend"})
+
+	// MirrorReplayQueueDepth is the number of changes still queued for a backend of a mirrored store.
+	MirrorReplayQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_mirror_replay_queue_depth",
+		Help: "Changes queued for replay on a backend of the mirrored store, by backend index.",
+	}, []string{"backend"})
+
+	// SegmentReclaimedBytes counts the bytes compaction freed in segment stores.
+	SegmentReclaimedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bastion_segment_reclaimed_bytes_total",
+		Help: "Bytes of superseded records dropped by segment store compaction.",
+	})
+
+	// RetentionPruned counts archived incarnations removed by retention, or only reported in dry runs.
+	RetentionPruned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_retention_pruned_incarnations_total",
+		Help: "Archived incarnations the retention rules did not keep, by GVK and whether it was a dry run.",
+	}, []string{"gvk", "dry_run"})
+
+	// RetentionLastCompletion is the time the last retention pass finished.
+	RetentionLastCompletion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_retention_last_completion_timestamp_seconds",
+		Help: "Unix time the last retention pass over the store finished.",
+	})
+
+	// HeldDeletions counts deletions refused because the backup is under hold.
+	HeldDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_held_deletions_total",
+		Help: "Deletions refused because the backup is pinned or under legal hold, by operation.",
+	}, []string{"operation"})
+
+	// StoredManifestBytes is the size of the stored manifests encoded as JSON, archived incarnations
+	// included, by namespace and GVK.
+	StoredManifestBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_stored_manifest_bytes",
+		Help: "Bytes of stored manifests encoded as JSON, archived incarnations included, by namespace and GVK.",
+	}, []string{"namespace", "gvk"})
+
+	// QuotaUsedManifestBytes is the usage of every namespace selected by a backup policy quota.
+	QuotaUsedManifestBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_quota_used_manifest_bytes",
+		Help: "Manifest bytes used by the objects a backup policy quota selects, by policy, quota index and namespace.",
+	}, []string{"policy", "quota", "namespace"})
+
+	// QuotaExceeded is 1 for every namespace over a backup policy quota.
+	QuotaExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bastion_quota_exceeded",
+		Help: "Whether a namespace uses more than a backup policy quota, by policy, quota index and namespace.",
+	}, []string{"policy", "quota", "namespace"})
+
+	// QuotaPruned counts archived incarnations pruned to bring a namespace under its quota.
+	QuotaPruned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_quota_pruned_incarnations_total",
+		Help: "Archived incarnations pruned to bring a namespace under its quota, by namespace.",
+	}, []string{"namespace"})
+
+	// BackupsSuspended counts backups skipped because a quota suspended them.
+	BackupsSuspended = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_backups_suspended_total",
+		Help: "Backups skipped because the namespace exceeded a suspending quota, by GVK.",
+	}, []string{"gvk"})
+
+	// GCSweepDuration observes how long a garbage collector sweep takes.
+	GCSweepDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bastion_gc_sweep_duration_seconds",
+		Help:    "Time taken by a garbage collector sweep.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	// GCCleaned counts expired tombstones handled by the garbage collector, by result.
+	GCCleaned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_gc_cleaned_total",
+		Help: "Expired tombstones handled by the garbage collector, by result (deleted, untombstoned, held, failed).",
+	}, []string{"result"})
+
+	// GCDeferred is the number of expired tombstones the last sweep left for the next one.
+	GCDeferred = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_gc_deferred_tombstones",
+		Help: "Expired tombstones left for a later sweep by the per-sweep limit.",
+	})
+
+	// MassDeletions counts the mass deletions that froze garbage collection, by scope.
+	MassDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bastion_mass_deletions_total",
+		Help: "Deletion bursts over the threshold that froze garbage collection, by kind or namespace scope.",
+	}, []string{"scope"})
+
+	// GCFrozenScopes is the number of scopes whose garbage collection awaits acknowledgement.
+	GCFrozenScopes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bastion_gc_frozen_scopes",
+		Help: "Scopes whose tombstones are not garbage collected until their mass deletion is acknowledged.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		StartupSyncObjects,
+		StartupSyncComplete,
+		ReconcileDrift,
+		ReconcileDuration,
+		ScrubProblems,
+		ScrubScannedObjects,
+		ScrubLastCompletion,
+		SyncObjects,
+		SyncLastCompletion,
+		MirrorWriteFailures,
+		MirrorReplayQueueDepth,
+		SegmentReclaimedBytes,
+		RetentionPruned,
+		RetentionLastCompletion,
+		HeldDeletions,
+		StoredManifestBytes,
+		QuotaUsedManifestBytes,
+		QuotaExceeded,
+		QuotaPruned,
+		BackupsSuspended,
+		GCSweepDuration,
+		GCCleaned,
+		GCDeferred,
+		MassDeletions,
+		GCFrozenScopes,
+	)
+}
@@ -0,0 +1,365 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/replica"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"time"
+)
+
+const (
+	// checkpointEvery is how many objects are migrated between two checkpoint writes.
+	checkpointEvery = 100
+	// readAttempts bounds how often an object that changes while it is read is read again.
+	readAttempts = 3
+)
+
+// MigrationReport summarizes a migration.
+type MigrationReport struct {
+	Kinds      int      `json:"kinds"`
+	Objects    int      `json:"objects"`    // Objects whose current revision was copied
+	Revisions  int      `json:"revisions"`  // Archived incarnations copied
+	Tombstones int      `json:"tombstones"` // Tombstones copied
+	Skipped    int      `json:"skipped"`    // Objects already migrated according to the checkpoint
+	CaughtUp   int      `json:"caughtUp"`   // Changes made to the source during the migration and copied after it
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// checkpoint is the progress of a migration, so an interrupted one resumes where it stopped.
+type checkpoint struct {
+	From          string   `json:"from"`                    // Migrator.From the progress was made for
+	To            string   `json:"to"`                      // Migrator.To the progress was made for
+	DestinationID string   `json:"destinationID,omitempty"` // Identity of the destination, if it has one
+	Kind          string   `json:"kind"`                    // GVK being migrated
+	LastKey       string   `json:"lastKey"`                 // namespace/name of the last object migrated in Kind
+	Done          []string `json:"done"`                    // GVKs fully migrated
+}
+
+// Migrator streams every object, revision and tombstone from Source to Destination. Objects are
+// visited in a stable order and progress is checkpointed, so a migration can be stopped and resumed.
+// Changes the controller makes to Source while the migration runs are copied by catch-up passes.
+type Migrator struct {
+	Source         storage.Storage
+	Destination    storage.Storage
+	Hasher         hash.Hasher
+	CheckpointPath string // File progress is kept in, empty disables resuming
+	From, To       string // Source and Destination as given, a checkpoint made for others is refused
+	DryRun         bool   // Only count what would be copied
+	CatchUpPasses  int    // Passes over the hash index after the migration to copy concurrent changes
+}
+
+func NewMigrator(source, destination storage.Storage, hasher hash.Hasher, checkpointPath string, dryRun bool) *Migrator {
+	return &Migrator{
+		Source:         source,
+		Destination:    destination,
+		Hasher:         hasher,
+		CheckpointPath: checkpointPath,
+		DryRun:         dryRun,
+		CatchUpPasses:  3,
+	}
+}
+
+// Migrate runs the migration to completion, resuming from the checkpoint if there is one.
+func (m *Migrator) Migrate(ctx context.Context) (MigrationReport, error) {
+	logger := log.FromContext(ctx).WithName("Migrator").WithName("migrate")
+	var report MigrationReport
+	cp, err := m.loadCheckpoint(ctx)
+	if err != nil {
+		return report, err
+	}
+	done := make(map[string]bool, len(cp.Done))
+	for _, k := range cp.Done {
+		done[k] = true
+	}
+
+	kinds, err := m.Source.Kinds(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list source kinds: %w", err)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].String() < kinds[j].String() })
+	for _, gvk := range kinds {
+		report.Kinds++
+		if done[gvk.String()] {
+			continue
+		}
+		if cp.Kind != gvk.String() {
+			cp.Kind, cp.LastKey = gvk.String(), ""
+		}
+		if err := m.migrateKind(ctx, gvk, cp, &report); err != nil {
+			return report, fmt.Errorf("failed to migrate %s: %w", gvk, err)
+		}
+		cp.Done = append(cp.Done, gvk.String())
+		cp.Kind, cp.LastKey = "", ""
+		if err := m.saveCheckpoint(cp); err != nil {
+			return report, err
+		}
+		logger.Info("Migrated kind", "gvk", gvk.String(), "objects", report.Objects)
+	}
+
+	if m.DryRun {
+		return report, nil
+	}
+	// Copy what the controller changed in the source while the kinds were migrated
+	syncer := replica.NewSyncer(m.Source, m.Destination, 0, false)
+	for pass := 0; pass < m.CatchUpPasses; pass++ {
+		sync, err := syncer.SyncOnce(ctx)
+		if err != nil {
+			return report, fmt.Errorf("failed to catch up: %w", err)
+		}
+		changes := sync.Copied + sync.Tombstoned + sync.Untombstoned
+		report.CaughtUp += changes
+		if changes == 0 {
+			break
+		}
+	}
+	return report, nil
+}
+
+func (m *Migrator) migrateKind(ctx context.Context, gvk schema.GroupVersionKind, cp *checkpoint, report *MigrationReport) error {
+	entries, err := m.Source.List(ctx, gvk)
+	if err != nil {
+		return fmt.Errorf("failed to list source: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Namespace+"/"+entries[i].Name < entries[j].Namespace+"/"+entries[j].Name
+	})
+	sinceCheckpoint := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := entry.Namespace + "/" + entry.Name
+		if cp.LastKey != "" && key <= cp.LastKey {
+			report.Skipped++
+			continue
+		}
+		if err := m.migrateObject(ctx, entry, report); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", key, err)
+		}
+		cp.LastKey = key
+		if sinceCheckpoint++; sinceCheckpoint >= checkpointEvery {
+			if err := m.saveCheckpoint(cp); err != nil {
+				return err
+			}
+			sinceCheckpoint = 0
+		}
+	}
+	return nil
+}
+
+// migrateObject copies the archived incarnations of an object the destination is missing, oldest first,
+// then its current revision and tombstone. Incarnations are matched by UID, so a run that stopped halfway
+// through the history of an object copies the rest when resumed. An incarnation older than one the
+// destination already has is reported instead, as writing it over the newer one would archive that one.
+func (m *Migrator) migrateObject(ctx context.Context, entry storage.ObjectEntry, report *MigrationReport) error {
+	existing, err := m.Destination.Lineage(ctx, entry.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read destination lineage: %w", err)
+	}
+	lineage, err := m.Source.Lineage(ctx, entry.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read source lineage: %w", err)
+	}
+	copied := make(map[types.UID]bool, len(existing))
+	for _, inc := range existing {
+		copied[inc.UID] = true
+	}
+	newest := -1 // Position in the source lineage of the newest incarnation the destination has
+	for i, inc := range lineage {
+		if copied[inc.UID] {
+			newest = i
+		}
+	}
+	for i := 0; i < len(lineage)-1; i++ {
+		inc := lineage[i]
+		if copied[inc.UID] {
+			continue
+		}
+		if i < newest {
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s: incarnation %s is missing before incarnation %s",
+				entry.Key, inc.UID, lineage[newest].UID))
+			continue
+		}
+		obj, hash, err := m.read(func() (*unstructured.Unstructured, string, error) {
+			return m.Source.ReadIncarnation(ctx, entry.Key, inc.UID)
+		})
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			continue
+		}
+		report.Revisions++
+		if m.DryRun {
+			continue
+		}
+		if err := m.copy(ctx, obj, hash, report); err != nil {
+			return err
+		}
+		if inc.DeletedAt != nil {
+			if err := m.Destination.MarkTombstone(ctx, obj, *inc.DeletedAt); err != nil {
+				return fmt.Errorf("failed to write tombstone of incarnation %s: %w", inc.UID, err)
+			}
+		}
+	}
+
+	obj, hash, err := m.read(func() (*unstructured.Unstructured, string, error) {
+		return m.Source.Read(ctx, entry.Key)
+	})
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return nil // collected since it was listed
+	}
+	report.Objects++
+	if !m.DryRun {
+		if err := m.copy(ctx, obj, hash, report); err != nil {
+			return err
+		}
+	}
+	if !entry.Tombstoned {
+		return nil
+	}
+	tomb, err := m.Source.ReadTombstone(ctx, entry.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read source tombstone: %w", err)
+	}
+	if tomb == nil {
+		return nil
+	}
+	report.Tombstones++
+	if m.DryRun {
+		return nil
+	}
+	final := tomb.FinalState
+	if final == nil {
+		final = obj
+	}
+	final.SetGroupVersionKind(entry.GVK)
+	if err := m.Destination.MarkTombstone(ctx, final, tomb.DeletedAt); err != nil {
+		return fmt.Errorf("failed to write tombstone: %w", err)
+	}
+	return nil
+}
+
+// read reads an object from the source until its manifest agrees with its hash, as an object written
+// by the controller between reading the hash and the manifest can come back torn.
+func (m *Migrator) read(fn func() (*unstructured.Unstructured, string, error)) (*unstructured.Unstructured, string, error) {
+	var (
+		obj  *unstructured.Unstructured
+		hash string
+		err  error
+	)
+	for attempt := 0; attempt < readAttempts; attempt++ {
+		obj, hash, err = fn()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read source: %w", err)
+		}
+		if obj == nil || m.Hasher == nil {
+			return obj, hash, nil
+		}
+		if computed, err := m.Hasher.Hash(obj); err == nil && computed == hash {
+			return obj, hash, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return obj, hash, nil // copied as stored, verification reports the mismatch
+}
+
+// copy writes an object to the destination, keeping the metadata of its capture, and verifies it reads
+// back with the same hash.
+func (m *Migrator) copy(ctx context.Context, obj *unstructured.Unstructured, hash string, report *MigrationReport) error {
+	ctx, err := storage.WithSourceMetadata(ctx, m.Source, obj)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+	if _, err := m.Destination.Write(ctx, obj, hash); err != nil {
+		return fmt.Errorf("failed to write destination: %w", err)
+	}
+	copied, copiedHash, err := m.Destination.ReadIncarnation(ctx, storage.KeyOf(obj), obj.GetUID())
+	if err != nil {
+		return fmt.Errorf("failed to read back destination: %w", err)
+	}
+	key := storage.KeyOf(obj).String()
+	switch {
+	case copied == nil:
+		report.Mismatches = append(report.Mismatches, key+": missing after copy")
+	case copiedHash != hash:
+		report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s: hash %s after copy, expected %s", key, copiedHash, hash))
+	case m.Hasher != nil:
+		if computed, err := m.Hasher.Hash(copied); err != nil || computed != hash {
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("%s: content hashes to %s, expected %s", key, computed, hash))
+		}
+	}
+	return nil
+}
+
+// loadCheckpoint returns the progress made by earlier runs of this migration. A checkpoint made for another
+// pair of stores is refused, and one made for a destination since recreated is dropped, as resuming from
+// either would skip objects the destination does not have. Dry runs do not identify the destination, as
+// that may create its identity.
+func (m *Migrator) loadCheckpoint(ctx context.Context) (*checkpoint, error) {
+	fresh := &checkpoint{From: m.From, To: m.To}
+	identifier, ok := m.Destination.(storage.Identifier)
+	if ok && !m.DryRun {
+		id, err := identifier.ID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to identify destination: %w", err)
+		}
+		fresh.DestinationID = id
+	}
+	if m.CheckpointPath == "" {
+		return fresh, nil
+	}
+	data, err := os.ReadFile(m.CheckpointPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fresh, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkpoint: %w", err)
+	}
+	if cp.From != m.From || cp.To != m.To {
+		return nil, fmt.Errorf("checkpoint %s is for a migration from %q to %q, not from %q to %q",
+			m.CheckpointPath, cp.From, cp.To, m.From, m.To)
+	}
+	if cp.DestinationID != fresh.DestinationID && !m.DryRun {
+		log.FromContext(ctx).WithName("Migrator").Info("Destination was recreated, migrating from the start",
+			"checkpoint", m.CheckpointPath)
+		return fresh, nil
+	}
+	return cp, nil
+}
+
+// saveCheckpoint replaces the checkpoint file atomically and durably. Dry runs leave it untouched.
+func (m *Migrator) saveCheckpoint(cp *checkpoint) error {
+	if m.CheckpointPath == "" || m.DryRun {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.CheckpointPath), 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint dir: %w", err)
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	if err := atomicfile.WriteFile(m.CheckpointPath, data); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
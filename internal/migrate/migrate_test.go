@@ -0,0 +1,165 @@
+package migrate
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/filesystem"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMigrate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Migrate Suite")
+}
+
+var taskGVK = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+
+func newTask(name, uid string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(taskGVK)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetUID(types.UID(uid))
+	obj.Object["spec"] = map[string]interface{}{"description": "Sample Task " + uid}
+	return obj
+}
+
+var _ = Describe("Migrator", func() {
+	var (
+		ctx         context.Context
+		hasher      *hash.DefaultHasher
+		source      *filesystem.FileSystem
+		destination *filesystem.FileSystem
+		write       func(obj *unstructured.Unstructured)
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		hasher = hash.NewDefaultHasher()
+		source = &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		destination = &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		write = func(obj *unstructured.Unstructured) {
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = source.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		first := newTask("recreated", "uid-1")
+		write(first)
+		Expect(source.MarkTombstone(ctx, first, time.Now())).To(Succeed())
+		write(newTask("recreated", "uid-2"))
+		deleted := newTask("deleted", "uid-3")
+		write(deleted)
+		Expect(source.MarkTombstone(ctx, deleted, time.Now())).To(Succeed())
+		write(newTask("plain", "uid-4"))
+	})
+
+	It("copies objects, archived incarnations and tombstones and verifies them", func() {
+		m := NewMigrator(source, destination, hasher, filepath.Join(GinkgoT().TempDir(), "checkpoint.json"), false)
+		report, err := m.Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Objects).To(Equal(3))
+		Expect(report.Revisions).To(Equal(1))
+		Expect(report.Tombstones).To(Equal(1))
+		Expect(report.Mismatches).To(BeEmpty())
+
+		lineage, err := destination.Lineage(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "recreated"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(2))
+		Expect(lineage[0].DeletedAt).NotTo(BeNil())
+		old, _, err := destination.ReadIncarnation(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "recreated"}, "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(old).NotTo(BeNil())
+		captured, err := source.ReadMetadata(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "recreated"}, "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		copied, err := destination.ReadMetadata(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "recreated"}, "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(copied.CapturedAt).To(BeTemporally("==", captured.CapturedAt))
+		tomb, err := destination.ReadTombstone(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "deleted"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tomb).NotTo(BeNil())
+
+		// A second run resumes from the checkpoint and has nothing left to copy
+		report, err = m.Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Objects).To(BeZero())
+		Expect(report.CaughtUp).To(BeZero())
+	})
+
+	It("copies the archived incarnations a stopped run left out, and reports those it cannot", func() {
+		for _, name := range []string{"resumed", "gapped"} {
+			for _, uid := range []string{"uid-a", "uid-b"} {
+				obj := newTask(name, uid)
+				write(obj)
+				Expect(source.MarkTombstone(ctx, obj, time.Now())).To(Succeed())
+			}
+			write(newTask(name, "uid-c"))
+		}
+		// The stopped run copied the oldest incarnation of one object, and only a newer one of the other
+		Expect(destination.Upgrade(ctx)).To(Succeed())
+		for _, copied := range []*unstructured.Unstructured{newTask("resumed", "uid-a"), newTask("gapped", "uid-b")} {
+			h, err := hasher.Hash(copied)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = destination.Write(ctx, copied, h)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(destination.MarkTombstone(ctx, copied, time.Now())).To(Succeed())
+		}
+
+		report, err := NewMigrator(source, destination, hasher, "", false).Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Revisions).To(Equal(2), "uid-1 of recreated and uid-b of resumed")
+		Expect(report.Mismatches).To(ConsistOf(ContainSubstring("incarnation uid-a is missing before incarnation uid-b")))
+		uids := func(name string) []types.UID {
+			lineage, err := destination.Lineage(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: name})
+			Expect(err).NotTo(HaveOccurred())
+			var uids []types.UID
+			for _, inc := range lineage {
+				uids = append(uids, inc.UID)
+			}
+			return uids
+		}
+		Expect(uids("resumed")).To(Equal([]types.UID{"uid-a", "uid-b", "uid-c"}))
+		Expect(uids("gapped")).To(Equal([]types.UID{"uid-b", "uid-c"}))
+	})
+
+	It("resumes only the migration between the stores its checkpoint was made for", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "checkpoint.json")
+		m := NewMigrator(source, destination, hasher, path, false)
+		m.From, m.To = "fs:/backups", "fs:/new-backups"
+		_, err := m.Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		other := NewMigrator(source, destination, hasher, path, false)
+		other.From, other.To = "fs:/backups", "fs:/other-backups"
+		_, err = other.Migrate(ctx)
+		Expect(err).To(MatchError(ContainSubstring("not from")))
+
+		// A recreated destination has none of the objects the checkpoint skips
+		recreated := NewMigrator(source, &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}, hasher, path, false)
+		recreated.From, recreated.To = m.From, m.To
+		report, err := recreated.Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Objects).To(Equal(3))
+		Expect(report.Skipped).To(BeZero())
+	})
+
+	It("writes nothing in a dry run", func() {
+		m := NewMigrator(source, destination, hasher, "", true)
+		report, err := m.Migrate(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Objects).To(Equal(3))
+		kinds, err := destination.Kinds(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kinds).To(BeEmpty())
+	})
+})
@@ -0,0 +1,380 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/retention"
+	"github.com/bastion/internal/storage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Item is a stored incarnation of an object and the size of its manifest.
+type Item struct {
+	storage.Key
+	UID           types.UID `json:"uid,omitempty"`
+	ManifestBytes int64     `json:"manifestBytes"`
+	LastBackup    time.Time `json:"lastBackup"`
+	Current       bool      `json:"current,omitempty"`
+}
+
+// Scope is a namespace and GVK whose usage is tracked.
+type Scope struct {
+	Namespace string
+	GVK       schema.GroupVersionKind
+}
+
+// Sizes returns every stored incarnation with the size of its manifest encoded as JSON, so usage does not
+// depend on how a backend lays manifests out. It reads and encodes every manifest; a Meter measures
+// repeatedly without doing so again for incarnations it already measured.
+func Sizes(ctx context.Context, store storage.Storage) ([]Item, error) {
+	return (&Meter{}).Measure(ctx, store)
+}
+
+// measured identifies a stored incarnation whose manifest cannot change without the identity changing: the
+// current one by its hash, archived ones by their last backup.
+type measured struct {
+	key        storage.Key
+	uid        types.UID
+	hash       string
+	lastBackup int64
+}
+
+// size is what a Meter remembers of a measured incarnation.
+type size struct {
+	uid   types.UID
+	bytes int64
+}
+
+// Meter measures stored incarnations like Sizes, and remembers the sizes it measured, so later passes only
+// read and encode the manifests of incarnations written since. Incarnations gone from the store are
+// forgotten.
+type Meter struct {
+	mu    sync.Mutex
+	sizes map[measured]size
+}
+
+// Measure returns every stored incarnation with the size of its manifest encoded as JSON.
+func (m *Meter) Measure(ctx context.Context, store storage.Storage) ([]Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := map[measured]size{}
+	var items []Item
+	err := store.Walk(ctx, storage.Filter{}, func(entry storage.ObjectEntry) error {
+		current := measured{key: entry.Key, hash: entry.Hash}
+		known, ok := m.sizes[current]
+		if !ok {
+			obj, _, err := store.Read(ctx, entry.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", entry.Key, err)
+			}
+			if obj != nil {
+				bytes, err := sizeOf(obj)
+				if err != nil {
+					return err
+				}
+				known, ok = size{uid: obj.GetUID(), bytes: bytes}, true
+			}
+		}
+		if ok {
+			sizes[current] = known
+			items = append(items, Item{Key: entry.Key, UID: known.uid, ManifestBytes: known.bytes, LastBackup: entry.Modified, Current: true})
+		}
+		lineage, err := store.Lineage(ctx, entry.Key)
+		if err != nil {
+			return fmt.Errorf("failed to read lineage of %s: %w", entry.Key, err)
+		}
+		for i := 0; i < len(lineage)-1; i++ {
+			incarnation := measured{key: entry.Key, uid: lineage[i].UID, lastBackup: lineage[i].LastBackup.UnixNano()}
+			known, ok := m.sizes[incarnation]
+			if !ok {
+				archived, _, err := store.ReadIncarnation(ctx, entry.Key, lineage[i].UID)
+				if err != nil {
+					return fmt.Errorf("failed to read incarnation %s of %s: %w", lineage[i].UID, entry.Key, err)
+				}
+				if archived == nil {
+					continue
+				}
+				bytes, err := sizeOf(archived)
+				if err != nil {
+					return err
+				}
+				known = size{uid: lineage[i].UID, bytes: bytes}
+			}
+			sizes[incarnation] = known
+			items = append(items, Item{Key: entry.Key, UID: lineage[i].UID, ManifestBytes: known.bytes, LastBackup: lineage[i].LastBackup})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.sizes = sizes
+	return items, nil
+}
+
+func sizeOf(obj *unstructured.Unstructured) (int64, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal %s: %w", obj.GetName(), err)
+	}
+	return int64(len(data)), nil
+}
+
+// Usage sums the manifest bytes of items by namespace and GVK.
+func Usage(items []Item) map[Scope]int64 {
+	usage := map[Scope]int64{}
+	for _, item := range items {
+		usage[Scope{Namespace: item.Namespace, GVK: item.GVK}] += item.ManifestBytes
+	}
+	return usage
+}
+
+// suspension stops backups of the objects a quota selects in one namespace.
+type suspension struct {
+	selector  v1alpha1.ObjectSelector
+	namespace string
+}
+
+// Enforcer periodically measures the store, publishes usage in metrics and in the status of the backup
+// policies, and applies their quotas: it prunes the oldest archived incarnations of a namespace over its
+// limit, or suspends its backups. While no policy defines quotas, nothing is measured.
+type Enforcer struct {
+	Store        storage.Storage
+	Policies     func(ctx context.Context) ([]v1alpha1.BackupPolicy, error)
+	UpdateStatus func(ctx context.Context, policy *v1alpha1.BackupPolicy) error // Nil skips status updates
+	Recorder     record.EventRecorder                                           // Nil emits no events
+	Interval     time.Duration
+
+	meter     Meter
+	mu        sync.RWMutex
+	suspended []suspension
+	exceeded  map[string]bool // Quotas of a namespace exceeded at the last pass, by policy, index and namespace
+}
+
+func NewEnforcer(store storage.Storage, policies func(ctx context.Context) ([]v1alpha1.BackupPolicy, error),
+	interval time.Duration) *Enforcer {
+	return &Enforcer{
+		Store:    store,
+		Policies: policies,
+		Interval: interval,
+	}
+}
+
+// Run enforces quotas right away, so suspensions are back in place after a restart, then every Interval.
+func (e *Enforcer) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("Enforcer").WithName("run")
+	logger.Info("Starting quota enforcer", "interval", e.Interval)
+	if _, err := e.Enforce(ctx); err != nil {
+		logger.Error(err, "failed to enforce quotas")
+	}
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Quota enforcer stopped")
+			return
+		case <-ticker.C:
+			if _, err := e.Enforce(ctx); err != nil {
+				logger.Error(err, "failed to enforce quotas")
+			}
+		}
+	}
+}
+
+// Suspended reports whether backups of the object stored under key are suspended by a quota.
+func (e *Enforcer) Suspended(key storage.Key) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, s := range e.suspended {
+		if s.namespace == key.Namespace && retention.Selects(s.selector, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforce measures the store and applies every quota once. It returns the incarnations pruned.
+func (e *Enforcer) Enforce(ctx context.Context) ([]Item, error) {
+	logger := log.FromContext(ctx).WithName("Enforcer").WithName("enforce")
+	policies, err := e.Policies(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup policies: %w", err)
+	}
+	quotas := false
+	for _, policy := range policies {
+		quotas = quotas || len(policy.Spec.Quotas) > 0
+	}
+	if !quotas {
+		metrics.StoredManifestBytes.Reset()
+		metrics.QuotaUsedManifestBytes.Reset()
+		metrics.QuotaExceeded.Reset()
+		e.mu.Lock()
+		e.suspended, e.exceeded = nil, nil
+		e.mu.Unlock()
+		return nil, nil
+	}
+	items, err := e.meter.Measure(ctx, e.Store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure store: %w", err)
+	}
+	measured := metav1.Now()
+	metrics.StoredManifestBytes.Reset()
+	for scope, bytes := range Usage(items) {
+		metrics.StoredManifestBytes.WithLabelValues(scope.Namespace, scope.GVK.String()).Set(float64(bytes))
+	}
+
+	e.mu.RLock()
+	previous := e.exceeded
+	e.mu.RUnlock()
+	var suspended []suspension
+	exceeded := map[string]bool{}
+	deleted := map[int]bool{}
+	var pruned []Item
+	metrics.QuotaUsedManifestBytes.Reset()
+	metrics.QuotaExceeded.Reset()
+	for p := range policies {
+		policy := &policies[p]
+		if len(policy.Spec.Quotas) == 0 {
+			continue
+		}
+		var usages []v1alpha1.QuotaUsage
+		for q, quota := range policy.Spec.Quotas {
+			byNamespace := map[string][]int{}
+			for i, item := range items {
+				if !deleted[i] && retention.Selects(quota.ObjectSelector, item.Key) {
+					byNamespace[item.Namespace] = append(byNamespace[item.Namespace], i)
+				}
+			}
+			namespaces := make([]string, 0, len(byNamespace))
+			for namespace := range byNamespace {
+				namespaces = append(namespaces, namespace)
+			}
+			sort.Strings(namespaces)
+			for _, namespace := range namespaces {
+				usage := v1alpha1.QuotaUsage{Quota: int32(q), Namespace: namespace, LimitBytes: quota.Limit.Value()}
+				for _, i := range byNamespace[namespace] {
+					usage.UsedManifestBytes += items[i].ManifestBytes
+				}
+				if usage.UsedManifestBytes > usage.LimitBytes && quota.Action != v1alpha1.QuotaActionSuspend {
+					removed, err := e.prune(ctx, items, byNamespace[namespace], usage.UsedManifestBytes-usage.LimitBytes, deleted)
+					if err != nil {
+						return pruned, err
+					}
+					for _, item := range removed {
+						usage.UsedManifestBytes -= item.ManifestBytes
+					}
+					pruned = append(pruned, removed...)
+				}
+				usage.Exceeded = usage.UsedManifestBytes > usage.LimitBytes
+				if usage.Exceeded && quota.Action == v1alpha1.QuotaActionSuspend {
+					usage.Suspended = true
+					suspended = append(suspended, suspension{selector: quota.ObjectSelector, namespace: namespace})
+				}
+				id := policy.Namespace + "/" + policy.Name + "/" + strconv.Itoa(q) + "/" + namespace
+				exceeded[id] = usage.Exceeded
+				e.record(policy, usage, previous[id])
+				labels := []string{policy.Namespace + "/" + policy.Name, strconv.Itoa(q), namespace}
+				metrics.QuotaUsedManifestBytes.WithLabelValues(labels...).Set(float64(usage.UsedManifestBytes))
+				if usage.Exceeded {
+					metrics.QuotaExceeded.WithLabelValues(labels...).Set(1)
+				} else {
+					metrics.QuotaExceeded.WithLabelValues(labels...).Set(0)
+				}
+				usages = append(usages, usage)
+			}
+		}
+		policy.Status.Quotas = usages
+		policy.Status.LastMeasured = &measured
+		if e.UpdateStatus != nil {
+			if err := e.UpdateStatus(ctx, policy); err != nil {
+				logger.Error(err, "failed to update backup policy status", "policy", policy.Namespace+"/"+policy.Name)
+			}
+		}
+	}
+
+	e.mu.Lock()
+	e.suspended = suspended
+	e.exceeded = exceeded
+	e.mu.Unlock()
+	logger.Info("Quota pass complete", "incarnations", len(items), "pruned", len(pruned), "suspended", len(suspended))
+	return pruned, nil
+}
+
+// prune removes the oldest archived incarnations among items[indexes] until excess bytes are gone, or
+// none is left that is not under hold, and returns the ones it removed.
+func (e *Enforcer) prune(ctx context.Context, items []Item, indexes []int, excess int64, deleted map[int]bool) ([]Item, error) {
+	logger := log.FromContext(ctx).WithName("Enforcer").WithName("prune")
+	var archived []int
+	for _, i := range indexes {
+		if !items[i].Current {
+			archived = append(archived, i)
+		}
+	}
+	sort.SliceStable(archived, func(a, b int) bool { return items[archived[a]].LastBackup.Before(items[archived[b]].LastBackup) })
+	holder, _ := e.Store.(storage.Holder)
+	var removed []Item
+	for _, i := range archived {
+		if excess <= 0 {
+			break
+		}
+		item := items[i]
+		if holder != nil {
+			held, err := holder.Held(ctx, item.Key, item.UID)
+			if err != nil {
+				return removed, err
+			}
+			if held {
+				continue
+			}
+		}
+		if err := e.Store.DeleteIncarnation(ctx, item.Key, item.UID); err != nil {
+			if errors.Is(err, storage.ErrHeld) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to prune incarnation %s of %s: %w", item.UID, item.Key, err)
+		}
+		deleted[i] = true
+		excess -= item.ManifestBytes
+		removed = append(removed, item)
+		metrics.QuotaPruned.WithLabelValues(item.Namespace).Inc()
+		logger.Info("Pruned incarnation over quota", "key", item.Key.String(), "uid", item.UID,
+			"manifestBytes", item.ManifestBytes, "lastBackup", item.LastBackup)
+	}
+	return removed, nil
+}
+
+// record emits an event on the policy when the quota of a namespace becomes exceeded or fits again.
+func (e *Enforcer) record(policy *v1alpha1.BackupPolicy, usage v1alpha1.QuotaUsage, wasExceeded bool) {
+	if e.Recorder == nil || usage.Exceeded == wasExceeded {
+		return
+	}
+	used := resource.NewQuantity(usage.UsedManifestBytes, resource.BinarySI)
+	limit := resource.NewQuantity(usage.LimitBytes, resource.BinarySI)
+	if !usage.Exceeded {
+		e.Recorder.Eventf(policy, corev1.EventTypeNormal, "QuotaRestored",
+			"Namespace %q uses %s of its %s quota %d", usage.Namespace, used, limit, usage.Quota)
+		return
+	}
+	action := "pruning could not bring it under the limit"
+	if usage.Suspended {
+		action = "its backups are suspended"
+	}
+	e.Recorder.Eventf(policy, corev1.EventTypeWarning, "QuotaExceeded",
+		"Namespace %q uses %s of its %s quota %d, %s", usage.Namespace, used, limit, usage.Quota, action)
+}
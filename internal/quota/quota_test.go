@@ -0,0 +1,141 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestQuota(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Quota Suite")
+}
+
+var _ = Describe("Enforcer", func() {
+	var (
+		ctx      context.Context
+		store    *memory.Store
+		recorder *record.FakeRecorder
+		statuses map[string]v1alpha1.BackupPolicyStatus
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		store = memory.NewStore()
+		store.Clock = func() time.Time { now = now.Add(time.Minute); return now }
+		// Four incarnations of a 1000 byte task in the tenant namespace, one small task elsewhere
+		for i := 1; i <= 4; i++ {
+			_, err := store.Write(ctx, storagetest.NewTask("task-a", fmt.Sprintf("uid-%d", i), strings.Repeat("x", 1000), storagetest.InNamespace("tenant")), fmt.Sprintf("h%d", i))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := store.Write(ctx, storagetest.NewTask("task-b", "uid-5", strings.Repeat("x", 10), storagetest.InNamespace("other")), "h5")
+		Expect(err).NotTo(HaveOccurred())
+		recorder = record.NewFakeRecorder(10)
+		statuses = map[string]v1alpha1.BackupPolicyStatus{}
+	})
+
+	enforcer := func(action v1alpha1.QuotaAction) *Enforcer {
+		policy := v1alpha1.BackupPolicy{Spec: v1alpha1.BackupPolicySpec{Quotas: []v1alpha1.Quota{{
+			Limit:  resource.MustParse("2500"),
+			Action: action,
+		}}}}
+		policy.Name = "tenants"
+		e := NewEnforcer(store, func(context.Context) ([]v1alpha1.BackupPolicy, error) {
+			return []v1alpha1.BackupPolicy{*policy.DeepCopy()}, nil
+		}, 0)
+		e.Recorder = recorder
+		e.UpdateStatus = func(ctx context.Context, policy *v1alpha1.BackupPolicy) error {
+			statuses[policy.Name] = policy.Status
+			return nil
+		}
+		return e
+	}
+
+	It("measures usage per namespace and GVK", func() {
+		items, err := Sizes(ctx, store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(HaveLen(5))
+		usage := Usage(items)
+		Expect(usage[Scope{Namespace: "tenant", GVK: storagetest.TaskGVK}]).To(BeNumerically(">", 4000))
+		Expect(usage[Scope{Namespace: "other", GVK: storagetest.TaskGVK}]).To(BeNumerically("<", 500))
+	})
+
+	It("reads only the manifests written since the last measurement", func() {
+		store.Faults = &memory.Faults{}
+		meter := &Meter{}
+		items, err := meter.Measure(ctx, store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(HaveLen(5))
+		Expect(store.Faults.Calls(memory.OpRead) + store.Faults.Calls(memory.OpReadIncarnation)).To(Equal(5))
+
+		_, err = store.Write(ctx, storagetest.NewTask("task-b", "uid-5", strings.Repeat("x", 20), storagetest.InNamespace("other")), "h6")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.DeleteIncarnation(ctx, storagetest.TaskKey("task-a", storagetest.InNamespace("tenant")), "uid-1")).To(Succeed())
+		again, err := meter.Measure(ctx, store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(HaveLen(4))
+		Expect(store.Faults.Calls(memory.OpRead) + store.Faults.Calls(memory.OpReadIncarnation)).To(Equal(6))
+		items, err = Sizes(ctx, store)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(Usage(again)).To(Equal(Usage(items)))
+	})
+
+	It("measures nothing while no policy defines quotas", func() {
+		store.Faults = &memory.Faults{}
+		e := NewEnforcer(store, func(context.Context) ([]v1alpha1.BackupPolicy, error) {
+			return []v1alpha1.BackupPolicy{{}}, nil
+		}, 0)
+		_, err := e.Enforce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Faults.Calls(memory.OpWalk)).To(BeZero())
+	})
+
+	It("prunes the oldest archived incarnations of a namespace over its quota", func() {
+		pruned, err := enforcer(v1alpha1.QuotaActionPrune).Enforce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pruned).To(HaveLen(2))
+		Expect(pruned[0].UID).To(Equal(types.UID("uid-1")))
+		Expect(pruned[1].UID).To(Equal(types.UID("uid-2")))
+		Expect(store.Lineage(ctx, storagetest.TaskKey("task-a", storagetest.InNamespace("tenant")))).To(HaveLen(2))
+
+		status := statuses["tenants"]
+		Expect(status.LastMeasured).NotTo(BeNil())
+		Expect(status.Quotas).To(HaveLen(2))
+		Expect(status.Quotas[1].Namespace).To(Equal("tenant"))
+		Expect(status.Quotas[1].UsedManifestBytes).To(BeNumerically("<=", 2500))
+		Expect(status.Quotas[1].Exceeded).To(BeFalse())
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("suspends the backups of a namespace over a suspending quota until it fits again", func() {
+		e := enforcer(v1alpha1.QuotaActionSuspend)
+		_, err := e.Enforce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Suspended(storagetest.TaskKey("task-c", storagetest.InNamespace("tenant")))).To(BeTrue())
+		Expect(e.Suspended(storagetest.TaskKey("task-b", storagetest.InNamespace("other")))).To(BeFalse())
+		Expect(statuses["tenants"].Quotas[1].Suspended).To(BeTrue())
+		Expect(recorder.Events).To(Receive(ContainSubstring("QuotaExceeded")))
+
+		key := storagetest.TaskKey("task-a", storagetest.InNamespace("tenant"))
+		for _, uid := range []types.UID{"uid-1", "uid-2", "uid-3"} {
+			Expect(store.DeleteIncarnation(ctx, key, uid)).To(Succeed())
+		}
+		_, err = e.Enforce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Suspended(key)).To(BeFalse())
+		Expect(recorder.Events).To(Receive(ContainSubstring("QuotaRestored")))
+	})
+})
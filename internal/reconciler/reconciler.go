@@ -0,0 +1,206 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"github.com/bastion/internal/finalizer"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/worker"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+	"time"
+)
+
+// listPageSize bounds how many live objects are held in memory at once while listing a GVK.
+const listPageSize = 500
+
+// DriftReport summarizes the differences found between the cluster and the store for a GVK.
+type DriftReport struct {
+	GVK      schema.GroupVersionKind
+	Live     int           // Objects in the cluster
+	Stored   int           // Objects in the store that are not tombstoned
+	Missing  int           // Live objects without a backup
+	Changed  int           // Live objects whose backup has a different hash
+	Orphaned int           // Stored objects that no longer exist in the cluster
+	Duration time.Duration // Time taken to reconcile the GVK
+}
+
+// Drifted reports whether any difference was found.
+func (r DriftReport) Drifted() bool {
+	return r.Missing+r.Changed+r.Orphaned > 0
+}
+
+// Reconciler periodically compares every registered GVK in the cluster against the store, catching
+// events that were dropped or failed all retries. Differences are queued on the backup worker.
+type Reconciler struct {
+	DynamicClient dynamic.Interface
+	Store         storage.Storage
+	Hasher        hash.Hasher
+	Worker        *worker.BackupWorker
+	Registered    func() map[schema.GroupVersionKind]schema.GroupVersionResource // GVKs to reconcile
+	Interval      time.Duration
+	Concurrency   int // Number of GVKs reconciled in parallel
+}
+
+func NewReconciler(dynamicClient dynamic.Interface,
+	store storage.Storage,
+	hasher hash.Hasher,
+	w *worker.BackupWorker,
+	registered func() map[schema.GroupVersionKind]schema.GroupVersionResource,
+	interval time.Duration,
+	concurrency int) *Reconciler {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &Reconciler{
+		DynamicClient: dynamicClient,
+		Store:         store,
+		Hasher:        hasher,
+		Worker:        w,
+		Registered:    registered,
+		Interval:      interval,
+		Concurrency:   concurrency,
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("Reconciler").WithName("run")
+	logger.Info("Starting reconciler", "interval", r.Interval, "concurrency", r.Concurrency)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Reconciler stopped")
+			return
+		case <-ticker.C:
+			r.ReconcileAll(ctx)
+		}
+	}
+}
+
+// ReconcileAll reconciles every registered GVK, at most Concurrency at a time.
+func (r *Reconciler) ReconcileAll(ctx context.Context) []DriftReport {
+	logger := log.FromContext(ctx).WithName("Reconciler").WithName("reconcileAll")
+	registered := r.Registered()
+	var (
+		reports []DriftReport
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, r.Concurrency)
+	for gvk, gvr := range registered {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(gvk schema.GroupVersionKind, gvr schema.GroupVersionResource) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			report, err := r.Reconcile(ctx, gvk, gvr)
+			if err != nil {
+				logger.Error(err, "failed to reconcile", "gvk", gvk.String())
+				return
+			}
+			mu.Lock()
+			reports = append(reports, report)
+			mu.Unlock()
+		}(gvk, gvr)
+	}
+	wg.Wait()
+	return reports
+}
+
+// Reconcile lists the live objects of a GVK and walks its stored objects, queueing backups for live
+// objects that are missing or changed and tombstones for stored objects that no longer exist.
+func (r *Reconciler) Reconcile(ctx context.Context, gvk schema.GroupVersionKind, gvr schema.GroupVersionResource) (DriftReport, error) {
+	logger := log.FromContext(ctx).WithName("Reconciler").WithName("reconcile").WithValues("gvk", gvk.String())
+	start := time.Now()
+	report := DriftReport{GVK: gvk}
+
+	entries, err := r.Store.List(ctx, gvk)
+	if err != nil {
+		return report, fmt.Errorf("failed to list stored objects: %w", err)
+	}
+	stored := make(map[storage.Key]storage.ObjectEntry, len(entries))
+	for _, entry := range entries {
+		if entry.Tombstoned {
+			continue
+		}
+		stored[entry.Key] = entry
+	}
+	report.Stored = len(stored)
+
+	opts := metav1.ListOptions{Limit: listPageSize}
+	for {
+		list, err := r.DynamicClient.Resource(gvr).List(ctx, opts)
+		if err != nil {
+			return report, fmt.Errorf("failed to list live objects: %w", err)
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			obj.SetGroupVersionKind(gvk)
+			obj.SetManagedFields(nil)
+			report.Live++
+			key := storage.KeyOf(obj)
+			entry, ok := stored[key]
+			delete(stored, key)
+			if ok {
+				hashStr, err := r.Hasher.Hash(obj)
+				if err != nil {
+					return report, fmt.Errorf("failed to hash: %w", err)
+				}
+				if hashStr == entry.Hash {
+					continue
+				}
+				report.Changed++
+			} else {
+				report.Missing++
+			}
+			// The resume points disagree with the store, so they must not skip the repair
+			if r.Worker.Checkpoints != nil {
+				r.Worker.Checkpoints.Forget(gvk, obj.GetNamespace(), obj.GetName())
+			}
+			eventType := worker.EventType(worker.Update)
+			if finalizer.Deleting(obj) {
+				eventType = worker.Finalize
+			}
+			r.Worker.EnqueueEvent(worker.BackupEvent{Object: obj.DeepCopy(), EventType: eventType, GVK: gvk, GVR: gvr})
+		}
+		if list.GetContinue() == "" {
+			break
+		}
+		opts.Continue = list.GetContinue()
+	}
+
+	// What is left in the store no longer exists in the cluster
+	for _, entry := range stored {
+		obj, _, err := r.Store.Read(ctx, entry.Key)
+		if err != nil {
+			return report, fmt.Errorf("failed to read stored object: %w", err)
+		}
+		if obj == nil {
+			continue
+		}
+		report.Orphaned++
+		r.Worker.EnqueueEvent(worker.BackupEvent{Object: obj, EventType: worker.Delete, GVK: gvk, GVR: gvr})
+	}
+
+	report.Duration = time.Since(start)
+	metrics.ReconcileDrift.WithLabelValues(gvk.String(), "missing").Set(float64(report.Missing))
+	metrics.ReconcileDrift.WithLabelValues(gvk.String(), "changed").Set(float64(report.Changed))
+	metrics.ReconcileDrift.WithLabelValues(gvk.String(), "orphaned").Set(float64(report.Orphaned))
+	metrics.ReconcileDuration.WithLabelValues(gvk.String()).Observe(report.Duration.Seconds())
+	logger.Info("Reconciled",
+		"live", report.Live,
+		"stored", report.Stored,
+		"missing", report.Missing,
+		"changed", report.Changed,
+		"orphaned", report.Orphaned,
+		"drifted", report.Drifted(),
+		"duration", report.Duration)
+	return report, nil
+}
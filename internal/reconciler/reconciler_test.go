@@ -0,0 +1,92 @@
+package reconciler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/checkpoint"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage/filesystem"
+	"github.com/bastion/internal/worker"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestReconciler(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Reconciler Suite")
+}
+
+var (
+	taskGVK = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+	taskGVR = schema.GroupVersionResource{Group: "demo.bastion.io", Version: "v1", Resource: "tasks"}
+)
+
+func newTask(name, description string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(taskGVK)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.Object["spec"] = map[string]interface{}{"description": description}
+	return obj
+}
+
+var _ = Describe("Reconciler", func() {
+	It("queues missing, changed and orphaned objects", func() {
+		ctx := context.Background()
+		hasher := hash.NewDefaultHasher()
+		store := &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		backup := func(obj *unstructured.Unstructured) {
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		backup(newTask("in-sync", "same"))
+		backup(newTask("changed", "old"))
+		backup(newTask("orphaned", "gone"))
+
+		client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{taskGVR: "TaskList"},
+			newTask("in-sync", "same"), newTask("changed", "new"), newTask("missing", "new"))
+		w := worker.NewBackupWorker("test", hasher, store, 10, 1, 1)
+		// Resume points claiming the changed object is backed up must not hide the repair
+		w.Checkpoints = checkpoint.NewStore(GinkgoT().TempDir())
+		changed := newTask("changed", "new")
+		changed.SetResourceVersion("2")
+		w.Checkpoints.Record(taskGVK, changed, "stale")
+		registered := func() map[schema.GroupVersionKind]schema.GroupVersionResource {
+			return map[schema.GroupVersionKind]schema.GroupVersionResource{taskGVK: taskGVR}
+		}
+		rec := NewReconciler(client, store, hasher, w, registered, time.Hour, 1)
+
+		reports := rec.ReconcileAll(ctx)
+		Expect(reports).To(HaveLen(1))
+		report := reports[0]
+		Expect(report.Live).To(Equal(3))
+		Expect(report.Stored).To(Equal(3))
+		Expect(report.Missing).To(Equal(1))
+		Expect(report.Changed).To(Equal(1))
+		Expect(report.Orphaned).To(Equal(1))
+		Expect(report.Drifted()).To(BeTrue())
+
+		queued := map[string]worker.EventType{}
+		for len(w.Queue) > 0 {
+			event := <-w.Queue
+			queued[event.Object.GetName()] = event.EventType
+		}
+		Expect(queued).To(Equal(map[string]worker.EventType{
+			"changed":  worker.Update,
+			"missing":  worker.Update,
+			"orphaned": worker.Delete,
+		}))
+		_, recorded := w.Checkpoints.Hash(taskGVK, "default", "changed")
+		Expect(recorded).To(BeFalse())
+	})
+})
@@ -0,0 +1,202 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+// SyncReport summarizes one pass of the Syncer.
+type SyncReport struct {
+	Kinds        int // GVKs compared
+	Compared     int // Source objects compared against the destination
+	Copied       int // Objects missing or different in the destination that were copied
+	Tombstoned   int // Tombstones copied to the destination
+	Untombstoned int // Destination tombstones dropped because the source object was resurrected
+	Pruned       int // Destination objects that no longer exist in the source and were deleted
+	Held         int // Destination objects that no longer exist in the source but are under hold
+	Duration     time.Duration
+}
+
+// Syncer copies what differs from Source to Destination, in that direction only. Both stores are
+// compared by their hash index, so only manifests that differ are ever read.
+type Syncer struct {
+	Source      storage.Storage
+	Destination storage.Storage
+	Interval    time.Duration // Pause between passes in continuous mode
+	Prune       bool          // Delete destination objects that are not in the source
+}
+
+func NewSyncer(source, destination storage.Storage, interval time.Duration, prune bool) *Syncer {
+	return &Syncer{
+		Source:      source,
+		Destination: destination,
+		Interval:    interval,
+		Prune:       prune,
+	}
+}
+
+// Run syncs every interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("Syncer").WithName("run")
+	logger.Info("Starting replica sync", "interval", s.Interval, "prune", s.Prune)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Replica sync stopped")
+			return
+		case <-ticker.C:
+			if _, err := s.SyncOnce(ctx); err != nil {
+				logger.Error(err, "failed to sync replica")
+			}
+		}
+	}
+}
+
+// SyncOnce makes one pass over every GVK of the source.
+func (s *Syncer) SyncOnce(ctx context.Context) (SyncReport, error) {
+	logger := log.FromContext(ctx).WithName("Syncer").WithName("syncOnce")
+	start := time.Now()
+	var report SyncReport
+	kinds, err := s.Source.Kinds(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list source kinds: %w", err)
+	}
+	if s.Prune {
+		// Kinds only found in the destination are pruned as a whole
+		destinationKinds, err := s.Destination.Kinds(ctx)
+		if err != nil {
+			return report, fmt.Errorf("failed to list destination kinds: %w", err)
+		}
+		seen := make(map[schema.GroupVersionKind]bool, len(kinds))
+		for _, gvk := range kinds {
+			seen[gvk] = true
+		}
+		for _, gvk := range destinationKinds {
+			if !seen[gvk] {
+				kinds = append(kinds, gvk)
+			}
+		}
+	}
+	for _, gvk := range kinds {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := s.syncKind(ctx, gvk, &report); err != nil {
+			return report, fmt.Errorf("failed to sync %s: %w", gvk, err)
+		}
+		report.Kinds++
+	}
+	report.Duration = time.Since(start)
+	metrics.SyncLastCompletion.Set(float64(time.Now().Unix()))
+	logger.Info("Replica synced",
+		"kinds", report.Kinds,
+		"compared", report.Compared,
+		"copied", report.Copied,
+		"tombstoned", report.Tombstoned,
+		"untombstoned", report.Untombstoned,
+		"pruned", report.Pruned,
+		"held", report.Held,
+		"duration", report.Duration)
+	return report, nil
+}
+
+func (s *Syncer) syncKind(ctx context.Context, gvk schema.GroupVersionKind, report *SyncReport) error {
+	sourceEntries, err := s.Source.List(ctx, gvk)
+	if err != nil {
+		return fmt.Errorf("failed to list source: %w", err)
+	}
+	destinationEntries, err := s.Destination.List(ctx, gvk)
+	if err != nil {
+		return fmt.Errorf("failed to list destination: %w", err)
+	}
+	destination := make(map[storage.Key]storage.ObjectEntry, len(destinationEntries))
+	for _, e := range destinationEntries {
+		destination[e.Key] = e
+	}
+
+	for _, src := range sourceEntries {
+		report.Compared++
+		dst, ok := destination[src.Key]
+		delete(destination, src.Key)
+		if !ok || dst.Hash != src.Hash {
+			obj, hash, err := s.Source.Read(ctx, src.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read source object: %w", err)
+			}
+			if obj == nil {
+				continue // removed since it was listed
+			}
+			writeCtx, err := storage.WithSourceMetadata(ctx, s.Source, obj)
+			if err != nil {
+				return fmt.Errorf("failed to read source object: %w", err)
+			}
+			if _, err := s.Destination.Write(writeCtx, obj, hash); err != nil {
+				return fmt.Errorf("failed to write destination object: %w", err)
+			}
+			report.Copied++
+			metrics.SyncObjects.WithLabelValues("copied").Inc()
+			// Writing another incarnation archives the destination tombstone along with the old manifest
+			tomb, err := s.Destination.ReadTombstone(ctx, src.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read destination tombstone: %w", err)
+			}
+			dst.Tombstoned = tomb != nil
+		}
+		switch {
+		case src.Tombstoned && !dst.Tombstoned:
+			tomb, err := s.Source.ReadTombstone(ctx, src.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read source tombstone: %w", err)
+			}
+			if tomb == nil {
+				continue
+			}
+			final := tomb.FinalState
+			if final == nil {
+				// Legacy tombstones carry no final state, the stored manifest is the last known one
+				if final, _, err = s.Source.Read(ctx, src.Key); err != nil {
+					return fmt.Errorf("failed to read source object: %w", err)
+				}
+				if final == nil {
+					continue
+				}
+			}
+			final.SetGroupVersionKind(gvk)
+			if err := s.Destination.MarkTombstone(ctx, final, tomb.DeletedAt); err != nil {
+				return fmt.Errorf("failed to write destination tombstone: %w", err)
+			}
+			report.Tombstoned++
+			metrics.SyncObjects.WithLabelValues("tombstoned").Inc()
+		case !src.Tombstoned && dst.Tombstoned:
+			if err := s.Destination.DeleteTombstone(ctx, src.Key); err != nil {
+				return fmt.Errorf("failed to delete destination tombstone: %w", err)
+			}
+			report.Untombstoned++
+			metrics.SyncObjects.WithLabelValues("untombstoned").Inc()
+		}
+	}
+
+	if !s.Prune {
+		return nil
+	}
+	// What is left in the destination is gone from the source, e.g. collected by its GC
+	for _, dst := range destination {
+		if err := s.Destination.Delete(ctx, dst.Key); errors.Is(err, storage.ErrHeld) {
+			report.Held++
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to prune destination object: %w", err)
+		}
+		report.Pruned++
+		metrics.SyncObjects.WithLabelValues("pruned").Inc()
+	}
+	return nil
+}
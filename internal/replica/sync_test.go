@@ -0,0 +1,82 @@
+package replica
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/filesystem"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestReplica(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Replica Suite")
+}
+
+var taskGVK = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+
+func newTask(name, description string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(taskGVK)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetUID(types.UID("uid-" + name))
+	obj.Object["spec"] = map[string]interface{}{"description": description}
+	return obj
+}
+
+var _ = Describe("Syncer", func() {
+	It("copies missing, changed and tombstoned objects one way", func() {
+		ctx := context.Background()
+		hasher := hash.NewDefaultHasher()
+		source := &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		destination := &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		write := func(store *filesystem.FileSystem, obj *unstructured.Unstructured) {
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		write(source, newTask("same", "same"))
+		write(destination, newTask("same", "same"))
+		write(source, newTask("changed", "new"))
+		write(destination, newTask("changed", "old"))
+		write(source, newTask("missing", "new"))
+		deleted := newTask("deleted", "gone")
+		write(source, deleted)
+		write(destination, deleted)
+		Expect(source.MarkTombstone(ctx, deleted, time.Now())).To(Succeed())
+		write(destination, newTask("extra", "only in destination"))
+
+		syncer := NewSyncer(source, destination, time.Minute, true)
+		report, err := syncer.SyncOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Compared).To(Equal(4))
+		Expect(report.Copied).To(Equal(2))
+		Expect(report.Tombstoned).To(Equal(1))
+		Expect(report.Pruned).To(Equal(1))
+
+		obj, _, err := destination.Read(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "changed"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Object["spec"]).To(Equal(map[string]interface{}{"description": "new"}))
+		tomb, err := destination.ReadTombstone(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "deleted"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tomb).NotTo(BeNil())
+		obj, _, err = destination.Read(ctx, storage.Key{GVK: taskGVK, Namespace: "default", Name: "extra"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+
+		// A second pass has nothing left to do
+		report, err = syncer.SyncOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Copied + report.Tombstoned + report.Untombstoned + report.Pruned).To(BeZero())
+	})
+})
@@ -0,0 +1,200 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Selects reports whether selector selects the object stored under key.
+func Selects(selector v1alpha1.ObjectSelector, key storage.Key) bool {
+	if selector.Kind != "" && selector.Kind != key.GVK.Kind {
+		return false
+	}
+	// An empty group is the core group of a kind, but selects every group without one
+	if (selector.Kind != "" || selector.Group != "") && selector.Group != key.GVK.Group {
+		return false
+	}
+	if len(selector.Namespaces) == 0 {
+		return true
+	}
+	for _, namespace := range selector.Namespaces {
+		if namespace == key.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep returns the incarnations of a lineage that rule keeps at now. Incarnations are dated by their
+// last backup, and calendar periods are taken in UTC.
+func Keep(rule v1alpha1.RetentionRule, lineage []storage.Incarnation, now time.Time) map[types.UID]bool {
+	latest := append([]storage.Incarnation(nil), lineage...)
+	sort.SliceStable(latest, func(i, j int) bool { return latest[i].LastBackup.After(latest[j].LastBackup) })
+	kept := map[types.UID]bool{}
+	for i, incarnation := range latest {
+		if i < int(rule.KeepLast) || (rule.KeepWithin != nil && now.Sub(incarnation.LastBackup) <= rule.KeepWithin.Duration) {
+			kept[incarnation.UID] = true
+		}
+	}
+	for _, period := range []struct {
+		keep   int32
+		bucket func(time.Time) string
+	}{
+		{rule.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{rule.KeepWeekly, func(t time.Time) string { year, week := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", year, week) }},
+		{rule.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		last, n := "", int32(0)
+		for _, incarnation := range latest {
+			if n == period.keep {
+				break
+			}
+			// The first incarnation seen in a period is its latest one
+			if bucket := period.bucket(incarnation.LastBackup.UTC()); bucket != last {
+				kept[incarnation.UID] = true
+				last = bucket
+				n++
+			}
+		}
+	}
+	return kept
+}
+
+// Pruned is an archived incarnation removed, or in a dry run that would be removed, by retention.
+type Pruned struct {
+	storage.Key
+	UID        types.UID `json:"uid"`
+	LastBackup time.Time `json:"lastBackup"`
+}
+
+// PruneReport is the result of a pruning pass.
+type PruneReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dryRun,omitempty"`
+	Scanned  int       `json:"scanned"` // Objects selected by a rule
+	Held     int       `json:"held"`    // Incarnations no rule kept that are under hold
+	Pruned   []Pruned  `json:"pruned"`
+}
+
+// Pruner periodically removes the archived incarnations the retention rules of the backup policies do
+// not keep.
+type Pruner struct {
+	Store    storage.Storage
+	Policies func(ctx context.Context) ([]v1alpha1.BackupPolicy, error)
+	Interval time.Duration
+	DryRun   bool // Only report what would be pruned
+}
+
+func NewPruner(store storage.Storage, policies func(ctx context.Context) ([]v1alpha1.BackupPolicy, error),
+	interval time.Duration, dryRun bool) *Pruner {
+	return &Pruner{
+		Store:    store,
+		Policies: policies,
+		Interval: interval,
+		DryRun:   dryRun,
+	}
+}
+
+func (p *Pruner) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("Pruner").WithName("run")
+	logger.Info("Starting retention pruner", "interval", p.Interval, "dryRun", p.DryRun)
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Retention pruner stopped")
+			return
+		case <-ticker.C:
+			if _, err := p.Prune(ctx); err != nil {
+				logger.Error(err, "failed to prune store")
+			}
+		}
+	}
+}
+
+// Prune applies the retention rules to the whole store once. Incarnations under hold, in stores that
+// hold backups, are left in place.
+func (p *Pruner) Prune(ctx context.Context) (PruneReport, error) {
+	logger := log.FromContext(ctx).WithName("Pruner").WithName("prune")
+	report := PruneReport{Started: time.Now().UTC(), DryRun: p.DryRun}
+	policies, err := p.Policies(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list backup policies: %w", err)
+	}
+	var rules []v1alpha1.RetentionRule
+	for _, policy := range policies {
+		rules = append(rules, policy.Spec.Retention...)
+	}
+	if len(rules) == 0 {
+		return report, nil
+	}
+	err = p.Store.Walk(ctx, storage.Filter{}, func(entry storage.ObjectEntry) error {
+		var selecting []v1alpha1.RetentionRule
+		for _, rule := range rules {
+			if Selects(rule.ObjectSelector, entry.Key) {
+				selecting = append(selecting, rule)
+			}
+		}
+		if len(selecting) == 0 {
+			return nil
+		}
+		report.Scanned++
+		lineage, err := p.Store.Lineage(ctx, entry.Key)
+		if err != nil {
+			return fmt.Errorf("failed to read lineage of %s: %w", entry.Key, err)
+		}
+		if len(lineage) < 2 {
+			return nil
+		}
+		kept := map[types.UID]bool{storage.Current(lineage).UID: true}
+		for _, rule := range selecting {
+			for uid := range Keep(rule, lineage, report.Started) {
+				kept[uid] = true
+			}
+		}
+		holder, _ := p.Store.(storage.Holder)
+		for _, incarnation := range lineage {
+			if kept[incarnation.UID] {
+				continue
+			}
+			if holder != nil {
+				held, err := holder.Held(ctx, entry.Key, incarnation.UID)
+				if err != nil {
+					return err
+				}
+				if held {
+					report.Held++
+					continue
+				}
+			}
+			if !p.DryRun {
+				if err := p.Store.DeleteIncarnation(ctx, entry.Key, incarnation.UID); err != nil {
+					return fmt.Errorf("failed to prune incarnation %s of %s: %w", incarnation.UID, entry.Key, err)
+				}
+			}
+			report.Pruned = append(report.Pruned, Pruned{Key: entry.Key, UID: incarnation.UID, LastBackup: incarnation.LastBackup})
+			metrics.RetentionPruned.WithLabelValues(entry.GVK.String(), strconv.FormatBool(p.DryRun)).Inc()
+			logger.Info("Pruned incarnation", "key", entry.Key.String(), "uid", incarnation.UID,
+				"lastBackup", incarnation.LastBackup, "dryRun", p.DryRun)
+		}
+		return nil
+	})
+	report.Finished = time.Now().UTC()
+	if err != nil {
+		return report, err
+	}
+	metrics.RetentionLastCompletion.Set(float64(report.Finished.Unix()))
+	logger.Info("Retention pass complete", "scanned", report.Scanned, "pruned", len(report.Pruned),
+		"held", report.Held, "dryRun", p.DryRun, "duration", report.Finished.Sub(report.Started))
+	return report, nil
+}
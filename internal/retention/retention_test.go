@@ -0,0 +1,127 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/api/v1alpha1"
+	"github.com/bastion/internal/hold"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRetention(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Retention Suite")
+}
+
+// daily returns a lineage with one incarnation backed up at noon on each of the days before now.
+func daily(now time.Time, days int) []storage.Incarnation {
+	var lineage []storage.Incarnation
+	for i := days; i > 0; i-- {
+		lineage = append(lineage, storage.Incarnation{
+			UID:        types.UID(fmt.Sprintf("uid-%d", i)),
+			LastBackup: now.AddDate(0, 0, -i).Truncate(24 * time.Hour).Add(12 * time.Hour),
+		})
+	}
+	return lineage
+}
+
+var _ = Describe("Selects", func() {
+	It("selects by kind within a group, by group alone, and by namespace", func() {
+		key := storagetest.TaskKey("task-a", storagetest.InNamespace("ci"))
+		core := storage.Key{GVK: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, Namespace: "ci", Name: "config"}
+		Expect(Selects(v1alpha1.ObjectSelector{}, key)).To(BeTrue())
+		Expect(Selects(v1alpha1.ObjectSelector{Group: "demo.bastion.io", Kind: "Task"}, key)).To(BeTrue())
+		Expect(Selects(v1alpha1.ObjectSelector{Kind: "Task"}, key)).To(BeFalse())
+		Expect(Selects(v1alpha1.ObjectSelector{Group: "demo.bastion.io"}, key)).To(BeTrue())
+		Expect(Selects(v1alpha1.ObjectSelector{Group: "demo.bastion.io"}, core)).To(BeFalse())
+		Expect(Selects(v1alpha1.ObjectSelector{Kind: "ConfigMap"}, core)).To(BeTrue())
+		Expect(Selects(v1alpha1.ObjectSelector{Namespaces: []string{"prod"}}, key)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Keep", func() {
+	// A Wednesday
+	now := time.Date(2024, 3, 13, 18, 0, 0, 0, time.UTC)
+	lineage := daily(now, 60)
+
+	It("keeps the last N and the recent incarnations", func() {
+		Expect(Keep(v1alpha1.RetentionRule{KeepLast: 2}, lineage, now)).To(HaveLen(2))
+		kept := Keep(v1alpha1.RetentionRule{KeepWithin: &metav1.Duration{Duration: 96 * time.Hour}}, lineage, now)
+		Expect(kept).To(Equal(map[types.UID]bool{"uid-1": true, "uid-2": true, "uid-3": true}))
+	})
+
+	It("keeps the latest incarnation of each calendar period", func() {
+		kept := Keep(v1alpha1.RetentionRule{KeepWeekly: 2, KeepMonthly: 3}, lineage, now)
+		// Tuesday 12th and Sunday 10th end the last two ISO weeks, and the 12th, Feb 29th and Jan 31st
+		// the last three months
+		Expect(kept).To(Equal(map[types.UID]bool{"uid-1": true, "uid-3": true, "uid-13": true, "uid-42": true}))
+	})
+})
+
+var _ = Describe("Pruner", func() {
+	var (
+		ctx   context.Context
+		store *memory.Store
+		key   storage.Key
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = memory.NewStore()
+		key = storagetest.TaskKey("task-a", storagetest.InNamespace("ci"))
+		for i := 1; i <= 4; i++ {
+			_, err := store.Write(ctx, storagetest.NewTask("task-a", fmt.Sprintf("uid-%d", i), "", storagetest.InNamespace("ci")), fmt.Sprintf("h%d", i))
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	prune := func(dryRun bool, rules ...v1alpha1.RetentionRule) PruneReport {
+		policies := []v1alpha1.BackupPolicy{{Spec: v1alpha1.BackupPolicySpec{Retention: rules}}}
+		pruner := NewPruner(store, func(context.Context) ([]v1alpha1.BackupPolicy, error) { return policies, nil }, 0, dryRun)
+		report, err := pruner.Prune(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return report
+	}
+
+	It("removes the archived incarnations no rule keeps, unless it is a dry run", func() {
+		Expect(prune(false, v1alpha1.RetentionRule{ObjectSelector: v1alpha1.ObjectSelector{
+			Kind: "Task", Group: "demo.bastion.io", Namespaces: []string{"prod"}}}).Pruned).To(BeEmpty())
+
+		report := prune(true, v1alpha1.RetentionRule{KeepLast: 1})
+		Expect(report.Pruned).To(HaveLen(3))
+		Expect(store.Lineage(ctx, key)).To(HaveLen(4))
+
+		report = prune(false, v1alpha1.RetentionRule{KeepLast: 2})
+		Expect(report.Pruned).To(HaveLen(2))
+		lineage, err := store.Lineage(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(2))
+		Expect(storage.Current(lineage).UID).To(Equal(types.UID("uid-4")))
+		obj, _, err := store.ReadIncarnation(ctx, key, "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+	})
+
+	It("leaves incarnations under hold in place", func() {
+		pinned := []hold.Tag{{Name: "pin", Object: "task-a", UID: "uid-2", Hold: true}}
+		guard := hold.NewGuard(store, func(context.Context) ([]hold.Tag, error) { return pinned, nil })
+		policies := []v1alpha1.BackupPolicy{{Spec: v1alpha1.BackupPolicySpec{Retention: []v1alpha1.RetentionRule{{KeepLast: 1}}}}}
+		pruner := NewPruner(guard, func(context.Context) ([]v1alpha1.BackupPolicy, error) { return policies, nil }, 0, false)
+		report, err := pruner.Prune(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Pruned).To(HaveLen(2))
+		Expect(report.Held).To(Equal(1))
+		Expect(store.Lineage(ctx, key)).To(HaveLen(2))
+	})
+})
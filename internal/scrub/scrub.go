@@ -0,0 +1,97 @@
+package scrub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+// Scrubber periodically verifies the integrity of the store, recording what it finds in a report
+// file and in metrics.
+type Scrubber struct {
+	Store      storage.Scrubber
+	Hasher     hash.Hasher
+	Interval   time.Duration
+	ReportPath string // File the last report is written to, empty skips writing it
+}
+
+func NewScrubber(store storage.Scrubber, hasher hash.Hasher, interval time.Duration, reportPath string) *Scrubber {
+	return &Scrubber{
+		Store:      store,
+		Hasher:     hasher,
+		Interval:   interval,
+		ReportPath: reportPath,
+	}
+}
+
+func (s *Scrubber) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("Scrubber").WithName("run")
+	logger.Info("Starting scrubber", "interval", s.Interval)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Scrubber stopped")
+			return
+		case <-ticker.C:
+			if _, err := s.Scrub(ctx); err != nil {
+				logger.Error(err, "failed to scrub store")
+			}
+		}
+	}
+}
+
+// Scrub verifies the whole store once.
+func (s *Scrubber) Scrub(ctx context.Context) (storage.ScrubReport, error) {
+	logger := log.FromContext(ctx).WithName("Scrubber").WithName("scrub")
+	started := time.Now().UTC()
+	report, err := s.Store.Scrub(ctx, s.Hasher)
+	if err != nil {
+		return report, fmt.Errorf("failed to scrub store: %w", err)
+	}
+	report.Started = started
+	report.Finished = time.Now().UTC()
+
+	counts := report.Counts()
+	metrics.ScrubProblems.Reset()
+	for problemType, count := range counts {
+		metrics.ScrubProblems.WithLabelValues(string(problemType)).Set(float64(count))
+	}
+	metrics.ScrubScannedObjects.Set(float64(report.Scanned))
+	metrics.ScrubLastCompletion.Set(float64(report.Finished.Unix()))
+	for _, p := range report.Problems {
+		logger.Info("Integrity problem", "type", p.Type, "path", p.Path, "detail", p.Detail)
+	}
+	logger.Info("Scrub complete", "scanned", report.Scanned, "problems", len(report.Problems), "duration", report.Finished.Sub(started))
+
+	if s.ReportPath != "" {
+		if err := writeReport(s.ReportPath, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// writeReport replaces the report file atomically and durably, so readers never see a partial report.
+func writeReport(path string, report storage.ScrubReport) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report dir: %w", err)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	if err := atomicfile.WriteFile(path, data); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
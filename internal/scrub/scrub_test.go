@@ -0,0 +1,94 @@
+package scrub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrub(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Scrub Suite")
+}
+
+// scrubbed is a store whose scrubs find the given report or fail with err.
+type scrubbed struct {
+	report storage.ScrubReport
+	err    error
+}
+
+func (s *scrubbed) Scrub(ctx context.Context, hasher hash.Hasher) (storage.ScrubReport, error) {
+	return s.report, s.err
+}
+
+var _ = Describe("Scrubber", func() {
+	var (
+		ctx        context.Context
+		store      *scrubbed
+		reportPath string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &scrubbed{report: storage.ScrubReport{
+			Scanned: 3,
+			Problems: []storage.ScrubProblem{
+				{Type: storage.ProblemHashMismatch, Path: "a/hash.txt"},
+				{Type: storage.ProblemHashMismatch, Path: "b/hash.txt"},
+				{Type: storage.ProblemOrphanedFile, Path: "c/notes.txt"},
+			},
+		}}
+		reportPath = filepath.Join(GinkgoT().TempDir(), ".bastion", "scrub-report.json")
+	})
+
+	It("counts the problems by type and writes the report", func() {
+		report, err := NewScrubber(store, nil, 0, reportPath).Scrub(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testutil.ToFloat64(metrics.ScrubProblems.WithLabelValues(string(storage.ProblemHashMismatch)))).To(Equal(2.0))
+		Expect(testutil.ToFloat64(metrics.ScrubProblems.WithLabelValues(string(storage.ProblemOrphanedFile)))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.ScrubScannedObjects)).To(Equal(3.0))
+
+		data, err := os.ReadFile(reportPath)
+		Expect(err).NotTo(HaveOccurred())
+		var written storage.ScrubReport
+		Expect(json.Unmarshal(data, &written)).To(Succeed())
+		Expect(written.Problems).To(Equal(report.Problems))
+		Expect(written.Finished).NotTo(BeZero())
+		entries, err := os.ReadDir(filepath.Dir(reportPath))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1), "no temp file is left behind")
+	})
+
+	It("drops the counts of problems that are gone", func() {
+		_, err := NewScrubber(store, nil, 0, reportPath).Scrub(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		store.report.Problems = store.report.Problems[:1]
+		_, err = NewScrubber(store, nil, 0, reportPath).Scrub(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testutil.ToFloat64(metrics.ScrubProblems.WithLabelValues(string(storage.ProblemHashMismatch)))).To(Equal(1.0))
+		Expect(testutil.CollectAndCount(metrics.ScrubProblems)).To(Equal(1))
+	})
+
+	It("keeps the last report when the store cannot be scrubbed", func() {
+		_, err := NewScrubber(store, nil, 0, reportPath).Scrub(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		before, err := os.ReadFile(reportPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		store.err = errors.New("unreadable")
+		_, err = NewScrubber(store, nil, 0, reportPath).Scrub(ctx)
+		Expect(err).To(MatchError(ContainSubstring("unreadable")))
+		Expect(os.ReadFile(reportPath)).To(Equal(before))
+	})
+})
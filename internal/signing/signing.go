@@ -0,0 +1,175 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"time"
+)
+
+// Signature is the record kept next to every signed revision of an object.
+type Signature struct {
+	KeyID     string    `json:"keyID"`
+	Digest    string    `json:"digest"` // SHA-256 of the stored manifest bytes
+	Hash      string    `json:"hash"`   // The object hash stored with the manifest
+	Signature []byte    `json:"signature"`
+	SignedAt  time.Time `json:"signedAt"`
+}
+
+// Signer signs revisions and attestations with an ed25519 private key.
+type Signer struct {
+	Key   ed25519.PrivateKey
+	KeyID string
+}
+
+// Verifier checks signatures made by the Signer of the matching private key.
+type Verifier struct {
+	Key   ed25519.PublicKey
+	KeyID string
+}
+
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{Key: key, KeyID: KeyID(key.Public().(ed25519.PublicKey))}
+}
+
+func NewVerifier(key ed25519.PublicKey) *Verifier {
+	return &Verifier{Key: key, KeyID: KeyID(key)}
+}
+
+// Verifier returns the verifier of the signatures made by s.
+func (s *Signer) Verifier() *Verifier {
+	return NewVerifier(s.Key.Public().(ed25519.PublicKey))
+}
+
+// LoadSigner reads a PEM encoded PKCS #8 ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`.
+func LoadSigner(path string) (*Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is %T, not ed25519", path, key)
+	}
+	return NewSigner(edKey), nil
+}
+
+// LoadVerifier reads a PEM encoded PKIX ed25519 public key, as written by `openssl pkey -pubout`.
+func LoadVerifier(path string) (*Verifier, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in %s is %T, not ed25519", path, key)
+	}
+	return NewVerifier(edKey), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// KeyID identifies a key pair by the first bytes of the digest of its public key.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Digest returns the hex SHA-256 of data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// revisionMessage binds a signature to the object it was made for, so a signed manifest cannot be
+// moved to another path or incarnation without the signature failing.
+func revisionMessage(gvk schema.GroupVersionKind, namespace, name string, uid types.UID, hash, digest string) []byte {
+	return []byte(fmt.Sprintf("bastion.io/revision/v1\n%s\n%s\n%s\n%s\n%s\n%s", gvk.String(), namespace, name, uid, hash, digest))
+}
+
+// SignRevision signs the stored manifest bytes of an object together with its hash.
+func (s *Signer) SignRevision(gvk schema.GroupVersionKind, namespace, name string, uid types.UID, hash string, manifest []byte) *Signature {
+	digest := Digest(manifest)
+	return &Signature{
+		KeyID:     s.KeyID,
+		Digest:    digest,
+		Hash:      hash,
+		Signature: ed25519.Sign(s.Key, revisionMessage(gvk, namespace, name, uid, hash, digest)),
+		SignedAt:  time.Now().UTC(),
+	}
+}
+
+// VerifyRevision checks that sig was made by this key over the given manifest bytes and hash.
+func (v *Verifier) VerifyRevision(sig *Signature, gvk schema.GroupVersionKind, namespace, name string, uid types.UID, hash string, manifest []byte) error {
+	if sig.KeyID != v.KeyID {
+		return fmt.Errorf("signed by key %s, expected %s", sig.KeyID, v.KeyID)
+	}
+	digest := Digest(manifest)
+	if sig.Digest != digest {
+		return fmt.Errorf("manifest digest is %s, signed %s", digest, sig.Digest)
+	}
+	if sig.Hash != hash {
+		return fmt.Errorf("stored hash is %s, signed %s", hash, sig.Hash)
+	}
+	if !ed25519.Verify(v.Key, revisionMessage(gvk, namespace, name, uid, hash, digest), sig.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// tombstoneMessage binds a tombstone signature to the object whose deletion it records.
+func tombstoneMessage(gvk schema.GroupVersionKind, namespace, name string, uid types.UID, digest string) []byte {
+	return []byte(fmt.Sprintf("bastion.io/tombstone/v1\n%s\n%s\n%s\n%s\n%s", gvk.String(), namespace, name, uid, digest))
+}
+
+// SignTombstone signs the stored tombstone bytes of an object, final state included.
+func (s *Signer) SignTombstone(gvk schema.GroupVersionKind, namespace, name string, uid types.UID, tombstone []byte) *Signature {
+	digest := Digest(tombstone)
+	return &Signature{
+		KeyID:     s.KeyID,
+		Digest:    digest,
+		Signature: ed25519.Sign(s.Key, tombstoneMessage(gvk, namespace, name, uid, digest)),
+		SignedAt:  time.Now().UTC(),
+	}
+}
+
+// VerifyTombstone checks that sig was made by this key over the given tombstone bytes.
+func (v *Verifier) VerifyTombstone(sig *Signature, gvk schema.GroupVersionKind, namespace, name string, uid types.UID, tombstone []byte) error {
+	if sig.KeyID != v.KeyID {
+		return fmt.Errorf("signed by key %s, expected %s", sig.KeyID, v.KeyID)
+	}
+	digest := Digest(tombstone)
+	if sig.Digest != digest {
+		return fmt.Errorf("tombstone digest is %s, signed %s", digest, sig.Digest)
+	}
+	if !ed25519.Verify(v.Key, tombstoneMessage(gvk, namespace, name, uid, digest), sig.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSigning(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Signing Suite")
+}
+
+var _ = Describe("Signing", func() {
+	var (
+		signer   *Signer
+		verifier *Verifier
+		gvk      = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+	)
+
+	BeforeEach(func() {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		signer = NewSigner(private)
+		verifier = NewVerifier(public)
+	})
+
+	It("binds a revision signature to the manifest, hash and object", func() {
+		manifest := []byte(`{"kind":"Task"}`)
+		sig := signer.SignRevision(gvk, "default", "task-a", "uid-1", "h1", manifest)
+		Expect(verifier.VerifyRevision(sig, gvk, "default", "task-a", "uid-1", "h1", manifest)).To(Succeed())
+
+		Expect(verifier.VerifyRevision(sig, gvk, "default", "task-a", "uid-1", "h1", []byte(`{"kind":"Other"}`))).NotTo(Succeed())
+		Expect(verifier.VerifyRevision(sig, gvk, "default", "task-a", "uid-1", "h2", manifest)).NotTo(Succeed())
+		Expect(verifier.VerifyRevision(sig, gvk, "default", "task-b", "uid-1", "h1", manifest)).NotTo(Succeed())
+	})
+
+	It("binds a tombstone signature to the tombstone and object", func() {
+		tombstone := []byte(`{"uid":"uid-1","finalState":{"kind":"Task"}}`)
+		sig := signer.SignTombstone(gvk, "default", "task-a", "uid-1", tombstone)
+		Expect(signer.Verifier().VerifyTombstone(sig, gvk, "default", "task-a", "uid-1", tombstone)).To(Succeed())
+
+		Expect(verifier.VerifyTombstone(sig, gvk, "default", "task-a", "uid-1", []byte(`{"uid":"uid-1"}`))).NotTo(Succeed())
+		Expect(verifier.VerifyTombstone(sig, gvk, "default", "task-a", "uid-2", tombstone)).NotTo(Succeed())
+		// Nor does it pass for a revision
+		Expect(verifier.VerifyRevision(sig, gvk, "default", "task-a", "uid-1", "", tombstone)).NotTo(Succeed())
+	})
+
+	It("attests to the exact set of leaves", func() {
+		leaves := []Leaf{{Key: "a", Hash: "h1"}, {Key: "b", Hash: "h2"}, {Key: "c", Hash: "h3"}}
+		attestation := signer.Attest(leaves)
+		reordered := []Leaf{leaves[2], leaves[0], leaves[1]}
+		Expect(verifier.VerifyAttestation(attestation, reordered)).To(Succeed())
+
+		Expect(verifier.VerifyAttestation(attestation, leaves[:2])).NotTo(Succeed())
+		changed := []Leaf{{Key: "a", Hash: "h1"}, {Key: "b", Hash: "tampered"}, {Key: "c", Hash: "h3"}}
+		Expect(verifier.VerifyAttestation(attestation, changed)).NotTo(Succeed())
+	})
+})
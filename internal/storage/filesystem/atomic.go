@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// pendingFile marks an object directory whose files are being replaced. It is created before the
+	// first file changes and removed once all of them are committed, so recovery knows what to check.
+	pendingFile = ".pending"
+	// tempInfix is part of the name of every temp file, e.g. .manifest.yaml.tmp-123456.
+	tempInfix = atomicfile.TempInfix
+)
+
+// mkdirAllSync creates dir and its missing parents like os.MkdirAll, then syncs the parent of every
+// directory it created, up to and including base, so a crash cannot lose a new entry whose files were
+// synced.
+func mkdirAllSync(dir, base string) error {
+	var created []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		created = append(created, d)
+		if d == filepath.Clean(base) || filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := atomicfile.SyncDir(filepath.Dir(created[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beginWrite marks dir as being written until endWrite is called.
+func beginWrite(dir string) error {
+	if err := os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644); err != nil {
+		return fmt.Errorf("failed to mark pending write: %w", err)
+	}
+	return atomicfile.SyncDir(dir)
+}
+
+// endWrite clears the mark set by beginWrite once every file of dir is committed.
+func endWrite(dir string) error {
+	if err := os.Remove(filepath.Join(dir, pendingFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear pending write: %w", err)
+	}
+	return atomicfile.SyncDir(dir)
+}
+
+// isPending reports whether dir, an object directory or an archived incarnation in one, is marked by
+// beginWrite. Archiving writes to the object directory, so its mark covers the incarnations too.
+func isPending(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, pendingFile)); err == nil {
+		return true
+	}
+	if parent := filepath.Dir(dir); filepath.Base(parent) == incarnationsDir {
+		_, err := os.Stat(filepath.Join(filepath.Dir(parent), pendingFile))
+		return err == nil
+	}
+	return false
+}
+
+// isTempFile reports whether name is a temp file left by atomicfile.WriteFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempInfix)
+}
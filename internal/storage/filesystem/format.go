@@ -0,0 +1,438 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// formatFile describes the layout of the store and sits directly in the base dir.
+	formatFile = "format.json"
+	formatName = "bastion.io/filesystem"
+	// FormatVersion is the layout version written and read by this build.
+	FormatVersion = 1
+)
+
+// Format is the descriptor of the on-disk layout of a store.
+type Format struct {
+	Name     string         `json:"format"`
+	Version  int            `json:"version"`
+	Layout   Layout         `json:"layout,omitempty"` // Flat unless set
+	ID       string         `json:"id,omitempty"`     // Identity of the store, set on first use
+	Upgrades []FormatChange `json:"upgrades,omitempty"`
+}
+
+// FormatChange records an upgrade applied to a store.
+type FormatChange struct {
+	From int       `json:"from"`
+	To   int       `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// upgrader moves a store from one layout version to the next. Upgraders must be idempotent, since an
+// interrupted upgrade runs its current step again.
+type upgrader struct {
+	from        int
+	description string
+	run         func(ctx context.Context, w *FileSystem) error
+}
+
+// upgraders are applied in order, each moving the store one version forward.
+var upgraders = []upgrader{
+	{from: 0, description: "record tombstones with their final state, seed lineage indexes and lay out objects by encoded key segments", run: upgradeV0},
+}
+
+// ReadFormat returns the format of the store. A store without descriptor is at version 0 if it holds
+// backups in the layout written before it was versioned, or at the current version and in the layout
+// configured for new stores otherwise, e.g. if it is empty or the base dir holds unrelated directories.
+func (w *FileSystem) ReadFormat(ctx context.Context) (*Format, error) {
+	data, err := os.ReadFile(filepath.Join(w.BaseDir, formatFile))
+	if err == nil {
+		format := &Format{}
+		if err := json.Unmarshal(data, format); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal format: %w", err)
+		}
+		return format, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read format: %w", err)
+	}
+	legacy, err := holdsBackups(ctx, w.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return &Format{Name: formatName, Version: 0}, nil
+	}
+	layout, err := ParseLayout(string(w.Layout))
+	if err != nil {
+		return nil, err
+	}
+	return &Format{Name: formatName, Version: FormatVersion, Layout: layout}, nil
+}
+
+// CheckFormat fails unless this build can read the store as it is, and adopts the layout of the store.
+func (w *FileSystem) CheckFormat(ctx context.Context) (*Format, error) {
+	format, err := w.ReadFormat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if format.Name != formatName {
+		return format, fmt.Errorf("store %s has unknown format %q", w.BaseDir, format.Name)
+	}
+	if format.Version > FormatVersion {
+		return format, fmt.Errorf("store %s has format version %d, this build supports up to %d", w.BaseDir, format.Version, FormatVersion)
+	}
+	layout, err := ParseLayout(string(format.Layout))
+	if err != nil {
+		return format, fmt.Errorf("store %s: %w", w.BaseDir, err)
+	}
+	format.Layout = layout
+	w.Layout = layout
+	return format, nil
+}
+
+// Upgrade moves the store to the current format version step by step, recording each step in the
+// descriptor as soon as it completes. Stores in an unknown format are left untouched.
+func (w *FileSystem) Upgrade(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("FileSystem").WithName("upgrade")
+	configured := w.Layout
+	format, err := w.CheckFormat(ctx)
+	if err != nil {
+		return err
+	}
+	if configured != "" && configured != format.Layout {
+		logger.Info("Keeping the layout of the existing store, migrate it to change the layout", "dir", w.BaseDir, "layout", format.Layout, "configured", configured)
+	}
+	for _, u := range upgraders {
+		if u.from != format.Version {
+			continue
+		}
+		logger.Info("Upgrading store format", "dir", w.BaseDir, "from", u.from, "to", u.from+1, "step", u.description)
+		if err := u.run(ctx, w); err != nil {
+			return fmt.Errorf("failed to upgrade format from version %d: %w", u.from, err)
+		}
+		format.Upgrades = append(format.Upgrades, FormatChange{From: u.from, To: u.from + 1, At: time.Now().UTC()})
+		format.Version = u.from + 1
+		if err := w.writeFormat(format); err != nil {
+			return err
+		}
+	}
+	if format.Version != FormatVersion {
+		return fmt.Errorf("no upgrade path from format version %d to %d", format.Version, FormatVersion)
+	}
+	// Stores created empty get their descriptor on first start
+	if _, err := os.Stat(filepath.Join(w.BaseDir, formatFile)); os.IsNotExist(err) {
+		return w.writeFormat(format)
+	}
+	return nil
+}
+
+// ID returns the identity of the store, recording a new one in the descriptor of stores that have none.
+// Stores are only identified once at the current format version.
+func (w *FileSystem) ID(ctx context.Context) (string, error) {
+	w.formatMu.Lock()
+	defer w.formatMu.Unlock()
+	format, err := w.CheckFormat(ctx)
+	if err != nil {
+		return "", err
+	}
+	if format.ID != "" {
+		return format.ID, nil
+	}
+	if format.Version != FormatVersion {
+		return "", fmt.Errorf("store %s must be upgraded from format version %d before it is identified", w.BaseDir, format.Version)
+	}
+	format.ID = string(uuid.NewUUID())
+	if err := w.writeFormat(format); err != nil {
+		return "", err
+	}
+	return format.ID, nil
+}
+
+func (w *FileSystem) writeFormat(format *Format) error {
+	if err := mkdirAllSync(w.BaseDir, w.BaseDir); err != nil {
+		return fmt.Errorf("failed to create base dir: %w", err)
+	}
+	data, err := json.MarshalIndent(format, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal format: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(w.BaseDir, formatFile), data); err != nil {
+		return fmt.Errorf("failed to write format: %w", err)
+	}
+	return nil
+}
+
+// holdsBackups reports whether base holds an object directory of the layouts before version 1, a
+// group/version/kind/[namespace/]name directory whose manifest names a Kubernetes object, where the group
+// is left out for core kinds. Directories nested deeper than that are not looked into.
+func holdsBackups(ctx context.Context, base string) (bool, error) {
+	base = filepath.Clean(base)
+	found := false
+	err := filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if path == base && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if path != base && os.IsPermission(err) {
+				return filepath.SkipDir // unrelated directories of a shared base dir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() || path == base {
+			return nil
+		}
+		if d.Name() == internalDir && filepath.Dir(path) == base {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		depth := len(strings.Split(rel, string(os.PathSeparator)))
+		if depth >= 3 {
+			if _, ok := manifestKey(path); ok {
+				found = true
+				return filepath.SkipAll
+			}
+		}
+		if depth >= 5 {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read base dir: %w", err)
+	}
+	return found, nil
+}
+
+// upgradeV0 rewrites the empty tombstone markers of version 0 as tombstone records holding the final
+// state, dated by the marker modification time, starts the lineage index of every backup and then moves
+// the objects to encoded key segments.
+func upgradeV0(ctx context.Context, w *FileSystem) error {
+	if err := recordTombstones(ctx, w); err != nil {
+		return err
+	}
+	return encodeKeys(ctx, w)
+}
+
+// recordTombstones rewrites the empty tombstone markers in the raw layout of version 0 and seeds the
+// lineage indexes. Entries already moved by an interrupted upgrade have theirs rewritten already.
+func recordTombstones(ctx context.Context, w *FileSystem) error {
+	return w.walkLayout(ctx, parseLegacyEntryDir, func(dir, _ string, key storage.Key) error {
+		data, err := os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+		if err != nil {
+			return nil // left for scrub to report
+		}
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(data, &obj.Object); err != nil {
+			return nil
+		}
+		obj.SetGroupVersionKind(key.GVK)
+		if obj.GetUID() != "" {
+			if err := seedLineage(dir, obj.GetUID()); err != nil {
+				return err
+			}
+		}
+		tombstonePath := filepath.Join(dir, "tombstone")
+		info, err := os.Stat(tombstonePath)
+		if err != nil || info.Size() > 0 {
+			return nil
+		}
+		deletedAt := info.ModTime().UTC()
+		tomb, err := json.MarshalIndent(storage.NewTombstone(obj, deletedAt), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal tombstone: %w", err)
+		}
+		if err := atomicfile.WriteFile(tombstonePath, tomb); err != nil {
+			return fmt.Errorf("failed to write tombstone: %w", err)
+		}
+		return recordDeletion(dir, obj.GetUID(), &deletedAt)
+	})
+}
+
+// encodeKeys moves every object from the raw paths of version 0 to encoded key segments. Objects are
+// keyed by their manifest where it can be read, as version 0 dropped the empty group of core kinds from
+// the path, and by their path otherwise. Entries are moved file by file, deepest first and the manifest
+// last, because a cluster-scoped object of version 0 may share its directory with a namespace of the
+// same name, and an interrupted move must still find the manifest on the next run. Only the directories
+// the moves left empty are removed.
+func encodeKeys(ctx context.Context, w *FileSystem) error {
+	type move struct {
+		dir   string
+		depth int
+		key   storage.Key
+	}
+	var moves []move
+	base := filepath.Clean(w.BaseDir)
+	err := filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == base {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() || path == base {
+			return nil
+		}
+		if d.Name() == internalDir && filepath.Dir(path) == base {
+			return filepath.SkipDir
+		}
+		if d.Name() == incarnationsDir && isEntryDir(filepath.Dir(path)) {
+			return filepath.SkipDir // moved along with their object
+		}
+		if !isEntryDir(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(os.PathSeparator))
+		if _, err := storage.ParseSegments(parts); err == nil {
+			return nil // already in place
+		}
+		key, ok := manifestKey(path)
+		if !ok {
+			if key, err = parseLegacyEntryDir(rel); err != nil {
+				return nil // left for scrub to report
+			}
+		}
+		moves = append(moves, move{dir: path, depth: len(parts), key: key})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(moves, func(i, j int) bool { return moves[i].depth > moves[j].depth })
+	for _, m := range moves {
+		if err := moveEntry(m.dir, w.objectDir(m.key), base); err != nil {
+			return fmt.Errorf("failed to move %s: %w", m.key, err)
+		}
+	}
+	for _, m := range moves {
+		if err := removeEmptyParents(m.dir, base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEntryDir reports whether dir holds the files of an object.
+func isEntryDir(dir string) bool {
+	for _, file := range []string{"manifest.yaml", "hash.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestKey returns the key named by the manifest in dir, if it can be read.
+func manifestKey(dir string) (storage.Key, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		return storage.Key{}, false
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		return storage.Key{}, false
+	}
+	key := storage.KeyOf(obj)
+	if key.GVK.Version == "" || key.GVK.Kind == "" || key.Name == "" {
+		return storage.Key{}, false
+	}
+	return key, true
+}
+
+// moveEntry moves the files and archived incarnations of an object from dir to target, below base.
+func moveEntry(dir, target, base string) error {
+	if dir == target {
+		return nil
+	}
+	if err := mkdirAllSync(target, base); err != nil {
+		return fmt.Errorf("failed to create dir: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read dir: %w", err)
+	}
+	var names []string
+	for _, f := range files {
+		if f.Name() == "manifest.yaml" {
+			continue
+		}
+		if (f.IsDir() && f.Name() == incarnationsDir) || (!f.IsDir() && entryFiles[f.Name()]) {
+			names = append(names, f.Name())
+		}
+	}
+	names = append(names, "manifest.yaml")
+	for _, name := range names {
+		err := os.Rename(filepath.Join(dir, name), filepath.Join(target, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return atomicfile.SyncDir(target)
+}
+
+// removeEmptyParents removes dir and its parents below base as long as they are empty, so a moved entry
+// leaves none of its directories behind while anything else in them is kept.
+func removeEmptyParents(dir, base string) error {
+	for ; dir != base && strings.HasPrefix(dir, base+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue // removed along with a deeper entry
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dir: %w", err)
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		if err := os.Remove(dir); err != nil {
+			return fmt.Errorf("failed to remove dir: %w", err)
+		}
+		if err := atomicfile.SyncDir(filepath.Dir(dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLegacyEntryDir maps an object directory of the layout of version 0 to the object it holds.
+// Namespaced objects lived at group/version/kind/namespace/name and cluster-scoped ones at
+// group/version/kind/name, in raw segments.
+func parseLegacyEntryDir(rel string) (storage.Key, error) {
+	parts := strings.Split(rel, string(os.PathSeparator))
+	if n := len(parts); n >= 6 && parts[n-2] == incarnationsDir {
+		parts = parts[:n-2]
+	}
+	switch len(parts) {
+	case 4:
+		return storage.Key{GVK: schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}, Name: parts[3]}, nil
+	case 5:
+		return storage.Key{GVK: schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}, Namespace: parts[3], Name: parts[4]}, nil
+	}
+	return storage.Key{}, fmt.Errorf("expected group/version/kind/[namespace/]name, got %d path segments", len(parts))
+}
@@ -4,18 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/signing"
 	"github.com/bastion/internal/storage"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 )
 
 // FileSystem writes backup data to the local filesystem default storage implementation
 type FileSystem struct {
 	BaseDir string
+	Signer  *signing.Signer // Signs every written revision when set
+	Layout  Layout          // Layout of a new store, existing stores keep the one they were created with
+
+	formatMu sync.Mutex // Serializes identifying the store
 }
 
 // writerCache holds cached writers and synchronization
@@ -39,11 +45,11 @@ func NewFileSystemBasedBackup(baseDir string) *FileSystem {
 	return w
 }
 
-// Write stores manifest and hash.txt for the given object.
+// Write stores manifest, hash.txt and the metadata of the capture for the given object.
+// Writing an object whose UID differs from the stored one archives the previous incarnation first.
 func (w *FileSystem) Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (bool, error) {
-	gvk := obj.GroupVersionKind()
-	dir := filepath.Join(w.BaseDir, gvk.Group, gvk.Version, gvk.Kind, obj.GetNamespace(), obj.GetName())
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	dir := w.objectDir(storage.KeyOf(obj))
+	if err := mkdirAllSync(dir, w.BaseDir); err != nil {
 		return false, fmt.Errorf("failed to create backup dir: %w", err)
 	}
 	hashPath := filepath.Join(dir, "hash.txt")
@@ -52,23 +58,55 @@ func (w *FileSystem) Write(ctx context.Context, obj *unstructured.Unstructured,
 	if string(oldHash) == hash {
 		return false, nil // no change
 	}
-	if err := os.WriteFile(hashPath, []byte(hash), 0644); err != nil {
-		return false, fmt.Errorf("failed to write hash: %w", err)
-	}
 	data, err := json.MarshalIndent(obj.Object, "", "  ")
 	if err != nil {
 		return false, fmt.Errorf("failed to marshal object: %w", err)
 	}
 
-	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+	if err := beginWrite(dir); err != nil {
+		return false, err
+	}
+	if err := archiveIncarnation(dir, obj.GetUID()); err != nil {
+		return false, err
+	}
+	// The manifest is committed before its hash: a crash in between leaves a stale hash, which only
+	// causes the next event to write again, never one that hides an outdated manifest.
+	if err := atomicfile.WriteFile(manifestPath, data); err != nil {
 		return false, fmt.Errorf("failed to write manifest: %w", err)
 	}
-	return true, nil
+	if err := writeLabels(dir, obj.GetLabels()); err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	if err := writeMetadata(dir, storage.NewMetadata(ctx, obj, now)); err != nil {
+		return false, err
+	}
+	if err := atomicfile.WriteFile(hashPath, []byte(hash)); err != nil {
+		return true, fmt.Errorf("failed to write hash: %w", err)
+	}
+	if w.Signer != nil {
+		if err := w.sign(dir, obj, hash, data); err != nil {
+			return true, err
+		}
+	}
+	if err := recordBackup(dir, obj.GetUID(), now); err != nil {
+		return true, err
+	}
+	if w.sharded() {
+		if err := w.indexObject(storage.KeyOf(obj)); err != nil {
+			return true, err
+		}
+	}
+	return true, endWrite(dir)
 }
 
 // Read loads a CR's manifest and hash from the filesystem.
-func (w *FileSystem) Read(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) (*unstructured.Unstructured, string, error) {
-	dir := filepath.Join(w.BaseDir, gvk.Group, gvk.Version, gvk.Kind, namespace, name)
+func (w *FileSystem) Read(ctx context.Context, key storage.Key) (*unstructured.Unstructured, string, error) {
+	return readManifestDir(w.objectDir(key), key.GVK)
+}
+
+// readManifestDir loads the manifest and hash stored in dir, or nil if there are none.
+func readManifestDir(dir string, gvk schema.GroupVersionKind) (*unstructured.Unstructured, string, error) {
 	hashPath := filepath.Join(dir, "hash.txt")
 	manifestPath := filepath.Join(dir, "manifest.yaml")
 	hashBytes, err := os.ReadFile(hashPath)
@@ -93,86 +131,225 @@ func (w *FileSystem) Read(ctx context.Context, gvk schema.GroupVersionKind, name
 	return obj, string(hashBytes), nil
 }
 
-func (w *FileSystem) Delete(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error {
-	dir := filepath.Join(w.BaseDir, gvk.Group, gvk.Version, gvk.Kind, namespace, name)
+func (w *FileSystem) Delete(ctx context.Context, key storage.Key) error {
+	dir := w.objectDir(key)
+	if _, err := os.Stat(dir); err == nil && w.sharded() {
+		// The entry stays marked until it is gone, so recovery indexes it again if the removal is cut short
+		if err := beginWrite(dir); err != nil {
+			return err
+		}
+		if err := w.updateIndex(key, func(index shardIndex, name string) { delete(index, name) }); err != nil {
+			return err
+		}
+	}
 	writerMu.Lock()
 	defer writerMu.Unlock()
 	delete(writerCache, w.BaseDir)
 	return os.RemoveAll(dir)
 }
 
-func (w *FileSystem) MarkTombstone(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error {
-	orig := filepath.Join(w.BaseDir, gvk.Group, gvk.Version, gvk.Kind, namespace, name)
-	tomb := filepath.Join(w.BaseDir, gvk.Group, gvk.Version, gvk.Kind, namespace, name, "tombstone")
+// MarkTombstone writes the tombstone record, including the object's final state, next to its manifest.
+func (w *FileSystem) MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error {
+	key := storage.KeyOf(obj)
+	orig := w.objectDir(key)
 	// Check if original path exists
 	if _, err := os.Stat(orig); os.IsNotExist(err) {
 		return fmt.Errorf("cannot mark tombstone: original path does not exist: %s", orig)
 	}
-	_, err := os.Create(tomb)
+	data, err := json.MarshalIndent(storage.NewTombstone(obj, deletedAt), "", "  ")
 	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone: %w", err)
+	}
+	// The entry stays marked until the tombstone is signed, so attestation does not take it for unsigned
+	if err := beginWrite(orig); err != nil {
 		return err
 	}
-	return nil
+	if err := atomicfile.WriteFile(w.TombstonePath(key), data); err != nil {
+		return fmt.Errorf("failed to write tombstone: %w", err)
+	}
+	if w.Signer != nil {
+		if err := w.signTombstone(orig, obj, data); err != nil {
+			return err
+		}
+	}
+	deletedAt = deletedAt.UTC()
+	if err := recordDeletion(orig, obj.GetUID(), &deletedAt); err != nil {
+		return err
+	}
+	return w.endIndexedWrite(key)
+}
+
+// endIndexedWrite indexes the tombstone change in a sharded store and clears the pending mark set for it.
+func (w *FileSystem) endIndexedWrite(key storage.Key) error {
+	if w.sharded() {
+		if err := w.indexObject(key); err != nil {
+			return err
+		}
+	}
+	return endWrite(w.objectDir(key))
+}
+
+// ReadTombstone loads the tombstone record of an object, or returns nil if it has none.
+func (w *FileSystem) ReadTombstone(ctx context.Context, key storage.Key) (*storage.Tombstone, error) {
+	path := w.TombstonePath(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to stat tombstone: %w", err)
+	}
+	return w.readTombstoneFile(path, info)
+}
+
+func (w *FileSystem) readTombstoneFile(path string, info os.FileInfo) (*storage.Tombstone, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tombstone: %w", err)
+	}
+	// Tombstones written by older versions are empty marker files.
+	if len(data) == 0 {
+		return &storage.Tombstone{DeletedAt: info.ModTime()}, nil
+	}
+	tomb := &storage.Tombstone{}
+	if err := json.Unmarshal(data, tomb); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %w", err)
+	}
+	return tomb, nil
 }
 
+// ListTombstones returns the tombstones of every kind in the store.
 func (w *FileSystem) ListTombstones(ctx context.Context) ([]storage.TombstoneEntry, error) {
+	kinds, err := w.Kinds(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var entries []storage.TombstoneEntry
-	err := filepath.Walk(w.BaseDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info == nil {
-			return nil
-		}
-		if info.IsDir() {
-			return nil
+	for _, gvk := range kinds {
+		objects, err := w.List(ctx, gvk)
+		if err != nil {
+			return nil, err
 		}
-		if strings.HasSuffix(path, "tombstone") {
-			gvk, namespace, name, parseErr := w.parsePathFromFilePath(path, w.BaseDir)
-			if parseErr != nil {
-				return nil // skip bad entries
+		for _, obj := range objects {
+			if !obj.Tombstoned {
+				continue
+			}
+			path := w.TombstonePath(obj.Key)
+			info, err := os.Stat(path)
+			if err != nil {
+				continue // removed since it was listed
+			}
+			tomb, err := w.readTombstoneFile(path, info)
+			if err != nil {
+				continue // skip bad entries, reported by Scrub
 			}
 			entries = append(entries, storage.TombstoneEntry{
-				GVK:       gvk,
-				Namespace: namespace,
-				Name:      name,
+				Key:       obj.Key,
+				UID:       tomb.UID,
+				DeletedAt: tomb.DeletedAt,
 				ModTime:   info.ModTime(),
 			})
 		}
-		return nil
-	})
-	return entries, err
+	}
+	return entries, nil
 }
 
-func (w *FileSystem) TombstonePath(gvk schema.GroupVersionKind, namespace, name string) string {
-	return filepath.Join(
-		w.BaseDir,
-		gvk.Group,
-		gvk.Version,
-		gvk.Kind,
-		namespace,
-		name,
-		"tombstone",
-	)
+// Kinds reads the group, version and kind directories below the base dir. Directories that are not
+// encoded key segments, such as the internal state dir, are skipped.
+func (w *FileSystem) Kinds(ctx context.Context) ([]schema.GroupVersionKind, error) {
+	var kinds []schema.GroupVersionKind
+	groups, err := readSegments(w.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		versions, err := readSegments(filepath.Join(w.BaseDir, group.encoded))
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			names, err := readSegments(filepath.Join(w.BaseDir, group.encoded, version.encoded))
+			if err != nil {
+				return nil, err
+			}
+			for _, kind := range names {
+				kinds = append(kinds, schema.GroupVersionKind{Group: group.decoded, Version: version.decoded, Kind: kind.decoded})
+			}
+		}
+	}
+	return kinds, nil
 }
 
-func (w *FileSystem) DeleteTombstone(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error {
-	tombstonePath := w.TombstonePath(gvk, namespace, name)
-	return os.Remove(tombstonePath)
+// segment is a directory name along with the key segment it encodes.
+type segment struct {
+	encoded string
+	decoded string
 }
 
-func (w *FileSystem) parsePathFromFilePath(path string, baseDir string) (schema.GroupVersionKind, string, string, error) {
-	relPath, err := filepath.Rel(baseDir, filepath.Dir(path))
+// readSegments returns the directories in dir that are encoded key segments, or none if dir does not
+// exist.
+func readSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return schema.GroupVersionKind{}, "", "", err
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read dir: %w", err)
 	}
-	parts := strings.Split(relPath, string(os.PathSeparator))
-	if len(parts) < 5 {
-		return schema.GroupVersionKind{}, "", "", fmt.Errorf("invalid path format")
+	var segments []segment
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		decoded, err := storage.DecodeSegment(e.Name())
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{encoded: e.Name(), decoded: decoded})
 	}
-	gvk := schema.GroupVersionKind{
-		Group:   parts[0],
-		Version: parts[1],
-		Kind:    parts[2],
+	return segments, nil
+}
+
+// List reads the objects stored for a GVK. Every object sits at kind/namespace/name, cluster-scoped
+// ones in the namespace directory of the empty namespace. Sharded stores are listed from their indexes.
+func (w *FileSystem) List(ctx context.Context, gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	return w.listKind(gvk)
+}
+
+func (w *FileSystem) TombstonePath(key storage.Key) string {
+	return filepath.Join(w.objectDir(key), "tombstone")
+}
+
+func (w *FileSystem) DeleteTombstone(ctx context.Context, key storage.Key) error {
+	tombstonePath := w.TombstonePath(key)
+	if _, err := os.Stat(tombstonePath); err != nil {
+		return err
+	}
+	if err := beginWrite(w.objectDir(key)); err != nil {
+		return err
+	}
+	if err := os.Remove(tombstonePath); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(w.objectDir(key), tombstoneSignatureFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tombstone signature: %w", err)
+	}
+	if err := atomicfile.SyncDir(filepath.Dir(tombstonePath)); err != nil {
+		return fmt.Errorf("failed to sync tombstone removal: %w", err)
+	}
+	if err := recordDeletion(w.objectDir(key), "", nil); err != nil {
+		return err
+	}
+	return w.endIndexedWrite(key)
+}
+
+// objectDir returns the directory holding the backup of an object, one encoded key segment per level,
+// with the shard of the name in between namespace and name in sharded stores.
+func (w *FileSystem) objectDir(key storage.Key) string {
+	segments := key.Segments()
+	if w.sharded() {
+		name := segments[4]
+		segments = append(segments[:4], shardOf(key.Name), name)
 	}
-	namespace := parts[3]
-	name := parts[4]
-	return gvk, namespace, name, nil
+	return filepath.Join(append([]string{w.BaseDir}, segments...)...)
 }
@@ -0,0 +1,88 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+)
+
+// benchObjects is the number of objects the layout benchmarks store in a single namespace, e.g.
+// go test ./internal/storage/filesystem -run '^$' -bench Layouts -bench-objects 1000000 -timeout 4h
+var benchObjects = flag.Int("bench-objects", 10000, "objects stored in one namespace by the layout benchmarks")
+
+// BenchmarkLayouts compares the flat and sharded layouts on a namespace holding -bench-objects objects,
+// one in a hundred of them tombstoned.
+func BenchmarkLayouts(b *testing.B) {
+	for _, layout := range []Layout{LayoutFlat, LayoutSharded} {
+		store := &FileSystem{BaseDir: b.TempDir(), Layout: layout}
+		populate(b, store, *benchObjects)
+		gvk := storagetest.NewTask("", "", "Sample Task").GroupVersionKind()
+		ctx := context.Background()
+
+		b.Run(fmt.Sprintf("%s/ListTombstones", layout), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tombstones, err := store.ListTombstones(ctx)
+				if err != nil || len(tombstones) != *benchObjects/100 {
+					b.Fatalf("listed %d tombstones: %v", len(tombstones), err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%s/List", layout), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := store.List(ctx, gvk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%s/Read", layout), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				key := storage.KeyOf(storagetest.NewTask(fmt.Sprintf("task-%07d", i*7919%*benchObjects), "", "Sample Task"))
+				if obj, _, err := store.Read(ctx, key); err != nil || obj == nil {
+					b.Fatalf("failed to read %s: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+// populate lays out n objects the way Write does, without syncing every file, so that a million
+// objects can be set up in minutes. Shard indexes are built by a first listing.
+func populate(b *testing.B, store *FileSystem, n int) {
+	b.Helper()
+	start := time.Now()
+	manifest, err := json.Marshal(storagetest.NewTask("task", "uid", "Sample Task").Object)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tomb, err := json.Marshal(storage.NewTombstone(storagetest.NewTask("task", "uid", "Sample Task"), time.Now()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		dir := store.objectDir(storage.KeyOf(storagetest.NewTask(fmt.Sprintf("task-%07d", i), "", "Sample Task")))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		files := map[string][]byte{"manifest.yaml": manifest, "hash.txt": []byte("h1")}
+		if i%100 == 0 {
+			files["tombstone"] = tomb
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if _, err := store.List(context.Background(), storagetest.NewTask("", "", "Sample Task").GroupVersionKind()); err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("stored %d objects in the %s layout in %s", n, store.Layout, time.Since(start).Round(time.Second))
+}
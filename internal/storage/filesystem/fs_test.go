@@ -0,0 +1,562 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/signing"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestFileSystem(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FileSystem Storage Suite")
+}
+
+var (
+	_ = storagetest.DescribeStorage("FileSystem", func() storage.Storage {
+		return &FileSystem{BaseDir: GinkgoT().TempDir()}
+	})
+	_ = storagetest.DescribeStorage("Sharded FileSystem", func() storage.Storage {
+		store := &FileSystem{BaseDir: GinkgoT().TempDir(), Layout: LayoutSharded}
+		Expect(store.Upgrade(context.Background())).To(Succeed())
+		return store
+	})
+)
+
+var _ = Describe("Tombstones", func() {
+	var (
+		ctx   context.Context
+		store *FileSystem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &FileSystem{BaseDir: GinkgoT().TempDir()}
+	})
+
+	It("reads legacy empty tombstone markers", func() {
+		obj := storagetest.NewTask("task-c", "uid-3", "Sample Task")
+		_, err := store.Write(ctx, obj, "h1")
+		Expect(err).NotTo(HaveOccurred())
+		path := store.TombstonePath(storage.Key{GVK: obj.GroupVersionKind(), Namespace: "default", Name: "task-c"})
+		Expect(os.WriteFile(path, nil, 0644)).To(Succeed())
+
+		tomb, err := store.ReadTombstone(ctx, storage.Key{GVK: obj.GroupVersionKind(), Namespace: "default", Name: "task-c"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tomb.UID).To(BeEmpty())
+		Expect(tomb.Resurrects(storagetest.NewTask("task-c", "any", "Sample Task"))).To(BeTrue())
+	})
+})
+
+var _ = Describe("Sharding", func() {
+	var (
+		ctx   context.Context
+		store *FileSystem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &FileSystem{BaseDir: GinkgoT().TempDir(), Layout: LayoutSharded}
+		Expect(store.Upgrade(ctx)).To(Succeed())
+	})
+
+	It("lists, tombstones and deletes through the shard indexes", func() {
+		for i := 0; i < 50; i++ {
+			_, err := store.Write(ctx, storagetest.NewTask(fmt.Sprintf("task-%d", i), fmt.Sprintf("uid-%d", i), "Sample Task"), "h1")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(store.MarkTombstone(ctx, storagetest.NewTask("task-7", "uid-7", "Sample Task"), time.Now())).To(Succeed())
+		Expect(store.Delete(ctx, storage.KeyOf(storagetest.NewTask("task-8", "", "Sample Task")))).To(Succeed())
+		Expect(filepath.Join(store.BaseDir, "demo.bastion.io", "v1", "!task", "default", shardOf("task-1"), "task-1", "hash.txt")).To(BeAnExistingFile())
+
+		entries, err := store.List(ctx, storagetest.NewTask("", "", "Sample Task").GroupVersionKind())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(49))
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(HaveLen(1))
+		Expect(tombstones[0].Name).To(Equal("task-7"))
+		Expect(store.DeleteTombstone(ctx, tombstones[0].Key)).To(Succeed())
+		tombstones, err = store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(BeEmpty())
+
+		report, err := store.Scrub(ctx, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Problems).To(BeEmpty())
+		Expect(report.Scanned).To(Equal(49))
+	})
+
+	It("keeps the layout a store was created with", func() {
+		reopened := &FileSystem{BaseDir: store.BaseDir, Layout: LayoutFlat}
+		Expect(reopened.Upgrade(ctx)).To(Succeed())
+		Expect(reopened.Layout).To(Equal(LayoutSharded))
+	})
+
+	It("reports stale indexes and rebuilds them when recovering", func() {
+		hasher := hash.NewDefaultHasher()
+		obj := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		h, err := hasher.Hash(obj)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, obj, h)
+		Expect(err).NotTo(HaveOccurred())
+		// A crash after the tombstone was written but before the shard index was updated
+		dir := store.objectDir(storage.KeyOf(obj))
+		Expect(os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "tombstone"), nil, 0644)).To(Succeed())
+
+		report, err := store.Scrub(ctx, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(HaveKeyWithValue(storage.ProblemStaleIndex, 1))
+
+		_, err = store.Recover(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Metadata", func() {
+	var (
+		ctx   context.Context
+		store *FileSystem
+		key   storage.Key
+	)
+
+	BeforeEach(func() {
+		ctx = storage.WithMetadata(context.Background(), storage.Metadata{EventType: "update", Cluster: "test", Hasher: "h"})
+		store = &FileSystem{BaseDir: GinkgoT().TempDir()}
+		key = storage.KeyOf(storagetest.NewTask("task-a", "uid-1", "Sample Task"))
+	})
+
+	It("drops metadata left from the previous revision by an interrupted write", func() {
+		obj := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		obj.SetResourceVersion("1")
+		_, err := store.Write(ctx, obj, "h1")
+		Expect(err).NotTo(HaveOccurred())
+		dir := store.objectDir(key)
+		obj.SetResourceVersion("2")
+		data, err := json.Marshal(obj.Object)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		old := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(filepath.Join(dir, pendingFile), old, old)).To(Succeed())
+
+		report, err := store.Scrub(ctx, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(HaveKeyWithValue(storage.ProblemCorruptMetadata, 1))
+		_, err = store.Recover(ctx, hash.NewDefaultHasher())
+		Expect(err).NotTo(HaveOccurred())
+		md, err := store.ReadMetadata(ctx, key, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md).To(BeNil())
+	})
+})
+
+var _ = Describe("Recovery", func() {
+	var (
+		ctx    context.Context
+		store  *FileSystem
+		hasher *hash.DefaultHasher
+		dir    string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &FileSystem{BaseDir: GinkgoT().TempDir()}
+		hasher = hash.NewDefaultHasher()
+		obj := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		h, err := hasher.Hash(obj)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, obj, h)
+		Expect(err).NotTo(HaveOccurred())
+		dir = store.objectDir(storage.Key{GVK: obj.GroupVersionKind(), Namespace: "default", Name: "task-a"})
+	})
+
+	It("leaves no pending marker or temp files after a write", func() {
+		files, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		for _, f := range files {
+			Expect(f.Name()).NotTo(Equal(pendingFile))
+			Expect(isTempFile(f.Name())).To(BeFalse())
+		}
+	})
+
+	It("rehashes the manifest of an entry torn between manifest and hash", func() {
+		updated := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		updated.Object["spec"] = map[string]interface{}{"description": "Updated Task"}
+		data, err := json.Marshal(updated.Object)
+		Expect(err).NotTo(HaveOccurred())
+		// Crash after the new manifest was committed but before its hash
+		Expect(os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, ".hash.txt.tmp-1"), []byte("partial"), 0644)).To(Succeed())
+
+		report, err := store.Recover(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Checked).To(Equal(1))
+		Expect(report.Repaired).To(Equal(1))
+		Expect(report.TempFilesRemoved).To(Equal(1))
+
+		_, stored, err := store.Read(ctx, storage.Key{GVK: updated.GroupVersionKind(), Namespace: "default", Name: "task-a"})
+		Expect(err).NotTo(HaveOccurred())
+		want, err := hasher.Hash(updated)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored).To(Equal(want))
+		Expect(filepath.Join(dir, pendingFile)).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dir, ".hash.txt.tmp-1")).NotTo(BeAnExistingFile())
+	})
+
+	It("quarantines a corrupt manifest and drops its hash", func() {
+		Expect(os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte("{\"trunc"), 0644)).To(Succeed())
+
+		report, err := store.Recover(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Quarantined).To(Equal(1))
+
+		obj, _, err := store.Read(ctx, storage.KeyOf(storagetest.NewTask("task-a", "uid-1", "Sample Task")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+		Expect(filepath.Join(dir, "manifest.yaml.corrupt")).To(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("Scrub", func() {
+	It("reports hash mismatches, orphaned files and invalid paths", func() {
+		ctx := context.Background()
+		store := &FileSystem{BaseDir: GinkgoT().TempDir()}
+		hasher := hash.NewDefaultHasher()
+		for _, name := range []string{"intact", "tampered"} {
+			obj := storagetest.NewTask(name, "uid-"+name, "Sample Task")
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		gvk := storagetest.NewTask("", "", "Sample Task").GroupVersionKind()
+		tampered := store.objectDir(storage.Key{GVK: gvk, Namespace: "default", Name: "tampered"})
+		Expect(os.WriteFile(filepath.Join(tampered, "manifest.yaml"), []byte(`{"apiVersion":"demo.bastion.io/v1","kind":"Task","metadata":{"name":"tampered","namespace":"default"}}`), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(store.objectDir(storage.Key{GVK: gvk, Namespace: "default", Name: "intact"}), "notes.txt"), nil, 0644)).To(Succeed())
+		stray := filepath.Join(store.BaseDir, "demo.bastion.io", "v1")
+		Expect(os.WriteFile(filepath.Join(stray, "hash.txt"), []byte("h"), 0644)).To(Succeed())
+		// Writes in progress are left alone, interrupted ones are reported
+		intact := store.objectDir(storage.Key{GVK: gvk, Namespace: "default", Name: "intact"})
+		Expect(os.WriteFile(filepath.Join(intact, ".hash.txt"+tempInfix+"1"), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tampered, pendingFile), nil, 0644)).To(Succeed())
+		stale := filepath.Join(intact, ".manifest.yaml"+tempInfix+"2")
+		Expect(os.WriteFile(stale, nil, 0644)).To(Succeed())
+		old := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(stale, old, old)).To(Succeed())
+		// Internal state is not scrubbed
+		Expect(os.MkdirAll(filepath.Join(store.BaseDir, internalDir), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(store.BaseDir, internalDir, "state"), nil, 0644)).To(Succeed())
+
+		report, err := store.Scrub(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Scanned).To(Equal(2))
+		Expect(report.Counts()).To(Equal(map[storage.ProblemType]int{
+			storage.ProblemOrphanedFile: 2,
+			storage.ProblemInvalidPath:  1,
+		}))
+
+		Expect(os.Chtimes(filepath.Join(tampered, pendingFile), old, old)).To(Succeed())
+		report, err = store.Scrub(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(Equal(map[storage.ProblemType]int{
+			storage.ProblemHashMismatch: 1,
+			storage.ProblemPendingWrite: 1,
+			storage.ProblemOrphanedFile: 2,
+			storage.ProblemInvalidPath:  1,
+		}))
+	})
+})
+
+var _ = Describe("Scrub of a live store", func() {
+	It("reads an entry caught between its manifest and its hash again before reporting it", func() {
+		ctx := context.Background()
+		store := &FileSystem{BaseDir: GinkgoT().TempDir()}
+		hasher := hash.NewDefaultHasher()
+		obj := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		h, err := hasher.Hash(obj)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, obj, h)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The manifest of the next revision is committed, its hash lands while the scrub runs
+		updated := storagetest.NewTask("task-a", "uid-1", "Updated Task")
+		updatedHash, err := hasher.Hash(updated)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(updated.Object)
+		Expect(err).NotTo(HaveOccurred())
+		dir := store.objectDir(storage.KeyOf(obj))
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			time.Sleep(scrubRetryDelay / 2)
+			_ = os.WriteFile(filepath.Join(dir, "hash.txt"), []byte(updatedHash), 0644)
+		}()
+		report, err := store.Scrub(ctx, hasher)
+		<-done
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Problems).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Signatures", func() {
+	It("detects revisions changed after they were signed and attested", func() {
+		ctx := context.Background()
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		store := &FileSystem{BaseDir: GinkgoT().TempDir(), Signer: signing.NewSigner(private)}
+		verifier := signing.NewVerifier(public)
+		hasher := hash.NewDefaultHasher()
+		for _, name := range []string{"intact", "tampered"} {
+			obj := storagetest.NewTask(name, "uid-"+name, "Sample Task")
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err = store.Attest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		report, err := store.Verify(ctx, verifier, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Scanned).To(Equal(2))
+		Expect(report.Problems).To(BeEmpty())
+
+		// Rewrite the manifest and its hash consistently, as someone without the key could
+		tampered := storagetest.NewTask("tampered", "uid-tampered", "Sample Task")
+		tampered.Object["spec"] = map[string]interface{}{"description": "Tampered Task"}
+		data, err := json.MarshalIndent(tampered.Object, "", "  ")
+		Expect(err).NotTo(HaveOccurred())
+		h, err := hasher.Hash(tampered)
+		Expect(err).NotTo(HaveOccurred())
+		dir := store.objectDir(storage.Key{GVK: tampered.GroupVersionKind(), Namespace: "default", Name: "tampered"})
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "hash.txt"), []byte(h), 0644)).To(Succeed())
+
+		report, err = store.Verify(ctx, verifier, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(Equal(map[storage.ProblemType]int{
+			storage.ProblemBadSignature: 1,
+			storage.ProblemRootMismatch: 1,
+		}))
+	})
+
+	It("signs tombstones but nothing recovery finds, and attests only what verifies", func() {
+		ctx := context.Background()
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		store := &FileSystem{BaseDir: GinkgoT().TempDir(), Signer: signing.NewSigner(private)}
+		verifier := signing.NewVerifier(public)
+		hasher := hash.NewDefaultHasher()
+		for _, name := range []string{"deleted", "torn"} {
+			obj := storagetest.NewTask(name, "uid-"+name, "Sample Task")
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		deleted := storagetest.NewTask("deleted", "uid-deleted", "Sample Task")
+		Expect(store.MarkTombstone(ctx, deleted, time.Now())).To(Succeed())
+		_, err = store.Attest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		report, err := store.Verify(ctx, verifier, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Problems).To(BeEmpty())
+
+		// A manifest replaced while Bastion was down, as a torn write would leave it
+		torn := storagetest.NewTask("torn", "uid-torn", "Sample Task")
+		torn.Object["spec"] = map[string]interface{}{"description": "Replaced Task"}
+		data, err := json.MarshalIndent(torn.Object, "", "  ")
+		Expect(err).NotTo(HaveOccurred())
+		dir := store.objectDir(storage.KeyOf(torn))
+		Expect(os.WriteFile(filepath.Join(dir, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		recovery, err := store.Recover(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recovery.Unsigned).To(Equal(1))
+		Expect(filepath.Join(dir, signatureFile)).NotTo(BeAnExistingFile())
+		_, err = store.Attest(ctx)
+		Expect(err).To(MatchError(ContainSubstring("missing_signature")))
+
+		// The final state of a tombstone is signed too
+		path := store.TombstonePath(storage.KeyOf(deleted))
+		tombstone, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(path, []byte(strings.Replace(string(tombstone), "Task", "Tampered", 1)), 0644)).To(Succeed())
+		report, err = store.Verify(ctx, verifier, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(Equal(map[storage.ProblemType]int{
+			storage.ProblemMissingSignature: 1,
+			storage.ProblemBadSignature:     1,
+			storage.ProblemRootMismatch:     1,
+		}))
+	})
+
+	It("signs what was stored without a key, and attests around writes in progress", func() {
+		ctx := context.Background()
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		store := &FileSystem{BaseDir: GinkgoT().TempDir()}
+		verifier := signing.NewVerifier(public)
+		hasher := hash.NewDefaultHasher()
+		for _, name := range []string{"deleted", "tampered", "writing"} {
+			obj := storagetest.NewTask(name, "uid-"+name, "Sample Task")
+			h, err := hasher.Hash(obj)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.Write(ctx, obj, h)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		deleted := storagetest.NewTask("deleted", "uid-deleted", "Sample Task")
+		Expect(store.MarkTombstone(ctx, deleted, time.Now())).To(Succeed())
+		// A manifest that no longer hashes to its stored hash is not vouched for
+		tampered := store.objectDir(storage.KeyOf(storagetest.NewTask("tampered", "", "")))
+		Expect(os.WriteFile(filepath.Join(tampered, "hash.txt"), []byte("stale"), 0644)).To(Succeed())
+
+		// The signing key is configured on a store that already holds backups
+		store.Signer = signing.NewSigner(private)
+		_, err = store.Attest(ctx)
+		Expect(err).To(MatchError(ContainSubstring("missing_signature")))
+		signed, err := store.SignUnsigned(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signed).To(Equal(3), "two revisions and a tombstone")
+		Expect(filepath.Join(tampered, signatureFile)).NotTo(BeAnExistingFile())
+		Expect(os.Remove(filepath.Join(tampered, "hash.txt"))).To(Succeed())
+
+		// An entry whose signature is not written yet is left out until it is
+		writing := store.objectDir(storage.KeyOf(storagetest.NewTask("writing", "", "")))
+		Expect(os.WriteFile(filepath.Join(writing, pendingFile), nil, 0644)).To(Succeed())
+		Expect(os.Remove(filepath.Join(writing, signatureFile))).To(Succeed())
+		attestation, err := store.Attest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attestation.Leaves).To(Equal(1))
+
+		Expect(store.SignUnsigned(ctx, hasher)).To(Equal(0))
+		Expect(os.Remove(filepath.Join(writing, pendingFile))).To(Succeed())
+		Expect(store.SignUnsigned(ctx, hasher)).To(Equal(1))
+		_, err = store.Attest(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		report, err := store.Verify(ctx, verifier, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Problems).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Format", func() {
+	var (
+		ctx   context.Context
+		store *FileSystem
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &FileSystem{BaseDir: GinkgoT().TempDir()}
+	})
+
+	It("upgrades version 0 stores", func() {
+		// A backup taken before the layout was versioned, with an empty tombstone marker
+		obj := storagetest.NewTask("task-a", "uid-1", "Sample Task")
+		dir := filepath.Join(store.BaseDir, "demo.bastion.io", "v1", "Task", "default", "task-a")
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		data, err := json.Marshal(obj.Object)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "hash.txt"), []byte("h1"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "tombstone"), nil, 0644)).To(Succeed())
+
+		format, err := store.ReadFormat(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format.Version).To(Equal(0))
+		Expect(store.Upgrade(ctx)).To(Succeed())
+
+		format, err = store.ReadFormat(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format.Version).To(Equal(FormatVersion))
+		Expect(format.Upgrades).To(HaveLen(1))
+		tomb, err := store.ReadTombstone(ctx, storage.Key{GVK: obj.GroupVersionKind(), Namespace: "default", Name: "task-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tomb.FinalState).NotTo(BeNil())
+		Expect(string(tomb.UID)).To(Equal("uid-1"))
+		lineage, err := store.Lineage(ctx, storage.Key{GVK: obj.GroupVersionKind(), Namespace: "default", Name: "task-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(1))
+		Expect(lineage[0].DeletedAt).NotTo(BeNil())
+	})
+
+	It("moves version 0 layouts to encoded key segments, leaving unrelated directories alone", func() {
+		legacy := func(obj *unstructured.Unstructured, parts ...string) {
+			dir := filepath.Join(append([]string{store.BaseDir}, parts...)...)
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			data, err := json.Marshal(obj.Object)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, "manifest.yaml"), data, 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "hash.txt"), []byte("h1"), 0644)).To(Succeed())
+		}
+		// Version 0 dropped the empty core group and put cluster-scoped objects next to namespaces
+		configMap := &unstructured.Unstructured{}
+		configMap.SetGroupVersionKind(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"})
+		configMap.SetNamespace("default")
+		configMap.SetName("settings")
+		legacy(configMap, "v1", "ConfigMap", "default", "settings")
+		cluster := storagetest.NewTask("default", "uid-1", "Sample Task")
+		cluster.SetNamespace("")
+		legacy(cluster, "demo.bastion.io", "v1", "Task", "default")
+		namespaced := storagetest.NewTask("task-a", "uid-2", "Sample Task")
+		legacy(namespaced, "demo.bastion.io", "v1", "Task", "default", "task-a")
+		unrelated := filepath.Join(store.BaseDir, "demo.bastion.io", "v1", "Task", "default", "cache")
+		Expect(os.MkdirAll(unrelated, 0755)).To(Succeed())
+
+		Expect(store.Upgrade(ctx)).To(Succeed())
+		for _, obj := range []*unstructured.Unstructured{configMap, cluster, namespaced} {
+			stored, hash, err := store.Read(ctx, storage.KeyOf(obj))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).NotTo(BeNil(), storage.KeyOf(obj).String())
+			Expect(hash).To(Equal("h1"))
+		}
+		Expect(filepath.Join(store.BaseDir, "v1")).NotTo(BeADirectory())
+		Expect(unrelated).To(BeADirectory())
+		report, err := store.Scrub(ctx, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Problems).To(BeEmpty())
+	})
+
+	It("takes a base dir holding unrelated directories for a new store", func() {
+		Expect(os.MkdirAll(filepath.Join(store.BaseDir, "go-build", "ab", "cd", "ef", "gh"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(store.BaseDir, "go-build", "ab", "cd", "manifest.yaml"), []byte("not json"), 0644)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(store.BaseDir, "empty"), 0755)).To(Succeed())
+
+		format, err := store.ReadFormat(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format.Version).To(Equal(FormatVersion))
+		Expect(store.Upgrade(ctx)).To(Succeed())
+		Expect(filepath.Join(store.BaseDir, "empty")).To(BeADirectory())
+		Expect(filepath.Join(store.BaseDir, "go-build", "ab", "cd", "ef", "gh")).To(BeADirectory())
+	})
+
+	It("refuses formats newer than this build", func() {
+		Expect(os.WriteFile(filepath.Join(store.BaseDir, formatFile), []byte(`{"format":"bastion.io/filesystem","version":99}`), 0644)).To(Succeed())
+		Expect(store.Upgrade(ctx)).To(MatchError(ContainSubstring("version 99")))
+	})
+})
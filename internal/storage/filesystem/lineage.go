@@ -0,0 +1,171 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lineageFile     = "lineage.json"
+	incarnationsDir = "incarnations"
+)
+
+// Lineage returns the incarnations stored under a name, oldest first.
+func (w *FileSystem) Lineage(ctx context.Context, key storage.Key) ([]storage.Incarnation, error) {
+	return readLineage(w.objectDir(key))
+}
+
+// ReadIncarnation loads the latest backup of the incarnation with the given UID.
+// Superseded incarnations are read from their archive under incarnations/<encoded uid>.
+func (w *FileSystem) ReadIncarnation(ctx context.Context, key storage.Key, uid types.UID) (*unstructured.Unstructured, string, error) {
+	dir := w.objectDir(key)
+	current, err := currentUID(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if uid == "" || uid == current {
+		return readManifestDir(dir, key.GVK)
+	}
+	return readManifestDir(filepath.Join(dir, incarnationsDir, storage.EncodeSegment(string(uid))), key.GVK)
+}
+
+// DeleteIncarnation removes the archive of a superseded incarnation, then its lineage entry.
+func (w *FileSystem) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	dir := w.objectDir(key)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	current, err := currentUID(dir)
+	if err != nil {
+		return err
+	}
+	if uid == "" || uid == current {
+		return fmt.Errorf("cannot delete incarnation %s of %s: it is the current one", uid, key)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, incarnationsDir, storage.EncodeSegment(string(uid)))); err != nil {
+		return fmt.Errorf("failed to remove incarnation %s: %w", uid, err)
+	}
+	return updateLineage(dir, func(lineage []storage.Incarnation) []storage.Incarnation {
+		return storage.DropIncarnation(lineage, uid)
+	})
+}
+
+// archiveIncarnation moves the backup of the current incarnation aside when an object with another UID
+// is written under the same name, so the histories of the two objects are never merged.
+func archiveIncarnation(dir string, uid types.UID) error {
+	current, err := currentUID(dir)
+	if err != nil {
+		return err
+	}
+	if current == "" || uid == "" || current == uid {
+		return nil
+	}
+	if err := seedLineage(dir, current); err != nil {
+		return err
+	}
+	archive := filepath.Join(dir, incarnationsDir, storage.EncodeSegment(string(current)))
+	if err := mkdirAllSync(archive, dir); err != nil {
+		return fmt.Errorf("failed to create incarnation archive: %w", err)
+	}
+	for _, file := range []string{"manifest.yaml", "hash.txt", metadataFile, signatureFile, "tombstone", tombstoneSignatureFile} {
+		err := os.Rename(filepath.Join(dir, file), filepath.Join(archive, file))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to archive incarnation %s: %w", current, err)
+		}
+	}
+	return nil
+}
+
+// currentUID returns the UID of the incarnation stored at the top of dir. Backups taken before lineage
+// was tracked fall back to the UID in their manifest.
+func currentUID(dir string) (types.UID, error) {
+	lineage, err := readLineage(dir)
+	if err != nil {
+		return "", err
+	}
+	if current := storage.Current(lineage); current != nil {
+		return current.UID, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		return "", fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	return obj.GetUID(), nil
+}
+
+// seedLineage starts the lineage index of a backup taken before lineage was tracked, dating its
+// incarnation by the manifest modification time.
+func seedLineage(dir string, uid types.UID) error {
+	lineage, err := readLineage(dir)
+	if err != nil || len(lineage) > 0 {
+		return err
+	}
+	info, err := os.Stat(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		return fmt.Errorf("failed to stat manifest: %w", err)
+	}
+	return recordBackup(dir, uid, info.ModTime().UTC())
+}
+
+// recordBackup notes a backup of the incarnation uid in the lineage index.
+func recordBackup(dir string, uid types.UID, at time.Time) error {
+	if uid == "" {
+		return nil
+	}
+	return updateLineage(dir, func(lineage []storage.Incarnation) []storage.Incarnation {
+		return storage.RecordBackup(lineage, uid, at)
+	})
+}
+
+// recordDeletion sets or, with a nil deletedAt, clears the deletion time of the incarnation uid.
+// An empty uid refers to the current incarnation.
+func recordDeletion(dir string, uid types.UID, deletedAt *time.Time) error {
+	return updateLineage(dir, func(lineage []storage.Incarnation) []storage.Incarnation {
+		return storage.RecordDeletion(lineage, uid, deletedAt)
+	})
+}
+
+func updateLineage(dir string, update func([]storage.Incarnation) []storage.Incarnation) error {
+	lineage, err := readLineage(dir)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(update(lineage), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lineage: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, lineageFile), data); err != nil {
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	return nil
+}
+
+func readLineage(dir string) ([]storage.Incarnation, error) {
+	data, err := os.ReadFile(filepath.Join(dir, lineageFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read lineage: %w", err)
+	}
+	var lineage []storage.Incarnation
+	if err := json.Unmarshal(data, &lineage); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lineage: %w", err)
+	}
+	return lineage, nil
+}
@@ -0,0 +1,75 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+)
+
+// metadataFile records how the manifest next to it was captured. It is written after the manifest in
+// the pending window, so recovery drops one left behind by an interrupted write.
+const metadataFile = "metadata.json"
+
+// ReadMetadata loads the metadata of the incarnation with the given UID, read from its archive when it
+// was superseded.
+func (w *FileSystem) ReadMetadata(ctx context.Context, key storage.Key, uid types.UID) (*storage.Metadata, error) {
+	dir := w.objectDir(key)
+	current, err := currentUID(dir)
+	if err != nil {
+		return nil, err
+	}
+	if uid != "" && uid != current {
+		dir = filepath.Join(dir, incarnationsDir, storage.EncodeSegment(string(uid)))
+	}
+	return readMetadata(dir)
+}
+
+func writeMetadata(dir string, md *storage.Metadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, metadataFile), data); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
+// readMetadata returns the metadata in dir, or nil if there is none.
+func readMetadata(dir string) (*storage.Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	md := &storage.Metadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return md, nil
+}
+
+// repairMetadata drops the metadata of dir unless it parses and describes the manifest, as a write
+// interrupted before its metadata landed leaves the metadata of the previous revision.
+func repairMetadata(dir string) error {
+	md, err := readMetadata(dir)
+	if err == nil && md == nil {
+		return nil
+	}
+	if err == nil {
+		if obj, err := readManifest(dir); err == nil && obj != nil && md.Describes(obj) {
+			return nil
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, metadataFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// internalDir holds Bastion's own state below BaseDir and is never scanned for backups.
+const internalDir = ".bastion"
+
+// Recover scans the store for entries torn by a crash and repairs them. Only directories marked as
+// pending, and temp files left by interrupted writes, are looked at, so the scan does not read every
+// manifest. A pending entry whose manifest is readable gets its hash recomputed with hasher; one whose
+// manifest is missing or corrupt loses its hash, so the next event or reconciliation writes it again.
+// Recovery never signs what it finds: signatures that no longer verify are moved aside, see
+// dropTornSignatures.
+func (w *FileSystem) Recover(ctx context.Context, hasher hash.Hasher) (storage.RecoveryReport, error) {
+	logger := log.FromContext(ctx).WithName("FileSystem").WithName("recover")
+	var report storage.RecoveryReport
+	err := filepath.WalkDir(w.BaseDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == w.BaseDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == internalDir && filepath.Dir(path) == filepath.Clean(w.BaseDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case isTempFile(d.Name()):
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove temp file: %w", err)
+			}
+			report.TempFilesRemoved++
+		case d.Name() == pendingFile:
+			dir := filepath.Dir(path)
+			if err := repairEntry(dir, hasher, &report); err != nil {
+				return err
+			}
+			if err := repairLabels(dir); err != nil {
+				return err
+			}
+			if err := repairMetadata(dir); err != nil {
+				return err
+			}
+			if err := w.dropTornSignatures(dir, &report); err != nil {
+				return err
+			}
+			archives, _ := os.ReadDir(filepath.Join(dir, incarnationsDir))
+			for _, archive := range archives {
+				if archive.IsDir() {
+					if err := repairEntry(filepath.Join(dir, incarnationsDir, archive.Name()), hasher, &report); err != nil {
+						return err
+					}
+				}
+			}
+			// The index of the shard may have missed the change the entry was in the middle of
+			if w.sharded() {
+				if err := rebuildIndex(filepath.Dir(dir)); err != nil {
+					return err
+				}
+			}
+			if err := endWrite(dir); err != nil {
+				return err
+			}
+			logger.Info("Recovered torn entry", "dir", dir)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// repairEntry makes the hash of dir agree with its manifest.
+func repairEntry(dir string, hasher hash.Hasher, report *storage.RecoveryReport) error {
+	report.Checked++
+	hashPath := filepath.Join(dir, "hash.txt")
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	data, err := os.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return dropHash(hashPath, report)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		if err := os.Rename(manifestPath, manifestPath+".corrupt"); err != nil {
+			return fmt.Errorf("failed to quarantine manifest: %w", err)
+		}
+		report.Quarantined++
+		return dropHash(hashPath, report)
+	}
+	if hasher == nil {
+		return dropHash(hashPath, report)
+	}
+	want, err := hasher.Hash(obj)
+	if err != nil {
+		return fmt.Errorf("failed to hash manifest: %w", err)
+	}
+	if got, _ := os.ReadFile(hashPath); string(got) == want {
+		return nil
+	}
+	if err := atomicfile.WriteFile(hashPath, []byte(want)); err != nil {
+		return fmt.Errorf("failed to write hash: %w", err)
+	}
+	report.Repaired++
+	return nil
+}
+
+// dropHash removes a hash that cannot be trusted, so the entry is written again.
+func dropHash(hashPath string, report *storage.RecoveryReport) error {
+	err := os.Remove(hashPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove hash: %w", err)
+	}
+	report.Repaired++
+	return nil
+}
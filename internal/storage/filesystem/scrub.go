@@ -0,0 +1,269 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scrubGrace is the age below which temp files and pending markers are taken for writes in progress, as
+// scrubs run alongside the workers, rather than for writes a crash interrupted.
+const scrubGrace = 5 * time.Minute
+
+const (
+	// scrubAttempts is how many times an entry whose manifest does not check out is read before its
+	// problems are reported, scrubRetryDelay apart.
+	scrubAttempts   = 3
+	scrubRetryDelay = 100 * time.Millisecond
+)
+
+// entryFiles are the files an object directory may hold.
+var entryFiles = map[string]bool{
+	"manifest.yaml":                     true,
+	"hash.txt":                          true,
+	"tombstone":                         true,
+	lineageFile:                         true,
+	labelsFile:                          true,
+	metadataFile:                        true,
+	signatureFile:                       true,
+	tombstoneSignatureFile:              true,
+	signatureFile + tornSuffix:          true,
+	tombstoneSignatureFile + tornSuffix: true,
+	pendingFile:                         true,
+	"manifest.yaml.corrupt":             true,
+}
+
+// Scrub walks the whole store and verifies every entry: the manifest parses, names the object its path
+// says it is, and hashes to the content of hash.txt, and the tombstone, lineage and metadata files parse.
+// Files outside of an object directory and directories that do not map to an object are reported too.
+// Entries being written are skipped, see scrubGrace.
+func (w *FileSystem) Scrub(ctx context.Context, hasher hash.Hasher) (storage.ScrubReport, error) {
+	var report storage.ScrubReport
+	now := time.Now()
+	base := filepath.Clean(w.BaseDir)
+	err := filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == base {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != base && d.Name() == internalDir && filepath.Dir(path) == base {
+			return filepath.SkipDir
+		}
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("failed to read dir: %w", err)
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		isEntry := false
+		for _, f := range files {
+			if !f.IsDir() && entryFiles[f.Name()] {
+				isEntry = true
+				break
+			}
+		}
+		if !isEntry {
+			shard := w.isShardDir(rel)
+			for _, f := range files {
+				if f.IsDir() || (isTempFile(f.Name()) && inFlight(f, now)) {
+					continue
+				}
+				if !(path == base && f.Name() == formatFile) && !(shard && f.Name() == indexFile) {
+					report.Add(storage.ScrubProblem{Type: storage.ProblemOrphanedFile, Path: filepath.Join(path, f.Name())})
+				}
+			}
+			if shard {
+				scrubIndex(path, &report)
+			}
+			return nil
+		}
+		key, err := w.parseEntryDir(rel)
+		if err != nil {
+			report.Add(storage.ScrubProblem{Type: storage.ProblemInvalidPath, Path: path, Detail: err.Error()})
+			return nil
+		}
+		report.Scanned++
+		scrubEntry(path, key, files, hasher, now, &report)
+		return nil
+	})
+	return report, err
+}
+
+// inFlight reports whether f, a temp file or pending marker, is young enough to belong to a write in
+// progress.
+func inFlight(f os.DirEntry, now time.Time) bool {
+	info, err := f.Info()
+	if err != nil {
+		return true // gone since the directory was read, so its write completed
+	}
+	return now.Sub(info.ModTime()) < scrubGrace
+}
+
+// scrubEntry verifies the files of the object directory dir, unless a write to it is in progress.
+func scrubEntry(dir string, key storage.Key, files []os.DirEntry, hasher hash.Hasher, now time.Time, report *storage.ScrubReport) {
+	problem := func(t storage.ProblemType, path, detail string) {
+		report.Add(storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+	}
+	present := map[string]bool{}
+	for _, f := range files {
+		if f.IsDir() || (isTempFile(f.Name()) && inFlight(f, now)) {
+			continue
+		}
+		if f.Name() == pendingFile && inFlight(f, now) {
+			return // the files may not agree until the write completes
+		}
+		present[f.Name()] = true
+		if !entryFiles[f.Name()] {
+			problem(storage.ProblemOrphanedFile, filepath.Join(dir, f.Name()), "")
+		}
+	}
+	if present[pendingFile] {
+		problem(storage.ProblemPendingWrite, dir, "interrupted write not yet recovered")
+	}
+	if present["manifest.yaml.corrupt"] {
+		problem(storage.ProblemCorruptManifest, filepath.Join(dir, "manifest.yaml.corrupt"), "quarantined by recovery")
+	}
+	if present["tombstone"] {
+		if data, err := os.ReadFile(filepath.Join(dir, "tombstone")); err != nil {
+			problem(storage.ProblemCorruptTombstone, filepath.Join(dir, "tombstone"), err.Error())
+		} else if len(data) > 0 {
+			if err := json.Unmarshal(data, &storage.Tombstone{}); err != nil {
+				problem(storage.ProblemCorruptTombstone, filepath.Join(dir, "tombstone"), err.Error())
+			}
+		}
+	}
+	if present[labelsFile] {
+		if data, err := os.ReadFile(filepath.Join(dir, labelsFile)); err != nil || json.Unmarshal(data, &map[string]string{}) != nil {
+			problem(storage.ProblemStaleIndex, filepath.Join(dir, labelsFile), "labels cannot be parsed, walks read the manifest instead")
+		}
+	}
+	if present[lineageFile] {
+		if _, err := readLineage(dir); err != nil {
+			problem(storage.ProblemCorruptLineage, filepath.Join(dir, lineageFile), err.Error())
+		}
+	}
+
+	// A write commits the manifest before its hash, so an entry that does not check out may be caught
+	// between the two: it is read again before its problems are reported
+	problems := scrubManifest(dir, key, hasher)
+	for attempt := 1; len(problems) > 0 && attempt < scrubAttempts; attempt++ {
+		time.Sleep(scrubRetryDelay)
+		if info, err := os.Stat(filepath.Join(dir, pendingFile)); err == nil && time.Since(info.ModTime()) < scrubGrace {
+			return // a write started since, its files may not agree until it completes
+		}
+		problems = scrubManifest(dir, key, hasher)
+	}
+	for _, p := range problems {
+		report.Add(p)
+	}
+}
+
+// scrubManifest verifies the manifest of the object directory dir against its path, its metadata and
+// its hash, and returns the problems it finds.
+func scrubManifest(dir string, key storage.Key, hasher hash.Hasher) []storage.ScrubProblem {
+	var problems []storage.ScrubProblem
+	problem := func(t storage.ProblemType, path, detail string) {
+		problems = append(problems, storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+	}
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	hashPath := filepath.Join(dir, "hash.txt")
+	data, err := os.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(hashPath); err == nil {
+			problem(storage.ProblemMissingManifest, manifestPath, "")
+		}
+		return problems
+	}
+	if err != nil {
+		problem(storage.ProblemCorruptManifest, manifestPath, err.Error())
+		return problems
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		problem(storage.ProblemCorruptManifest, manifestPath, err.Error())
+		return problems
+	}
+	if storage.KeyOf(obj) != key {
+		problem(storage.ProblemPathMismatch, manifestPath, fmt.Sprintf("manifest is %s", storage.KeyOf(obj)))
+	}
+	if md, err := readMetadata(dir); err != nil {
+		problem(storage.ProblemCorruptMetadata, filepath.Join(dir, metadataFile), err.Error())
+	} else if md != nil && !md.Describes(obj) {
+		problem(storage.ProblemCorruptMetadata, filepath.Join(dir, metadataFile),
+			fmt.Sprintf("metadata is of uid %s, resourceVersion %s", md.UID, md.ResourceVersion))
+	}
+	// The hash is read after the manifest, so the hash of a write that completed in between is seen too
+	stored, hashErr := os.ReadFile(hashPath)
+	if os.IsNotExist(hashErr) {
+		problem(storage.ProblemMissingHash, hashPath, "")
+		return problems
+	}
+	if hashErr != nil {
+		problem(storage.ProblemHashMismatch, hashPath, hashErr.Error())
+		return problems
+	}
+	if hasher == nil {
+		return problems
+	}
+	computed, err := hasher.Hash(obj)
+	if err != nil {
+		problem(storage.ProblemCorruptManifest, manifestPath, err.Error())
+		return problems
+	}
+	if computed != string(stored) {
+		problem(storage.ProblemHashMismatch, hashPath, fmt.Sprintf("stored %s, computed %s", stored, computed))
+	}
+	return problems
+}
+
+// parseEntryDir maps an object directory, relative to the base dir, to the object it holds. Objects live
+// at group/version/kind/namespace/name in encoded key segments, with the shard of the name before the
+// name in sharded stores, and archived incarnations of them below incarnations/<uid>.
+func (w *FileSystem) parseEntryDir(rel string) (storage.Key, error) {
+	parts := strings.Split(rel, string(os.PathSeparator))
+	depth := 5
+	if w.sharded() {
+		depth = 6
+	}
+	if n := len(parts); n == depth+2 && parts[n-2] == incarnationsDir {
+		parts = parts[:n-2]
+	}
+	if len(parts) != depth {
+		return storage.Key{}, fmt.Errorf("expected %d path segments, got %d", depth, len(parts))
+	}
+	if w.sharded() {
+		shard := parts[4]
+		parts = append(parts[:4], parts[5])
+		key, err := storage.ParseSegments(parts)
+		if err != nil {
+			return key, err
+		}
+		if shard != shardOf(key.Name) {
+			return key, fmt.Errorf("object belongs to shard %s, not %s", shardOf(key.Name), shard)
+		}
+		return key, nil
+	}
+	return storage.ParseSegments(parts)
+}
+
+// isShardDir reports whether dir, relative to the base dir, is a shard directory of a sharded store.
+func (w *FileSystem) isShardDir(rel string) bool {
+	return w.sharded() && len(strings.Split(rel, string(os.PathSeparator))) == 5
+}
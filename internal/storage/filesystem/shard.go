@@ -0,0 +1,257 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Layout is how object directories are arranged below their namespace directory.
+type Layout string
+
+const (
+	// LayoutFlat keeps every object directly below its namespace directory.
+	LayoutFlat Layout = "flat"
+	// LayoutSharded spreads the objects of a namespace over shard directories named by a hash prefix of
+	// the object name, each with an index of the objects it holds, so no directory grows with the number
+	// of objects and listing reads one index per shard instead of one hash per object.
+	LayoutSharded Layout = "sharded"
+)
+
+const (
+	// indexFile lists the objects of a shard. Its leading dot keeps it apart from encoded object names.
+	indexFile = ".index.json"
+	// shardDigits is the number of hex digits naming a shard, for 4096 shards per namespace.
+	shardDigits = 3
+)
+
+// ParseLayout validates a layout name.
+func ParseLayout(s string) (Layout, error) {
+	switch Layout(s) {
+	case "", LayoutFlat:
+		return LayoutFlat, nil
+	case LayoutSharded:
+		return LayoutSharded, nil
+	}
+	return "", fmt.Errorf("unknown storage layout %q, expected flat or sharded", s)
+}
+
+// indexEntry is what a shard index records about an object.
+type indexEntry struct {
+	Hash       string            `json:"hash"`
+	Tombstoned bool              `json:"tombstoned,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Modified   time.Time         `json:"modified"` // Modification time of hash.txt
+}
+
+func (e indexEntry) equal(other indexEntry) bool {
+	return e.Hash == other.Hash && e.Tombstoned == other.Tombstoned && e.Modified.Equal(other.Modified) && maps.Equal(e.Labels, other.Labels)
+}
+
+func (e indexEntry) objectEntry(key storage.Key) storage.ObjectEntry {
+	return storage.ObjectEntry{Key: key, Hash: e.Hash, Tombstoned: e.Tombstoned, Labels: e.Labels, Modified: e.Modified}
+}
+
+// shardIndex maps the encoded names of the objects in a shard to their index entries.
+type shardIndex map[string]indexEntry
+
+// outdated reports whether the index was written before entries recorded labels and modification times.
+func (index shardIndex) outdated() bool {
+	for _, entry := range index {
+		if entry.Modified.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// shardLocks serializes updates of a shard index, keyed by shard directory.
+var shardLocks sync.Map
+
+func (w *FileSystem) sharded() bool {
+	return w.Layout == LayoutSharded
+}
+
+// shardOf returns the shard directory name of an object name.
+func shardOf(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%0*x", shardDigits, h.Sum32()&(1<<(4*shardDigits)-1))
+}
+
+// updateIndex applies update to the index of the shard holding key. An index that is missing or cannot
+// be read is rebuilt from the shard first.
+func (w *FileSystem) updateIndex(key storage.Key, update func(index shardIndex, name string)) error {
+	shardDir := filepath.Dir(w.objectDir(key))
+	lock, _ := shardLocks.LoadOrStore(shardDir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	index, err := readIndex(shardDir)
+	if err != nil || index == nil {
+		if index, err = scanShard(shardDir); err != nil {
+			return err
+		}
+	}
+	update(index, storage.EncodeSegment(key.Name))
+	return writeIndex(shardDir, index)
+}
+
+// indexObject records the current hash and tombstone state of the object stored under key.
+func (w *FileSystem) indexObject(key storage.Key) error {
+	return w.updateIndex(key, func(index shardIndex, name string) {
+		entry, ok := readEntry(filepath.Join(filepath.Dir(w.objectDir(key)), name), true)
+		if !ok {
+			delete(index, name)
+			return
+		}
+		index[name] = entry
+	})
+}
+
+// rebuildIndex replaces the index of shardDir with what the shard holds.
+func rebuildIndex(shardDir string) error {
+	lock, _ := shardLocks.LoadOrStore(shardDir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	index, err := scanShard(shardDir)
+	if err != nil {
+		return err
+	}
+	return writeIndex(shardDir, index)
+}
+
+// readIndex returns the index of shardDir, or nil if it has none.
+func readIndex(shardDir string) (shardIndex, error) {
+	data, err := os.ReadFile(filepath.Join(shardDir, indexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	index := shardIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+	return index, nil
+}
+
+func writeIndex(shardDir string, index shardIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(shardDir, indexFile), data); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// scanShard builds the index of shardDir from the object directories it holds.
+func scanShard(shardDir string) (shardIndex, error) {
+	names, err := readSegments(shardDir)
+	if err != nil {
+		return nil, err
+	}
+	index := shardIndex{}
+	for _, name := range names {
+		if entry, ok := readEntry(filepath.Join(shardDir, name.encoded), true); ok {
+			index[name.encoded] = entry
+		}
+	}
+	return index, nil
+}
+
+// readEntry reads the index entry of the object directory dir, if it holds a hash. Labels are read when
+// withLabels is set.
+func readEntry(dir string, withLabels bool) (indexEntry, bool) {
+	hashPath := filepath.Join(dir, "hash.txt")
+	hashBytes, err := os.ReadFile(hashPath)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	info, err := os.Stat(hashPath)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	entry := indexEntry{Hash: string(hashBytes), Modified: info.ModTime().UTC()}
+	if _, err := os.Stat(filepath.Join(dir, "tombstone")); err == nil {
+		entry.Tombstoned = true
+	}
+	if withLabels {
+		entry.Labels, _ = readLabels(dir)
+	}
+	return entry, true
+}
+
+// listShards returns the objects of a namespace directory of a sharded store from the shard indexes,
+// rebuilding those that are missing, cannot be read or were written before entries had a modification
+// time.
+func listShards(namespaceDir string, key storage.Key) ([]storage.ObjectEntry, error) {
+	shards, err := readSegments(namespaceDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []storage.ObjectEntry
+	for _, shard := range shards {
+		shardDir := filepath.Join(namespaceDir, shard.encoded)
+		index, err := readIndex(shardDir)
+		if err != nil || index == nil || index.outdated() {
+			if err := rebuildIndex(shardDir); err != nil {
+				return nil, err
+			}
+			if index, err = readIndex(shardDir); err != nil {
+				return nil, err
+			}
+		}
+		for encoded, e := range index {
+			name, err := storage.DecodeSegment(encoded)
+			if err != nil {
+				continue
+			}
+			key.Name = name
+			entries = append(entries, e.objectEntry(key))
+		}
+	}
+	return entries, nil
+}
+
+// scrubIndex reports a shard index that does not list what its shard holds.
+func scrubIndex(shardDir string, report *storage.ScrubReport) {
+	path := filepath.Join(shardDir, indexFile)
+	stored, err := readIndex(shardDir)
+	if err != nil {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemStaleIndex, Path: path, Detail: err.Error()})
+		return
+	}
+	if stored == nil {
+		return // built on the next list
+	}
+	actual, err := scanShard(shardDir)
+	if err != nil {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemStaleIndex, Path: path, Detail: err.Error()})
+		return
+	}
+	differ := 0
+	for name, entry := range actual {
+		if !stored[name].equal(entry) {
+			differ++
+		}
+	}
+	for name := range stored {
+		if _, ok := actual[name]; !ok {
+			differ++
+		}
+	}
+	if differ > 0 {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemStaleIndex, Path: path,
+			Detail: fmt.Sprintf("%d objects differ from the shard, remove the index to rebuild it", differ)})
+	}
+}
@@ -0,0 +1,407 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/signing"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+const (
+	signatureFile          = "signature.json"
+	tombstoneSignatureFile = "tombstone.signature.json"
+	attestationFile        = "attestation.json"
+	tornSuffix             = ".torn" // Appended to signatures recovery moved aside
+)
+
+// sign writes the signature of the manifest and hash just committed to dir.
+func (w *FileSystem) sign(dir string, obj *unstructured.Unstructured, hash string, manifest []byte) error {
+	sig := w.Signer.SignRevision(obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName(), obj.GetUID(), hash, manifest)
+	data, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal signature: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, signatureFile), data); err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+	return nil
+}
+
+// signTombstone writes the signature of the tombstone just committed to dir, final state included.
+func (w *FileSystem) signTombstone(dir string, obj *unstructured.Unstructured, tombstone []byte) error {
+	sig := w.Signer.SignTombstone(obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName(), obj.GetUID(), tombstone)
+	data, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone signature: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, tombstoneSignatureFile), data); err != nil {
+		return fmt.Errorf("failed to write tombstone signature: %w", err)
+	}
+	return nil
+}
+
+// SignUnsigned signs the revisions and tombstones that were never signed, e.g. stored before a signing key
+// was configured, so the store can be attested, and returns the number of signatures it wrote. Only
+// revisions whose manifest names the object of their path and hashes to their stored hash are signed.
+// Entries being written, and those whose signatures recovery moved aside, are left for their next write. It
+// must run before anything writes to the store, as it signs what it reads without holding the entry.
+func (w *FileSystem) SignUnsigned(ctx context.Context, hasher hash.Hasher) (int, error) {
+	if w.Signer == nil {
+		return 0, fmt.Errorf("no signing key configured")
+	}
+	signed := 0
+	err := w.walkEntries(ctx, func(dir, rel string, key storage.Key) error {
+		if isPending(dir) {
+			return nil
+		}
+		if neverSigned(dir, signatureFile) {
+			obj, hash, manifest, ok := readVerifiedRevision(dir, key, hasher)
+			if ok {
+				if err := w.sign(dir, obj, hash, manifest); err != nil {
+					return err
+				}
+				signed++
+			}
+		}
+		if neverSigned(dir, tombstoneSignatureFile) {
+			data, err := os.ReadFile(filepath.Join(dir, "tombstone"))
+			tomb := &storage.Tombstone{}
+			if err != nil || len(data) == 0 || json.Unmarshal(data, tomb) != nil {
+				return nil // no tombstone, or reported by Scrub
+			}
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(key.GVK)
+			obj.SetNamespace(key.Namespace)
+			obj.SetName(key.Name)
+			obj.SetUID(tomb.UID)
+			if err := w.signTombstone(dir, obj, data); err != nil {
+				return err
+			}
+			signed++
+		}
+		return nil
+	})
+	return signed, err
+}
+
+// neverSigned reports whether dir holds neither the signature name nor one recovery moved aside.
+func neverSigned(dir, name string) bool {
+	for _, path := range []string{filepath.Join(dir, name), filepath.Join(dir, name+tornSuffix)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// readVerifiedRevision reads the revision in dir and reports whether its manifest names the object under
+// key and hashes to its stored hash.
+func readVerifiedRevision(dir string, key storage.Key, hasher hash.Hasher) (*unstructured.Unstructured, string, []byte, bool) {
+	hashBytes, err := os.ReadFile(filepath.Join(dir, "hash.txt"))
+	if err != nil {
+		return nil, "", nil, false
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		return nil, "", nil, false
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(manifest, &obj.Object); err != nil || storage.KeyOf(obj) != key {
+		return nil, "", nil, false
+	}
+	if computed, err := hasher.Hash(obj); err != nil || computed != string(hashBytes) {
+		return nil, "", nil, false
+	}
+	return obj, string(hashBytes), manifest, true
+}
+
+// dropTornSignatures moves the signatures of the torn entry dir aside unless they still verify, as they may
+// have been made for what the interrupted write replaced. Nothing is signed again: what recovery finds was
+// not necessarily written by Bastion, so the entry stays unsigned, and Verify reports it, until it is
+// written again.
+func (w *FileSystem) dropTornSignatures(dir string, report *storage.RecoveryReport) error {
+	rel, err := filepath.Rel(w.BaseDir, dir)
+	if err != nil {
+		return err
+	}
+	key, err := w.parseEntryDir(rel)
+	if err != nil {
+		return nil // reported by Scrub
+	}
+	dropped := false
+	for _, name := range []string{signatureFile, tombstoneSignatureFile} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		valid := false
+		if w.Signer != nil {
+			valid = true
+			invalid := func(storage.ProblemType, string, string) { valid = false }
+			if name == signatureFile {
+				verifyEntry(dir, key, w.Signer.Verifier(), nil, invalid)
+			} else {
+				verifyTombstone(dir, key, w.Signer.Verifier(), invalid)
+			}
+		}
+		if valid {
+			continue
+		}
+		if err := os.Rename(path, path+tornSuffix); err != nil {
+			return fmt.Errorf("failed to move torn signature aside: %w", err)
+		}
+		report.Unsigned++
+		dropped = true
+	}
+	if !dropped {
+		return nil
+	}
+	return atomicfile.SyncDir(dir)
+}
+
+// walkEntries calls fn for every directory of the store holding a hash, skipping internal state.
+func (w *FileSystem) walkEntries(ctx context.Context, fn func(dir, rel string, key storage.Key) error) error {
+	return w.walkLayout(ctx, w.parseEntryDir, fn)
+}
+
+// walkLayout walks the store like walkEntries, mapping directories to keys with parse, so upgrades can
+// walk the layouts of older format versions.
+func (w *FileSystem) walkLayout(ctx context.Context, parse func(rel string) (storage.Key, error), fn func(dir, rel string, key storage.Key) error) error {
+	base := filepath.Clean(w.BaseDir)
+	return filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == base {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == internalDir && filepath.Dir(path) == base {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "hash.txt")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		key, err := parse(rel)
+		if err != nil {
+			return nil // reported by Scrub
+		}
+		return fn(path, filepath.ToSlash(rel), key)
+	})
+}
+
+// Leaves returns every stored revision, archived incarnations included, as leaves of the Merkle tree.
+func (w *FileSystem) Leaves(ctx context.Context) ([]signing.Leaf, error) {
+	var leaves []signing.Leaf
+	err := w.walkEntries(ctx, func(dir, rel string, _ storage.Key) error {
+		hashBytes, err := os.ReadFile(filepath.Join(dir, "hash.txt"))
+		if err != nil {
+			return fmt.Errorf("failed to read hash: %w", err)
+		}
+		leaves = append(leaves, signing.Leaf{Key: rel, Hash: string(hashBytes)})
+		return nil
+	})
+	return leaves, err
+}
+
+// Attest signs the Merkle root over the whole store and writes it to .bastion/attestation.json, once every
+// revision and tombstone in it verifies against its signature, so the attestation never vouches for
+// anything Bastion did not sign. Entries being written are left out until a later attestation, as their
+// signature is written last.
+func (w *FileSystem) Attest(ctx context.Context) (*signing.Attestation, error) {
+	if w.Signer == nil {
+		return nil, fmt.Errorf("no signing key configured")
+	}
+	verifier := w.Signer.Verifier()
+	var report storage.ScrubReport
+	var leaves []signing.Leaf
+	err := w.walkEntries(ctx, func(dir, rel string, key storage.Key) error {
+		if isPending(dir) {
+			return nil
+		}
+		hashBytes, err := os.ReadFile(filepath.Join(dir, "hash.txt"))
+		if err != nil {
+			return fmt.Errorf("failed to read hash: %w", err)
+		}
+		leaves = append(leaves, signing.Leaf{Key: rel, Hash: string(hashBytes)})
+		problem := func(t storage.ProblemType, path, detail string) {
+			report.Add(storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+		}
+		verifyEntry(dir, key, verifier, nil, problem)
+		verifyTombstone(dir, key, verifier, problem)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Problems) > 0 {
+		first := report.Problems[0]
+		return nil, fmt.Errorf("refusing to attest a store with %d signature problems, first %s at %s: %s",
+			len(report.Problems), first.Type, first.Path, first.Detail)
+	}
+	attestation := w.Signer.Attest(leaves)
+	data, err := json.MarshalIndent(attestation, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attestation: %w", err)
+	}
+	dir := filepath.Join(w.BaseDir, internalDir)
+	if err := mkdirAllSync(dir, w.BaseDir); err != nil {
+		return nil, fmt.Errorf("failed to create attestation dir: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, attestationFile), data); err != nil {
+		return nil, fmt.Errorf("failed to write attestation: %w", err)
+	}
+	return attestation, nil
+}
+
+// RunAttestation refreshes the attestation every interval until ctx is done.
+func (w *FileSystem) RunAttestation(ctx context.Context, interval time.Duration) {
+	logger := log.FromContext(ctx).WithName("FileSystem").WithName("attest")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			attestation, err := w.Attest(ctx)
+			if err != nil {
+				logger.Error(err, "failed to attest store")
+				continue
+			}
+			logger.Info("Attested store", "root", attestation.Root, "revisions", attestation.Leaves)
+		}
+	}
+}
+
+// Verify checks every stored revision against its hash and signature, every tombstone against its signature,
+// and the store as a whole against the last attestation. Revisions written since the attestation show up as a root mismatch.
+func (w *FileSystem) Verify(ctx context.Context, verifier *signing.Verifier, hasher hash.Hasher) (storage.ScrubReport, error) {
+	var report storage.ScrubReport
+	var leaves []signing.Leaf
+	err := w.walkEntries(ctx, func(dir, rel string, key storage.Key) error {
+		report.Scanned++
+		problem := func(t storage.ProblemType, path, detail string) {
+			report.Add(storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+		}
+		hashBytes, err := os.ReadFile(filepath.Join(dir, "hash.txt"))
+		if err != nil {
+			return fmt.Errorf("failed to read hash: %w", err)
+		}
+		leaves = append(leaves, signing.Leaf{Key: rel, Hash: string(hashBytes)})
+		verifyEntry(dir, key, verifier, hasher, problem)
+		verifyTombstone(dir, key, verifier, problem)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	attestationPath := filepath.Join(w.BaseDir, internalDir, attestationFile)
+	data, err := os.ReadFile(attestationPath)
+	if err != nil {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemRootMismatch, Path: attestationPath, Detail: "no attestation found"})
+		return report, nil
+	}
+	attestation := &signing.Attestation{}
+	if err := json.Unmarshal(data, attestation); err != nil {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemRootMismatch, Path: attestationPath, Detail: err.Error()})
+		return report, nil
+	}
+	if err := verifier.VerifyAttestation(attestation, leaves); err != nil {
+		report.Add(storage.ScrubProblem{Type: storage.ProblemRootMismatch, Path: attestationPath,
+			Detail: fmt.Sprintf("attestation of %s: %s", attestation.CreatedAt.Format(time.RFC3339), err)})
+	}
+	return report, nil
+}
+
+// verifyEntry checks the revision in dir against its signature, and against hasher unless nil.
+func verifyEntry(dir string, key storage.Key, verifier *signing.Verifier, hasher hash.Hasher, problem func(t storage.ProblemType, path, detail string)) {
+	hashBytes, err := os.ReadFile(filepath.Join(dir, "hash.txt"))
+	if err != nil {
+		problem(storage.ProblemMissingHash, filepath.Join(dir, "hash.txt"), err.Error())
+		return
+	}
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		problem(storage.ProblemMissingManifest, manifestPath, err.Error())
+		return
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(manifest, &obj.Object); err != nil {
+		problem(storage.ProblemCorruptManifest, manifestPath, err.Error())
+		return
+	}
+	if hasher != nil {
+		if computed, err := hasher.Hash(obj); err != nil || computed != string(hashBytes) {
+			problem(storage.ProblemHashMismatch, manifestPath, fmt.Sprintf("stored %s, computed %s", hashBytes, computed))
+		}
+	}
+	sig, ok := readSignature(filepath.Join(dir, signatureFile), problem)
+	if !ok {
+		return
+	}
+	if err := verifier.VerifyRevision(sig, key.GVK, key.Namespace, key.Name, obj.GetUID(), string(hashBytes), manifest); err != nil {
+		problem(storage.ProblemBadSignature, filepath.Join(dir, signatureFile), err.Error())
+	}
+}
+
+// verifyTombstone checks the tombstone in dir, if there is one, against its signature. Empty tombstones
+// written by older versions record no final state and are left alone.
+func verifyTombstone(dir string, key storage.Key, verifier *signing.Verifier, problem func(t storage.ProblemType, path, detail string)) {
+	path := filepath.Join(dir, "tombstone")
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return // reported by Scrub if unreadable
+	}
+	tomb := &storage.Tombstone{}
+	if err := json.Unmarshal(data, tomb); err != nil {
+		problem(storage.ProblemCorruptTombstone, path, err.Error())
+		return
+	}
+	sig, ok := readSignature(filepath.Join(dir, tombstoneSignatureFile), problem)
+	if !ok {
+		return
+	}
+	if err := verifier.VerifyTombstone(sig, key.GVK, key.Namespace, key.Name, tomb.UID, data); err != nil {
+		problem(storage.ProblemBadSignature, filepath.Join(dir, tombstoneSignatureFile), err.Error())
+	}
+}
+
+// readSignature reads the signature at path, reporting it missing, with the reason if recovery moved it
+// aside, or unparsable.
+func readSignature(path string, problem func(t storage.ProblemType, path, detail string)) (*signing.Signature, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		detail := ""
+		if _, err := os.Stat(path + tornSuffix); err == nil {
+			detail = "moved aside by the recovery of a torn write"
+		}
+		problem(storage.ProblemMissingSignature, path, detail)
+		return nil, false
+	}
+	sig := &signing.Signature{}
+	if err := json.Unmarshal(data, sig); err != nil {
+		problem(storage.ProblemBadSignature, path, err.Error())
+		return nil, false
+	}
+	return sig, true
+}
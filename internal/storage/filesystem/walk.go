@@ -0,0 +1,209 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// labelsFile holds the labels of the manifest next to it, so walks filter by label without parsing
+// manifests. Entries written before it existed fall back to the manifest.
+const labelsFile = "labels.json"
+
+// writeLabels records the labels of the manifest written to dir.
+func writeLabels(dir string, labels map[string]string) error {
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, labelsFile), data); err != nil {
+		return fmt.Errorf("failed to write labels: %w", err)
+	}
+	return nil
+}
+
+// readLabels returns the labels of the manifest in dir.
+func readLabels(dir string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, labelsFile))
+	if err == nil {
+		var labels map[string]string
+		if err := json.Unmarshal(data, &labels); err == nil {
+			return labels, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read labels: %w", err)
+	}
+	obj, err := readManifest(dir)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	return obj.GetLabels(), nil
+}
+
+// repairLabels makes the labels file of dir agree with its manifest, dropping it if the manifest is gone.
+func repairLabels(dir string) error {
+	obj, err := readManifest(dir)
+	if err != nil || obj == nil {
+		if err := os.Remove(filepath.Join(dir, labelsFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove labels: %w", err)
+		}
+		return nil
+	}
+	return writeLabels(dir, obj.GetLabels())
+}
+
+// readManifest parses the manifest in dir, or returns nil if there is none.
+func readManifest(dir string) (*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	return obj, nil
+}
+
+// Walk visits one kind at a time, in the order of the encoded keys. Only the namespace the filter names
+// is read, and in flat stores object directories that sort before After or lack the name prefix are
+// skipped before any of their files are read, so every page of a listing reads only the objects it visits.
+func (w *FileSystem) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	kinds, err := w.Kinds(ctx)
+	if err != nil {
+		return err
+	}
+	storage.SortKinds(kinds)
+	for _, gvk := range kinds {
+		if filter.SkipsKind(gvk) {
+			continue
+		}
+		if err := w.walkKind(ctx, gvk, filter, fn); err != nil {
+			if errors.Is(err, storage.StopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// walkKind visits the objects of a GVK selected by filter in the order of their encoded keys. Sharded
+// stores are read from their indexes, labels included; flat stores read the labels of an object only when
+// the filter selects by label.
+func (w *FileSystem) walkKind(ctx context.Context, gvk schema.GroupVersionKind, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	kindDir := filepath.Join(w.BaseDir, storage.EncodeSegment(gvk.Group), storage.EncodeSegment(gvk.Version), storage.EncodeSegment(gvk.Kind))
+	namespaces := []segment{{encoded: storage.EncodeSegment(filter.Namespace), decoded: filter.Namespace}}
+	if filter.Namespace == "" {
+		var err error
+		if namespaces, err = readSegments(kindDir); err != nil {
+			return err
+		}
+		// Keys continue with a slash after the namespace, which sorts after some encoded characters
+		sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].encoded+"/" < namespaces[j].encoded+"/" })
+	}
+	visit := func(entry storage.ObjectEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !filter.Matches(entry) {
+			return nil
+		}
+		return fn(entry)
+	}
+	for _, namespace := range namespaces {
+		// Every key of the namespace starts with its prefix, so all sort before After when the prefix does
+		prefix := storage.KindPrefix(gvk) + namespace.encoded + "/"
+		if filter.After != "" && prefix < filter.After && !strings.HasPrefix(filter.After, prefix) {
+			continue
+		}
+		namespaceDir := filepath.Join(kindDir, namespace.encoded)
+		key := storage.Key{GVK: gvk, Namespace: namespace.decoded}
+		if w.sharded() {
+			// Shards are picked by hash, so the entries of a namespace are only in order once sorted
+			entries, err := listShards(namespaceDir, key)
+			if err != nil {
+				return err
+			}
+			storage.SortEntries(entries)
+			for _, entry := range entries {
+				if err := visit(entry); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		names, err := readSegments(namespaceDir)
+		if err != nil {
+			return err
+		}
+		// Directories are read sorted by name, and names with the prefix are next to each other
+		var encodedPrefix string
+		if filter.NamePrefix != "" {
+			encodedPrefix = storage.EncodeSegment(filter.NamePrefix)
+		}
+		start := sort.Search(len(names), func(i int) bool {
+			return names[i].encoded >= encodedPrefix && (filter.After == "" || prefix+names[i].encoded > filter.After)
+		})
+		for _, name := range names[start:] {
+			if !strings.HasPrefix(name.encoded, encodedPrefix) {
+				break
+			}
+			e, ok := readEntry(filepath.Join(namespaceDir, name.encoded), filter.Labels != nil)
+			if !ok {
+				continue // deleted, or torn and left for recovery
+			}
+			key.Name = name.decoded
+			if err := visit(e.objectEntry(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listKind reads the objects of a GVK, without their labels. Sharded stores are listed from their indexes.
+func (w *FileSystem) listKind(gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	kindDir := filepath.Join(w.BaseDir, storage.EncodeSegment(gvk.Group), storage.EncodeSegment(gvk.Version), storage.EncodeSegment(gvk.Kind))
+	namespaces, err := readSegments(kindDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []storage.ObjectEntry
+	for _, namespace := range namespaces {
+		key := storage.Key{GVK: gvk, Namespace: namespace.decoded}
+		if w.sharded() {
+			listed, err := listShards(filepath.Join(kindDir, namespace.encoded), key)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, listed...)
+			continue
+		}
+		names, err := readSegments(filepath.Join(kindDir, namespace.encoded))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			e, ok := readEntry(filepath.Join(kindDir, namespace.encoded, name.encoded), false)
+			if !ok {
+				continue // deleted, or torn and left for recovery
+			}
+			key.Name = name.decoded
+			entries = append(entries, e.objectEntry(key))
+		}
+	}
+	return entries, nil
+}
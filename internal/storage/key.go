@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strconv"
+	"strings"
+)
+
+// Key identifies a stored object. Cluster-scoped objects have an empty Namespace.
+type Key struct {
+	GVK       schema.GroupVersionKind `json:"gvk"`
+	Namespace string                  `json:"namespace,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+}
+
+// KeyOf returns the key an object is stored under.
+func KeyOf(obj *unstructured.Unstructured) Key {
+	return Key{GVK: obj.GroupVersionKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+}
+
+// NamespacedName returns namespace/name, or only the name for cluster-scoped objects.
+func (k Key) NamespacedName() string {
+	if k.Namespace == "" {
+		return k.Name
+	}
+	return k.Namespace + "/" + k.Name
+}
+
+func (k Key) String() string {
+	return k.GVK.String() + " " + k.NamespacedName()
+}
+
+// Segments returns the encoded group, version, kind, namespace and name of the key. Every backend lays
+// out or indexes objects by these segments, so keys map to storage locations the same way everywhere.
+func (k Key) Segments() []string {
+	return []string{
+		EncodeSegment(k.GVK.Group),
+		EncodeSegment(k.GVK.Version),
+		EncodeSegment(k.GVK.Kind),
+		EncodeSegment(k.Namespace),
+		EncodeSegment(k.Name),
+	}
+}
+
+// Encode returns the segments of the key joined by slashes. The encoded string is the canonical order of
+// keys: walks, pages and continue tokens compare it as a whole, which need not match comparing the
+// segments one by one.
+func (k Key) Encode() string {
+	return strings.Join(k.Segments(), "/")
+}
+
+// ParseSegments is the inverse of Segments.
+func ParseSegments(segments []string) (Key, error) {
+	if len(segments) != 5 {
+		return Key{}, fmt.Errorf("expected group/version/kind/namespace/name, got %d segments", len(segments))
+	}
+	decoded := make([]string, len(segments))
+	for i, s := range segments {
+		d, err := DecodeSegment(s)
+		if err != nil {
+			return Key{}, err
+		}
+		decoded[i] = d
+	}
+	if decoded[1] == "" || decoded[2] == "" || decoded[4] == "" {
+		return Key{}, fmt.Errorf("version, kind and name must not be empty")
+	}
+	return Key{
+		GVK:       schema.GroupVersionKind{Group: decoded[0], Version: decoded[1], Kind: decoded[2]},
+		Namespace: decoded[3],
+		Name:      decoded[4],
+	}, nil
+}
+
+// ParseKey is the inverse of Encode.
+func ParseKey(encoded string) (Key, error) {
+	return ParseSegments(strings.Split(encoded, "/"))
+}
+
+// EncodeSegment encodes a key segment so it is safe as a single path element on any filesystem,
+// including case-insensitive ones, and distinct segments never encode alike:
+//   - lowercase letters, digits, '-' and '.' are kept, except for a leading '.'
+//   - an uppercase letter becomes '!' followed by the letter in lowercase
+//   - any other byte becomes '%' followed by two uppercase hex digits
+//   - the empty segment, e.g. the namespace of a cluster-scoped object, becomes '_'
+func EncodeSegment(s string) string {
+	if s == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.' && i > 0:
+			b.WriteByte(c)
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte('!')
+			b.WriteByte(c + 'a' - 'A')
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeSegment is the inverse of EncodeSegment. It only accepts segments in the form EncodeSegment
+// produces, so every segment has exactly one encoding.
+func DecodeSegment(s string) (string, error) {
+	if s == "_" {
+		return "", nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '!':
+			if i+1 >= len(s) || s[i+1] < 'a' || s[i+1] > 'z' {
+				return "", fmt.Errorf("invalid segment %q: '!' must precede a lowercase letter", s)
+			}
+			b.WriteByte(s[i+1] - 'a' + 'A')
+			i++
+		case '%':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("invalid segment %q: truncated escape", s)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid segment %q: bad escape", s)
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	decoded := b.String()
+	if EncodeSegment(decoded) != s {
+		return "", fmt.Errorf("invalid segment %q: not in canonical encoding", s)
+	}
+	return decoded, nil
+}
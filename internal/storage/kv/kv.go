@@ -0,0 +1,615 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dbFile is the database below the root of a store.
+	dbFile = "bastion.db"
+	// FormatVersion is the layout of buckets this build writes. Version 2 added the index bucket, version 3
+	// the metadata bucket.
+	FormatVersion = 3
+	// walkBatch is the number of objects Walk reads in one transaction. Its callback runs in between, so
+	// it may write to the store.
+	walkBatch = 1000
+)
+
+// Top-level buckets. Objects and hashes hold a bucket per kind, named by the encoded group, version and
+// kind, keyed by encoded namespace/name, so listing a kind reads its hashes without touching manifests.
+// The others are keyed by the whole encoded key.
+var (
+	bucketMeta         = []byte("meta")
+	bucketObjects      = []byte("objects")      // Manifest of the current revision
+	bucketHashes       = []byte("hashes")       // Hash of the current revision
+	bucketIndex        = []byte("index")        // Labels and backup time of the current revision, for Walk
+	bucketMetadata     = []byte("metadata")     // Metadata of the current revision
+	bucketTombstones   = []byte("tombstones")   // Tombstones, so listing them does not scan every object
+	bucketLineage      = []byte("lineage")      // Incarnations that existed under a name
+	bucketIncarnations = []byte("incarnations") // Latest revision of superseded incarnations, keyed by key/uid
+	keyVersion         = []byte("version")
+	keyID              = []byte("id")
+)
+
+// KV is a Storage kept in a single-file embedded key-value database. Every change is one transaction, so
+// a manifest and its hash are always updated together, and reads see a consistent point in time.
+type KV struct {
+	Dir string // Root of the store, the database is Dir/bastion.db
+	db  *bolt.DB
+}
+
+var _ storage.Storage = &KV{}
+
+// kvCache holds open stores: the database is locked by the process that opened it.
+var (
+	kvCache = make(map[string]*KV)
+	kvMu    sync.Mutex
+)
+
+// Open opens the store rooted at dir, creating its database if needed. Databases written by a newer
+// build are refused.
+func Open(dir string) (*KV, error) {
+	kvMu.Lock()
+	defer kvMu.Unlock()
+	if s, ok := kvCache[dir]; ok {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, dbFile), 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketMeta, bucketObjects, bucketHashes, bucketIndex, bucketMetadata, bucketTombstones, bucketLineage, bucketIncarnations} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(bucketMeta)
+		if meta.Get(keyID) == nil {
+			if err := meta.Put(keyID, []byte(uuid.NewUUID())); err != nil {
+				return err
+			}
+		}
+		stored := meta.Get(keyVersion)
+		if stored == nil {
+			return meta.Put(keyVersion, []byte(strconv.Itoa(FormatVersion)))
+		}
+		version, err := strconv.Atoi(string(stored))
+		if err != nil {
+			return fmt.Errorf("invalid format version %q", stored)
+		}
+		if version > FormatVersion {
+			return fmt.Errorf("database format version %d is newer than this build, which writes version %d", version, FormatVersion)
+		}
+		if version < 2 {
+			if err := buildIndex(tx); err != nil {
+				return fmt.Errorf("failed to build index: %w", err)
+			}
+		}
+		return meta.Put(keyVersion, []byte(strconv.Itoa(FormatVersion)))
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	s := &KV{Dir: dir, db: db}
+	kvCache[dir] = s
+	return s, nil
+}
+
+// ID returns the identity recorded in the database when it was created.
+func (s *KV) ID(ctx context.Context) (string, error) {
+	var id string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(bucketMeta).Get(keyID))
+		return nil
+	})
+	return id, err
+}
+
+// Close closes the database. The store cannot be used afterwards.
+func (s *KV) Close() error {
+	kvMu.Lock()
+	delete(kvCache, s.Dir)
+	kvMu.Unlock()
+	return s.db.Close()
+}
+
+// Snapshot writes a consistent copy of the whole database to w, taken in a single read transaction while
+// writes carry on. The copy is a database Open can read, once placed in a store dir as bastion.db.
+func (s *KV) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return n, nil
+}
+
+// revision is the manifest, hash and metadata of an archived incarnation.
+type revision struct {
+	Hash     string          `json:"hash"`
+	Manifest json.RawMessage `json:"manifest"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// indexValue is what the index records about the current revision of an object.
+type indexValue struct {
+	Labels   map[string]string `json:"labels,omitempty"`
+	Modified time.Time         `json:"modified"`
+}
+
+// tombstoneValue is a tombstone along with the time it was written.
+type tombstoneValue struct {
+	storage.Tombstone
+	Written time.Time `json:"written"`
+}
+
+// kindName is the name of the bucket holding the objects of a kind.
+func kindName(gvk schema.GroupVersionKind) []byte {
+	return []byte(strings.Join(storage.Key{GVK: gvk}.Segments()[:3], "/"))
+}
+
+// parseKindName is the inverse of kindName.
+func parseKindName(name string) (schema.GroupVersionKind, error) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 3 {
+		return schema.GroupVersionKind{}, fmt.Errorf("invalid kind bucket %q", name)
+	}
+	decoded := make([]string, len(segments))
+	for i, segment := range segments {
+		d, err := storage.DecodeSegment(segment)
+		if err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		decoded[i] = d
+	}
+	return schema.GroupVersionKind{Group: decoded[0], Version: decoded[1], Kind: decoded[2]}, nil
+}
+
+// objectName is the key of an object in the bucket of its kind.
+func objectName(key storage.Key) []byte {
+	segments := key.Segments()
+	return []byte(segments[3] + "/" + segments[4])
+}
+
+// kindBucket returns the bucket of a kind below parent, creating it if create is set. It returns nil if
+// the kind has no bucket and create is not set.
+func kindBucket(tx *bolt.Tx, parent []byte, gvk schema.GroupVersionKind, create bool) (*bolt.Bucket, error) {
+	if create {
+		return tx.Bucket(parent).CreateBucketIfNotExists(kindName(gvk))
+	}
+	return tx.Bucket(parent).Bucket(kindName(gvk)), nil
+}
+
+// incarnationKey is the key of the archived incarnation uid of key.
+func incarnationKey(key storage.Key, uid types.UID) []byte {
+	return []byte(key.Encode() + "/" + storage.EncodeSegment(string(uid)))
+}
+
+// Write stores the manifest, hash and metadata of obj in one transaction, unless the hash is the one
+// stored.
+// Writing an object whose UID differs from the stored one archives the previous incarnation first.
+func (s *KV) Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (bool, error) {
+	key := storage.KeyOf(obj)
+	manifest, err := json.Marshal(obj.Object)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal object: %w", err)
+	}
+	now := time.Now().UTC()
+	md, err := json.Marshal(storage.NewMetadata(ctx, obj, now))
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	changed := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		hashes, err := kindBucket(tx, bucketHashes, key.GVK, true)
+		if err != nil {
+			return err
+		}
+		objects, err := kindBucket(tx, bucketObjects, key.GVK, true)
+		if err != nil {
+			return err
+		}
+		name := objectName(key)
+		if string(hashes.Get(name)) == hash {
+			return nil // no change
+		}
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		current := storage.Current(lineage)
+		metadata, err := kindBucket(tx, bucketMetadata, key.GVK, true)
+		if err != nil {
+			return err
+		}
+		if current != nil && obj.GetUID() != "" && current.UID != obj.GetUID() && objects.Get(name) != nil {
+			if err := archive(tx, key, current.UID, revision{Hash: string(hashes.Get(name)), Manifest: objects.Get(name), Metadata: metadata.Get(name)}); err != nil {
+				return err
+			}
+		}
+		if err := objects.Put(name, manifest); err != nil {
+			return err
+		}
+		if err := hashes.Put(name, []byte(hash)); err != nil {
+			return err
+		}
+		if err := metadata.Put(name, md); err != nil {
+			return err
+		}
+		changed = true
+		if err := writeIndex(tx, key, indexValue{Labels: obj.GetLabels(), Modified: now}); err != nil {
+			return err
+		}
+		return writeLineage(tx, key, storage.RecordBackup(lineage, obj.GetUID(), now))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to write object: %w", err)
+	}
+	return changed, nil
+}
+
+// archive keeps the revision of the incarnation uid apart when another object takes its name, and
+// drops its tombstone.
+func archive(tx *bolt.Tx, key storage.Key, uid types.UID, rev revision) error {
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return fmt.Errorf("failed to marshal incarnation: %w", err)
+	}
+	if err := tx.Bucket(bucketIncarnations).Put(incarnationKey(key, uid), data); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTombstones).Delete([]byte(key.Encode()))
+}
+
+func (s *KV) Read(ctx context.Context, key storage.Key) (*unstructured.Unstructured, string, error) {
+	var obj *unstructured.Unstructured
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		obj, hash, err = readObject(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, hash, nil
+}
+
+// readObject loads the manifest and hash of the current revision of key, or nil if there are none.
+func readObject(tx *bolt.Tx, key storage.Key) (*unstructured.Unstructured, string, error) {
+	objects, _ := kindBucket(tx, bucketObjects, key.GVK, false)
+	hashes, _ := kindBucket(tx, bucketHashes, key.GVK, false)
+	if objects == nil || hashes == nil {
+		return nil, "", nil
+	}
+	manifest, hash := objects.Get(objectName(key)), hashes.Get(objectName(key))
+	if manifest == nil || hash == nil {
+		return nil, "", nil
+	}
+	obj, err := decodeManifest(manifest, key.GVK)
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, string(hash), nil
+}
+
+// decodeManifest parses a stored manifest. bbolt values are only valid inside their transaction, so the
+// object is unmarshaled before it ends.
+func decodeManifest(manifest []byte, gvk schema.GroupVersionKind) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(manifest, &obj.Object); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	obj.SetGroupVersionKind(gvk)
+	return obj, nil
+}
+
+// Delete removes an object along with its tombstone, lineage and archived incarnations.
+func (s *KV) Delete(ctx context.Context, key storage.Key) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, parent := range [][]byte{bucketObjects, bucketHashes, bucketIndex, bucketMetadata} {
+			b, _ := kindBucket(tx, parent, key.GVK, false)
+			if b == nil {
+				continue
+			}
+			if err := b.Delete(objectName(key)); err != nil {
+				return err
+			}
+		}
+		encoded := []byte(key.Encode())
+		if err := tx.Bucket(bucketTombstones).Delete(encoded); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketLineage).Delete(encoded); err != nil {
+			return err
+		}
+		incarnations := tx.Bucket(bucketIncarnations)
+		prefix := key.Encode() + "/"
+		var archived [][]byte
+		c := incarnations.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			archived = append(archived, append([]byte(nil), k...))
+		}
+		for _, k := range archived {
+			if err := incarnations.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+// MarkTombstone stores the tombstone record of obj, including its final state.
+func (s *KV) MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error {
+	key := storage.KeyOf(obj)
+	tomb := storage.NewTombstone(obj, deletedAt)
+	data, err := json.Marshal(tombstoneValue{Tombstone: *tomb, Written: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		hashes, _ := kindBucket(tx, bucketHashes, key.GVK, false)
+		if hashes == nil || hashes.Get(objectName(key)) == nil {
+			return fmt.Errorf("cannot mark tombstone: %s is not stored", key)
+		}
+		if err := tx.Bucket(bucketTombstones).Put([]byte(key.Encode()), data); err != nil {
+			return fmt.Errorf("failed to write tombstone: %w", err)
+		}
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		return writeLineage(tx, key, storage.RecordDeletion(lineage, obj.GetUID(), &tomb.DeletedAt))
+	})
+}
+
+func (s *KV) ReadTombstone(ctx context.Context, key storage.Key) (*storage.Tombstone, error) {
+	var tomb *storage.Tombstone
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketTombstones).Get([]byte(key.Encode()))
+		if data == nil {
+			return nil
+		}
+		value := &tombstoneValue{}
+		if err := json.Unmarshal(data, value); err != nil {
+			return fmt.Errorf("failed to unmarshal tombstone: %w", err)
+		}
+		tomb = &value.Tombstone
+		return nil
+	})
+	return tomb, err
+}
+
+// ListTombstones reads the tombstones bucket only. ModTime is the time the tombstone was written.
+func (s *KV) ListTombstones(ctx context.Context) ([]storage.TombstoneEntry, error) {
+	var entries []storage.TombstoneEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTombstones).ForEach(func(k, v []byte) error {
+			key, err := storage.ParseKey(string(k))
+			if err != nil {
+				return nil // skip bad entries, reported by Scrub
+			}
+			value := &tombstoneValue{}
+			if err := json.Unmarshal(v, value); err != nil {
+				return nil
+			}
+			entries = append(entries, storage.TombstoneEntry{
+				Key:       key,
+				UID:       value.UID,
+				DeletedAt: value.DeletedAt,
+				ModTime:   value.Written,
+			})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// TombstonePath returns the database file holding the tombstone.
+func (s *KV) TombstonePath(key storage.Key) string {
+	return filepath.Join(s.Dir, dbFile)
+}
+
+// DeleteTombstone clears the tombstone of an object. It fails with an error wrapping os.ErrNotExist if
+// the object has no tombstone.
+func (s *KV) DeleteTombstone(ctx context.Context, key storage.Key) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		tombstones := tx.Bucket(bucketTombstones)
+		if tombstones.Get([]byte(key.Encode())) == nil {
+			return fmt.Errorf("no tombstone for %s: %w", key, os.ErrNotExist)
+		}
+		if err := tombstones.Delete([]byte(key.Encode())); err != nil {
+			return err
+		}
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		return writeLineage(tx, key, storage.RecordDeletion(lineage, "", nil))
+	})
+}
+
+// Kinds returns the kinds whose hash bucket holds any object.
+func (s *KV) Kinds(ctx context.Context) ([]schema.GroupVersionKind, error) {
+	var kinds []schema.GroupVersionKind
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hashes := tx.Bucket(bucketHashes)
+		return hashes.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil // not a bucket
+			}
+			if first, _ := hashes.Bucket(k).Cursor().First(); first == nil {
+				return nil
+			}
+			gvk, err := parseKindName(string(k))
+			if err != nil {
+				return nil
+			}
+			kinds = append(kinds, gvk)
+			return nil
+		})
+	})
+	return kinds, err
+}
+
+// List reads the hash and index buckets of a kind, and the tombstones bucket for every object in it.
+func (s *KV) List(ctx context.Context, gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	var entries []storage.ObjectEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := newKindReader(tx, gvk)
+		if k == nil {
+			return nil
+		}
+		return k.hashes.ForEach(func(name, hash []byte) error {
+			if entry, ok := k.entry(name, hash); ok {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *KV) Lineage(ctx context.Context, key storage.Key) ([]storage.Incarnation, error) {
+	var lineage []storage.Incarnation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lineage, err = readLineage(tx, key)
+		return err
+	})
+	return lineage, err
+}
+
+// ReadIncarnation loads the latest revision of the incarnation with the given UID.
+func (s *KV) ReadIncarnation(ctx context.Context, key storage.Key, uid types.UID) (*unstructured.Unstructured, string, error) {
+	var obj *unstructured.Unstructured
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		if current := storage.Current(lineage); uid == "" || (current != nil && current.UID == uid) {
+			obj, hash, err = readObject(tx, key)
+			return err
+		}
+		data := tx.Bucket(bucketIncarnations).Get(incarnationKey(key, uid))
+		if data == nil {
+			return nil
+		}
+		rev := revision{}
+		if err := json.Unmarshal(data, &rev); err != nil {
+			return fmt.Errorf("failed to unmarshal incarnation: %w", err)
+		}
+		obj, err = decodeManifest(rev.Manifest, key.GVK)
+		hash = rev.Hash
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, hash, nil
+}
+
+// ReadMetadata loads the metadata of the latest revision of the incarnation with the given UID.
+func (s *KV) ReadMetadata(ctx context.Context, key storage.Key, uid types.UID) (*storage.Metadata, error) {
+	var md *storage.Metadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if current := storage.Current(lineage); uid == "" || (current != nil && current.UID == uid) {
+			if metadata, _ := kindBucket(tx, bucketMetadata, key.GVK, false); metadata != nil {
+				data = metadata.Get(objectName(key))
+			}
+		} else if archived := tx.Bucket(bucketIncarnations).Get(incarnationKey(key, uid)); archived != nil {
+			rev := revision{}
+			if err := json.Unmarshal(archived, &rev); err != nil {
+				return fmt.Errorf("failed to unmarshal incarnation: %w", err)
+			}
+			data = rev.Metadata
+		}
+		if data == nil {
+			return nil
+		}
+		md = &storage.Metadata{}
+		if err := json.Unmarshal(data, md); err != nil {
+			return fmt.Errorf("failed to unmarshal metadata: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// DeleteIncarnation removes an archived incarnation and its lineage entry in one transaction.
+func (s *KV) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		lineage, err := readLineage(tx, key)
+		if err != nil {
+			return err
+		}
+		if current := storage.Current(lineage); uid == "" || (current != nil && current.UID == uid) {
+			return fmt.Errorf("cannot delete incarnation %s of %s: it is the current one", uid, key)
+		}
+		if err := tx.Bucket(bucketIncarnations).Delete(incarnationKey(key, uid)); err != nil {
+			return err
+		}
+		return writeLineage(tx, key, storage.DropIncarnation(lineage, uid))
+	})
+}
+
+func readLineage(tx *bolt.Tx, key storage.Key) ([]storage.Incarnation, error) {
+	data := tx.Bucket(bucketLineage).Get([]byte(key.Encode()))
+	if data == nil {
+		return nil, nil
+	}
+	var lineage []storage.Incarnation
+	if err := json.Unmarshal(data, &lineage); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lineage: %w", err)
+	}
+	return lineage, nil
+}
+
+func writeLineage(tx *bolt.Tx, key storage.Key, lineage []storage.Incarnation) error {
+	if len(lineage) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(lineage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lineage: %w", err)
+	}
+	return tx.Bucket(bucketLineage).Put([]byte(key.Encode()), data)
+}
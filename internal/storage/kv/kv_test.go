@@ -0,0 +1,190 @@
+package kv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestKV(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KV Suite")
+}
+
+var _ = storagetest.DescribeStorage("KV", func() storage.Storage {
+	store, err := Open(GinkgoT().TempDir())
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(store.Close)
+	return store
+})
+
+var _ = Describe("KV", func() {
+	var (
+		ctx    context.Context
+		store  *KV
+		hasher hash.Hasher
+	)
+
+	write := func(obj *unstructured.Unstructured) {
+		h, err := hasher.Hash(obj)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, obj, h)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		hasher = hash.NewDefaultHasher()
+		var err error
+		store, err = Open(GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() { _ = store.Close() })
+	})
+
+	It("keeps objects, tombstones and incarnations in their buckets across a reopen", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		write(storagetest.NewTask("task-b", "uid-2", "other"))
+		Expect(store.MarkTombstone(ctx, storagetest.NewTask("task-b", "uid-2", "other"), time.Now())).To(Succeed())
+		write(storagetest.NewTask("task-a", "uid-3", "recreated"))
+		write(storagetest.NewTask("task-c", "uid-4", "gone"))
+		Expect(store.Delete(ctx, storagetest.TaskKey("task-c"))).To(Succeed())
+
+		dir := store.Dir
+		Expect(store.Close()).To(Succeed())
+		var err error
+		store, err = Open(dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.GetUID()).To(Equal(types.UID("uid-3")))
+		previous, _, err := store.ReadIncarnation(ctx, storagetest.TaskKey("task-a"), "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(previous.Object["spec"]).To(HaveKeyWithValue("description", "first"))
+		md, err := store.ReadMetadata(ctx, storagetest.TaskKey("task-a"), "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md.UID).To(Equal(types.UID("uid-1")))
+		md, err = store.ReadMetadata(ctx, storagetest.TaskKey("task-a"), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md.UID).To(Equal(types.UID("uid-3")))
+		lineage, err := store.Lineage(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(2))
+
+		kinds, err := store.Kinds(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kinds).To(ConsistOf(storagetest.TaskGVK))
+		entries, err := store.List(ctx, storagetest.TaskGVK)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[1].Tombstoned).To(BeTrue())
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(HaveLen(1))
+		Expect(tombstones[0].Key).To(Equal(storagetest.TaskKey("task-b")))
+	})
+
+	It("takes snapshots that later writes do not change", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		snapshotDir := GinkgoT().TempDir()
+		f, err := os.Create(filepath.Join(snapshotDir, dbFile))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Snapshot(ctx, f)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		write(storagetest.NewTask("task-a", "uid-1", "second"))
+
+		snapshot, err := Open(snapshotDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer snapshot.Close()
+		obj, _, err := snapshot.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Object["spec"]).To(HaveKeyWithValue("description", "first"))
+	})
+
+	It("serves snapshots to processes that cannot open the locked database", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		path := filepath.Join(GinkgoT().TempDir(), dbFile)
+		_, err := RequestSnapshot(ctx, store.Dir, path)
+		Expect(err).To(MatchError(ErrNotServed))
+
+		serveCtx, cancel := context.WithCancel(ctx)
+		served := make(chan error)
+		go func() { served <- store.ServeSnapshots(serveCtx) }()
+		Eventually(func() error {
+			_, err := RequestSnapshot(ctx, store.Dir, path)
+			return err
+		}).Should(Succeed())
+		_, err = RequestSnapshot(ctx, store.Dir, "relative.db")
+		Expect(err).To(MatchError(ContainSubstring("must be absolute")))
+		cancel()
+		Expect(<-served).To(Succeed())
+
+		snapshot, err := Open(filepath.Dir(path))
+		Expect(err).NotTo(HaveOccurred())
+		defer snapshot.Close()
+		obj, _, err := snapshot.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Object["spec"]).To(HaveKeyWithValue("description", "first"))
+	})
+
+	It("walks from the seek position of its filter and indexes databases of version 1", func() {
+		for _, name := range []string{"app-a", "app-b", "app-c", "job-a"} {
+			obj := storagetest.NewTask(name, "uid-"+name, name)
+			obj.SetLabels(map[string]string{"team": "blue"})
+			write(obj)
+		}
+		dir := store.Dir
+		Expect(store.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(bucketIndex); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketMeta).Put(keyVersion, []byte("1"))
+		})).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+		var err error
+		store, err = Open(dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		filter := storage.Filter{
+			Namespace:  "default",
+			NamePrefix: "app-",
+			Labels:     labels.SelectorFromSet(labels.Set{"team": "blue"}),
+			After:      storagetest.TaskKey("app-a").Encode(),
+		}
+		page, err := storage.ListPage(ctx, store, filter, 1, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Entries).To(HaveLen(1))
+		Expect(page.Entries[0].Name).To(Equal("app-b"))
+		Expect(page.Entries[0].Modified).NotTo(BeZero())
+		page, err = storage.ListPage(ctx, store, filter, 1, page.Continue)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Entries[0].Name).To(Equal("app-c"))
+		Expect(page.Continue).To(BeEmpty())
+	})
+
+	It("reports manifests that do not match their hash", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		Expect(store.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketHashes).Bucket(kindName(storagetest.TaskGVK)).Put(objectName(storagetest.TaskKey("task-a")), []byte("stale"))
+		})).To(Succeed())
+
+		report, err := store.Scrub(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Scanned).To(Equal(1))
+		Expect(report.Counts()).To(Equal(map[storage.ProblemType]int{storage.ProblemHashMismatch: 1}))
+	})
+})
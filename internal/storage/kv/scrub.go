@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"path/filepath"
+)
+
+// Scrub verifies every stored object within one read transaction, so it sees the store at a single
+// point in time while writes carry on.
+func (s *KV) Scrub(ctx context.Context, hasher hash.Hasher) (storage.ScrubReport, error) {
+	var report storage.ScrubReport
+	path := filepath.Join(s.Dir, dbFile)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// The pages of the database itself, before what they hold
+		for err := range tx.Check() {
+			report.Add(storage.ScrubProblem{Type: storage.ProblemCorruptRecord, Path: path, Detail: err.Error()})
+		}
+		objects, hashes := tx.Bucket(bucketObjects), tx.Bucket(bucketHashes)
+		err := objects.ForEach(func(kind, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			manifests := objects.Bucket(kind)
+			stored := hashes.Bucket(kind)
+			metadata := tx.Bucket(bucketMetadata).Bucket(kind)
+			return manifests.ForEach(func(name, manifest []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				report.Scanned++
+				key, err := storage.ParseKey(string(kind) + "/" + string(name))
+				if err != nil {
+					report.Add(storage.ScrubProblem{Type: storage.ProblemInvalidPath, Path: path, Detail: err.Error()})
+					return nil
+				}
+				var h, md []byte
+				if stored != nil {
+					h = stored.Get(name)
+				}
+				if metadata != nil {
+					md = metadata.Get(name)
+				}
+				scrubObject(path, key, manifest, h, md, hasher, &report)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = hashes.ForEach(func(kind, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			manifests := objects.Bucket(kind)
+			return hashes.Bucket(kind).ForEach(func(name, _ []byte) error {
+				if manifests == nil || manifests.Get(name) == nil {
+					key, _ := storage.ParseKey(string(kind) + "/" + string(name))
+					report.Add(storage.ScrubProblem{Type: storage.ProblemMissingManifest, Path: path, Key: key})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bucketTombstones).ForEach(func(k, v []byte) error {
+			key, _ := storage.ParseKey(string(k))
+			if err := json.Unmarshal(v, &tombstoneValue{}); err != nil {
+				report.Add(storage.ScrubProblem{Type: storage.ProblemCorruptTombstone, Path: path, Key: key, Detail: err.Error()})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketLineage).ForEach(func(k, v []byte) error {
+			key, _ := storage.ParseKey(string(k))
+			if err := json.Unmarshal(v, &[]storage.Incarnation{}); err != nil {
+				report.Add(storage.ScrubProblem{Type: storage.ProblemCorruptLineage, Path: path, Key: key, Detail: err.Error()})
+			}
+			return nil
+		})
+	})
+	return report, err
+}
+
+// scrubObject verifies the manifest of key against its stored hash and metadata.
+func scrubObject(path string, key storage.Key, manifest, stored, metadata []byte, hasher hash.Hasher, report *storage.ScrubReport) {
+	problem := func(t storage.ProblemType, detail string) {
+		report.Add(storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(manifest, &obj.Object); err != nil {
+		problem(storage.ProblemCorruptManifest, err.Error())
+		return
+	}
+	if storage.KeyOf(obj) != key {
+		problem(storage.ProblemPathMismatch, fmt.Sprintf("manifest is %s", storage.KeyOf(obj)))
+	}
+	if metadata != nil {
+		md := &storage.Metadata{}
+		if err := json.Unmarshal(metadata, md); err != nil {
+			problem(storage.ProblemCorruptMetadata, err.Error())
+		} else if !md.Describes(obj) {
+			problem(storage.ProblemCorruptMetadata, fmt.Sprintf("metadata is of uid %s, resourceVersion %s", md.UID, md.ResourceVersion))
+		}
+	}
+	if stored == nil {
+		problem(storage.ProblemMissingHash, "")
+		return
+	}
+	if hasher == nil {
+		return
+	}
+	computed, err := hasher.Hash(obj)
+	if err != nil {
+		problem(storage.ProblemCorruptManifest, err.Error())
+		return
+	}
+	if computed != string(stored) {
+		problem(storage.ProblemHashMismatch, fmt.Sprintf("stored %s, computed %s", stored, computed))
+	}
+}
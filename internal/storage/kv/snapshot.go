@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strconv"
+	"strings"
+)
+
+// ErrNotServed is returned by RequestSnapshot when no process takes snapshot requests for a store.
+var ErrNotServed = errors.New("no process serves snapshots of the store")
+
+// SnapshotSocket returns the socket the process holding the store rooted at dir takes snapshot requests on.
+func SnapshotSocket(dir string) string {
+	return filepath.Join(dir, ".bastion", "snapshot.sock")
+}
+
+// SnapshotFile writes a snapshot to path through a temp file next to it, renamed into place once synced,
+// and returns its size.
+func (s *KV) SnapshotFile(ctx context.Context, path string) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	n, err := s.Snapshot(ctx, tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return n, fmt.Errorf("failed to commit snapshot: %w", err)
+	}
+	return n, nil
+}
+
+// ServeSnapshots takes snapshot requests on the socket of the store until ctx is done. The database is
+// locked by the process holding it open, so other processes, such as bastionctl, cannot open it and ask
+// that process for snapshots instead. Snapshots are written where requested, by this process.
+func (s *KV) ServeSnapshots(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("KV").WithName("snapshots")
+	socket := SnapshotSocket(s.Dir)
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot socket dir: %w", err)
+	}
+	// A socket left by a process that crashed refuses connections, and is replaced
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale snapshot socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen for snapshot requests: %w", err)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to restrict snapshot socket: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("to")
+		if !filepath.IsAbs(path) {
+			http.Error(w, "the snapshot path must be absolute", http.StatusBadRequest)
+			return
+		}
+		n, err := s.SnapshotFile(r.Context(), path)
+		if err != nil {
+			logger.Error(err, "failed to write requested snapshot", "path", path)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Wrote requested snapshot", "path", path, "bytes", n)
+		fmt.Fprint(w, n)
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve snapshot requests: %w", err)
+	}
+	return nil
+}
+
+// RequestSnapshot asks the process holding the store rooted at dir to write a snapshot to the absolute
+// path, and returns its size.
+func RequestSnapshot(ctx context.Context, dir, path string) (int64, error) {
+	socket := SnapshotSocket(dir)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://kv/snapshot?to="+url.QueryEscape(path), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return 0, fmt.Errorf("%w: %v", ErrNotServed, err)
+		}
+		return 0, fmt.Errorf("failed to request snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read snapshot response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("snapshot refused: %s", strings.TrimSpace(string(body)))
+	}
+	return strconv.ParseInt(string(body), 10, 64)
+}
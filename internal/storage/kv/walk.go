@@ -0,0 +1,179 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/storage"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strings"
+)
+
+// kindReader builds the entries of one kind within a transaction.
+type kindReader struct {
+	prefix     string // Kind prefix of the encoded keys
+	hashes     *bolt.Bucket
+	index      *bolt.Bucket // Nil if no object of the kind was indexed
+	tombstones *bolt.Bucket
+}
+
+// newKindReader returns nil if the kind has no objects.
+func newKindReader(tx *bolt.Tx, gvk schema.GroupVersionKind) *kindReader {
+	hashes, _ := kindBucket(tx, bucketHashes, gvk, false)
+	if hashes == nil {
+		return nil
+	}
+	index, _ := kindBucket(tx, bucketIndex, gvk, false)
+	return &kindReader{prefix: storage.KindPrefix(gvk), hashes: hashes, index: index, tombstones: tx.Bucket(bucketTombstones)}
+}
+
+// entry builds the entry of the object stored under name, skipping names that are not encoded keys.
+func (k *kindReader) entry(name, hash []byte) (storage.ObjectEntry, bool) {
+	encoded := k.prefix + string(name)
+	key, err := storage.ParseKey(encoded)
+	if err != nil {
+		return storage.ObjectEntry{}, false
+	}
+	entry := storage.ObjectEntry{
+		Key:        key,
+		Hash:       string(hash),
+		Tombstoned: k.tombstones.Get([]byte(encoded)) != nil,
+	}
+	if k.index != nil {
+		value := indexValue{}
+		if data := k.index.Get(name); data != nil && json.Unmarshal(data, &value) == nil {
+			entry.Labels, entry.Modified = value.Labels, value.Modified
+		}
+	}
+	return entry, true
+}
+
+// Walk seeks to the first object the filter can select in every kind and reads on in batches, each in a
+// transaction of its own, so fn runs outside of them.
+func (s *KV) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	kinds, err := s.Kinds(ctx)
+	if err != nil {
+		return err
+	}
+	storage.SortKinds(kinds)
+	for _, gvk := range kinds {
+		if filter.SkipsKind(gvk) {
+			continue
+		}
+		// Names in the bucket of a kind are the encoded keys without the kind prefix
+		var within, after string
+		if filter.Namespace != "" {
+			within = storage.EncodeSegment(filter.Namespace) + "/"
+			if filter.NamePrefix != "" {
+				within += storage.EncodeSegment(filter.NamePrefix)
+			}
+		}
+		if prefix := storage.KindPrefix(gvk); strings.HasPrefix(filter.After, prefix) {
+			after = filter.After[len(prefix):]
+		}
+		for {
+			batch, next, err := s.walkBatch(gvk, filter, within, after)
+			if err != nil {
+				return err
+			}
+			for _, entry := range batch {
+				if err := fn(entry); err != nil {
+					if errors.Is(err, storage.StopWalk) {
+						return nil
+					}
+					return err
+				}
+			}
+			if next == "" {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			after = next
+		}
+	}
+	return nil
+}
+
+// walkBatch reads up to walkBatch objects of a kind whose names start with within and sort after after.
+// It returns the entries the filter selects and the name to resume after, empty once the kind is done.
+func (s *KV) walkBatch(gvk schema.GroupVersionKind, filter storage.Filter, within, after string) ([]storage.ObjectEntry, string, error) {
+	var entries []storage.ObjectEntry
+	var next string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := newKindReader(tx, gvk)
+		if k == nil {
+			return nil
+		}
+		seek := within
+		if after > seek {
+			seek = after
+		}
+		c := k.hashes.Cursor()
+		name, hash := c.Seek([]byte(seek))
+		if name != nil && string(name) == after {
+			name, hash = c.Next()
+		}
+		for read := 0; name != nil && bytes.HasPrefix(name, []byte(within)); name, hash = c.Next() {
+			if read == walkBatch {
+				next = after
+				return nil
+			}
+			read++
+			after = string(name)
+			if entry, ok := k.entry(name, hash); ok && filter.Matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, next, err
+}
+
+// writeIndex records the labels and backup time of the current revision of key.
+func writeIndex(tx *bolt.Tx, key storage.Key, value indexValue) error {
+	index, err := kindBucket(tx, bucketIndex, key.GVK, true)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	return index.Put(objectName(key), data)
+}
+
+// buildIndex indexes every stored object, for databases written before the index bucket existed. The
+// backup time of an object is the last backup of its current incarnation, if it has a lineage.
+func buildIndex(tx *bolt.Tx) error {
+	objects := tx.Bucket(bucketObjects)
+	return objects.ForEach(func(kind, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		gvk, err := parseKindName(string(kind))
+		if err != nil {
+			return nil
+		}
+		return objects.Bucket(kind).ForEach(func(name, manifest []byte) error {
+			key, err := storage.ParseKey(string(kind) + "/" + string(name))
+			if err != nil {
+				return nil
+			}
+			obj, err := decodeManifest(manifest, gvk)
+			if err != nil {
+				return nil // reported by Scrub
+			}
+			value := indexValue{Labels: obj.GetLabels()}
+			lineage, err := readLineage(tx, key)
+			if err == nil && storage.Current(lineage) != nil {
+				value.Modified = storage.Current(lineage).LastBackup
+			}
+			return writeIndex(tx, key, value)
+		})
+	})
+}
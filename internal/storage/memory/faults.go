@@ -0,0 +1,140 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Op names a store operation faults can be injected into.
+type Op string
+
+const (
+	OpWrite             Op = "Write"
+	OpRead              Op = "Read"
+	OpDelete            Op = "Delete"
+	OpMarkTombstone     Op = "MarkTombstone"
+	OpReadTombstone     Op = "ReadTombstone"
+	OpListTombstones    Op = "ListTombstones"
+	OpDeleteTombstone   Op = "DeleteTombstone"
+	OpKinds             Op = "Kinds"
+	OpList              Op = "List"
+	OpWalk              Op = "Walk"
+	OpLineage           Op = "Lineage"
+	OpReadIncarnation   Op = "ReadIncarnation"
+	OpReadMetadata      Op = "ReadMetadata"
+	OpDeleteIncarnation Op = "DeleteIncarnation"
+)
+
+// ErrInjected is returned by operations failed on purpose.
+var ErrInjected = errors.New("injected fault")
+
+// Faults injects latency and errors into the operations of a store. Random failures are drawn from a
+// source seeded with Seed, so the same sequence of calls fails the same way on every run.
+type Faults struct {
+	Latency   time.Duration // Delay before every operation, cut short by the context
+	ErrorRate float64       // Chance, from 0 to 1, that an operation fails
+	Seed      int64
+	Ops       []Op  // Operations that fail at ErrorRate, all if empty
+	Err       error // Returned by failing operations, ErrInjected if nil
+	// Partial applies the change of a failing Write, Delete, MarkTombstone, DeleteTombstone or
+	// DeleteIncarnation before its error is returned, as when a write lands but its acknowledgement is lost.
+	Partial bool
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	next  map[Op]int
+	calls map[Op]int
+}
+
+// FailNext makes the next n calls of op fail, whatever the error rate.
+func (f *Faults) FailNext(op Op, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.next == nil {
+		f.next = make(map[Op]int)
+	}
+	f.next[op] = n
+}
+
+// Calls returns how many times op was called, failed calls included.
+func (f *Faults) Calls(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// fail counts a call of op and decides whether it fails.
+func (f *Faults) fail(op Op) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[Op]int)
+	}
+	f.calls[op]++
+	if f.next[op] > 0 {
+		f.next[op]--
+		return true
+	}
+	if f.ErrorRate <= 0 || !f.applies(op) {
+		return false
+	}
+	if f.rand == nil {
+		f.rand = rand.New(rand.NewSource(f.Seed))
+	}
+	return f.rand.Float64() < f.ErrorRate
+}
+
+func (f *Faults) applies(op Op) bool {
+	if len(f.Ops) == 0 {
+		return true
+	}
+	for _, o := range f.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Faults) err() error {
+	if f.Err != nil {
+		return f.Err
+	}
+	return ErrInjected
+}
+
+// inject waits out the latency of op and returns the error it fails with, if any. A nil Faults injects
+// nothing.
+func (f *Faults) inject(ctx context.Context, op Op) error {
+	if f == nil {
+		return nil
+	}
+	if f.Latency > 0 {
+		timer := time.NewTimer(f.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if f.fail(op) {
+		return f.err()
+	}
+	return nil
+}
+
+// mutate runs apply unless op fails. With Partial set, a failing op is applied all the same.
+func (f *Faults) mutate(ctx context.Context, op Op, apply func() (bool, error)) (bool, error) {
+	err := f.inject(ctx, op)
+	if err == nil {
+		return apply()
+	}
+	if f.Partial && ctx.Err() == nil {
+		_, _ = apply()
+	}
+	return false, err
+}
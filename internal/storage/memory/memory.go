@@ -0,0 +1,367 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock returns the current time. Stores read it for backup and tombstone times, so tests can age
+// tombstones without waiting.
+type Clock func() time.Time
+
+// revision is a stored manifest along with its hash and metadata.
+type revision struct {
+	obj      *unstructured.Unstructured
+	hash     string
+	metadata *storage.Metadata
+	modified time.Time // When it was written
+}
+
+// object is everything stored under one key.
+type object struct {
+	current   revision
+	tombstone *storage.Tombstone
+	written   time.Time // When the tombstone was written
+	lineage   []storage.Incarnation
+	archived  map[types.UID]revision // Latest revision of superseded incarnations
+}
+
+// Store is a Storage kept in memory, for tests and dry runs. It is safe for concurrent use and holds
+// deep copies, so callers may modify objects they wrote or read. Nothing survives the process.
+type Store struct {
+	Clock  Clock   // Time source, time.Now if nil
+	Faults *Faults // Faults injected into operations, none if nil
+
+	mu      sync.RWMutex
+	id      string
+	objects map[schema.GroupVersionKind]map[storage.Key]*object
+}
+
+var _ storage.Storage = &Store{}
+
+// storeCache holds the stores opened by name, so every backend opened for a root shares its objects.
+var (
+	storeCache = make(map[string]*Store)
+	storeMu    sync.Mutex
+)
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{id: string(uuid.NewUUID()), objects: make(map[schema.GroupVersionKind]map[storage.Key]*object)}
+}
+
+// ID returns the identity of the store, which lives as long as the process does.
+func (s *Store) ID(ctx context.Context) (string, error) {
+	return s.id, nil
+}
+
+// Open returns the store named name, creating it empty on first use.
+func Open(name string) *Store {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if s, ok := storeCache[name]; ok {
+		return s
+	}
+	s := NewStore()
+	storeCache[name] = s
+	return s
+}
+
+func (s *Store) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// lookup returns the object stored under key, or nil. Callers hold mu.
+func (s *Store) lookup(key storage.Key) *object {
+	return s.objects[key.GVK][key]
+}
+
+// Write stores a copy of obj, unless the hash is the one stored. Writing an object whose UID differs
+// from the stored one archives the previous incarnation and drops its tombstone.
+func (s *Store) Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (bool, error) {
+	return s.Faults.mutate(ctx, OpWrite, func() (bool, error) {
+		key := storage.KeyOf(obj)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		o := s.lookup(key)
+		if o != nil && o.current.hash == hash {
+			return false, nil
+		}
+		if o == nil {
+			if s.objects == nil {
+				s.objects = make(map[schema.GroupVersionKind]map[storage.Key]*object)
+			}
+			if s.objects[key.GVK] == nil {
+				s.objects[key.GVK] = make(map[storage.Key]*object)
+			}
+			o = &object{archived: make(map[types.UID]revision)}
+			s.objects[key.GVK][key] = o
+		}
+		current := storage.Current(o.lineage)
+		if current != nil && obj.GetUID() != "" && current.UID != obj.GetUID() && o.current.obj != nil {
+			o.archived[current.UID] = o.current
+			o.tombstone = nil
+		}
+		now := s.now()
+		o.current = revision{obj: obj.DeepCopy(), hash: hash, metadata: storage.NewMetadata(ctx, obj, now), modified: now}
+		o.lineage = storage.RecordBackup(o.lineage, obj.GetUID(), now)
+		return true, nil
+	})
+}
+
+func (s *Store) Read(ctx context.Context, key storage.Key) (*unstructured.Unstructured, string, error) {
+	if err := s.Faults.inject(ctx, OpRead); err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o := s.lookup(key)
+	if o == nil {
+		return nil, "", nil
+	}
+	return o.current.obj.DeepCopy(), o.current.hash, nil
+}
+
+// Delete removes an object along with its tombstone, lineage and archived incarnations.
+func (s *Store) Delete(ctx context.Context, key storage.Key) error {
+	_, err := s.Faults.mutate(ctx, OpDelete, func() (bool, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.objects[key.GVK], key)
+		if len(s.objects[key.GVK]) == 0 {
+			delete(s.objects, key.GVK)
+		}
+		return true, nil
+	})
+	return err
+}
+
+// MarkTombstone stores the tombstone record of obj, including its final state.
+func (s *Store) MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error {
+	_, err := s.Faults.mutate(ctx, OpMarkTombstone, func() (bool, error) {
+		key := storage.KeyOf(obj)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		o := s.lookup(key)
+		if o == nil {
+			return false, fmt.Errorf("cannot mark tombstone: %s is not stored", key)
+		}
+		o.tombstone = storage.NewTombstone(obj, deletedAt)
+		o.written = s.now()
+		o.lineage = storage.RecordDeletion(o.lineage, obj.GetUID(), &o.tombstone.DeletedAt)
+		return true, nil
+	})
+	return err
+}
+
+func (s *Store) ReadTombstone(ctx context.Context, key storage.Key) (*storage.Tombstone, error) {
+	if err := s.Faults.inject(ctx, OpReadTombstone); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o := s.lookup(key)
+	if o == nil || o.tombstone == nil {
+		return nil, nil
+	}
+	return copyTombstone(o.tombstone), nil
+}
+
+// ListTombstones returns the tombstones ordered by key. ModTime is the time the tombstone was written,
+// as read from the clock.
+func (s *Store) ListTombstones(ctx context.Context) ([]storage.TombstoneEntry, error) {
+	if err := s.Faults.inject(ctx, OpListTombstones); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []storage.TombstoneEntry
+	for _, objects := range s.objects {
+		for key, o := range objects {
+			if o.tombstone == nil {
+				continue
+			}
+			entries = append(entries, storage.TombstoneEntry{
+				Key:       key,
+				UID:       o.tombstone.UID,
+				DeletedAt: o.tombstone.DeletedAt,
+				ModTime:   o.written,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Encode() < entries[j].Encode() })
+	return entries, nil
+}
+
+// TombstonePath returns "": tombstones are not kept in files.
+func (s *Store) TombstonePath(key storage.Key) string {
+	return ""
+}
+
+// DeleteTombstone clears the tombstone of an object. It fails with an error wrapping os.ErrNotExist if
+// the object has no tombstone.
+func (s *Store) DeleteTombstone(ctx context.Context, key storage.Key) error {
+	_, err := s.Faults.mutate(ctx, OpDeleteTombstone, func() (bool, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		o := s.lookup(key)
+		if o == nil || o.tombstone == nil {
+			return false, fmt.Errorf("no tombstone for %s: %w", key, os.ErrNotExist)
+		}
+		o.tombstone = nil
+		o.lineage = storage.RecordDeletion(o.lineage, "", nil)
+		return true, nil
+	})
+	return err
+}
+
+// Kinds returns the kinds that have objects in the store, in the order Walk visits them.
+func (s *Store) Kinds(ctx context.Context) ([]schema.GroupVersionKind, error) {
+	if err := s.Faults.inject(ctx, OpKinds); err != nil {
+		return nil, err
+	}
+	return s.kinds(), nil
+}
+
+func (s *Store) kinds() []schema.GroupVersionKind {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var kinds []schema.GroupVersionKind
+	for gvk := range s.objects {
+		kinds = append(kinds, gvk)
+	}
+	storage.SortKinds(kinds)
+	return kinds
+}
+
+// List returns the objects of a kind ordered by key.
+func (s *Store) List(ctx context.Context, gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	if err := s.Faults.inject(ctx, OpList); err != nil {
+		return nil, err
+	}
+	return s.list(gvk), nil
+}
+
+func (s *Store) list(gvk schema.GroupVersionKind) []storage.ObjectEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []storage.ObjectEntry
+	for key, o := range s.objects[gvk] {
+		entries = append(entries, storage.ObjectEntry{
+			Key:        key,
+			Hash:       o.current.hash,
+			Tombstoned: o.tombstone != nil,
+			Labels:     o.current.obj.GetLabels(),
+			Modified:   o.current.modified,
+		})
+	}
+	storage.SortEntries(entries)
+	return entries
+}
+
+// Walk lists one kind at a time, so fn may write to the store.
+func (s *Store) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	if err := s.Faults.inject(ctx, OpWalk); err != nil {
+		return err
+	}
+	return storage.WalkKinds(ctx, s.kinds(), filter, func(gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+		return s.list(gvk), nil
+	}, fn)
+}
+
+func (s *Store) Lineage(ctx context.Context, key storage.Key) ([]storage.Incarnation, error) {
+	if err := s.Faults.inject(ctx, OpLineage); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o := s.lookup(key)
+	if o == nil {
+		return nil, nil
+	}
+	lineage := make([]storage.Incarnation, len(o.lineage))
+	copy(lineage, o.lineage)
+	return lineage, nil
+}
+
+// ReadIncarnation loads the latest revision of the incarnation with the given UID.
+func (s *Store) ReadIncarnation(ctx context.Context, key storage.Key, uid types.UID) (*unstructured.Unstructured, string, error) {
+	if err := s.Faults.inject(ctx, OpReadIncarnation); err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rev, ok := s.incarnation(key, uid)
+	if !ok {
+		return nil, "", nil
+	}
+	return rev.obj.DeepCopy(), rev.hash, nil
+}
+
+// ReadMetadata returns the metadata of the latest revision of the incarnation with the given UID.
+func (s *Store) ReadMetadata(ctx context.Context, key storage.Key, uid types.UID) (*storage.Metadata, error) {
+	if err := s.Faults.inject(ctx, OpReadMetadata); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rev, ok := s.incarnation(key, uid)
+	if !ok || rev.metadata == nil {
+		return nil, nil
+	}
+	md := *rev.metadata
+	return &md, nil
+}
+
+// DeleteIncarnation removes an archived incarnation and its lineage entry.
+func (s *Store) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	_, err := s.Faults.mutate(ctx, OpDeleteIncarnation, func() (bool, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		o := s.lookup(key)
+		if o == nil {
+			return false, nil
+		}
+		if current := storage.Current(o.lineage); uid == "" || (current != nil && current.UID == uid) {
+			return false, fmt.Errorf("cannot delete incarnation %s of %s: it is the current one", uid, key)
+		}
+		delete(o.archived, uid)
+		o.lineage = storage.DropIncarnation(o.lineage, uid)
+		return true, nil
+	})
+	return err
+}
+
+// incarnation returns the latest revision of the incarnation with the given UID, the current one if uid
+// is empty. Callers hold mu.
+func (s *Store) incarnation(key storage.Key, uid types.UID) (revision, bool) {
+	o := s.lookup(key)
+	if o == nil {
+		return revision{}, false
+	}
+	if current := storage.Current(o.lineage); uid != "" && (current == nil || current.UID != uid) {
+		rev, ok := o.archived[uid]
+		return rev, ok
+	}
+	return o.current, true
+}
+
+func copyTombstone(tomb *storage.Tombstone) *storage.Tombstone {
+	c := *tomb
+	if tomb.FinalState != nil {
+		c.FinalState = tomb.FinalState.DeepCopy()
+	}
+	return &c
+}
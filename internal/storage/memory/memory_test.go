@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+)
+
+func TestMemory(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Memory Suite")
+}
+
+var _ = storagetest.DescribeStorage("Memory", func() storage.Storage { return NewStore() })
+
+var _ = Describe("Store", func() {
+	var (
+		ctx   context.Context
+		now   time.Time
+		store *Store
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		store = NewStore()
+		store.Clock = func() time.Time { return now }
+	})
+
+	It("hands out copies and dates backups and tombstones with its clock", func() {
+		_, err := store.Write(ctx, storagetest.NewTask("task-a", "uid-1", "first"), "h1")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, storagetest.NewTask("task-b", "uid-2", "other"), "h2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.MarkTombstone(ctx, storagetest.NewTask("task-b", "uid-2", "other"), now)).To(Succeed())
+		now = now.Add(time.Hour)
+		_, err = store.Write(ctx, storagetest.NewTask("task-a", "uid-3", "recreated"), "h3")
+		Expect(err).NotTo(HaveOccurred())
+
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		obj.SetName("changed")
+		obj, _, err = store.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.GetName()).To(Equal("task-a"))
+		lineage, err := store.Lineage(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage[1].FirstBackup).To(Equal(now))
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones[0].ModTime).To(Equal(now.Add(-time.Hour)))
+	})
+
+	It("fails the calls it is told to, and applies partial failures", func() {
+		store.Faults = &Faults{Partial: true}
+		store.Faults.FailNext(OpWrite, 2)
+		for i := 0; i < 2; i++ {
+			_, err := store.Write(ctx, storagetest.NewTask("task-a", "uid-1", "first"), "h1")
+			Expect(err).To(MatchError(ErrInjected))
+		}
+		changed, err := store.Write(ctx, storagetest.NewTask("task-a", "uid-1", "first"), "h1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse()) // landed on the first failed attempt
+		Expect(store.Faults.Calls(OpWrite)).To(Equal(3))
+	})
+
+	It("fails the same calls for the same seed", func() {
+		failures := func() []bool {
+			s := NewStore()
+			s.Faults = &Faults{ErrorRate: 0.5, Seed: 42, Ops: []Op{OpRead}}
+			var failed []bool
+			for i := 0; i < 20; i++ {
+				_, _, err := s.Read(ctx, storagetest.TaskKey("task-a"))
+				failed = append(failed, err != nil)
+			}
+			_, err := s.List(ctx, storagetest.TaskGVK)
+			Expect(err).NotTo(HaveOccurred())
+			return failed
+		}
+		first := failures()
+		Expect(first).To(ContainElements(true, false))
+		Expect(failures()).To(Equal(first))
+	})
+
+	It("gives up waiting out latency when the context is done", func() {
+		store.Faults = &Faults{Latency: time.Hour}
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, _, err := store.Read(cancelled, storagetest.TaskKey("task-a"))
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
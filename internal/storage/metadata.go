@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// Metadata records how a revision was captured. Backends store it next to every manifest they write.
+type Metadata struct {
+	CapturedAt      time.Time `json:"capturedAt"`
+	EventType       string    `json:"eventType,omitempty"` // Event that triggered the backup, e.g. update or finalize
+	UID             types.UID `json:"uid,omitempty"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	Cluster         string    `json:"cluster,omitempty"`        // Identity of the cluster the object was captured from
+	BastionVersion  string    `json:"bastionVersion,omitempty"` // Version of Bastion that captured it
+	Hasher          string    `json:"hasher,omitempty"`         // Hasher that produced the stored hash
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context whose writes record md. Fields left empty are filled from the written
+// object, so callers set what only they know, or pass on the metadata of a revision they copy.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// NewMetadata returns the metadata of obj written at now, starting from the one carried by ctx.
+func NewMetadata(ctx context.Context, obj *unstructured.Unstructured, now time.Time) *Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	if md.CapturedAt.IsZero() {
+		md.CapturedAt = now.UTC()
+	}
+	if md.UID == "" {
+		md.UID = obj.GetUID()
+	}
+	if md.ResourceVersion == "" {
+		md.ResourceVersion = obj.GetResourceVersion()
+	}
+	return &md
+}
+
+// Describes reports whether md was recorded for obj. Objects without a UID or resourceVersion match any
+// metadata on that field.
+func (md *Metadata) Describes(obj *unstructured.Unstructured) bool {
+	return (obj.GetUID() == "" || md.UID == obj.GetUID()) &&
+		(obj.GetResourceVersion() == "" || md.ResourceVersion == obj.GetResourceVersion())
+}
+
+// WithSourceMetadata returns a context whose writes of obj, read from source, keep the metadata source
+// recorded for it, so copies between stores do not look like fresh captures.
+func WithSourceMetadata(ctx context.Context, source Storage, obj *unstructured.Unstructured) (context.Context, error) {
+	md, err := source.ReadMetadata(ctx, KeyOf(obj), obj.GetUID())
+	if err != nil {
+		return ctx, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if md == nil || !md.Describes(obj) {
+		return ctx, nil // written before metadata was recorded, or since obj was read
+	}
+	return WithMetadata(ctx, *md), nil
+}
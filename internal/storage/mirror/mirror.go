@@ -0,0 +1,409 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy decides when a change fanned out to several backends counts as stored.
+type Policy string
+
+const (
+	// PolicyAll requires every backend to apply a change.
+	PolicyAll Policy = "all"
+	// PolicyQuorum requires a majority of backends to apply a change. Backends that failed catch up
+	// through the replay queue.
+	PolicyQuorum Policy = "quorum"
+	// PolicyPrimarySync applies a change to the primary only and queues it for the secondaries.
+	PolicyPrimarySync Policy = "primary-sync"
+)
+
+// ParsePolicy validates a policy name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyAll, PolicyQuorum, PolicyPrimarySync:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown mirror policy %q, expected all, quorum or primary-sync", s)
+}
+
+// Mirror is a Storage that fans changes out to several backends, the first of which is the primary.
+// Reads are served by the primary and fall back to the other backends, in order, when it fails.
+type Mirror struct {
+	Backends []storage.Storage
+	Policy   Policy
+	Queue    *Queue // Changes still to be applied to a backend, required by the quorum and primary-sync policies
+}
+
+var _ storage.Storage = &Mirror{}
+
+func NewMirror(backends []storage.Storage, policy Policy, queue *Queue) (*Mirror, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("mirror needs at least one backend")
+	}
+	if policy != PolicyAll && queue == nil {
+		return nil, fmt.Errorf("mirror policy %s needs a replay queue", policy)
+	}
+	return &Mirror{Backends: backends, Policy: policy, Queue: queue}, nil
+}
+
+// apply runs fn against the backends the policy writes synchronously, and queues o for the rest and
+// for those that failed. The result of the first backend that succeeded is returned.
+func (m *Mirror) apply(ctx context.Context, o op, fn func(storage.Storage) (bool, error)) (bool, error) {
+	logger := log.FromContext(ctx).WithName("Mirror").WithName("apply")
+	targets := len(m.Backends)
+	if m.Policy == PolicyPrimarySync {
+		targets = 1
+	}
+	changed := make([]bool, targets)
+	errs := make([]error, targets)
+	var wg sync.WaitGroup
+	for i := 0; i < targets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			changed[i], errs[i] = fn(m.Backends[i])
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	result := false
+	for i, err := range errs {
+		if err == nil {
+			if succeeded == 0 {
+				result = changed[i]
+			}
+			succeeded++
+			continue
+		}
+		metrics.MirrorWriteFailures.WithLabelValues(strconv.Itoa(i)).Inc()
+		logger.Error(err, "backend failed to apply change", "backend", i, "op", o.Type, "key", o.Key.String())
+		if m.Policy == PolicyQuorum {
+			m.enqueue(ctx, i, o)
+		}
+	}
+	if m.Policy == PolicyPrimarySync && errs[0] == nil {
+		for i := 1; i < len(m.Backends); i++ {
+			m.enqueue(ctx, i, o)
+		}
+	}
+
+	switch m.Policy {
+	case PolicyQuorum:
+		if succeeded <= len(m.Backends)/2 {
+			return result, fmt.Errorf("quorum not reached, %d of %d backends applied the change: %w", succeeded, len(m.Backends), errors.Join(errs...))
+		}
+	default:
+		if succeeded < targets {
+			return result, errors.Join(errs...)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mirror) enqueue(ctx context.Context, backend int, o op) {
+	if err := m.Queue.Enqueue(backend, o); err != nil {
+		log.FromContext(ctx).WithName("Mirror").WithName("enqueue").Error(err, "failed to queue change for replay", "backend", backend)
+		return
+	}
+	metrics.MirrorReplayQueueDepth.WithLabelValues(strconv.Itoa(backend)).Inc()
+}
+
+func (m *Mirror) Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (bool, error) {
+	o := op{Type: opWrite, Key: storage.KeyOf(obj)}
+	return m.apply(ctx, o, func(s storage.Storage) (bool, error) {
+		return s.Write(ctx, obj, hash)
+	})
+}
+
+func (m *Mirror) Delete(ctx context.Context, key storage.Key) error {
+	o := op{Type: opDelete, Key: key}
+	_, err := m.apply(ctx, o, func(s storage.Storage) (bool, error) {
+		return true, s.Delete(ctx, key)
+	})
+	return err
+}
+
+func (m *Mirror) MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error {
+	o := op{Type: opTombstone, Key: storage.KeyOf(obj)}
+	_, err := m.apply(ctx, o, func(s storage.Storage) (bool, error) {
+		return true, s.MarkTombstone(ctx, obj, deletedAt)
+	})
+	return err
+}
+
+func (m *Mirror) DeleteTombstone(ctx context.Context, key storage.Key) error {
+	o := op{Type: opUntombstone, Key: key}
+	_, err := m.apply(ctx, o, func(s storage.Storage) (bool, error) {
+		return true, s.DeleteTombstone(ctx, key)
+	})
+	return err
+}
+
+func (m *Mirror) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	o := op{Type: opPrune, Key: key, UID: uid}
+	_, err := m.apply(ctx, o, func(s storage.Storage) (bool, error) {
+		return true, s.DeleteIncarnation(ctx, key, uid)
+	})
+	return err
+}
+
+// read returns the result of the first backend that serves fn without an error.
+func read[T any](ctx context.Context, m *Mirror, fn func(storage.Storage) (T, error)) (T, error) {
+	var errs []error
+	for i, s := range m.Backends {
+		result, err := fn(s)
+		if err == nil {
+			return result, nil
+		}
+		log.FromContext(ctx).WithName("Mirror").WithName("read").Info("Backend failed to serve read, falling back", "backend", i, "error", err.Error())
+		errs = append(errs, err)
+	}
+	var zero T
+	return zero, errors.Join(errs...)
+}
+
+// stored is the result of Read and ReadIncarnation.
+type stored struct {
+	obj  *unstructured.Unstructured
+	hash string
+}
+
+func (m *Mirror) Read(ctx context.Context, key storage.Key) (*unstructured.Unstructured, string, error) {
+	r, err := read(ctx, m, func(s storage.Storage) (stored, error) {
+		obj, hash, err := s.Read(ctx, key)
+		return stored{obj, hash}, err
+	})
+	return r.obj, r.hash, err
+}
+
+func (m *Mirror) ReadTombstone(ctx context.Context, key storage.Key) (*storage.Tombstone, error) {
+	return read(ctx, m, func(s storage.Storage) (*storage.Tombstone, error) {
+		return s.ReadTombstone(ctx, key)
+	})
+}
+
+func (m *Mirror) ListTombstones(ctx context.Context) ([]storage.TombstoneEntry, error) {
+	return read(ctx, m, func(s storage.Storage) ([]storage.TombstoneEntry, error) {
+		return s.ListTombstones(ctx)
+	})
+}
+
+func (m *Mirror) TombstonePath(key storage.Key) string {
+	return m.Backends[0].TombstonePath(key)
+}
+
+func (m *Mirror) Kinds(ctx context.Context) ([]schema.GroupVersionKind, error) {
+	return read(ctx, m, func(s storage.Storage) ([]schema.GroupVersionKind, error) {
+		return s.Kinds(ctx)
+	})
+}
+
+func (m *Mirror) List(ctx context.Context, gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	return read(ctx, m, func(s storage.Storage) ([]storage.ObjectEntry, error) {
+		return s.List(ctx, gvk)
+	})
+}
+
+// Walk walks the first backend that serves it. A backend failing midway hands over to the next one,
+// which resumes after the last object visited.
+func (m *Mirror) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	var errs []error
+	for i, s := range m.Backends {
+		var fnErr error
+		err := s.Walk(ctx, filter, func(entry storage.ObjectEntry) error {
+			if fnErr = fn(entry); fnErr != nil {
+				return fnErr
+			}
+			filter.After = entry.Encode()
+			return nil
+		})
+		if err == nil || fnErr != nil {
+			return err
+		}
+		log.FromContext(ctx).WithName("Mirror").WithName("walk").Info("Backend failed to serve walk, falling back", "backend", i, "error", err.Error())
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mirror) Lineage(ctx context.Context, key storage.Key) ([]storage.Incarnation, error) {
+	return read(ctx, m, func(s storage.Storage) ([]storage.Incarnation, error) {
+		return s.Lineage(ctx, key)
+	})
+}
+
+func (m *Mirror) ReadIncarnation(ctx context.Context, key storage.Key, uid types.UID) (*unstructured.Unstructured, string, error) {
+	r, err := read(ctx, m, func(s storage.Storage) (stored, error) {
+		obj, hash, err := s.ReadIncarnation(ctx, key, uid)
+		return stored{obj, hash}, err
+	})
+	return r.obj, r.hash, err
+}
+
+func (m *Mirror) ReadMetadata(ctx context.Context, key storage.Key, uid types.UID) (*storage.Metadata, error) {
+	return read(ctx, m, func(s storage.Storage) (*storage.Metadata, error) {
+		return s.ReadMetadata(ctx, key, uid)
+	})
+}
+
+// Recover repairs every backend that supports it.
+func (m *Mirror) Recover(ctx context.Context, hasher hash.Hasher) (storage.RecoveryReport, error) {
+	var total storage.RecoveryReport
+	for i, s := range m.Backends {
+		recoverer, ok := s.(storage.Recoverer)
+		if !ok {
+			continue
+		}
+		report, err := recoverer.Recover(ctx, hasher)
+		if err != nil {
+			return total, fmt.Errorf("failed to recover backend %d: %w", i, err)
+		}
+		total.Checked += report.Checked
+		total.Repaired += report.Repaired
+		total.Quarantined += report.Quarantined
+		total.Unsigned += report.Unsigned
+		total.TempFilesRemoved += report.TempFilesRemoved
+	}
+	return total, nil
+}
+
+// Scrub verifies every backend that supports it, merging their problems into one report.
+func (m *Mirror) Scrub(ctx context.Context, hasher hash.Hasher) (storage.ScrubReport, error) {
+	var total storage.ScrubReport
+	for i, s := range m.Backends {
+		scrubber, ok := s.(storage.Scrubber)
+		if !ok {
+			continue
+		}
+		report, err := scrubber.Scrub(ctx, hasher)
+		if err != nil {
+			return total, fmt.Errorf("failed to scrub backend %d: %w", i, err)
+		}
+		total.Scanned += report.Scanned
+		total.Problems = append(total.Problems, report.Problems...)
+	}
+	return total, nil
+}
+
+// RunReplay applies queued changes to the backends every interval until ctx is done.
+func (m *Mirror) RunReplay(ctx context.Context, interval time.Duration) {
+	logger := log.FromContext(ctx).WithName("Mirror").WithName("runReplay")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for i := range m.Backends {
+				if err := m.Replay(ctx, i); err != nil {
+					logger.Error(err, "failed to replay changes", "backend", i)
+				}
+			}
+		}
+	}
+}
+
+// Replay applies the queued changes of a backend in order, stopping at the first one that fails so it
+// is retried on the next run. The state to apply is read from the mirror, the backend itself excluded.
+func (m *Mirror) Replay(ctx context.Context, backend int) error {
+	if m.Queue == nil {
+		return nil
+	}
+	ops, err := m.Queue.Pending(backend)
+	if err != nil {
+		return err
+	}
+	metrics.MirrorReplayQueueDepth.WithLabelValues(strconv.Itoa(backend)).Set(float64(len(ops)))
+	for n, o := range ops {
+		if err := m.replayOp(ctx, backend, o); err != nil {
+			return fmt.Errorf("failed to replay %s of %s: %w", o.Type, o.Key, err)
+		}
+		if err := m.Queue.Done(backend, o.Seq); err != nil {
+			return err
+		}
+		metrics.MirrorReplayQueueDepth.WithLabelValues(strconv.Itoa(backend)).Set(float64(len(ops) - n - 1))
+	}
+	return nil
+}
+
+func (m *Mirror) replayOp(ctx context.Context, backend int, o op) error {
+	target := m.Backends[backend]
+	others := &Mirror{Policy: m.Policy}
+	for i, s := range m.Backends {
+		if i != backend {
+			others.Backends = append(others.Backends, s)
+		}
+	}
+	switch o.Type {
+	case opWrite:
+		obj, hash, err := others.Read(ctx, o.Key)
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			return nil // deleted since, a later op removes it
+		}
+		if ctx, err = storage.WithSourceMetadata(ctx, others, obj); err != nil {
+			return err
+		}
+		_, err = target.Write(ctx, obj, hash)
+		return err
+	case opDelete:
+		return target.Delete(ctx, o.Key)
+	case opTombstone:
+		tomb, err := others.ReadTombstone(ctx, o.Key)
+		if err != nil || tomb == nil {
+			return err
+		}
+		final := tomb.FinalState
+		if final == nil {
+			if final, _, err = others.Read(ctx, o.Key); err != nil || final == nil {
+				return err
+			}
+		}
+		final.SetGroupVersionKind(o.GVK)
+		return target.MarkTombstone(ctx, final, tomb.DeletedAt)
+	case opPrune:
+		return target.DeleteIncarnation(ctx, o.Key, o.UID)
+	case opUntombstone:
+		err := target.DeleteTombstone(ctx, o.Key)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unknown op %q", o.Type)
+}
+
+// ID combines the identities of the backends, so the mirror is a new store when any of them is.
+func (m *Mirror) ID(ctx context.Context) (string, error) {
+	ids := make([]string, len(m.Backends))
+	for i, backend := range m.Backends {
+		identifier, ok := backend.(storage.Identifier)
+		if !ok {
+			return "", fmt.Errorf("backend %d of the mirror has no identity", i)
+		}
+		id, err := identifier.ID(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to identify backend %d: %w", i, err)
+		}
+		ids[i] = id
+	}
+	return strings.Join(ids, ","), nil
+}
@@ -0,0 +1,148 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/filesystem"
+	"github.com/bastion/internal/storage/storagetest"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMirror(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mirror Suite")
+}
+
+var _ = storagetest.DescribeStorage("Mirror", func() storage.Storage {
+	m, err := NewMirror([]storage.Storage{
+		&filesystem.FileSystem{BaseDir: GinkgoT().TempDir()},
+		&filesystem.FileSystem{BaseDir: GinkgoT().TempDir()},
+	}, PolicyAll, nil)
+	Expect(err).NotTo(HaveOccurred())
+	return m
+})
+
+// unavailable is a backend whose every call fails.
+type unavailable struct {
+	storage.Storage
+}
+
+var errUnavailable = errors.New("backend unavailable")
+
+func (unavailable) Write(context.Context, *unstructured.Unstructured, string) (bool, error) {
+	return false, errUnavailable
+}
+
+func (unavailable) Read(context.Context, storage.Key) (*unstructured.Unstructured, string, error) {
+	return nil, "", errUnavailable
+}
+
+// interrupted is a backend whose walks fail after visiting one object.
+type interrupted struct {
+	storage.Storage
+}
+
+func (b interrupted) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	visited := 0
+	return b.Storage.Walk(ctx, filter, func(entry storage.ObjectEntry) error {
+		if visited == 1 {
+			return errUnavailable
+		}
+		visited++
+		return fn(entry)
+	})
+}
+
+var _ = Describe("Mirror", func() {
+	var (
+		ctx     context.Context
+		first   *filesystem.FileSystem
+		second  *filesystem.FileSystem
+		queue   *Queue
+		queueTo string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		first = &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		second = &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		queueTo = filepath.Join(GinkgoT().TempDir(), "replay")
+		var err error
+		queue, err = NewQueue(queueTo)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("queues secondaries durably with primary-sync and replays them", func() {
+		m, err := NewMirror([]storage.Storage{first, second}, PolicyPrimarySync, queue)
+		Expect(err).NotTo(HaveOccurred())
+		changed, err := m.Write(ctx, storagetest.NewTask("task-a", "", "Sample Task"), "h1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+
+		obj, _, err := second.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+
+		// The queue survives a restart
+		reopened, err := NewQueue(queueTo)
+		Expect(err).NotTo(HaveOccurred())
+		m.Queue = reopened
+		Expect(m.Replay(ctx, 1)).To(Succeed())
+		_, h, err := second.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h).To(Equal("h1"))
+		pending, err := reopened.Pending(1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("accepts a write reaching a quorum and queues the failed backend", func() {
+		third := &filesystem.FileSystem{BaseDir: GinkgoT().TempDir()}
+		m, err := NewMirror([]storage.Storage{first, unavailable{}, third}, PolicyQuorum, queue)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = m.Write(ctx, storagetest.NewTask("task-a", "", "Sample Task"), "h1")
+		Expect(err).NotTo(HaveOccurred())
+		pending, err := queue.Pending(1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+
+		m.Backends = []storage.Storage{first, unavailable{}, unavailable{}}
+		_, err = m.Write(ctx, storagetest.NewTask("task-b", "", "Sample Task"), "h2")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("falls back to the next backend when the primary fails to read", func() {
+		_, err := second.Write(ctx, storagetest.NewTask("task-a", "", "Sample Task"), "h1")
+		Expect(err).NotTo(HaveOccurred())
+		m, err := NewMirror([]storage.Storage{unavailable{}, second}, PolicyAll, nil)
+		Expect(err).NotTo(HaveOccurred())
+		obj, h, err := m.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).NotTo(BeNil())
+		Expect(h).To(Equal("h1"))
+	})
+
+	It("resumes a walk on the next backend after the last object visited", func() {
+		for _, name := range []string{"task-a", "task-b", "task-c"} {
+			_, err := first.Write(ctx, storagetest.NewTask(name, "", "Sample Task"), "h1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = second.Write(ctx, storagetest.NewTask(name, "", "Sample Task"), "h1")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		m, err := NewMirror([]storage.Storage{interrupted{first}, second}, PolicyAll, nil)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		Expect(m.Walk(ctx, storage.Filter{}, func(entry storage.ObjectEntry) error {
+			names = append(names, entry.Name)
+			return nil
+		})).To(Succeed())
+		Expect(names).To(Equal([]string{"task-a", "task-b", "task-c"}))
+	})
+})
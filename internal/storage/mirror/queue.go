@@ -0,0 +1,160 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// opType is the kind of change replayed on a secondary.
+type opType string
+
+const (
+	opWrite       opType = "write"
+	opDelete      opType = "delete"
+	opTombstone   opType = "tombstone"
+	opUntombstone opType = "untombstone"
+	opPrune       opType = "prune"
+)
+
+// op names the object a change was made to. The content is read from the other backends when the op is
+// replayed, so a burst of changes to one object replays as its latest state.
+type op struct {
+	Seq  uint64 `json:"seq"`
+	Type opType `json:"type"`
+	storage.Key
+	UID types.UID `json:"uid,omitempty"` // Incarnation removed by a prune
+}
+
+// Queue is a durable per-backend queue of changes still to be applied, one file per op, so pending
+// changes survive a restart of the controller.
+type Queue struct {
+	Dir string
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewQueue opens the queue kept in dir, continuing after the highest sequence number found there.
+func NewQueue(dir string) (*Queue, error) {
+	q := &Queue{Dir: dir}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create replay queue dir: %w", err)
+	}
+	backends, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay queue: %w", err)
+	}
+	for _, b := range backends {
+		seqs, err := q.sequences(filepath.Join(dir, b.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if n := len(seqs); n > 0 && seqs[n-1] > q.seq {
+			q.seq = seqs[n-1]
+		}
+	}
+	return q, nil
+}
+
+// Enqueue durably appends an op for a backend.
+func (q *Queue) Enqueue(backend int, o op) error {
+	q.mu.Lock()
+	q.seq++
+	o.Seq = q.seq
+	q.mu.Unlock()
+	dir := q.backendDir(backend)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create replay queue dir: %w", err)
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("failed to marshal op: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%020d.json", o.Seq))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create op: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write op: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync op: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close op: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to commit op: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the ops of a backend in the order they were enqueued.
+func (q *Queue) Pending(backend int) ([]op, error) {
+	dir := q.backendDir(backend)
+	seqs, err := q.sequences(dir)
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]op, 0, len(seqs))
+	for _, seq := range seqs {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%020d.json", seq)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read op: %w", err)
+		}
+		var o op
+		if err := json.Unmarshal(data, &o); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal op: %w", err)
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+// Done removes an op once it was applied.
+func (q *Queue) Done(backend int, seq uint64) error {
+	err := os.Remove(filepath.Join(q.backendDir(backend), fmt.Sprintf("%020d.json", seq)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove op: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) backendDir(backend int) string {
+	return filepath.Join(q.Dir, strconv.Itoa(backend))
+}
+
+func (q *Queue) sequences(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read replay queue: %w", err)
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue // temp files of interrupted enqueues
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
@@ -0,0 +1,243 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"time"
+)
+
+// CompactionReport summarizes what a compaction rewrote.
+type CompactionReport struct {
+	Segments  int   // Sealed segments rewritten into one
+	Kept      int   // Records carried over
+	Dropped   int   // Superseded records dropped
+	Reclaimed int64 // Bytes freed
+}
+
+// RunCompaction compacts the store every interval until ctx is done.
+func (s *Store) RunCompaction(ctx context.Context, interval time.Duration) {
+	logger := log.FromContext(ctx).WithName("SegmentStore").WithName("compaction")
+	logger.Info("Starting compaction", "interval", interval, "retain", s.Retain)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Compaction stopped")
+			return
+		case <-ticker.C:
+			report, err := s.Compact(ctx)
+			if err != nil {
+				logger.Error(err, "failed to compact segments")
+				continue
+			}
+			logger.Info("Compaction complete", "segments", report.Segments, "kept", report.Kept,
+				"dropped", report.Dropped, "reclaimed", report.Reclaimed)
+		}
+	}
+}
+
+// Compact rewrites the sealed segments into one, dropping the records nothing refers to any more:
+// superseded revisions, cleared tombstones and everything of deleted objects. Records written less than
+// Retain ago are kept, along with every record after them, so replaying the compacted segment still
+// passes through the same states. The active segment is sealed first, and appends carry on in a new one
+// while the sealed segments are rewritten.
+func (s *Store) Compact(ctx context.Context) (CompactionReport, error) {
+	var report CompactionReport
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	if s.activeSize > headerSize {
+		if err := s.rotate(); err != nil {
+			s.mu.Unlock()
+			return report, err
+		}
+	}
+	var sealed []segmentID
+	files := map[segmentID]*os.File{}
+	for id, f := range s.files {
+		if id != s.active {
+			sealed = append(sealed, id)
+			files[id] = f
+		}
+	}
+	live := map[location]bool{}
+	lineages := map[storage.Key][]storage.Incarnation{}
+	for _, objects := range s.objects {
+		for key, e := range objects {
+			for _, loc := range e.locations() {
+				live[loc] = true
+			}
+			if len(e.lineage) > 0 {
+				lineages[key] = append([]storage.Incarnation(nil), e.lineage...)
+			}
+		}
+	}
+	gen := s.gen + 1
+	s.mu.Unlock()
+	if len(sealed) == 0 {
+		return report, nil
+	}
+	sortIDs(sealed)
+
+	target := segmentID{seq: sealed[len(sealed)-1].seq, gen: gen}
+	moved, err := s.rewrite(ctx, sealed, files, target, live, lineages, &report)
+	if err != nil {
+		return report, err
+	}
+	if moved == nil {
+		return report, nil // nothing to drop
+	}
+	f, err := os.OpenFile(segmentPath(s.Dir, target), os.O_RDWR, 0)
+	if err != nil {
+		return report, fmt.Errorf("failed to open compacted segment: %w", err)
+	}
+
+	s.mu.Lock()
+	for _, objects := range s.objects {
+		for _, e := range objects {
+			e.relocate(moved)
+		}
+	}
+	for _, id := range sealed {
+		_ = s.files[id].Close()
+		delete(s.files, id)
+	}
+	s.files[target] = f
+	s.gen = gen
+	s.mu.Unlock()
+
+	// The compacted segment supersedes these, a crash before they are gone only leaves them to the next open
+	for _, id := range sealed {
+		if err := os.Remove(segmentPath(s.Dir, id)); err != nil && !os.IsNotExist(err) {
+			return report, fmt.Errorf("failed to remove compacted segment: %w", err)
+		}
+	}
+	if err := syncDir(filepath.Dir(segmentPath(s.Dir, target))); err != nil {
+		return report, fmt.Errorf("failed to sync segments dir: %w", err)
+	}
+	if report.Reclaimed > 0 {
+		metrics.SegmentReclaimedBytes.Add(float64(report.Reclaimed))
+	}
+	return report, nil
+}
+
+// rewrite copies the records of the sealed segments that are live, or written after the retention
+// cutoff, into the target segment, followed by the lineage of every object. It returns where each copied
+// record moved, or nil if a single segment has nothing to drop and is left as it is.
+func (s *Store) rewrite(ctx context.Context, sealed []segmentID, files map[segmentID]*os.File, target segmentID,
+	live map[location]bool, lineages map[storage.Key][]storage.Incarnation, report *CompactionReport) (map[location]location, error) {
+	path := segmentPath(s.Dir, target)
+	tmp := path + tempSuffix
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compacted segment: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	if err := writeHeader(out); err != nil {
+		return nil, fmt.Errorf("failed to write segment header: %w", err)
+	}
+
+	cutoff := time.Now().Add(-s.Retain)
+	retained := false // Set at the first record within retention, every later record is kept too
+	moved := map[location]location{}
+	offset := headerSize
+	var before int64
+	for _, id := range sealed {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		info, err := files[id].Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat segment: %w", err)
+		}
+		before += info.Size()
+		end, err := readFrames(files[id], id, info.Size(), func(frame []byte, loc location) error {
+			var header struct {
+				Type    recordType `json:"type"`
+				Written time.Time  `json:"written"`
+			}
+			if err := json.Unmarshal(frame[frameHeaderSize:], &header); err != nil {
+				return fmt.Errorf("failed to unmarshal record: %w", err)
+			}
+			if header.Type == recordLineage {
+				return nil // written anew below
+			}
+			if s.Retain > 0 && !retained {
+				retained = !header.Written.Before(cutoff)
+			}
+			if !live[loc] && !retained {
+				report.Dropped++
+				return nil
+			}
+			if _, err := out.Write(frame); err != nil {
+				return fmt.Errorf("failed to write compacted segment: %w", err)
+			}
+			moved[loc] = location{id: target, offset: offset, size: loc.size}
+			offset += loc.size
+			report.Kept++
+			return nil
+		})
+		if errors.Is(err, errCorruptFrame) {
+			// Dropping what follows the corruption would lose it for good, the segment is left for scrubs to report
+			return nil, fmt.Errorf("cannot compact %s: %w at offset %d", id.fileName(), err, end)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if report.Dropped == 0 && len(sealed) == 1 {
+		*report = CompactionReport{}
+		return nil, nil
+	}
+	report.Segments = len(sealed)
+
+	// Replaying only the latest revisions would date the incarnations by them, so their lineage follows
+	keys := make([]storage.Key, 0, len(lineages))
+	for key := range lineages {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Encode() < keys[j].Encode() })
+	now := time.Now().UTC()
+	for _, key := range keys {
+		frame, err := encodeFrame(&record{Type: recordLineage, Key: key, Lineage: lineages[key], Written: now})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := out.Write(frame); err != nil {
+			return nil, fmt.Errorf("failed to write compacted segment: %w", err)
+		}
+		offset += int64(len(frame))
+	}
+
+	if err := out.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync compacted segment: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compacted segment: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("failed to commit compacted segment: %w", err)
+	}
+	committed = true
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("failed to sync segments dir: %w", err)
+	}
+	report.Reclaimed = before - offset
+	return moved, nil
+}
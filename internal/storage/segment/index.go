@@ -0,0 +1,116 @@
+package segment
+
+import (
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// entry is what the index knows about a stored object.
+type entry struct {
+	current   location // Latest put record
+	hash      string
+	uid       types.UID
+	labels    map[string]string
+	modified  time.Time // When the latest put record was written
+	tombstone *tombstoneRef
+	lineage   []storage.Incarnation
+	archived  map[types.UID]location // Latest put record of every superseded incarnation
+}
+
+// tombstoneRef is a tombstone record along with what ListTombstones reports about it.
+type tombstoneRef struct {
+	loc       location
+	uid       types.UID
+	deletedAt time.Time
+	written   time.Time
+}
+
+// locations returns the records the entry refers to, which compaction must keep.
+func (e *entry) locations() []location {
+	locs := []location{e.current}
+	if e.tombstone != nil {
+		locs = append(locs, e.tombstone.loc)
+	}
+	for _, loc := range e.archived {
+		locs = append(locs, loc)
+	}
+	return locs
+}
+
+// relocate points the entry at the records moved by a compaction.
+func (e *entry) relocate(moved map[location]location) {
+	if loc, ok := moved[e.current]; ok {
+		e.current = loc
+	}
+	if e.tombstone != nil {
+		if loc, ok := moved[e.tombstone.loc]; ok {
+			e.tombstone.loc = loc
+		}
+	}
+	for uid, archived := range e.archived {
+		if loc, ok := moved[archived]; ok {
+			e.archived[uid] = loc
+		}
+	}
+}
+
+// lookup returns the index entry of key, or nil. The caller holds s.mu.
+func (s *Store) lookup(key storage.Key) *entry {
+	return s.objects[key.GVK][key]
+}
+
+// apply updates the index with a record stored at loc. Appends and the scan rebuilding the index go
+// through it alike, so replaying the segments always yields the state the appends left.
+func (s *Store) apply(rec *record, loc location) {
+	objects := s.objects[rec.GVK]
+	e := objects[rec.Key]
+	switch rec.Type {
+	case recordPut:
+		if e == nil {
+			if objects == nil {
+				objects = map[storage.Key]*entry{}
+				s.objects[rec.GVK] = objects
+			}
+			e = &entry{}
+			objects[rec.Key] = e
+		} else if e.uid != "" && rec.UID != "" && e.uid != rec.UID {
+			// Another object took the name, the history of the previous one is kept apart
+			if e.archived == nil {
+				e.archived = map[types.UID]location{}
+			}
+			e.archived[e.uid] = e.current
+			e.tombstone = nil
+		}
+		e.current, e.hash, e.uid = loc, rec.Hash, rec.UID
+		e.labels, e.modified = rec.Labels, rec.Written
+		e.lineage = storage.RecordBackup(e.lineage, rec.UID, rec.Written)
+	case recordTombstone:
+		if e == nil || rec.Tombstone == nil {
+			return
+		}
+		deletedAt := rec.Tombstone.DeletedAt
+		e.tombstone = &tombstoneRef{loc: loc, uid: rec.Tombstone.UID, deletedAt: deletedAt, written: rec.Written}
+		e.lineage = storage.RecordDeletion(e.lineage, rec.Tombstone.UID, &deletedAt)
+	case recordUntombstone:
+		if e == nil {
+			return
+		}
+		e.tombstone = nil
+		e.lineage = storage.RecordDeletion(e.lineage, "", nil)
+	case recordDelete:
+		delete(objects, rec.Key)
+		if len(objects) == 0 {
+			delete(s.objects, rec.GVK)
+		}
+	case recordLineage:
+		if e != nil {
+			e.lineage = rec.Lineage
+		}
+	case recordPrune:
+		if e != nil {
+			delete(e.archived, rec.UID)
+			e.lineage = storage.DropIncarnation(e.lineage, rec.UID)
+		}
+	}
+}
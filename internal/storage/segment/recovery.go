@@ -0,0 +1,246 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+)
+
+// load builds the index by scanning every segment in the order it was written. Segments already
+// rewritten by a compaction and temp files are removed first, and a record torn by a crash at the end of
+// the last segment is cut off. The caller holds s.mu, or has the store to itself.
+func (s *Store) load() (storage.RecoveryReport, error) {
+	var report storage.RecoveryReport
+	if s.Dir == "" {
+		return report, fmt.Errorf("segment store has no directory")
+	}
+	dir := filepath.Join(s.Dir, segmentsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return report, fmt.Errorf("failed to create segments dir: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return report, fmt.Errorf("failed to read segments dir: %w", err)
+	}
+	var found []segmentID
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+		case strings.HasSuffix(f.Name(), tempSuffix), strings.Contains(f.Name(), atomicfile.TempInfix):
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return report, fmt.Errorf("failed to remove temp file: %w", err)
+			}
+			report.TempFilesRemoved++
+		default:
+			if id, ok := parseSegmentName(f.Name()); ok {
+				found = append(found, id)
+			}
+		}
+	}
+	var ids []segmentID
+	for _, id := range found {
+		if compacted(id, found) {
+			if err := os.Remove(segmentPath(s.Dir, id)); err != nil {
+				return report, fmt.Errorf("failed to remove compacted segment: %w", err)
+			}
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	s.files = map[segmentID]*os.File{}
+	s.objects = map[schema.GroupVersionKind]map[storage.Key]*entry{}
+	s.active, s.gen = segmentID{}, 0
+	for i, id := range ids {
+		last := i == len(ids)-1
+		path := segmentPath(s.Dir, id)
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			_ = s.closeFiles()
+			return report, fmt.Errorf("failed to open segment: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			_ = s.closeFiles()
+			return report, fmt.Errorf("failed to stat segment: %w", err)
+		}
+		if last && id.gen == 0 && info.Size() < headerSize {
+			// Created by a rotation that was cut short before anything was appended to it
+			_ = f.Close()
+			if err := os.Remove(path); err != nil {
+				_ = s.closeFiles()
+				return report, fmt.Errorf("failed to remove torn segment: %w", err)
+			}
+			report.Checked++
+			report.Repaired++
+			s.active = id
+			continue
+		}
+		end, err := readFrames(f, id, info.Size(), func(frame []byte, loc location) error {
+			rec, err := decodeRecord(frame[frameHeaderSize:])
+			if err != nil {
+				return err
+			}
+			s.apply(rec, loc)
+			return nil
+		})
+		switch {
+		case errors.Is(err, errCorruptFrame) && last && id.gen == 0:
+			// The process stopped while appending to the segment
+			report.Checked++
+			if err := f.Truncate(end); err != nil {
+				_ = f.Close()
+				_ = s.closeFiles()
+				return report, fmt.Errorf("failed to cut off torn record: %w", err)
+			}
+			if err := f.Sync(); err != nil {
+				_ = f.Close()
+				_ = s.closeFiles()
+				return report, fmt.Errorf("failed to sync segment: %w", err)
+			}
+			report.Repaired++
+		case errors.Is(err, errCorruptFrame):
+			// Sealed segments are never torn, the records past the corruption are kept for scrubs to report
+		case err != nil:
+			_ = f.Close()
+			_ = s.closeFiles()
+			return report, err
+		}
+		s.files[id] = f
+		s.active, s.activeSize = id, end
+		s.gen = max(s.gen, id.gen)
+	}
+	// Appends carry on in the last segment, unless a compaction wrote it or it is full
+	if _, ok := s.files[s.active]; ok && s.active.gen == 0 && s.activeSize < s.maxSegmentSize() {
+		return report, nil
+	}
+	if err := s.rotate(); err != nil {
+		_ = s.closeFiles()
+		return report, err
+	}
+	return report, nil
+}
+
+// compacted reports whether a compaction already rewrote id into another of the segments found.
+func compacted(id segmentID, found []segmentID) bool {
+	for _, other := range found {
+		if other.supersedes(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recover rebuilds the index by scanning every segment again, cutting off a record torn by a crash at
+// the end of the last one. Every record is checksummed along with its hash, so hasher is not needed.
+func (s *Store) Recover(ctx context.Context, hasher hash.Hasher) (storage.RecoveryReport, error) {
+	logger := log.FromContext(ctx).WithName("SegmentStore").WithName("recover")
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.closeFiles(); err != nil {
+		return storage.RecoveryReport{}, fmt.Errorf("failed to close segments: %w", err)
+	}
+	report, err := s.load()
+	if err != nil {
+		return report, err
+	}
+	logger.Info("Rebuilt segment index", "segments", len(s.files), "torn", report.Checked, "tempFilesRemoved", report.TempFilesRemoved)
+	return report, nil
+}
+
+// Scrub verifies the checksum of every record, and the manifest and hash of every current revision.
+func (s *Store) Scrub(ctx context.Context, hasher hash.Hasher) (storage.ScrubReport, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.RLock()
+	ids := make([]segmentID, 0, len(s.files))
+	files := make(map[segmentID]*os.File, len(s.files))
+	for id, f := range s.files {
+		ids = append(ids, id)
+		files[id] = f
+	}
+	active, activeSize := s.active, s.activeSize
+	current := map[location]storage.Key{}
+	for _, objects := range s.objects {
+		for key, e := range objects {
+			current[e.current] = key
+		}
+	}
+	s.mu.RUnlock()
+	sortIDs(ids)
+
+	var report storage.ScrubReport
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		size := activeSize
+		if id != active {
+			info, err := files[id].Stat()
+			if err != nil {
+				return report, fmt.Errorf("failed to stat segment: %w", err)
+			}
+			size = info.Size()
+		}
+		path := segmentPath(s.Dir, id)
+		end, err := readFrames(files[id], id, size, func(frame []byte, loc location) error {
+			if key, ok := current[loc]; ok {
+				report.Scanned++
+				scrubRecord(path, key, frame, hasher, &report)
+			}
+			return nil
+		})
+		if errors.Is(err, errCorruptFrame) {
+			report.Add(storage.ScrubProblem{Type: storage.ProblemCorruptRecord, Path: path,
+				Detail: fmt.Sprintf("records from offset %d on cannot be read", end)})
+		} else if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// scrubRecord verifies the manifest and hash of the current revision of key, stored in frame.
+func scrubRecord(path string, key storage.Key, frame []byte, hasher hash.Hasher, report *storage.ScrubReport) {
+	problem := func(t storage.ProblemType, detail string) {
+		report.Add(storage.ScrubProblem{Type: t, Path: path, Key: key, Detail: detail})
+	}
+	rec, err := decodeRecord(frame[frameHeaderSize:])
+	if err != nil {
+		problem(storage.ProblemCorruptRecord, err.Error())
+		return
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(rec.Manifest, &obj.Object); err != nil {
+		problem(storage.ProblemCorruptManifest, err.Error())
+		return
+	}
+	if storage.KeyOf(obj) != key {
+		problem(storage.ProblemPathMismatch, fmt.Sprintf("manifest is %s", storage.KeyOf(obj)))
+	}
+	if hasher == nil {
+		return
+	}
+	computed, err := hasher.Hash(obj)
+	if err != nil {
+		problem(storage.ProblemCorruptManifest, err.Error())
+		return
+	}
+	if computed != rec.Hash {
+		problem(storage.ProblemHashMismatch, fmt.Sprintf("stored %s, computed %s", rec.Hash, computed))
+	}
+}
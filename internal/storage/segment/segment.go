@@ -0,0 +1,226 @@
+package segment
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bastion/internal/storage"
+	"hash/crc32"
+	"io"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// segmentsDir holds the segment files below the root of a store.
+	segmentsDir = "segments"
+	// magic starts every segment file, followed by the format version as a little-endian uint32.
+	magic         = "BSEG"
+	formatVersion = 1
+	headerSize    = int64(len(magic) + 4)
+	// frameHeaderSize is the length and the CRC-32C of the payload that precede every record.
+	frameHeaderSize = 8
+	// maxRecordSize bounds the length a frame header may announce, so a corrupt length is not allocated.
+	maxRecordSize = 64 << 20
+	tempSuffix    = ".tmp"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptFrame is returned for a frame that is cut short or fails its checksum.
+var errCorruptFrame = errors.New("corrupt record")
+
+// recordType is the change a record applies to the object it belongs to.
+type recordType string
+
+const (
+	recordPut         recordType = "put"         // A new revision of the object, with its manifest and hash
+	recordTombstone   recordType = "tombstone"   // The object was deleted from the cluster
+	recordUntombstone recordType = "untombstone" // The object came back, its tombstone is cleared
+	recordDelete      recordType = "delete"      // The object and its history are removed from the store
+	recordLineage     recordType = "lineage"     // The lineage of the object, written by compaction
+	recordPrune       recordType = "prune"       // An archived incarnation of the object is removed
+)
+
+// record is a single change appended to a segment.
+type record struct {
+	Type recordType `json:"type"`
+	storage.Key
+	UID       types.UID             `json:"uid,omitempty"`
+	Hash      string                `json:"hash,omitempty"`
+	Manifest  json.RawMessage       `json:"manifest,omitempty"`
+	Labels    map[string]string     `json:"labels,omitempty"` // Of the manifest, so the index has them without parsing it
+	Metadata  *storage.Metadata     `json:"metadata,omitempty"`
+	Tombstone *storage.Tombstone    `json:"tombstone,omitempty"`
+	Lineage   []storage.Incarnation `json:"lineage,omitempty"`
+	Written   time.Time             `json:"written"`
+}
+
+// segmentID names a segment file. Appended segments have generation 0 and ascending sequence numbers.
+// Compaction rewrites every segment up to sequence n into one segment n with a higher generation,
+// which supersedes all the segments it was made from.
+type segmentID struct {
+	seq uint64
+	gen uint64
+}
+
+func (id segmentID) fileName() string {
+	return fmt.Sprintf("%020d-%d.seg", id.seq, id.gen)
+}
+
+// supersedes reports whether id was compacted from other.
+func (id segmentID) supersedes(other segmentID) bool {
+	return id.gen > other.gen && id.seq >= other.seq
+}
+
+// parseSegmentName is the inverse of segmentID.fileName.
+func parseSegmentName(name string) (segmentID, bool) {
+	seq, gen, found := strings.Cut(strings.TrimSuffix(name, ".seg"), "-")
+	if !found || !strings.HasSuffix(name, ".seg") {
+		return segmentID{}, false
+	}
+	s, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return segmentID{}, false
+	}
+	g, err := strconv.ParseUint(gen, 10, 64)
+	if err != nil {
+		return segmentID{}, false
+	}
+	return segmentID{seq: s, gen: g}, true
+}
+
+// sortIDs orders segments the way their records were written.
+func sortIDs(ids []segmentID) {
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].seq != ids[j].seq {
+			return ids[i].seq < ids[j].seq
+		}
+		return ids[i].gen < ids[j].gen
+	})
+}
+
+// location is where a record is stored, frame header included.
+type location struct {
+	id     segmentID
+	offset int64
+	size   int64
+}
+
+// encodeFrame prefixes the marshaled record with its length and checksum.
+func encodeFrame(rec *record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the limit of %d", len(payload), maxRecordSize)
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// decodeFrame verifies a whole frame and returns its payload.
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderSize {
+		return nil, errCorruptFrame
+	}
+	length := binary.LittleEndian.Uint32(frame[0:4])
+	payload := frame[frameHeaderSize:]
+	if int(length) != len(payload) || crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(frame[4:8]) {
+		return nil, errCorruptFrame
+	}
+	return payload, nil
+}
+
+func decodeRecord(payload []byte) (*record, error) {
+	rec := &record{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	return rec, nil
+}
+
+// writeHeader starts a new segment file.
+func writeHeader(w io.Writer) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[len(magic):], formatVersion)
+	_, err := w.Write(header)
+	return err
+}
+
+// checkHeader refuses files that are not segments, or segments of a newer format.
+func checkHeader(r io.Reader) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read segment header: %w", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return fmt.Errorf("not a segment file")
+	}
+	if version := binary.LittleEndian.Uint32(header[len(magic):]); version != formatVersion {
+		return fmt.Errorf("segment format version %d is not supported by this build, which knows version %d", version, formatVersion)
+	}
+	return nil
+}
+
+// readFrames calls fn for every intact frame of the first size bytes of f, in order. It returns the end
+// of the last intact frame, along with errCorruptFrame if anything but whole frames follows it.
+func readFrames(f *os.File, id segmentID, size int64, fn func(frame []byte, loc location) error) (int64, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, size), 1<<20)
+	if err := checkHeader(r); err != nil {
+		return 0, fmt.Errorf("%s: %w", id.fileName(), err)
+	}
+	offset := headerSize
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, errCorruptFrame
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return offset, errCorruptFrame
+		}
+		frame := make([]byte, frameHeaderSize+int64(length))
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+			return offset, errCorruptFrame
+		}
+		if _, err := decodeFrame(frame); err != nil {
+			return offset, err
+		}
+		if err := fn(frame, location{id: id, offset: offset, size: int64(len(frame))}); err != nil {
+			return offset, err
+		}
+		offset += int64(len(frame))
+	}
+}
+
+// syncDir makes creations, renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// segmentPath returns the path of a segment file of the store rooted at dir.
+func segmentPath(dir string, id segmentID) string {
+	return filepath.Join(dir, segmentsDir, id.fileName())
+}
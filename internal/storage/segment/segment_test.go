@@ -0,0 +1,201 @@
+package segment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/storagetest"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSegment(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Segment Suite")
+}
+
+var _ = storagetest.DescribeStorage("Segment", func() storage.Storage {
+	store, err := Open(GinkgoT().TempDir())
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(store.Close)
+	return store
+})
+
+// segmentFiles returns the names of the segment files of the store rooted at dir.
+func segmentFiles(dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, segmentsDir, "*"))
+	Expect(err).NotTo(HaveOccurred())
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+var _ = Describe("Store", func() {
+	var (
+		ctx    context.Context
+		dir    string
+		store  *Store
+		hasher hash.Hasher
+	)
+
+	write := func(obj *unstructured.Unstructured) {
+		h, err := hasher.Hash(obj)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.Write(ctx, obj, h)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	reopen := func() {
+		Expect(store.Close()).To(Succeed())
+		var err error
+		store, err = Open(dir)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		dir = GinkgoT().TempDir()
+		hasher = hash.NewDefaultHasher()
+		var err error
+		store, err = Open(dir)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() { _ = store.Close() })
+	})
+
+	It("keeps objects, tombstones and incarnations across a reopen", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		write(storagetest.NewTask("task-b", "uid-2", "other"))
+		Expect(store.MarkTombstone(ctx, storagetest.NewTask("task-b", "uid-2", "other"), time.Now())).To(Succeed())
+		write(storagetest.NewTask("task-a", "uid-3", "recreated"))
+		write(storagetest.NewTask("task-c", "uid-4", "gone"))
+		Expect(store.Delete(ctx, storagetest.TaskKey("task-c"))).To(Succeed())
+
+		reopen()
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.GetUID()).To(Equal(types.UID("uid-3")))
+		previous, _, err := store.ReadIncarnation(ctx, storagetest.TaskKey("task-a"), "uid-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(previous.Object["spec"]).To(HaveKeyWithValue("description", "first"))
+		lineage, err := store.Lineage(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(2))
+
+		entries, err := store.List(ctx, storagetest.TaskGVK)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[1].Tombstoned).To(BeTrue())
+		tombstones, err := store.ListTombstones(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tombstones).To(HaveLen(1))
+		Expect(tombstones[0].UID).To(Equal(types.UID("uid-2")))
+	})
+
+	It("cuts off a record torn by a crash and keeps appending after it", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		Expect(store.Close()).To(Succeed())
+		files := segmentFiles(dir)
+		torn, err := os.OpenFile(filepath.Join(dir, segmentsDir, files[len(files)-1]), os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = torn.Write([]byte{42, 0, 0, 0, 1, 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(torn.Close()).To(Succeed())
+
+		store, err = Open(dir)
+		Expect(err).NotTo(HaveOccurred())
+		report, err := store.Recover(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Checked).To(Equal(0)) // cut off when the store was opened
+		write(storagetest.NewTask("task-b", "uid-2", "second"))
+		reopen()
+		for _, name := range []string{"task-a", "task-b"} {
+			obj, _, err := store.Read(ctx, storagetest.TaskKey(name))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).NotTo(BeNil())
+		}
+		scrub, err := store.Scrub(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scrub.Problems).To(BeEmpty())
+		Expect(scrub.Scanned).To(Equal(2))
+	})
+
+	It("drops superseded records when compacting, keeping lineage and surviving a crash", func() {
+		store.MaxSegmentSize = 1024
+		for i := 0; i < 20; i++ {
+			write(storagetest.NewTask("task-a", "uid-1", time.Duration(i).String()))
+		}
+		write(storagetest.NewTask("task-b", "uid-2", "gone"))
+		Expect(store.Delete(ctx, storagetest.TaskKey("task-b"))).To(Succeed())
+		before, err := store.Lineage(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(segmentFiles(dir))).To(BeNumerically(">", 2))
+
+		// Keep the segments as they were, to play a crash before the compacted ones were removed
+		saved := map[string][]byte{}
+		for _, name := range segmentFiles(dir) {
+			data, err := os.ReadFile(filepath.Join(dir, segmentsDir, name))
+			Expect(err).NotTo(HaveOccurred())
+			saved[name] = data
+		}
+		report, err := store.Compact(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Dropped).To(Equal(21))
+		Expect(report.Reclaimed).To(BeNumerically(">", 0))
+		Expect(segmentFiles(dir)).To(HaveLen(2))
+		obj, _, err := store.Read(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Object["spec"]).To(HaveKeyWithValue("description", time.Duration(19).String()))
+
+		// Nothing is left to drop
+		report, err = store.Compact(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Dropped).To(BeZero())
+
+		for name, data := range saved {
+			Expect(os.WriteFile(filepath.Join(dir, segmentsDir, name), data, 0644)).To(Succeed())
+		}
+		reopen()
+		Expect(segmentFiles(dir)).To(HaveLen(2))
+		lineage, err := store.Lineage(ctx, storagetest.TaskKey("task-a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lineage).To(HaveLen(1))
+		Expect(lineage[0].FirstBackup).To(BeTemporally("==", before[0].FirstBackup))
+		obj, _, err = store.Read(ctx, storagetest.TaskKey("task-b"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).To(BeNil())
+	})
+
+	It("keeps superseded records within retention", func() {
+		store.Retain = time.Hour
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		write(storagetest.NewTask("task-a", "uid-1", "second"))
+		report, err := store.Compact(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Dropped).To(BeZero())
+	})
+
+	It("reports records that fail their checksum", func() {
+		write(storagetest.NewTask("task-a", "uid-1", "first"))
+		_, err := store.Compact(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		files := segmentFiles(dir)
+		path := filepath.Join(dir, segmentsDir, files[0])
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		data[len(data)-2] ^= 0xff
+		Expect(os.WriteFile(path, data, 0644)).To(Succeed())
+
+		report, err := store.Scrub(ctx, hasher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Counts()).To(HaveKeyWithValue(storage.ProblemCorruptRecord, 1))
+	})
+})
@@ -0,0 +1,412 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bastion/internal/atomicfile"
+	"github.com/bastion/internal/storage"
+	"io"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSegmentSize is the size after which the active segment is sealed.
+const DefaultMaxSegmentSize = 64 << 20
+
+// Store is a Storage that appends every change as a checksummed record to segment files, rather than
+// replacing a few small files per object. The latest state of every object is kept in an in-memory
+// index, rebuilt by scanning the segments when the store is opened. Compaction drops the records that
+// were superseded.
+type Store struct {
+	Dir            string        // Root of the store, the segments are kept in Dir/segments
+	MaxSegmentSize int64         // Size after which the active segment is sealed and a new one started
+	Retain         time.Duration // How long compaction keeps superseded records, zero drops them at once
+
+	mu         sync.RWMutex
+	files      map[segmentID]*os.File
+	active     segmentID
+	activeSize int64
+	gen        uint64 // Highest generation of any segment
+	objects    map[schema.GroupVersionKind]map[storage.Key]*entry
+	corrupt    []location // Where the scan of a sealed segment stopped at a corrupt record
+	compactMu  sync.Mutex // Serializes compactions, and keeps them out of scrubs
+}
+
+var _ storage.Storage = &Store{}
+
+// storeCache makes sure a process never has two stores appending to the same segments.
+var (
+	storeCache = make(map[string]*Store)
+	storeMu    sync.Mutex
+)
+
+// Open opens the segment store rooted at dir, creating it if needed, and builds its index.
+func Open(dir string) (*Store, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if s, ok := storeCache[dir]; ok {
+		return s, nil
+	}
+	s := &Store{Dir: dir, MaxSegmentSize: DefaultMaxSegmentSize}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	storeCache[dir] = s
+	return s, nil
+}
+
+// idFile holds the identity of the store next to its segments, so it goes with them.
+const idFile = "store.id"
+
+// ID returns the identity of the store, recording a new one if the segments have none.
+func (s *Store) ID(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.Dir, segmentsDir)
+	path := filepath.Join(dir, idFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read store id: %w", err)
+	}
+	id := string(uuid.NewUUID())
+	if err := atomicfile.WriteFile(path, []byte(id)); err != nil {
+		return "", fmt.Errorf("failed to write store id: %w", err)
+	}
+	return id, nil
+}
+
+// Close closes the segment files. The store cannot be used afterwards.
+func (s *Store) Close() error {
+	storeMu.Lock()
+	delete(storeCache, s.Dir)
+	storeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFiles()
+}
+
+func (s *Store) closeFiles() error {
+	var firstErr error
+	for id, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, id)
+	}
+	return firstErr
+}
+
+// Write appends a revision of obj, unless its hash is the one already stored.
+// Writing an object whose UID differs from the stored one archives the previous incarnation.
+func (s *Store) Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (bool, error) {
+	key := storage.KeyOf(obj)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.lookup(key); e != nil && e.hash == hash {
+		return false, nil // no change
+	}
+	manifest, err := json.Marshal(obj.Object)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal object: %w", err)
+	}
+	now := time.Now().UTC()
+	rec := &record{Type: recordPut, Key: key, UID: obj.GetUID(), Hash: hash, Manifest: manifest, Labels: obj.GetLabels(),
+		Metadata: storage.NewMetadata(ctx, obj, now), Written: now}
+	if err := s.commit(rec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) Read(ctx context.Context, key storage.Key) (*unstructured.Unstructured, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(key)
+	if e == nil {
+		return nil, "", nil
+	}
+	return s.readObject(e.current, key.GVK)
+}
+
+// Delete removes an object along with its tombstone and the incarnations archived under its name.
+func (s *Store) Delete(ctx context.Context, key storage.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookup(key) == nil {
+		return nil
+	}
+	return s.commit(&record{Type: recordDelete, Key: key, Written: time.Now().UTC()})
+}
+
+// MarkTombstone appends the tombstone of obj, including its final state.
+func (s *Store) MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error {
+	key := storage.KeyOf(obj)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookup(key) == nil {
+		return fmt.Errorf("cannot mark tombstone: %s is not stored", key)
+	}
+	return s.commit(&record{Type: recordTombstone, Key: key, Tombstone: storage.NewTombstone(obj, deletedAt), Written: time.Now().UTC()})
+}
+
+func (s *Store) ReadTombstone(ctx context.Context, key storage.Key) (*storage.Tombstone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(key)
+	if e == nil || e.tombstone == nil {
+		return nil, nil
+	}
+	rec, err := s.readRecord(e.tombstone.loc)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Tombstone, nil
+}
+
+// ListTombstones returns the tombstones of every kind in the store, from the index. ModTime is the time
+// the tombstone was appended.
+func (s *Store) ListTombstones(ctx context.Context) ([]storage.TombstoneEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []storage.TombstoneEntry
+	for _, objects := range s.objects {
+		for key, e := range objects {
+			if e.tombstone == nil {
+				continue
+			}
+			entries = append(entries, storage.TombstoneEntry{
+				Key:       key,
+				UID:       e.tombstone.uid,
+				DeletedAt: e.tombstone.deletedAt,
+				ModTime:   e.tombstone.written,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Encode() < entries[j].Encode() })
+	return entries, nil
+}
+
+// TombstonePath is empty: tombstones are records in a segment and have no file of their own.
+func (s *Store) TombstonePath(key storage.Key) string {
+	return ""
+}
+
+// DeleteTombstone appends the record clearing the tombstone of an object. It fails with an error
+// wrapping os.ErrNotExist if the object has no tombstone.
+func (s *Store) DeleteTombstone(ctx context.Context, key storage.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.lookup(key); e == nil || e.tombstone == nil {
+		return fmt.Errorf("no tombstone for %s: %w", key, os.ErrNotExist)
+	}
+	return s.commit(&record{Type: recordUntombstone, Key: key, Written: time.Now().UTC()})
+}
+
+// Kinds returns the kinds in the index, in the order Walk visits them.
+func (s *Store) Kinds(ctx context.Context) ([]schema.GroupVersionKind, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	kinds := make([]schema.GroupVersionKind, 0, len(s.objects))
+	for gvk := range s.objects {
+		kinds = append(kinds, gvk)
+	}
+	storage.SortKinds(kinds)
+	return kinds, nil
+}
+
+// List returns the objects stored for a GVK from the index, ordered by key.
+func (s *Store) List(ctx context.Context, gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]storage.ObjectEntry, 0, len(s.objects[gvk]))
+	for key, e := range s.objects[gvk] {
+		entries = append(entries, storage.ObjectEntry{
+			Key:        key,
+			Hash:       e.hash,
+			Tombstoned: e.tombstone != nil,
+			Labels:     e.labels,
+			Modified:   e.modified,
+		})
+	}
+	storage.SortEntries(entries)
+	return entries, nil
+}
+
+// Walk reads the index only, one kind at a time, so fn may write to the store.
+func (s *Store) Walk(ctx context.Context, filter storage.Filter, fn func(storage.ObjectEntry) error) error {
+	kinds, err := s.Kinds(ctx)
+	if err != nil {
+		return err
+	}
+	return storage.WalkKinds(ctx, kinds, filter, func(gvk schema.GroupVersionKind) ([]storage.ObjectEntry, error) {
+		return s.List(ctx, gvk)
+	}, fn)
+}
+
+func (s *Store) Lineage(ctx context.Context, key storage.Key) ([]storage.Incarnation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(key)
+	if e == nil {
+		return nil, nil
+	}
+	return append([]storage.Incarnation(nil), e.lineage...), nil
+}
+
+// ReadIncarnation loads the latest revision of the incarnation with the given UID.
+func (s *Store) ReadIncarnation(ctx context.Context, key storage.Key, uid types.UID) (*unstructured.Unstructured, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.incarnation(key, uid)
+	if !ok {
+		return nil, "", nil
+	}
+	return s.readObject(loc, key.GVK)
+}
+
+// ReadMetadata reads the metadata of the latest put record of the incarnation with the given UID.
+func (s *Store) ReadMetadata(ctx context.Context, key storage.Key, uid types.UID) (*storage.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.incarnation(key, uid)
+	if !ok {
+		return nil, nil
+	}
+	rec, err := s.readRecord(loc)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Metadata, nil
+}
+
+// DeleteIncarnation appends the record removing an archived incarnation. Compaction drops its revision.
+func (s *Store) DeleteIncarnation(ctx context.Context, key storage.Key, uid types.UID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return nil
+	}
+	if uid == "" || uid == e.uid {
+		return fmt.Errorf("cannot delete incarnation %s of %s: it is the current one", uid, key)
+	}
+	if _, ok := e.archived[uid]; !ok {
+		return nil
+	}
+	return s.commit(&record{Type: recordPrune, Key: key, UID: uid, Written: time.Now().UTC()})
+}
+
+// incarnation returns the latest put record of the incarnation with the given UID, the current one if
+// uid is empty. The caller holds s.mu.
+func (s *Store) incarnation(key storage.Key, uid types.UID) (location, bool) {
+	e := s.lookup(key)
+	if e == nil {
+		return location{}, false
+	}
+	if uid == "" || uid == e.uid {
+		return e.current, true
+	}
+	loc, ok := e.archived[uid]
+	return loc, ok
+}
+
+// commit appends rec to the active segment and applies it to the index. The caller holds s.mu.
+func (s *Store) commit(rec *record) error {
+	frame, err := encodeFrame(rec)
+	if err != nil {
+		return err
+	}
+	if s.activeSize > headerSize && s.activeSize+int64(len(frame)) > s.maxSegmentSize() {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	f := s.files[s.active]
+	if _, err := f.WriteAt(frame, s.activeSize); err != nil {
+		// Cut off what made it to disk, so the next record does not follow a torn one
+		_ = f.Truncate(s.activeSize)
+		return fmt.Errorf("failed to append record: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Truncate(s.activeSize)
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+	loc := location{id: s.active, offset: s.activeSize, size: int64(len(frame))}
+	s.activeSize += loc.size
+	s.apply(rec, loc)
+	return nil
+}
+
+func (s *Store) maxSegmentSize() int64 {
+	if s.MaxSegmentSize <= 0 {
+		return DefaultMaxSegmentSize
+	}
+	return s.MaxSegmentSize
+}
+
+// rotate seals the active segment and starts the next one. The caller holds s.mu.
+func (s *Store) rotate() error {
+	id := segmentID{seq: s.active.seq + 1}
+	path := segmentPath(s.Dir, id)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := writeHeader(f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync segments dir: %w", err)
+	}
+	s.files[id] = f
+	s.active, s.activeSize = id, headerSize
+	return nil
+}
+
+// readRecord reads and verifies the record at loc. The caller holds s.mu.
+func (s *Store) readRecord(loc location) (*record, error) {
+	f, ok := s.files[loc.id]
+	if !ok {
+		return nil, fmt.Errorf("segment %s is gone", loc.id.fileName())
+	}
+	frame := make([]byte, loc.size)
+	if _, err := f.ReadAt(frame, loc.offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	payload, err := decodeFrame(frame)
+	if err != nil {
+		return nil, fmt.Errorf("%s at offset %d: %w", loc.id.fileName(), loc.offset, err)
+	}
+	return decodeRecord(payload)
+}
+
+// readObject loads the manifest and hash of the put record at loc. The caller holds s.mu.
+func (s *Store) readObject(loc location, gvk schema.GroupVersionKind) (*unstructured.Unstructured, string, error) {
+	rec, err := s.readRecord(loc)
+	if err != nil {
+		return nil, "", err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(rec.Manifest, &obj.Object); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	obj.SetGroupVersionKind(gvk)
+	return obj, rec.Hash, nil
+}
@@ -2,25 +2,232 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"github.com/bastion/internal/hash"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"time"
 )
 
 // Storage defines the interface for any backup storage backend.
 type Storage interface {
 	Write(ctx context.Context, obj *unstructured.Unstructured, hash string) (changed bool, err error)
-	Read(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) (*unstructured.Unstructured, string, error)
-	Delete(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error
-	MarkTombstone(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error
+	Read(ctx context.Context, key Key) (*unstructured.Unstructured, string, error)
+	Delete(ctx context.Context, key Key) error
+	// MarkTombstone records that obj was deleted from the cluster at deletedAt, keeping its final state.
+	MarkTombstone(ctx context.Context, obj *unstructured.Unstructured, deletedAt time.Time) error
+	// ReadTombstone returns the tombstone of an object, or nil if the object is not tombstoned.
+	ReadTombstone(ctx context.Context, key Key) (*Tombstone, error)
 	ListTombstones(ctx context.Context) ([]TombstoneEntry, error)
-	TombstonePath(gvk schema.GroupVersionKind, namespace, name string) string
-	DeleteTombstone(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) error
+	TombstonePath(key Key) string
+	DeleteTombstone(ctx context.Context, key Key) error
+	// Kinds returns the GVKs that have objects in the store.
+	Kinds(ctx context.Context) ([]schema.GroupVersionKind, error)
+	// List returns the objects stored for a GVK, including tombstoned ones.
+	List(ctx context.Context, gvk schema.GroupVersionKind) ([]ObjectEntry, error)
+	// Walk calls fn for every object selected by filter, including tombstoned ones, in the order of their
+	// encoded keys. Returning StopWalk from fn ends the walk without an error.
+	Walk(ctx context.Context, filter Filter, fn func(ObjectEntry) error) error
+	// Lineage returns the incarnations that existed under a name, oldest first.
+	Lineage(ctx context.Context, key Key) ([]Incarnation, error)
+	// ReadIncarnation loads the latest backup of the incarnation with the given UID, or nil if there is none.
+	ReadIncarnation(ctx context.Context, key Key, uid types.UID) (*unstructured.Unstructured, string, error)
+	// DeleteIncarnation removes the archived incarnation with the given UID and drops it from the lineage.
+	// It fails for the current incarnation, which only goes with Delete, and does nothing if there is no
+	// such incarnation.
+	DeleteIncarnation(ctx context.Context, key Key, uid types.UID) error
+	// ReadMetadata returns the metadata of the latest backup of the incarnation with the given UID, the
+	// current one if uid is empty, or nil if there is none. Backups written before metadata was recorded
+	// have none.
+	ReadMetadata(ctx context.Context, key Key, uid types.UID) (*Metadata, error)
 }
 
+// Upgrader is implemented by backends with a versioned on-disk format. Upgrade fails on formats the
+// backend does not know, and moves older formats forward in place.
+type Upgrader interface {
+	Upgrade(ctx context.Context) error
+}
+
+// Recoverer is implemented by backends that can detect and repair entries torn by a crash.
+// It is run once at startup, before any worker writes to the store.
+type Recoverer interface {
+	Recover(ctx context.Context, hasher hash.Hasher) (RecoveryReport, error)
+}
+
+// RecoveryReport summarizes what a recovery scan found and fixed.
+type RecoveryReport struct {
+	Checked          int // Entries interrupted while being written
+	Repaired         int // Hashes rewritten or dropped to agree with their manifest
+	Quarantined      int // Manifests that could not be parsed and were moved aside
+	Unsigned         int // Signatures moved aside as they may belong to the revision a torn write replaced
+	TempFilesRemoved int // Temp files left by interrupted writes
+}
+
+// Identifier is implemented by stores with an identity they are created with and keep for their lifetime.
+// A store that is wiped, recreated in another engine or migrated has a new one, so state kept next to the
+// store, such as resume points, can tell it no longer describes the store.
+type Identifier interface {
+	ID(ctx context.Context) (string, error)
+}
+
+// Scrubber is implemented by backends that can verify the integrity of everything they store.
+type Scrubber interface {
+	Scrub(ctx context.Context, hasher hash.Hasher) (ScrubReport, error)
+}
+
+// ErrHeld is returned, wrapped, by stores that refuse to delete a backup under hold.
+var ErrHeld = errors.New("backup is under hold")
+
+// Holder is implemented by stores that refuse to delete backups under hold, so callers can leave them
+// out before trying.
+type Holder interface {
+	// Held reports whether the incarnation of key with the given UID, or any of them if uid is empty, is
+	// under hold.
+	Held(ctx context.Context, key Key, uid types.UID) (bool, error)
+}
+
+// ProblemType classifies an integrity problem found by a scrub.
+type ProblemType string
+
+const (
+	ProblemHashMismatch     ProblemType = "hash_mismatch"     // The manifest does not hash to the stored hash
+	ProblemCorruptManifest  ProblemType = "corrupt_manifest"  // The manifest cannot be read or parsed
+	ProblemMissingManifest  ProblemType = "missing_manifest"  // A hash is stored without its manifest
+	ProblemMissingHash      ProblemType = "missing_hash"      // A manifest is stored without its hash
+	ProblemPathMismatch     ProblemType = "path_mismatch"     // The manifest names another object than its path
+	ProblemCorruptTombstone ProblemType = "corrupt_tombstone" // The tombstone cannot be parsed
+	ProblemCorruptLineage   ProblemType = "corrupt_lineage"   // The lineage index cannot be parsed
+	ProblemPendingWrite     ProblemType = "pending_write"     // A write was interrupted and not yet recovered
+	ProblemOrphanedFile     ProblemType = "orphaned_file"     // A file that belongs to no object
+	ProblemInvalidPath      ProblemType = "invalid_path"      // A path that does not map to an object
+	ProblemMissingSignature ProblemType = "missing_signature" // A revision or tombstone that is not signed
+	ProblemBadSignature     ProblemType = "bad_signature"     // A signature that does not match what it signs
+	ProblemRootMismatch     ProblemType = "root_mismatch"     // The store does not match its signed Merkle root
+	ProblemStaleIndex       ProblemType = "stale_index"       // An index does not list what it indexes
+	ProblemCorruptRecord    ProblemType = "corrupt_record"    // A segment record or database page fails its checks
+	ProblemCorruptMetadata  ProblemType = "corrupt_metadata"  // The metadata cannot be parsed or names another revision
+)
+
+// ScrubProblem is a single integrity problem found by a scrub.
+type ScrubProblem struct {
+	Type   ProblemType `json:"type"`
+	Path   string      `json:"path"`
+	Key                // Object the problem belongs to, if any
+	Detail string      `json:"detail,omitempty"`
+}
+
+// ScrubReport is the result of a scrub.
+type ScrubReport struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Scanned  int            `json:"scanned"` // Entries verified
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// Add records a problem.
+func (r *ScrubReport) Add(p ScrubProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// Counts returns the number of problems of each type.
+func (r *ScrubReport) Counts() map[ProblemType]int {
+	counts := map[ProblemType]int{}
+	for _, p := range r.Problems {
+		counts[p.Type]++
+	}
+	return counts
+}
+
+// ObjectEntry describes a stored object as returned by List and Walk.
+type ObjectEntry struct {
+	Key
+	Hash       string            `json:"hash"`
+	Tombstoned bool              `json:"tombstoned,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`   // Labels of the stored revision, set by Walk when its filter selects by label
+	Modified   time.Time         `json:"modified,omitempty"` // When the stored revision was backed up, always set by Walk
+}
+
+// TombstoneEntry describes a tombstone as returned by ListTombstones.
 type TombstoneEntry struct {
-	GVK       schema.GroupVersionKind
-	Namespace string
-	Name      string
+	Key
+	UID       types.UID
+	DeletedAt time.Time
 	ModTime   time.Time
 }
+
+// Tombstone is the record kept for an object after it was deleted from the cluster.
+type Tombstone struct {
+	UID             types.UID                  `json:"uid,omitempty"`
+	ResourceVersion string                     `json:"resourceVersion,omitempty"`
+	DeletedAt       time.Time                  `json:"deletedAt"`
+	FinalState      *unstructured.Unstructured `json:"finalState,omitempty"`
+}
+
+// NewTombstone builds the tombstone for obj deleted at deletedAt.
+func NewTombstone(obj *unstructured.Unstructured, deletedAt time.Time) *Tombstone {
+	return &Tombstone{
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+		DeletedAt:       deletedAt.UTC(),
+		FinalState:      obj.DeepCopy(),
+	}
+}
+
+// Resurrects reports whether obj is the same incarnation that was tombstoned.
+// Tombstones written before UIDs were recorded match any object.
+func (t *Tombstone) Resurrects(obj *unstructured.Unstructured) bool {
+	return t.UID == "" || t.UID == obj.GetUID()
+}
+
+// Incarnation is one object, identified by its UID, in the lineage of objects that shared a name.
+type Incarnation struct {
+	UID         types.UID  `json:"uid"`
+	FirstBackup time.Time  `json:"firstBackup"`
+	LastBackup  time.Time  `json:"lastBackup"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+}
+
+// Current returns the latest incarnation of a lineage, or nil if it is empty.
+func Current(lineage []Incarnation) *Incarnation {
+	if len(lineage) == 0 {
+		return nil
+	}
+	return &lineage[len(lineage)-1]
+}
+
+// RecordBackup notes a backup of the incarnation uid taken at at, starting a new incarnation if uid is
+// not the current one. Objects without a UID have no lineage.
+func RecordBackup(lineage []Incarnation, uid types.UID, at time.Time) []Incarnation {
+	if uid == "" {
+		return lineage
+	}
+	if current := Current(lineage); current != nil && current.UID == uid {
+		current.LastBackup = at
+		return lineage
+	}
+	return append(lineage, Incarnation{UID: uid, FirstBackup: at, LastBackup: at})
+}
+
+// DropIncarnation removes the incarnation uid from a lineage.
+func DropIncarnation(lineage []Incarnation, uid types.UID) []Incarnation {
+	kept := lineage[:0]
+	for _, incarnation := range lineage {
+		if incarnation.UID != uid {
+			kept = append(kept, incarnation)
+		}
+	}
+	return kept
+}
+
+// RecordDeletion sets or, with a nil deletedAt, clears the deletion time of the incarnation uid.
+// An empty uid refers to the current incarnation.
+func RecordDeletion(lineage []Incarnation, uid types.UID, deletedAt *time.Time) []Incarnation {
+	for i := len(lineage) - 1; i >= 0; i-- {
+		if uid == "" || lineage[i].UID == uid {
+			lineage[i].DeletedAt = deletedAt
+			break
+		}
+	}
+	return lineage
+}
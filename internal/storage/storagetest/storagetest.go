@@ -0,0 +1,338 @@
+// Package storagetest is the conformance suite of storage.Storage, run by every engine so they all keep the
+// same contract, and the fixtures the engine tests share.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:golint,revive
+	. "github.com/onsi/gomega"    //nolint:golint,revive
+
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/storage"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TaskGVK is the kind of the objects the fixtures build.
+var TaskGVK = schema.GroupVersionKind{Group: "demo.bastion.io", Version: "v1", Kind: "Task"}
+
+// TaskGVR is the resource of TaskGVK.
+var TaskGVR = schema.GroupVersionResource{Group: "demo.bastion.io", Version: "v1", Resource: "tasks"}
+
+// TaskOption changes a Task the fixtures build.
+type TaskOption func(obj *unstructured.Unstructured)
+
+// InNamespace puts the Task in namespace, or makes it cluster scoped if namespace is empty.
+func InNamespace(namespace string) TaskOption {
+	return func(obj *unstructured.Unstructured) {
+		obj.SetNamespace(namespace)
+	}
+}
+
+// NewTask returns a Task in the default namespace, unless an option puts it elsewhere.
+func NewTask(name, uid, description string, options ...TaskOption) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(TaskGVK)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetUID(types.UID(uid))
+	obj.Object["spec"] = map[string]interface{}{"description": description}
+	for _, option := range options {
+		option(obj)
+	}
+	return obj
+}
+
+// TaskKey returns the key of the Task name in the default namespace, unless an option puts it elsewhere.
+func TaskKey(name string, options ...TaskOption) storage.Key {
+	return storage.KeyOf(NewTask(name, "", "", options...))
+}
+
+// Hash returns the hash of obj, so that distinct objects are written with distinct hashes.
+func Hash(obj *unstructured.Unstructured) string {
+	GinkgoHelper()
+	h, err := hash.NewDefaultHasher().Hash(obj)
+	Expect(err).NotTo(HaveOccurred())
+	return h
+}
+
+// Write writes obj to store with its hash.
+func Write(ctx context.Context, store storage.Storage, obj *unstructured.Unstructured) {
+	GinkgoHelper()
+	_, err := store.Write(ctx, obj, Hash(obj))
+	Expect(err).NotTo(HaveOccurred())
+}
+
+// DescribeStorage registers the conformance specs of storage.Storage, run against the stores open returns.
+// Every call of open must return a new, empty store; it runs within a BeforeEach, so it may register
+// cleanups.
+func DescribeStorage(engine string, open func() storage.Storage) bool {
+	return Describe(engine+" conformance", func() {
+		var (
+			ctx   context.Context
+			store storage.Storage
+		)
+
+		BeforeEach(func() {
+			ctx = context.Background()
+			store = open()
+		})
+
+		It("keeps objects apart whatever their names", func() {
+			names := []string{"tombstone", "hash.txt", "incarnations", "..", ".bastion", "_", "a/b", "Task", "task"}
+			for i, name := range names {
+				Write(ctx, store, NewTask(name, fmt.Sprintf("uid-%d", i), name))
+			}
+			cluster := NewTask("default", "uid-cluster", "cluster scoped")
+			cluster.SetNamespace("")
+			Write(ctx, store, cluster)
+			changed, err := store.Write(ctx, cluster, Hash(cluster))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeFalse())
+
+			kinds, err := store.Kinds(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kinds).To(ConsistOf(TaskGVK))
+			entries, err := store.List(ctx, TaskGVK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(len(names) + 1))
+			for _, name := range names {
+				obj, h, err := store.Read(ctx, TaskKey(name))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.GetName()).To(Equal(name))
+				Expect(h).To(Equal(Hash(NewTask(name, string(obj.GetUID()), name))))
+			}
+			obj, _, err := store.Read(ctx, storage.KeyOf(cluster))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.GetNamespace()).To(BeEmpty())
+			obj, _, err = store.Read(ctx, TaskKey("missing"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).To(BeNil())
+		})
+
+		It("records tombstones with the final state, UID and deletion time", func() {
+			deleted := NewTask("task-a", "uid-1", "deleted")
+			Write(ctx, store, deleted)
+			Write(ctx, store, NewTask("task-b", "uid-2", "kept"))
+			deletedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+			Expect(store.MarkTombstone(ctx, deleted, deletedAt)).To(Succeed())
+
+			tomb, err := store.ReadTombstone(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb.UID).To(Equal(types.UID("uid-1")))
+			Expect(tomb.DeletedAt).To(BeTemporally("==", deletedAt))
+			Expect(tomb.FinalState.Object["spec"]).To(Equal(deleted.Object["spec"]))
+			Expect(tomb.Resurrects(deleted)).To(BeTrue())
+			tomb, err = store.ReadTombstone(ctx, TaskKey("task-b"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb).To(BeNil())
+
+			tombstones, err := store.ListTombstones(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tombstones).To(HaveLen(1))
+			Expect(tombstones[0].Key).To(Equal(TaskKey("task-a")))
+			Expect(tombstones[0].UID).To(Equal(types.UID("uid-1")))
+			Expect(tombstones[0].DeletedAt).To(BeTemporally("==", deletedAt))
+			entries, err := store.List(ctx, TaskGVK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+			for _, entry := range entries {
+				Expect(entry.Tombstoned).To(Equal(entry.Name == "task-a"))
+			}
+
+			Expect(store.DeleteTombstone(ctx, TaskKey("task-a"))).To(Succeed())
+			Expect(store.DeleteTombstone(ctx, TaskKey("task-a"))).To(MatchError(os.ErrNotExist))
+			obj, _, err := store.Read(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).NotTo(BeNil())
+
+			Expect(store.Delete(ctx, TaskKey("task-a"))).To(Succeed())
+			obj, _, err = store.Read(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj).To(BeNil())
+			entries, err = store.List(ctx, TaskGVK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		It("archives the previous incarnation when a name is reused", func() {
+			first := NewTask("task-a", "uid-1", "first")
+			Write(ctx, store, first)
+			Expect(store.MarkTombstone(ctx, first, time.Now())).To(Succeed())
+			second := NewTask("task-a", "uid-2", "recreated")
+			changed, err := store.Write(ctx, second, Hash(second))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeTrue())
+
+			lineage, err := store.Lineage(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lineage).To(HaveLen(2))
+			Expect(lineage[0].UID).To(Equal(types.UID("uid-1")))
+			Expect(lineage[0].DeletedAt).NotTo(BeNil())
+			Expect(lineage[1].UID).To(Equal(types.UID("uid-2")))
+			Expect(lineage[1].DeletedAt).To(BeNil())
+			tomb, err := store.ReadTombstone(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb).To(BeNil())
+
+			old, h, err := store.ReadIncarnation(ctx, TaskKey("task-a"), "uid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(Hash(first)))
+			Expect(old.Object["spec"]).To(Equal(first.Object["spec"]))
+			latest, h, err := store.ReadIncarnation(ctx, TaskKey("task-a"), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(Equal(Hash(second)))
+			Expect(latest.GetUID()).To(Equal(types.UID("uid-2")))
+			missing, _, err := store.ReadIncarnation(ctx, TaskKey("task-a"), "uid-3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(missing).To(BeNil())
+
+			Expect(store.DeleteIncarnation(ctx, TaskKey("task-a"), "uid-2")).NotTo(Succeed())
+			Expect(store.DeleteIncarnation(ctx, TaskKey("task-a"), "uid-3")).To(Succeed())
+			Expect(store.DeleteIncarnation(ctx, TaskKey("task-a"), "uid-1")).To(Succeed())
+			lineage, err = store.Lineage(ctx, TaskKey("task-a"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lineage).To(HaveLen(1))
+			old, _, err = store.ReadIncarnation(ctx, TaskKey("task-a"), "uid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(old).To(BeNil())
+		})
+
+		It("walks objects in key order, selected by namespace, prefix, labels, change time and position", func() {
+			for i := 0; i < 10; i++ {
+				obj := NewTask(fmt.Sprintf("task-%d", i), fmt.Sprintf("uid-%d", i), "walked")
+				if i%2 == 0 {
+					obj.SetNamespace("other")
+				}
+				obj.SetLabels(map[string]string{"tier": map[bool]string{true: "web", false: "db"}[i < 6]})
+				Write(ctx, store, obj)
+			}
+
+			var names []string
+			filter := storage.Filter{Namespace: "default", Labels: labels.SelectorFromSet(labels.Set{"tier": "web"})}
+			var page storage.Page
+			for first := true; first || page.Continue != ""; first = false {
+				var err error
+				page, err = storage.ListPage(ctx, store, filter, 2, page.Continue)
+				Expect(err).NotTo(HaveOccurred())
+				for _, entry := range page.Entries {
+					names = append(names, entry.Name)
+				}
+			}
+			Expect(names).To(Equal([]string{"task-1", "task-3", "task-5"}))
+
+			// Labels are only read for walks selecting by them
+			var all []storage.ObjectEntry
+			Expect(store.Walk(ctx, storage.Filter{Labels: labels.Everything()}, func(entry storage.ObjectEntry) error {
+				all = append(all, entry)
+				return nil
+			})).To(Succeed())
+			Expect(all).To(HaveLen(10))
+			Expect(all[0].Namespace).To(Equal("default"))
+			Expect(all[0].Labels).To(HaveKeyWithValue("tier", "web"))
+			Expect(all[0].Modified).NotTo(BeZero())
+			_, h, err := store.Read(ctx, all[0].Key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(all[0].Hash).To(Equal(h))
+			for i := 1; i < len(all); i++ {
+				Expect(all[i-1].Encode() < all[i].Encode()).To(BeTrue())
+			}
+
+			var after []string
+			Expect(store.Walk(ctx, storage.Filter{NamePrefix: "task-", After: all[7].Encode()}, func(entry storage.ObjectEntry) error {
+				after = append(after, entry.Name)
+				return nil
+			})).To(Succeed())
+			Expect(after).To(Equal([]string{all[8].Name, all[9].Name}))
+			visited := 0
+			Expect(store.Walk(ctx, storage.Filter{}, func(storage.ObjectEntry) error {
+				visited++
+				return storage.StopWalk
+			})).To(Succeed())
+			Expect(visited).To(Equal(1))
+
+			since := time.Now()
+			time.Sleep(10 * time.Millisecond)
+			Write(ctx, store, NewTask("task-1", "uid-1", "changed"))
+			changed, err := storage.ListPage(ctx, store, storage.Filter{ChangedSince: since}, 0, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed.Entries).To(HaveLen(1))
+			Expect(changed.Entries[0].Name).To(Equal("task-1"))
+			Expect(changed.Entries[0].Labels).To(BeEmpty())
+		})
+
+		It("pages in key order through namespaces and names that are prefixes of one another", func() {
+			for _, namespace := range []string{"team-a", "team", "team.b"} {
+				for _, name := range []string{"task", "task-1", "task.2"} {
+					obj := NewTask(name, "uid-"+namespace+"-"+name, "paged")
+					obj.SetNamespace(namespace)
+					Write(ctx, store, obj)
+				}
+			}
+
+			var keys []string
+			var page storage.Page
+			for first := true; first || page.Continue != ""; first = false {
+				var err error
+				page, err = storage.ListPage(ctx, store, storage.Filter{}, 1, page.Continue)
+				Expect(err).NotTo(HaveOccurred())
+				for _, entry := range page.Entries {
+					keys = append(keys, entry.Encode())
+				}
+			}
+			Expect(keys).To(HaveLen(9))
+			Expect(sort.StringsAreSorted(keys)).To(BeTrue())
+
+			prefixed, err := storage.ListPage(ctx, store, storage.Filter{Namespace: "team", NamePrefix: "task-"}, 0, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(prefixed.Entries).To(HaveLen(1))
+			Expect(prefixed.Entries[0].Name).To(Equal("task-1"))
+		})
+
+		It("records the capture of every incarnation", func() {
+			capture := storage.WithMetadata(ctx, storage.Metadata{EventType: "update", Cluster: "test"})
+			first := NewTask("task-a", "uid-1", "first")
+			first.SetResourceVersion("7")
+			_, err := store.Write(capture, first, Hash(first))
+			Expect(err).NotTo(HaveOccurred())
+			second := NewTask("task-a", "uid-2", "second")
+			_, err = store.Write(storage.WithMetadata(ctx, storage.Metadata{EventType: "create"}), second, Hash(second))
+			Expect(err).NotTo(HaveOccurred())
+
+			md, err := store.ReadMetadata(ctx, TaskKey("task-a"), "uid-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(md.EventType).To(Equal("update"))
+			Expect(md.Cluster).To(Equal("test"))
+			Expect(md.ResourceVersion).To(Equal("7"))
+			Expect(md.UID).To(Equal(types.UID("uid-1")))
+			Expect(md.CapturedAt).NotTo(BeZero())
+			md, err = store.ReadMetadata(ctx, TaskKey("task-a"), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(md.EventType).To(Equal("create"))
+			Expect(md.UID).To(Equal(types.UID("uid-2")))
+			md, err = store.ReadMetadata(ctx, TaskKey("task-b"), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(md).To(BeNil())
+		})
+
+		It("keeps an identity of its own, if it has one", func() {
+			identifier, ok := store.(storage.Identifier)
+			if !ok {
+				Skip("the store has no identity")
+			}
+			id, err := identifier.ID(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).NotTo(BeEmpty())
+			Write(ctx, store, NewTask("task-a", "uid-1", "first"))
+			Expect(identifier.ID(ctx)).To(Equal(id))
+			Expect(open().(storage.Identifier).ID(ctx)).NotTo(Equal(id))
+		})
+	})
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StopWalk ends a walk early, without an error, when returned by its callback.
+var StopWalk = errors.New("stop walk")
+
+// Filter selects the objects visited by Walk. The zero Filter selects every object.
+type Filter struct {
+	GVK          schema.GroupVersionKind // Every kind if empty
+	Namespace    string                  // Every namespace if empty
+	NamePrefix   string
+	Labels       labels.Selector // Matched against the labels indexed at backup time, nil matches all
+	ChangedSince time.Time       // Only objects last backed up after this time, all if zero
+	After        string          // Encoded key the walk resumes after, from the start if empty
+}
+
+// Matches reports whether entry is selected by the filter.
+func (f Filter) Matches(entry ObjectEntry) bool {
+	if !f.GVK.Empty() && entry.GVK != f.GVK {
+		return false
+	}
+	if f.Namespace != "" && entry.Namespace != f.Namespace {
+		return false
+	}
+	if !strings.HasPrefix(entry.Name, f.NamePrefix) {
+		return false
+	}
+	if f.After != "" && entry.Encode() <= f.After {
+		return false
+	}
+	if !f.ChangedSince.IsZero() && !entry.Modified.After(f.ChangedSince) {
+		return false
+	}
+	return f.Labels == nil || f.Labels.Matches(labels.Set(entry.Labels))
+}
+
+// SkipsKind reports whether the filter selects no object of a kind, so a walk need not read it.
+func (f Filter) SkipsKind(gvk schema.GroupVersionKind) bool {
+	if !f.GVK.Empty() && gvk != f.GVK {
+		return true
+	}
+	// Every key of the kind starts with its prefix, so all sort before After when the prefix does
+	prefix := KindPrefix(gvk)
+	return f.After != "" && prefix < f.After && !strings.HasPrefix(f.After, prefix)
+}
+
+// KindPrefix returns the encoded group, version and kind every encoded key of a kind starts with, up
+// to and including the slash before the namespace.
+func KindPrefix(gvk schema.GroupVersionKind) string {
+	return strings.Join(Key{GVK: gvk}.Segments()[:3], "/") + "/"
+}
+
+// SortKinds orders kinds the way Walk visits their objects.
+func SortKinds(kinds []schema.GroupVersionKind) {
+	sort.Slice(kinds, func(i, j int) bool { return KindPrefix(kinds[i]) < KindPrefix(kinds[j]) })
+}
+
+// SortEntries orders entries by their encoded keys, the order Walk visits objects in.
+func SortEntries(entries []ObjectEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Encode() < entries[j].Encode() })
+}
+
+// WalkKinds walks kinds one after the other, listing the entries of every kind the filter does not skip
+// with list. It serves the walks of backends that read the entries of a kind at once.
+func WalkKinds(ctx context.Context, kinds []schema.GroupVersionKind, filter Filter, list func(gvk schema.GroupVersionKind) ([]ObjectEntry, error), fn func(ObjectEntry) error) error {
+	SortKinds(kinds)
+	for _, gvk := range kinds {
+		if filter.SkipsKind(gvk) {
+			continue
+		}
+		entries, err := list(gvk)
+		if err != nil {
+			return err
+		}
+		SortEntries(entries)
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !filter.Matches(entry) {
+				continue
+			}
+			if err := fn(entry); err != nil {
+				if errors.Is(err, StopWalk) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Page is one page of a listing.
+type Page struct {
+	Entries  []ObjectEntry `json:"entries"`
+	Continue string        `json:"continue,omitempty"` // Token of the next page, empty on the last one
+}
+
+// ListPage returns up to limit objects selected by filter, starting after the page whose continue token
+// is given. A limit of zero or less returns every object in one page.
+func ListPage(ctx context.Context, s Storage, filter Filter, limit int, token string) (Page, error) {
+	var page Page
+	if token != "" {
+		filter.After = token
+	}
+	err := s.Walk(ctx, filter, func(entry ObjectEntry) error {
+		if limit > 0 && len(page.Entries) == limit {
+			page.Continue = page.Entries[limit-1].Encode()
+			return StopWalk
+		}
+		page.Entries = append(page.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return Page{}, err
+	}
+	return page, nil
+}
@@ -0,0 +1,5 @@
+// Package version holds the version of the running Bastion build.
+package version
+
+// Version is set when building, with -ldflags "-X github.com/bastion/internal/version.Version=<version>".
+var Version = "dev"
@@ -3,18 +3,30 @@ package worker
 import (
 	"context"
 	"fmt"
+	"github.com/bastion/internal/checkpoint"
+	"github.com/bastion/internal/finalizer"
 	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
 	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/version"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"strconv"
+	"time"
 )
 
 type BackupEvent struct {
 	Object    *unstructured.Unstructured
 	EventType EventType
 	GVK       schema.GroupVersionKind
+	GVR       schema.GroupVersionResource
+	// MetadataOnly marks objects from metadata-only informers, the full object is fetched when needed.
+	MetadataOnly bool
 }
 
 type EventType int
@@ -23,15 +35,38 @@ const (
 	Update = iota
 	Delete
 	Create
+	// Finalize is an update of an object that is being deleted and still holds the Bastion finalizer.
+	Finalize
 )
 
+// String names the event type as recorded in backup metadata.
+func (e EventType) String() string {
+	switch e {
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	case Create:
+		return "create"
+	case Finalize:
+		return "finalize"
+	}
+	return strconv.Itoa(int(e))
+}
+
 type BackupWorker struct {
-	Name        string
-	Queue       chan BackupEvent
-	Hasher      hash.Hasher
-	Store       storage.Storage
-	MaxRetries  int
-	WorkerCount int
+	Name          string
+	Queue         chan BackupEvent
+	Hasher        hash.Hasher
+	Store         storage.Storage
+	MaxRetries    int
+	WorkerCount   int
+	Finalizer     *finalizer.Guard  // Adds and releases the pre-deletion capture finalizer, nil disables it
+	Checkpoints   *checkpoint.Store // Resume points recording backed up objects, nil disables them
+	DynamicClient dynamic.Interface // Fetches full objects for metadata-only events
+	Cluster       string            // Identity of the backed up cluster, recorded in backup metadata
+	// Reports objects whose backups a quota suspended, nil suspends none
+	Suspended func(key storage.Key) bool
 }
 
 func NewBackupWorker(name string, hasher hash.Hasher, store storage.Storage, queueSize, maxRetries, workerCount int) *BackupWorker {
@@ -63,49 +98,16 @@ func (bw *BackupWorker) StartWorkers(ctx context.Context) {
 					//	bw.processed++
 					retries := 0
 					for retries < bw.MaxRetries {
-						switch event.EventType {
-						case Delete:
-							logger.Info("Backup delete event triggered")
-							if err := bw.Store.MarkTombstone(ctx, event.GVK, event.Object.GetNamespace(), event.Object.GetName()); err != nil {
-								logger.Error(err, "failed to delete object", "currentRetry", retries+1, "maxRetries", bw.MaxRetries)
-								retries++
-								continue
-							}
-							break
-						case Update:
-							// TODO can handle anything special with Update
-							logger.Info("Backup update event triggered")
-						case Create:
-							// TODO can handle anything special with Create
-							logger.Info("Backup create event triggered")
-						default:
-							logger.Info("bad event triggered")
-						}
-						hashStr, err := bw.Hasher.Hash(event.Object)
-						if err != nil {
-							logger.Error(err, "failed to hash", "currentRetry", retries+1, "maxRetries", bw.MaxRetries)
-							retries++
-							continue
-						}
-						_, oldHash, err := bw.Store.Read(ctx, event.GVK, event.Object.GetNamespace(), event.Object.GetName())
-						if err != nil {
-							logger.Error(err, "failed to read file", "currentRetry", retries+1, "maxRetries", bw.MaxRetries)
-							retries++
-							continue
-						}
-						if hashStr == oldHash {
-							break // no change
-						}
-						if _, err := bw.Store.Write(ctx, event.Object, hashStr); err != nil {
-							logger.Error(err, "write failed")
+						if err := bw.process(ctx, logger, event); err != nil {
+							logger.Error(err, "backup attempt failed", "currentRetry", retries+1, "maxRetries", bw.MaxRetries)
 							retries++
 							continue
 						}
-						logger.Info("backup successful")
 						break
 					}
 					if retries == bw.MaxRetries {
-						logger.Info("backup retries exceeded", "currentRetry", retries+1, "maxRetries", bw.MaxRetries)
+						logger.Info("backup retries exceeded", "currentRetry", retries, "maxRetries", bw.MaxRetries)
+						bw.requeueFinalize(ctx, logger, event)
 					}
 				}
 			}
@@ -113,6 +115,254 @@ func (bw *BackupWorker) StartWorkers(ctx context.Context) {
 	}
 }
 
+// process handles a single attempt at backing up an event.
+func (bw *BackupWorker) process(ctx context.Context, logger logr.Logger, event BackupEvent) error {
+	ctx = storage.WithMetadata(ctx, storage.Metadata{
+		EventType:      event.EventType.String(),
+		Cluster:        bw.Cluster,
+		BastionVersion: version.Version,
+		Hasher:         hash.NameOf(bw.Hasher),
+	})
+	if event.MetadataOnly && event.EventType != Delete {
+		full, err := bw.fetch(ctx, event)
+		if err != nil {
+			return err
+		}
+		if full == nil {
+			logger.Info("object deleted before it could be fetched")
+			return nil
+		}
+		event.Object = full
+	}
+	key := storage.Key{GVK: event.GVK, Namespace: event.Object.GetNamespace(), Name: event.Object.GetName()}
+	suspended := bw.Suspended != nil && bw.Suspended(key)
+	switch event.EventType {
+	case Delete:
+		logger.Info("Backup delete event triggered")
+		tomb, err := bw.Store.ReadTombstone(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read tombstone: %w", err)
+		}
+		if tomb != nil && tomb.UID != "" && tomb.UID == event.Object.GetUID() {
+			// Already captured before deletion, the delete event may only carry a stale object.
+			logger.Info("final state already captured", "uid", tomb.UID)
+			return nil
+		}
+		// Deletions are still recorded while suspended, but only the stored state becomes the final one
+		return bw.tombstone(ctx, logger, event.Object, !event.MetadataOnly && !suspended)
+	case Finalize:
+		logger.Info("Backup finalize event triggered")
+		return bw.finalize(ctx, logger, event, !suspended)
+	case Update:
+		logger.Info("Backup update event triggered")
+	case Create:
+		logger.Info("Backup create event triggered")
+	default:
+		logger.Info("bad event triggered")
+	}
+	if suspended {
+		logger.Info("Backup suspended by quota")
+		metrics.BackupsSuspended.WithLabelValues(event.GVK.String()).Inc()
+		return nil
+	}
+	newLineage, err := bw.resurrect(ctx, logger, event.Object)
+	if err != nil {
+		return err
+	}
+	if err := bw.backup(ctx, logger, event.Object, newLineage); err != nil {
+		return err
+	}
+	if bw.Finalizer == nil {
+		return nil
+	}
+	if err := bw.Finalizer.Ensure(ctx, event.GVR, event.Object); err != nil {
+		if errors.IsConflict(err) || errors.IsNotFound(err) {
+			// A newer event for the object is on its way and will retry.
+			logger.Info("skipped adding finalizer to outdated object")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// tombstone captures the final state of a deleted object and marks it as tombstoned. Without capture,
+// obj only carries metadata and the stored backup is kept as the final state.
+func (bw *BackupWorker) tombstone(ctx context.Context, logger logr.Logger, obj *unstructured.Unstructured, capture bool) error {
+	superseded, err := bw.superseded(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if superseded {
+		// A late event for an incarnation whose name has since been reused, its history is already archived.
+		logger.Info("ignoring deletion of superseded incarnation", "uid", obj.GetUID())
+		return nil
+	}
+	final := obj
+	if capture {
+		// Capture the final state before tombstoning, the informer may hand us a newer object than the one stored.
+		if err := bw.backup(ctx, logger, obj, false); err != nil {
+			return err
+		}
+	} else {
+		stored, _, err := bw.Store.Read(ctx, storage.KeyOf(obj))
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if stored == nil {
+			logger.Info("deleted object was never backed up")
+			return nil
+		}
+		final = stored
+	}
+	deletedAt := time.Now()
+	if ts := obj.GetDeletionTimestamp(); ts != nil {
+		deletedAt = ts.Time
+	}
+	if err := bw.Store.MarkTombstone(ctx, final, deletedAt); err != nil {
+		return fmt.Errorf("failed to mark tombstone: %w", err)
+	}
+	if bw.Checkpoints != nil {
+		bw.Checkpoints.Forget(obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName())
+	}
+	logger.Info("tombstone recorded", "uid", obj.GetUID())
+	return nil
+}
+
+// fetch gets the full object of a metadata-only event, or nil if it no longer exists.
+func (bw *BackupWorker) fetch(ctx context.Context, event BackupEvent) (*unstructured.Unstructured, error) {
+	obj, err := bw.DynamicClient.Resource(event.GVR).Namespace(event.Object.GetNamespace()).
+		Get(ctx, event.Object.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch object: %w", err)
+	}
+	obj.SetManagedFields(nil)
+	return obj, nil
+}
+
+// finalize persists the exact final state of an object held by the Bastion finalizer, then releases it.
+// Bypassed objects are released without capture. The capture is attempted even past the guard timeout,
+// e.g. after a restart, and only a capture failing past the timeout releases the object without it.
+// Without capture the stored state is tombstoned as the final one.
+func (bw *BackupWorker) finalize(ctx context.Context, logger logr.Logger, event BackupEvent, capture bool) error {
+	if bw.Finalizer == nil {
+		return nil
+	}
+	obj := event.Object
+	if finalizer.Bypassed(obj) {
+		logger.Info("pre-deletion capture bypassed, releasing finalizer")
+	} else if err := bw.tombstone(ctx, logger, obj, capture); err != nil {
+		if bw.Finalizer.Remaining(obj, time.Now()) > 0 {
+			return err
+		}
+		logger.Error(err, "pre-deletion capture failed past the timeout, releasing finalizer", "timeout", bw.Finalizer.Timeout)
+	}
+	if err := bw.Finalizer.Release(ctx, event.GVR, obj); err != nil {
+		return err
+	}
+	logger.Info("finalizer released")
+	return nil
+}
+
+// requeueFinalize schedules a finalize event that exhausted its retries to run again once the guard
+// timeout is reached, so the finalizer is released even if the capture keeps failing.
+func (bw *BackupWorker) requeueFinalize(ctx context.Context, logger logr.Logger, event BackupEvent) {
+	if event.EventType != Finalize || bw.Finalizer == nil {
+		return
+	}
+	delay := bw.Finalizer.Remaining(event.Object, time.Now())
+	logger.Info("requeueing finalize event", "after", delay)
+	time.AfterFunc(delay, func() {
+		select {
+		case <-ctx.Done():
+		case bw.Queue <- event:
+		}
+	})
+}
+
+// resurrect clears the tombstone of an object that exists again in the cluster and reports whether the
+// object starts a new lineage. An object recreated with a different UID keeps the tombstone with the
+// incarnation it belongs to, which the store archives on the next write.
+func (bw *BackupWorker) resurrect(ctx context.Context, logger logr.Logger, obj *unstructured.Unstructured) (bool, error) {
+	if obj.GetDeletionTimestamp() != nil {
+		return false, nil // still being deleted, e.g. waiting on other finalizers
+	}
+	tomb, err := bw.Store.ReadTombstone(ctx, storage.KeyOf(obj))
+	if err != nil {
+		return false, fmt.Errorf("failed to read tombstone: %w", err)
+	}
+	if tomb == nil {
+		return false, nil
+	}
+	if !tomb.Resurrects(obj) {
+		logger.Info("object recreated, starting new lineage", "previousUID", tomb.UID, "uid", obj.GetUID())
+		return true, nil
+	}
+	logger.Info("object resurrected, clearing tombstone", "uid", obj.GetUID())
+	if err := bw.Store.DeleteTombstone(ctx, storage.KeyOf(obj)); err != nil {
+		return false, fmt.Errorf("failed to delete tombstone: %w", err)
+	}
+	return false, nil
+}
+
+// superseded reports whether obj is an older incarnation than the one currently stored under its name.
+func (bw *BackupWorker) superseded(ctx context.Context, obj *unstructured.Unstructured) (bool, error) {
+	lineage, err := bw.Store.Lineage(ctx, storage.KeyOf(obj))
+	if err != nil {
+		return false, fmt.Errorf("failed to read lineage: %w", err)
+	}
+	current := storage.Current(lineage)
+	if current == nil || current.UID == obj.GetUID() {
+		return false, nil
+	}
+	for _, incarnation := range lineage {
+		if incarnation.UID == obj.GetUID() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// backup writes obj to the store when its hash differs from the stored one, or unconditionally when force is set.
+// The hash recorded in the resume points, when there is one, spares reading the stored manifest.
+func (bw *BackupWorker) backup(ctx context.Context, logger logr.Logger, obj *unstructured.Unstructured, force bool) error {
+	hashStr, err := bw.Hasher.Hash(obj)
+	if err != nil {
+		return fmt.Errorf("failed to hash: %w", err)
+	}
+	gvk := obj.GroupVersionKind()
+	if bw.Checkpoints != nil && !force {
+		if recorded, ok := bw.Checkpoints.Hash(gvk, obj.GetNamespace(), obj.GetName()); ok && recorded == hashStr {
+			bw.Checkpoints.Record(gvk, obj, hashStr)
+			return nil // no change
+		}
+	}
+	_, oldHash, err := bw.Store.Read(ctx, storage.KeyOf(obj))
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if hashStr == oldHash && !force {
+		bw.record(obj, hashStr)
+		return nil // no change
+	}
+	if _, err := bw.Store.Write(ctx, obj, hashStr); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	bw.record(obj, hashStr)
+	logger.Info("backup successful")
+	return nil
+}
+
+// record notes a backed up object in the resume points.
+func (bw *BackupWorker) record(obj *unstructured.Unstructured, hash string) {
+	if bw.Checkpoints != nil {
+		bw.Checkpoints.Record(obj.GroupVersionKind(), obj, hash)
+	}
+}
+
 func (bw *BackupWorker) Stats() map[string]interface{} {
 	return map[string]interface{}{
 		"worker":   bw.Name,
@@ -120,6 +370,10 @@ func (bw *BackupWorker) Stats() map[string]interface{} {
 	}
 }
 
-func (bw *BackupWorker) Enqueue(obj *unstructured.Unstructured, eventType EventType) {
-	bw.Queue <- BackupEvent{Object: obj, EventType: eventType, GVK: obj.GroupVersionKind()}
+func (bw *BackupWorker) Enqueue(gvr schema.GroupVersionResource, obj *unstructured.Unstructured, eventType EventType) {
+	bw.EnqueueEvent(BackupEvent{Object: obj, EventType: eventType, GVK: obj.GroupVersionKind(), GVR: gvr})
+}
+
+func (bw *BackupWorker) EnqueueEvent(event BackupEvent) {
+	bw.Queue <- event
 }
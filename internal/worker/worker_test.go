@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bastion/internal/finalizer"
+	"github.com/bastion/internal/hash"
+	"github.com/bastion/internal/metrics"
+	"github.com/bastion/internal/storage"
+	"github.com/bastion/internal/storage/memory"
+	"github.com/bastion/internal/storage/storagetest"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestWorker(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Worker Suite")
+}
+
+var _ = Describe("BackupWorker", func() {
+	var (
+		ctx    context.Context
+		store  *memory.Store
+		client *dynamicfake.FakeDynamicClient
+		bw     *BackupWorker
+	)
+
+	key := storagetest.TaskKey("task-a")
+
+	process := func(obj *unstructured.Unstructured, eventType EventType) error {
+		return bw.process(ctx, logr.Discard(), BackupEvent{Object: obj, EventType: eventType, GVK: storagetest.TaskGVK, GVR: storagetest.TaskGVR})
+	}
+
+	stored := func() interface{} {
+		obj, _, err := store.Read(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj).NotTo(BeNil())
+		return obj.Object["spec"].(map[string]interface{})["description"]
+	}
+
+	// deleting creates obj in the cluster, held by the finalizer since it was deleted at deletedAt
+	deleting := func(obj *unstructured.Unstructured, deletedAt time.Time) *unstructured.Unstructured {
+		obj.SetFinalizers([]string{finalizer.Name})
+		obj.SetDeletionTimestamp(&metav1.Time{Time: deletedAt})
+		created, err := client.Resource(storagetest.TaskGVR).Namespace("default").Create(ctx, obj, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return created
+	}
+
+	finalizers := func() []string {
+		obj, err := client.Resource(storagetest.TaskGVR).Namespace("default").Get(ctx, "task-a", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return obj.GetFinalizers()
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = memory.NewStore()
+		client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{storagetest.TaskGVR: "TaskList"})
+		bw = NewBackupWorker("test", hash.NewDefaultHasher(), store, 10, 3, 1)
+	})
+
+	Context("with a quota suspending backups", func() {
+		BeforeEach(func() {
+			Expect(process(storagetest.NewTask("task-a", "uid-1", "first"), Create)).To(Succeed())
+			bw.Suspended = func(suspended storage.Key) bool { return suspended == key }
+		})
+
+		It("skips the backups of suspended objects and counts them", func() {
+			before := testutil.ToFloat64(metrics.BackupsSuspended.WithLabelValues(storagetest.TaskGVK.String()))
+			Expect(process(storagetest.NewTask("task-a", "uid-1", "second"), Update)).To(Succeed())
+			Expect(stored()).To(Equal("first"))
+			Expect(testutil.ToFloat64(metrics.BackupsSuspended.WithLabelValues(storagetest.TaskGVK.String()))).To(Equal(before + 1))
+
+			bw.Suspended = nil
+			Expect(process(storagetest.NewTask("task-a", "uid-1", "second"), Update)).To(Succeed())
+			Expect(stored()).To(Equal("second"))
+		})
+
+		It("still records deletions, with the stored state as the final one", func() {
+			Expect(process(storagetest.NewTask("task-a", "uid-1", "second"), Delete)).To(Succeed())
+			tomb, err := store.ReadTombstone(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb).NotTo(BeNil())
+			Expect(tomb.UID).To(Equal(types.UID("uid-1")))
+			Expect(stored()).To(Equal("first"))
+		})
+
+		It("releases finalized objects after tombstoning their stored state", func() {
+			bw.Finalizer = finalizer.NewGuard(client, true, time.Minute)
+			obj := deleting(storagetest.NewTask("task-a", "uid-1", "second"), time.Now())
+			Expect(process(obj, Finalize)).To(Succeed())
+			Expect(stored()).To(Equal("first"))
+			Expect(store.ReadTombstone(ctx, key)).NotTo(BeNil())
+			Expect(finalizers()).To(BeEmpty())
+		})
+	})
+
+	Context("finalizing objects held for pre-deletion capture", func() {
+		BeforeEach(func() {
+			bw.Finalizer = finalizer.NewGuard(client, true, time.Minute)
+		})
+
+		It("captures the final state, tombstones it and releases the object", func() {
+			Expect(process(storagetest.NewTask("task-a", "uid-1", "first"), Create)).To(Succeed())
+			obj := deleting(storagetest.NewTask("task-a", "uid-1", "final"), time.Now())
+			Expect(process(obj, Finalize)).To(Succeed())
+			Expect(stored()).To(Equal("final"))
+			tomb, err := store.ReadTombstone(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb.UID).To(Equal(types.UID("uid-1")))
+			Expect(finalizers()).To(BeEmpty())
+
+			// The delete event that follows is recognized as already captured
+			Expect(process(obj, Delete)).To(Succeed())
+			Expect(stored()).To(Equal("final"))
+		})
+
+		It("releases bypassed objects without capturing them", func() {
+			obj := storagetest.NewTask("task-a", "uid-1", "final")
+			obj.SetAnnotations(map[string]string{finalizer.BypassAnnotation: "true"})
+			Expect(process(deleting(obj, time.Now()), Finalize)).To(Succeed())
+			stored, _, err := store.Read(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(BeNil())
+			Expect(finalizers()).To(BeEmpty())
+		})
+
+		It("holds objects whose capture fails until the timeout, then releases them without it", func() {
+			store.Faults = &memory.Faults{}
+			store.Faults.FailNext(memory.OpWrite, 1)
+			obj := deleting(storagetest.NewTask("task-a", "uid-1", "final"), time.Now())
+			Expect(process(obj, Finalize)).To(MatchError(memory.ErrInjected))
+			Expect(finalizers()).To(ConsistOf(finalizer.Name))
+
+			store.Faults.FailNext(memory.OpWrite, 1)
+			obj.SetDeletionTimestamp(&metav1.Time{Time: time.Now().Add(-2 * time.Minute)})
+			Expect(process(obj, Finalize)).To(Succeed())
+			Expect(finalizers()).To(BeEmpty())
+			tomb, err := store.ReadTombstone(ctx, key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tomb).To(BeNil())
+		})
+	})
+})